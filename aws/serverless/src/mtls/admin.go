@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// readinessCheck is a backend the proxy needs, checked by connecting to it
+type readinessCheck struct {
+	name    string
+	address string
+}
+
+// readiness reports whether the proxy can serve: every upstream and the
+// introspection endpoint must accept connections, and the proxy must not be
+// shutting down
+type readiness struct {
+	checks   []readinessCheck
+	timeout  time.Duration
+	dial     func(ctx context.Context, network, address string) (net.Conn, error)
+	draining atomic.Bool
+}
+
+// newReadiness checks the upstreams of every route and, when set, the
+// introspection endpoint
+func newReadiness(routes routingConfig, introspectionURL string, timeout time.Duration) (*readiness, error) {
+	r := &readiness{timeout: timeout, dial: (&net.Dialer{}).DialContext}
+	seen := map[string]bool{}
+	add := func(name, rawURL string) error {
+		address, err := dialAddress(rawURL)
+		if err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+		if !seen[address] {
+			seen[address] = true
+			r.checks = append(r.checks, readinessCheck{name: name, address: address})
+		}
+		return nil
+	}
+	for _, route := range routes.Routes {
+		for _, upstream := range route.Upstreams {
+			if err := add("upstream "+upstream.URL, upstream.URL); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if introspectionURL != "" {
+		if err := add("introspection "+introspectionURL, introspectionURL); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// dialAddress is the host and port to connect to for a URL
+func dialAddress(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid url %q", rawURL)
+	}
+	if u.Port() != "" {
+		return u.Host, nil
+	}
+	port := "80"
+	if u.Scheme == "https" {
+		port = "443"
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// check connects to every backend at once, returning the failures by name
+func (r *readiness) check(ctx context.Context) map[string]string {
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	var mu sync.Mutex
+	failures := map[string]string{}
+	var wg sync.WaitGroup
+	for _, check := range r.checks {
+		wg.Add(1)
+		go func(check readinessCheck) {
+			defer wg.Done()
+			conn, err := r.dial(ctx, "tcp", check.address)
+			if err != nil {
+				mu.Lock()
+				failures[check.name] = err.Error()
+				mu.Unlock()
+				return
+			}
+			conn.Close()
+		}(check)
+	}
+	wg.Wait()
+	return failures
+}
+
+// healthResponse is the body of /healthz and /readyz
+type healthResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func writeHealth(w http.ResponseWriter, status int, body healthResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// adminHandler serves the endpoints for the orchestrator and monitoring:
+// /healthz while the process is up, /readyz while it can serve traffic, and
+// the expvar metrics on /metrics
+func adminHandler(ready *readiness) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ok"})
+	})
+	mux.HandleFunc("GET /readyz", func(w http.ResponseWriter, r *http.Request) {
+		if ready.draining.Load() {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "draining"})
+			return
+		}
+		checks := map[string]string{}
+		failures := ready.check(r.Context())
+		names := make([]string, 0, len(ready.checks))
+		for _, check := range ready.checks {
+			names = append(names, check.name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			checks[name] = "ok"
+			if failure, ok := failures[name]; ok {
+				checks[name] = failure
+			}
+		}
+		if len(failures) > 0 {
+			writeHealth(w, http.StatusServiceUnavailable, healthResponse{Status: "unavailable", Checks: checks})
+			return
+		}
+		writeHealth(w, http.StatusOK, healthResponse{Status: "ready", Checks: checks})
+	})
+	mux.Handle("GET /metrics", expvar.Handler())
+	return mux
+}
+
+// serveUntilSignal serves the proxy on ln, and the admin endpoints on
+// adminLn when there is one, until a signal arrives on stop. The proxy then
+// reports itself not ready for delay, so load balancers stop sending it
+// requests, and drains open connections for up to timeout.
+func serveUntilSignal(log *slog.Logger, proxy *http.Server, ln net.Listener, admin *http.Server, adminLn net.Listener, ready *readiness, stop <-chan os.Signal, delay, timeout time.Duration) error {
+	failed := make(chan error, 2)
+	go func() {
+		if err := proxy.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			failed <- fmt.Errorf("proxy server: %w", err)
+		}
+	}()
+	if admin != nil {
+		go func() {
+			if err := admin.Serve(adminLn); !errors.Is(err, http.ErrServerClosed) {
+				failed <- fmt.Errorf("admin server: %w", err)
+			}
+		}()
+	}
+
+	select {
+	case err := <-failed:
+		return err
+	case sig := <-stop:
+		log.Info("shutting down", slog.String("signal", sig.String()))
+	}
+
+	ready.draining.Store(true)
+	time.Sleep(delay)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := proxy.Shutdown(ctx)
+	if admin != nil {
+		admin.Shutdown(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("connections still open after %s: %w", timeout, err)
+	}
+	log.Info("shutdown complete")
+	return nil
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDialAddress(t *testing.T) {
+	tests := map[string]string{
+		"http://api:8080":                      "api:8080",
+		"http://op/token/introspection":        "op:80",
+		"https://auth.example/token":           "auth.example:443",
+		"https://[2001:db8::1]/token":          "[2001:db8::1]:443",
+		"http://localhost:3000/token?client=1": "localhost:3000",
+	}
+	for rawURL, want := range tests {
+		if got, err := dialAddress(rawURL); err != nil || got != want {
+			t.Errorf("%s: got %q, %v, want %q", rawURL, got, err, want)
+		}
+	}
+	if _, err := dialAddress("not a url"); err == nil {
+		t.Error("expected a url without a host to be rejected")
+	}
+}
+
+// getHealth fetches an admin endpoint and decodes its body
+func getHealth(t *testing.T, url string) (int, healthResponse) {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body healthResponse
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, body
+}
+
+func TestAdminEndpoints(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(up.Close)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+
+	routes := routingConfig{Routes: []routeConfig{
+		{Name: "auth", Upstreams: []upstreamConfig{{URL: up.URL}}},
+		{Name: "api", Upstreams: []upstreamConfig{{URL: up.URL + "/api"}, {URL: down.URL}}},
+	}}
+	ready, err := newReadiness(routes, up.URL+"/token/introspection", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ready.checks) != 2 {
+		t.Errorf("got checks %v, want each address once", ready.checks)
+	}
+	admin := httptest.NewServer(adminHandler(ready))
+	t.Cleanup(admin.Close)
+
+	if status, body := getHealth(t, admin.URL+"/healthz"); status != http.StatusOK || body.Status != "ok" {
+		t.Errorf("healthz: got %d %+v", status, body)
+	}
+
+	status, body := getHealth(t, admin.URL+"/readyz")
+	if status != http.StatusServiceUnavailable || body.Status != "unavailable" {
+		t.Fatalf("readyz with an upstream down: got %d %+v", status, body)
+	}
+	if body.Checks["upstream "+up.URL] != "ok" || body.Checks["upstream "+down.URL] == "ok" {
+		t.Errorf("got checks %v", body.Checks)
+	}
+
+	// Without the upstream that is down the proxy is ready
+	routes.Routes[1].Upstreams = routes.Routes[1].Upstreams[:1]
+	ready, _ = newReadiness(routes, up.URL, time.Second)
+	admin = httptest.NewServer(adminHandler(ready))
+	t.Cleanup(admin.Close)
+	if status, body := getHealth(t, admin.URL+"/readyz"); status != http.StatusOK || body.Status != "ready" {
+		t.Errorf("readyz: got %d %+v", status, body)
+	}
+	ready.draining.Store(true)
+	if status, body := getHealth(t, admin.URL+"/readyz"); status != http.StatusServiceUnavailable || body.Status != "draining" {
+		t.Errorf("readyz while draining: got %d %+v", status, body)
+	}
+
+	resp, err := http.Get(admin.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var metrics map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&metrics); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"introspection_cache", "rate_limit", "upstream"} {
+		if _, ok := metrics[name]; !ok {
+			t.Errorf("metrics have no %s", name)
+		}
+	}
+}
+
+func TestServeUntilSignalDrains(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	proxy := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ready := &readiness{timeout: time.Second}
+	admin := &http.Server{Handler: adminHandler(ready)}
+
+	stop := make(chan os.Signal, 1)
+	served := make(chan error, 1)
+	go func() {
+		served <- serveUntilSignal(discardLogger(), proxy, ln, admin, adminLn, ready, stop, 100*time.Millisecond, 5*time.Second)
+	}()
+
+	inflight := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String())
+		if err != nil {
+			inflight <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		body := make([]byte, 4)
+		n, _ := resp.Body.Read(body)
+		inflight <- string(body[:n])
+	}()
+	<-started
+
+	stop <- syscall.SIGTERM
+	// Load balancers are told to stop sending requests before draining starts
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(10 * time.Millisecond) {
+		status, body := getHealth(t, "http://"+adminLn.Addr().String()+"/readyz")
+		if status == http.StatusServiceUnavailable && body.Status == "draining" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("readyz after SIGTERM: got %d %+v", status, body)
+		}
+	}
+	select {
+	case err := <-served:
+		t.Fatalf("returned with a request in flight: %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	if got := <-inflight; got != "done" {
+		t.Errorf("in-flight request got %q", got)
+	}
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := http.Get("http://" + ln.Addr().String()); err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("got %v, want new connections refused", err)
+	}
+}
+
+func TestServeUntilSignalListenerFailure(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	err = serveUntilSignal(discardLogger(), &http.Server{}, ln, nil, nil, &readiness{}, make(chan os.Signal), 0, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "proxy server") {
+		t.Errorf("got %v, want the listener's error", err)
+	}
+}
@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Redaction modes for audited body fields
+const (
+	// auditHash replaces values with a keyed hash, so records about the same
+	// phone number or account can still be correlated
+	auditHash = "hash"
+	// auditMask keeps only the last four characters, or an email's domain
+	auditMask = "mask"
+)
+
+// maxAuditBody is the largest request body searched for audited fields
+const maxAuditBody = 64 << 10
+
+// auditRecord is written for every call to an audited route
+type auditRecord struct {
+	Time         time.Time           `json:"time"`
+	RequestID    string              `json:"request_id"`
+	Route        string              `json:"route"`
+	Method       string              `json:"method"`
+	Path         string              `json:"path"`
+	RemoteIP     string              `json:"remote_ip"`
+	ClientID     string              `json:"client_id,omitempty"`
+	Thumbprint   string              `json:"x5t#S256,omitempty"`
+	TokenBinding string              `json:"token_binding,omitempty"`
+	Status       int                 `json:"status"`
+	LatencyMS    float64             `json:"latency_ms"`
+	BytesIn      int64               `json:"bytes_in"`
+	BytesOut     int64               `json:"bytes_out"`
+	Fields       map[string][]string `json:"fields,omitempty"`
+	// Seq, PrevHash and Hash chain records together when hash chaining is on
+	Seq      uint64 `json:"seq,omitempty"`
+	PrevHash string `json:"prev_hash,omitempty"`
+	Hash     string `json:"hash,omitempty"`
+}
+
+// auditSink stores audit records
+type auditSink interface {
+	write(record *auditRecord) error
+}
+
+// auditLog receives the records of audited routes; nil turns auditing off
+var auditLog auditSink
+
+// auditRedaction redacts the body fields recorded in audit records
+var auditRedaction = newAuditRedactor([]string{"phoneNumber", "accountNumber", "emailAddress"}, auditHash, nil)
+
+// writerSink writes records as JSON lines, to stdout or a file
+type writerSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *writerSink) write(record *auditRecord) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err = s.w.Write(append(line, '\n'))
+	return err
+}
+
+// openAuditFile appends records to the file at path
+func openAuditFile(path string) (*writerSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSink{w: f}, nil
+}
+
+// newAuditSink opens the sink named by kind: stdout, file, or none for ""
+// to turn auditing off. chained links the records with hashes.
+func newAuditSink(kind, path string, chained bool) (auditSink, error) {
+	var sink auditSink
+	switch kind {
+	case "":
+		return nil, nil
+	case "stdout":
+		sink, path = &writerSink{w: os.Stdout}, ""
+	case "file":
+		file, err := openAuditFile(path)
+		if err != nil {
+			return nil, err
+		}
+		sink = file
+	default:
+		return nil, fmt.Errorf("unknown audit sink %q", kind)
+	}
+	if chained {
+		return newHashChainSink(sink, path)
+	}
+	return sink, nil
+}
+
+// hashChainSink links each record to the one before by including the
+// previous record's hash in its own, so removing or altering a record
+// breaks the chain from that point on
+type hashChainSink struct {
+	next auditSink
+
+	mu   sync.Mutex
+	seq  uint64
+	prev string
+}
+
+// newHashChainSink continues the chain in the log at path, if there is one,
+// or starts a new chain
+func newHashChainSink(next auditSink, path string) (*hashChainSink, error) {
+	s := &hashChainSink{next: next}
+	if path == "" {
+		return s, nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var last []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			last = append(last[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if last != nil {
+		var record auditRecord
+		if err := json.Unmarshal(last, &record); err != nil {
+			return nil, fmt.Errorf("unable to continue audit chain in %s: %w", path, err)
+		}
+		s.seq, s.prev = record.Seq, record.Hash
+	}
+	return s, nil
+}
+
+func (s *hashChainSink) write(record *auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	record.Seq = s.seq + 1
+	record.PrevHash = s.prev
+	hash, err := auditRecordHash(record)
+	if err != nil {
+		return err
+	}
+	record.Hash = hash
+	if err := s.next.write(record); err != nil {
+		return err
+	}
+	s.seq, s.prev = record.Seq, record.Hash
+	return nil
+}
+
+// auditRecordHash hashes a record as written, without its own hash
+func auditRecordHash(record *auditRecord) (string, error) {
+	unhashed := *record
+	unhashed.Hash = ""
+	data, err := json.Marshal(&unhashed)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// verifyAuditChain checks every record in a hash-chained log follows the
+// one before it, returning the number of records
+func verifyAuditChain(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<20)
+	count := 0
+	var prev *auditRecord
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return count, fmt.Errorf("record %d: %w", count+1, err)
+		}
+		hash, err := auditRecordHash(&record)
+		if err != nil {
+			return count, err
+		}
+		if hash != record.Hash {
+			return count, fmt.Errorf("record %d has been altered", record.Seq)
+		}
+		if prev != nil && (record.Seq != prev.Seq+1 || record.PrevHash != prev.Hash) {
+			return count, fmt.Errorf("record %d does not follow record %d", record.Seq, prev.Seq)
+		}
+		prev = &record
+		count++
+	}
+	return count, scanner.Err()
+}
+
+// auditRedactor finds the configured fields in JSON request bodies and
+// redacts their values
+type auditRedactor struct {
+	fields map[string]bool
+	mode   string
+	key    []byte
+}
+
+func newAuditRedactor(fields []string, mode string, key []byte) *auditRedactor {
+	r := &auditRedactor{fields: map[string]bool{}, mode: mode, key: key}
+	for _, field := range fields {
+		r.fields[field] = true
+	}
+	return r
+}
+
+// extract returns the redacted values of the audited fields anywhere in body
+func (r *auditRedactor) extract(body []byte) map[string][]string {
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return nil
+	}
+	found := map[string][]string{}
+	r.walk(document, found)
+	if len(found) == 0 {
+		return nil
+	}
+	return found
+}
+
+func (r *auditRedactor) walk(value interface{}, found map[string][]string) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, child := range v {
+			if r.fields[key] {
+				if s, ok := child.(string); ok {
+					found[key] = append(found[key], r.redact(s))
+					continue
+				}
+			}
+			r.walk(child, found)
+		}
+	case []interface{}:
+		for _, child := range v {
+			r.walk(child, found)
+		}
+	}
+}
+
+// redact hashes or masks a value
+func (r *auditRedactor) redact(value string) string {
+	if r.mode == auditMask {
+		if local, domain, ok := strings.Cut(value, "@"); ok && local != "" {
+			return string([]rune(local)[:1]) + "***@" + domain
+		}
+		runes := []rune(value)
+		if len(runes) <= 4 {
+			return strings.Repeat("*", len(runes))
+		}
+		return strings.Repeat("*", len(runes)-4) + string(runes[len(runes)-4:])
+	}
+	mac := hmac.New(sha256.New, r.key)
+	mac.Write([]byte(value))
+	return "hmac-sha256:" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditRecordKey is the context key for the record of the current request
+type auditRecordKey struct{}
+
+func auditRecordFromContext(ctx context.Context) (*auditRecord, bool) {
+	record, ok := ctx.Value(auditRecordKey{}).(*auditRecord)
+	return record, ok
+}
+
+// countingReader counts the bytes read from a request body
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// auditRequests writes an audit record for every request to the route once
+// it has been answered, whether it was proxied or rejected
+func auditRequests(route string, sink auditSink, redactor *auditRedactor, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestID, ok := requestIDFromContext(r.Context())
+		if !ok {
+			requestID = newRequestID()
+		}
+		record := &auditRecord{
+			Time:      start.UTC(),
+			RequestID: requestID,
+			Route:     route,
+			Method:    r.Method,
+			Path:      r.URL.Path,
+			RemoteIP:  clientIP(r),
+		}
+		if hasClientCert(r) {
+			hash := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+			record.Thumbprint = base64.RawURLEncoding.EncodeToString(hash[:])
+		}
+		if r.Body != nil && strings.Contains(r.Header.Get("Content-Type"), "json") {
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxAuditBody+1))
+			if err == nil && len(body) <= maxAuditBody {
+				record.Fields = redactor.extract(body)
+			}
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		var body *countingReader
+		if r.Body != nil {
+			body = &countingReader{ReadCloser: r.Body}
+			r.Body = body
+		}
+
+		ctx := context.WithValue(r.Context(), auditRecordKey{}, record)
+		ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		record.Status = rec.status
+		record.BytesOut = rec.bytes
+		if body != nil {
+			record.BytesIn = body.n
+		}
+		record.LatencyMS = float64(time.Since(start).Microseconds()) / 1000
+		if err := sink.write(record); err != nil {
+			slog.Error("Failed to write audit record", slog.String("requestID", requestID), slog.String("error", err.Error()))
+		}
+	})
+}
+
+// recordAuditIdentity adds the client the route policy authenticated to the
+// request's audit record
+func recordAuditIdentity(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if record, ok := auditRecordFromContext(r.Context()); ok {
+			if auth, ok := tokenAuthFromContext(r.Context()); ok {
+				record.TokenBinding = auth.binding
+				if auth.result != nil {
+					record.ClientID, _ = auth.result.response["client_id"].(string)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordingSink keeps the records written to it
+type recordingSink struct {
+	mu      sync.Mutex
+	records []auditRecord
+}
+
+func (s *recordingSink) write(record *auditRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records = append(s.records, *record)
+	return nil
+}
+
+func TestAuditRedactor(t *testing.T) {
+	body := []byte(`{
+		"phoneNumber": "+61400111222",
+		"accounts": [{"accountNumber": "12345678", "bsb": "062000"}],
+		"emailAddress": "jane@example.com",
+		"score": 12
+	}`)
+
+	hashed := newAuditRedactor([]string{"phoneNumber", "accountNumber", "emailAddress"}, auditHash, []byte("key")).extract(body)
+	if len(hashed) != 3 {
+		t.Fatalf("got fields %v", hashed)
+	}
+	for field, values := range hashed {
+		if len(values) != 1 || !strings.HasPrefix(values[0], "hmac-sha256:") {
+			t.Errorf("%s was not hashed: %v", field, values)
+		}
+	}
+	if again := newAuditRedactor([]string{"phoneNumber"}, auditHash, []byte("key")).extract(body); again["phoneNumber"][0] != hashed["phoneNumber"][0] {
+		t.Error("the same value hashed differently")
+	}
+	if other := newAuditRedactor([]string{"phoneNumber"}, auditHash, []byte("other")).extract(body); other["phoneNumber"][0] == hashed["phoneNumber"][0] {
+		t.Error("the hash does not depend on the key")
+	}
+
+	masked := newAuditRedactor([]string{"phoneNumber", "accountNumber", "emailAddress", "score"}, auditMask, nil).extract(body)
+	want := map[string]string{
+		"phoneNumber":   "********1222",
+		"accountNumber": "****5678",
+		"emailAddress":  "j***@example.com",
+	}
+	for field, value := range want {
+		if got := masked[field]; len(got) != 1 || got[0] != value {
+			t.Errorf("%s: got %v, want %q", field, got, value)
+		}
+	}
+	if _, ok := masked["score"]; ok {
+		t.Error("a number was recorded as a string field")
+	}
+	// Masking counts characters, not bytes
+	unicode := newAuditRedactor([]string{"name", "emailAddress"}, auditMask, nil).extract([]byte(`{"name": "Zoë Müller", "emailAddress": "élodie@example.com"}`))
+	if got := unicode["name"]; len(got) != 1 || got[0] != "******ller" {
+		t.Errorf("name: got %v", got)
+	}
+	if got := unicode["emailAddress"]; len(got) != 1 || got[0] != "é***@example.com" {
+		t.Errorf("emailAddress: got %v", got)
+	}
+
+	if fields := newAuditRedactor([]string{"phoneNumber"}, auditHash, nil).extract([]byte("phoneNumber=+61400111222")); fields != nil {
+		t.Errorf("got fields %v from a body that is not JSON", fields)
+	}
+}
+
+func TestHashChainSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	write := func(ids ...string) {
+		t.Helper()
+		file, err := openAuditFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.w.(io.Closer).Close()
+		sink, err := newHashChainSink(file, path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range ids {
+			if err := sink.write(&auditRecord{RequestID: id, Route: "api", Status: http.StatusOK}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// A restart continues the chain rather than starting another
+	write("a", "b")
+	write("c")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := verifyAuditChain(bytes.NewReader(data)); err != nil || n != 3 {
+		t.Fatalf("got %d records, error %v", n, err)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	altered := strings.Replace(string(data), `"status":200`, `"status":404`, 1)
+	if _, err := verifyAuditChain(strings.NewReader(altered)); err == nil {
+		t.Error("an altered record was not detected")
+	}
+	removed := lines[0] + lines[2]
+	if _, err := verifyAuditChain(strings.NewReader(removed)); err == nil {
+		t.Error("a removed record was not detected")
+	}
+}
+
+func TestNewAuditSink(t *testing.T) {
+	if sink, err := newAuditSink("", "", true); sink != nil || err != nil {
+		t.Errorf("got %v, %v with auditing off", sink, err)
+	}
+	if _, err := newAuditSink("syslog", "", false); err == nil {
+		t.Error("expected an unknown sink to be rejected")
+	}
+	sink, err := newAuditSink("stdout", "audit.log", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := sink.(*hashChainSink); !ok {
+		t.Errorf("got %T, want a hash chain", sink)
+	}
+}
+
+func TestAuditedRoute(t *testing.T) {
+	pki := newTestPKI(t)
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"bound": {"active": true, "client_id": "client", "cnf": map[string]interface{}{"x5t#S256": thumbprint(pki.clientCert)}},
+	})
+	received := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- string(body)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"score":12}`))
+	}))
+	t.Cleanup(upstream.Close)
+
+	sink := &recordingSink{}
+	auditLog = sink
+	t.Cleanup(func() { auditLog = nil })
+
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{
+		{Name: "api", Host: "api.example", Auth: authToken, Audit: true, Upstreams: []upstreamConfig{{URL: upstream.URL}}},
+		{Name: "portal", Host: "portal.example", Auth: authMTLS, Upstreams: []upstreamConfig{{URL: upstream.URL}}},
+	}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+	client := testClient(ts, pki.clientCert)
+
+	call := func(host, token string) int {
+		t.Helper()
+		body := `{"phoneNumber":"+61400111222"}`
+		req, _ := http.NewRequest(http.MethodPost, ts.URL+"/confirm", strings.NewReader(body))
+		req.Host = host
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusCreated {
+			if got := <-received; got != body {
+				t.Errorf("upstream got body %q", got)
+			}
+		}
+		return resp.StatusCode
+	}
+
+	if status := call("api.example", "bound"); status != http.StatusCreated {
+		t.Fatalf("got status %d", status)
+	}
+	if status := call("api.example", "unknown"); status != http.StatusUnauthorized {
+		t.Fatalf("got status %d for an invalid token", status)
+	}
+	call("portal.example", "")
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.records) != 2 {
+		t.Fatalf("got %d records, want only the api route's 2", len(sink.records))
+	}
+	record := sink.records[0]
+	if record.Route != "api" || record.ClientID != "client" || record.Thumbprint != thumbprint(pki.clientCert) {
+		t.Errorf("got identity %+v", record)
+	}
+	if record.Status != http.StatusCreated || record.BytesIn != 30 || record.BytesOut != 12 || record.RequestID == "" {
+		t.Errorf("got exchange %+v", record)
+	}
+	if phones := record.Fields["phoneNumber"]; len(phones) != 1 || strings.Contains(phones[0], "400111222") {
+		t.Errorf("got phone numbers %v", phones)
+	}
+	if rejected := sink.records[1]; rejected.Status != http.StatusUnauthorized || rejected.ClientID != "" || rejected.RequestID == record.RequestID {
+		t.Errorf("got rejected record %+v", rejected)
+	}
+}
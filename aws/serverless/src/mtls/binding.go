@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+)
+
+// Token binding recorded in the access log
+const (
+	// bindingCertificate is a token whose cnf x5t#S256 matched the client certificate
+	bindingCertificate = "certificate"
+	// bindingNone is a token with no cnf claim, accepted on routes that allow it
+	bindingNone = "none"
+)
+
+// routePolicy is what a route demands of a caller before a request is proxied
+type routePolicy struct {
+	// RequireClientCert rejects requests that did not present a verified client certificate
+	RequireClientCert bool
+	// RequireAccessToken rejects requests without an active bearer token
+	RequireAccessToken bool
+	// RequireBoundToken rejects tokens that are not bound to the client
+	// certificate through a cnf x5t#S256 claim (RFC 8705 section 3)
+	RequireBoundToken bool
+}
+
+// tokenAuth is what the route policy learned about the request's access token
+type tokenAuth struct {
+	binding string
+	result  *introspectionResult
+}
+
+type tokenAuthKey struct{}
+
+// tokenAuthFromContext returns the access token that authorised the request,
+// if the route checked one
+func tokenAuthFromContext(ctx context.Context) (tokenAuth, bool) {
+	auth, ok := ctx.Value(tokenAuthKey{}).(tokenAuth)
+	return auth, ok
+}
+
+func hasClientCert(req *http.Request) bool {
+	return req.TLS != nil && len(req.TLS.PeerCertificates) > 0
+}
+
+// enforceRoutePolicy rejects requests that do not meet the route's policy.
+// A token carrying cnf x5t#S256 must always match the presented certificate,
+// whatever the policy, so a stolen bound token is useless on its own.
+func enforceRoutePolicy(policy routePolicy, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if policy.RequireClientCert && !hasClientCert(r) {
+			slog.Error("No client certificate, returning 401")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !policy.RequireAccessToken {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		accessToken := getAccessToken(r)
+		if accessToken == "" {
+			slog.Error("No Authorization header, returning 401")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		result, err := introspections.lookup(r.Context(), accessToken)
+		if errors.Is(err, errIntrospectionUnavailable) {
+			slog.Error("Introspection endpoint unavailable, returning 503", slog.String("error", err.Error()))
+			writeJSONError(w, r, http.StatusServiceUnavailable, "The token could not be checked")
+			return
+		}
+		if err != nil {
+			slog.Error("Introspection failed, returning 401", slog.String("error", err.Error()))
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		binding := bindingNone
+		if x5tS256, ok := certificateThumbprintClaim(result.response); ok {
+			if !verifyCertificateThumbprint(r, x5tS256) {
+				slog.Error("Client certificate thumbprint verification failed, returning 401")
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			binding = bindingCertificate
+		} else if policy.RequireBoundToken {
+			slog.Error("Access token is not certificate bound, returning 401")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		addIntrospectionHeaders(r, result)
+		if details, ok := accessDetailsFromContext(r.Context()); ok {
+			details.tokenBinding = binding
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenAuthKey{}, tokenAuth{binding: binding, result: result})))
+	})
+}
+
+// certificateThumbprintClaim returns the cnf x5t#S256 claim of a token, if any
+func certificateThumbprintClaim(claims map[string]interface{}) (string, bool) {
+	cnf, ok := claims["cnf"].(map[string]interface{})
+	if !ok {
+		return "", false
+	}
+	x5tS256, ok := cnf["x5t#S256"].(string)
+	return x5tS256, ok && x5tS256 != ""
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testPKI is a CA and a client certificate it issued
+type testPKI struct {
+	ca         *x509.Certificate
+	caKey      *ecdsa.PrivateKey
+	pool       *x509.CertPool
+	clientCert tls.Certificate
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+
+	pki := &testPKI{ca: ca, caKey: caKey, pool: pool}
+	pki.clientCert = pki.issueClientCert(t, "client.example.com", 2)
+	return pki
+}
+
+// issueClientCert issues a client certificate with the given common name and serial
+func (p *testPKI) issueClientCert(t *testing.T, commonName string, serial int64) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"Test Participant"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	return p.issue(t, template, key)
+}
+
+// issue signs template with the CA
+func (p *testPKI) issue(t *testing.T, template *x509.Certificate, key *ecdsa.PrivateKey) tls.Certificate {
+	t.Helper()
+	der, err := x509.CreateCertificate(rand.Reader, template, p.ca, &key.PublicKey, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// thumbprint is the RFC 8705 x5t#S256 value of a certificate
+func thumbprint(cert tls.Certificate) string {
+	hash := sha256.Sum256(cert.Certificate[0])
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// newIntrospectionServer answers introspection with the response stored for each token
+func newIntrospectionServer(t *testing.T, responses map[string]map[string]interface{}) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		response, ok := responses[r.PostForm.Get("token")]
+		if !ok {
+			response = map[string]interface{}{"active": false}
+		}
+		// Written without a trailing newline, as the access_token header carries it verbatim
+		body, _ := json.Marshal(response)
+		w.Write(body)
+	}))
+	t.Cleanup(ts.Close)
+	t.Setenv("INTROSPECTION_URL", ts.URL)
+	useIntrospectionCache(t, newIntrospectionCache(time.Minute, time.Minute, 100))
+	return ts
+}
+
+// newTestProxy serves a route with policy in front of upstream over TLS,
+// asking for, but not requiring, a client certificate
+func newTestProxy(t *testing.T, pki *testPKI, policy routePolicy, upstream *httptest.Server, log *slog.Logger) *httptest.Server {
+	return serveTestTLS(t, pki, accessLogger(log, enforceRoutePolicy(policy, newTestReverseProxy(upstream))))
+}
+
+// newTestReverseProxy proxies to upstream the way main does
+func newTestReverseProxy(upstream *httptest.Server) http.Handler {
+	target, _ := url.Parse(upstream.URL)
+	proxy := &httputil.ReverseProxy{Rewrite: func(pr *httputil.ProxyRequest) {
+		rewriteUpstream(pr, target, true)
+	}}
+	return proxy
+}
+
+// serveTestTLS serves handler over TLS, asking for, but not requiring, a
+// client certificate issued by pki
+func serveTestTLS(t *testing.T, pki *testPKI, handler http.Handler) *httptest.Server {
+	ts := httptest.NewUnstartedServer(handler)
+	ts.TLS = &tls.Config{ClientCAs: pki.pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// testClient returns a client of ts presenting certs, with its own connections
+func testClient(ts *httptest.Server, certs ...tls.Certificate) *http.Client {
+	transport := ts.Client().Transport.(*http.Transport).Clone()
+	transport.TLSClientConfig.Certificates = certs
+	return &http.Client{Transport: transport}
+}
+
+func TestEnforceRoutePolicyTokenBinding(t *testing.T) {
+	pki := newTestPKI(t)
+	other := pki.issueClientCert(t, "other.example.com", 3)
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"bound":   {"active": true, "client_id": "client-1", "cnf": map[string]interface{}{"x5t#S256": thumbprint(pki.clientCert)}},
+		"unbound": {"active": true, "client_id": "client-1"},
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	strict := routePolicy{RequireClientCert: true, RequireAccessToken: true, RequireBoundToken: true}
+	lenient := routePolicy{RequireAccessToken: true}
+
+	tests := []struct {
+		name    string
+		policy  routePolicy
+		certs   []tls.Certificate
+		token   string
+		status  int
+		binding string
+	}{
+		{"bound token with its certificate", strict, []tls.Certificate{pki.clientCert}, "bound", http.StatusOK, bindingCertificate},
+		{"bound token with another certificate", strict, []tls.Certificate{other}, "bound", http.StatusUnauthorized, ""},
+		{"bound token without a certificate", strict, nil, "bound", http.StatusUnauthorized, ""},
+		{"unbound token with a certificate", strict, []tls.Certificate{pki.clientCert}, "unbound", http.StatusUnauthorized, ""},
+		{"unbound token without a certificate", strict, nil, "unbound", http.StatusUnauthorized, ""},
+		{"no token", strict, []tls.Certificate{pki.clientCert}, "", http.StatusUnauthorized, ""},
+		{"inactive token", strict, []tls.Certificate{pki.clientCert}, "revoked", http.StatusUnauthorized, ""},
+		{"lenient: unbound token without a certificate", lenient, nil, "unbound", http.StatusOK, bindingNone},
+		{"lenient: unbound token with a certificate", lenient, []tls.Certificate{pki.clientCert}, "unbound", http.StatusOK, bindingNone},
+		{"lenient: bound token with its certificate", lenient, []tls.Certificate{pki.clientCert}, "bound", http.StatusOK, bindingCertificate},
+		{"lenient: bound token without a certificate", lenient, nil, "bound", http.StatusUnauthorized, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			ts := newTestProxy(t, pki, tt.policy, upstream, slog.New(slog.NewJSONHandler(&logs, nil)))
+
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/au/v1.0/resource", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := testClient(ts, tt.certs...).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if tt.binding == "" {
+				return
+			}
+			var entry map[string]interface{}
+			if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+				t.Fatalf("no access log entry: %v", err)
+			}
+			if entry["tokenBinding"] != tt.binding {
+				t.Errorf("tokenBinding = %v, want %s", entry["tokenBinding"], tt.binding)
+			}
+		})
+	}
+}
+
+func TestEnforceRoutePolicyWithoutToken(t *testing.T) {
+	pki := newTestPKI(t)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+
+	var logs bytes.Buffer
+	ts := newTestProxy(t, pki, routePolicy{RequireClientCert: true}, upstream, slog.New(slog.NewJSONHandler(&logs, nil)))
+
+	resp, err := testClient(ts).Get(ts.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("without certificate: status = %d, want 401", resp.StatusCode)
+	}
+
+	resp, err = testClient(ts, pki.clientCert).Get(ts.URL + "/token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("with certificate: status = %d, want 200", resp.StatusCode)
+	}
+	if strings.Contains(logs.String(), "tokenBinding") {
+		t.Errorf("access log records a token binding for a route without tokens: %s", logs.String())
+	}
+}
+
+func discardLogger() *slog.Logger {
+	return slog.New(slog.NewJSONHandler(io.Discard, nil))
+}
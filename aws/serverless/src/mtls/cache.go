@@ -0,0 +1,190 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"sync"
+	"time"
+)
+
+// introspectionResult is what the OP said about a token, with the user info
+// for tokens that have a subject
+type introspectionResult struct {
+	response map[string]interface{}
+	body     []byte
+	userInfo []byte
+}
+
+// introspectionCacheMetrics are published through expvar as introspection_cache
+var introspectionCacheMetrics = expvar.NewMap("introspection_cache")
+
+func init() {
+	introspectionCacheMetrics.Set("hit_rate", expvar.Func(func() interface{} {
+		hits := metricValue("hits") + metricValue("negative_hits")
+		total := hits + metricValue("misses") + metricValue("shared")
+		if total == 0 {
+			return 0.0
+		}
+		return float64(hits) / float64(total)
+	}))
+}
+
+func metricValue(name string) int64 {
+	if v, ok := introspectionCacheMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+// introspectionCache holds introspection results, keyed by a hash of the
+// token so tokens are never kept in memory, for at most ttl and never beyond
+// the token's exp. Tokens the OP reports inactive are remembered for
+// negativeTTL. Concurrent lookups of the same token share one call to the OP.
+type introspectionCache struct {
+	ttl         time.Duration
+	negativeTTL time.Duration
+	maxEntries  int
+	fetch       func(ctx context.Context, token string) (*introspectionResult, error)
+
+	mu       sync.Mutex
+	entries  map[string]*list.Element
+	lru      *list.List
+	inflight map[string]*introspectionCall
+}
+
+type introspectionCacheEntry struct {
+	key       string
+	result    *introspectionResult
+	err       error
+	expiresAt time.Time
+}
+
+type introspectionCall struct {
+	done   chan struct{}
+	result *introspectionResult
+	err    error
+}
+
+// introspections caches the results used to authorise API requests
+var introspections = newIntrospectionCache(time.Minute, 10*time.Second, 10000)
+
+func newIntrospectionCache(ttl, negativeTTL time.Duration, maxEntries int) *introspectionCache {
+	return &introspectionCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		maxEntries:  maxEntries,
+		fetch:       fetchIntrospection,
+		entries:     map[string]*list.Element{},
+		lru:         list.New(),
+		inflight:    map[string]*introspectionCall{},
+	}
+}
+
+// fetchIntrospection validates the token and fetches user info for it
+func fetchIntrospection(ctx context.Context, token string) (*introspectionResult, error) {
+	response, body, err := validateAccessToken(ctx, token)
+	if err != nil {
+		return nil, err
+	}
+	result := &introspectionResult{response: response, body: body}
+	if _, ok := response["sub"].(string); ok {
+		result.userInfo = fetchUserInfo(ctx, token)
+	}
+	return result, nil
+}
+
+// lookup returns the cached result for the token, or introspects it. The OP
+// calls carry ctx's trace but are not cancelled with it, as other requests
+// may be waiting on the same call; a request waiting on another's call gives
+// up when ctx is done.
+func (c *introspectionCache) lookup(ctx context.Context, token string) (*introspectionResult, error) {
+	hash := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(hash[:])
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		entry := element.Value.(*introspectionCacheEntry)
+		if time.Now().Before(entry.expiresAt) {
+			c.lru.MoveToFront(element)
+			c.mu.Unlock()
+			if entry.err != nil {
+				introspectionCacheMetrics.Add("negative_hits", 1)
+			} else {
+				introspectionCacheMetrics.Add("hits", 1)
+			}
+			return entry.result, entry.err
+		}
+		c.remove(element)
+	}
+	if call, ok := c.inflight[key]; ok {
+		c.mu.Unlock()
+		introspectionCacheMetrics.Add("shared", 1)
+		select {
+		case <-call.done:
+			return call.result, call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	call := &introspectionCall{done: make(chan struct{})}
+	c.inflight[key] = call
+	c.mu.Unlock()
+
+	introspectionCacheMetrics.Add("misses", 1)
+	call.result, call.err = c.fetch(context.WithoutCancel(ctx), token)
+
+	c.mu.Lock()
+	delete(c.inflight, key)
+	if expiresAt, ok := c.expiry(call.result, call.err); ok {
+		c.store(&introspectionCacheEntry{key: key, result: call.result, err: call.err, expiresAt: expiresAt})
+	}
+	c.mu.Unlock()
+	close(call.done)
+
+	return call.result, call.err
+}
+
+// expiry returns when a result should leave the cache, or false if it must
+// not be cached at all. Failures to reach the OP are never cached.
+func (c *introspectionCache) expiry(result *introspectionResult, err error) (time.Time, bool) {
+	now := time.Now()
+	if err != nil {
+		if errors.Is(err, errTokenInactive) && c.negativeTTL > 0 {
+			return now.Add(c.negativeTTL), true
+		}
+		return time.Time{}, false
+	}
+	if c.ttl <= 0 {
+		return time.Time{}, false
+	}
+	expiresAt := now.Add(c.ttl)
+	if exp, ok := result.response["exp"].(float64); ok {
+		if tokenExpiry := time.Unix(int64(exp), 0); tokenExpiry.Before(expiresAt) {
+			expiresAt = tokenExpiry
+		}
+	}
+	return expiresAt, expiresAt.After(now)
+}
+
+// store adds an entry, evicting the least recently used when the cache is full
+func (c *introspectionCache) store(entry *introspectionCacheEntry) {
+	if c.maxEntries <= 0 {
+		return
+	}
+	for c.lru.Len() >= c.maxEntries {
+		c.remove(c.lru.Back())
+		introspectionCacheMetrics.Add("evictions", 1)
+	}
+	c.entries[entry.key] = c.lru.PushFront(entry)
+	introspectionCacheMetrics.Add("entries", 1)
+}
+
+func (c *introspectionCache) remove(element *list.Element) {
+	c.lru.Remove(element)
+	delete(c.entries, element.Value.(*introspectionCacheEntry).key)
+	introspectionCacheMetrics.Add("entries", -1)
+}
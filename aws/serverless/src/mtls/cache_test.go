@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useIntrospectionCache swaps in cache for the duration of the test
+func useIntrospectionCache(t *testing.T, cache *introspectionCache) {
+	previous := introspections
+	introspections = cache
+	t.Cleanup(func() { introspections = previous })
+}
+
+// countingFetch answers introspection from responses, counting calls to the OP
+type countingFetch struct {
+	calls     atomic.Int32
+	responses map[string]map[string]interface{}
+	err       error
+	release   chan struct{}
+}
+
+func (f *countingFetch) fetch(_ context.Context, token string) (*introspectionResult, error) {
+	f.calls.Add(1)
+	if f.release != nil {
+		<-f.release
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	response, ok := f.responses[token]
+	if !ok {
+		return nil, errTokenInactive
+	}
+	return &introspectionResult{response: response}, nil
+}
+
+func newTestCache(ttl, negativeTTL time.Duration, maxEntries int, f *countingFetch) *introspectionCache {
+	cache := newIntrospectionCache(ttl, negativeTTL, maxEntries)
+	cache.fetch = f.fetch
+	return cache
+}
+
+func TestIntrospectionCacheHit(t *testing.T) {
+	f := &countingFetch{responses: map[string]map[string]interface{}{"token": {"active": true}}}
+	cache := newTestCache(time.Minute, time.Minute, 10, f)
+
+	for i := 0; i < 3; i++ {
+		if _, err := cache.lookup(context.Background(), "token"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := f.calls.Load(); got != 1 {
+		t.Errorf("OP called %d times, want 1", got)
+	}
+	if _, ok := cache.entries["token"]; ok {
+		t.Error("cache is keyed by the raw token")
+	}
+}
+
+func TestIntrospectionCacheRespectsTokenExpiry(t *testing.T) {
+	f := &countingFetch{responses: map[string]map[string]interface{}{
+		"expiring": {"active": true, "exp": float64(time.Now().Add(time.Second).Unix())},
+		"expired":  {"active": true, "exp": float64(time.Now().Add(-time.Second).Unix())},
+	}}
+	cache := newTestCache(time.Hour, time.Minute, 10, f)
+
+	cache.lookup(context.Background(), "expiring")
+	cache.mu.Lock()
+	entry := cache.lru.Front().Value.(*introspectionCacheEntry)
+	cache.mu.Unlock()
+	if entry.expiresAt.After(time.Now().Add(2 * time.Second)) {
+		t.Errorf("entry outlives the token: expires at %v", entry.expiresAt)
+	}
+
+	cache.lookup(context.Background(), "expired")
+	cache.lookup(context.Background(), "expired")
+	if got := f.calls.Load(); got != 3 {
+		t.Errorf("OP called %d times, want 3 as expired tokens are not cached", got)
+	}
+}
+
+func TestIntrospectionCacheNegativeCaching(t *testing.T) {
+	f := &countingFetch{responses: map[string]map[string]interface{}{}}
+	cache := newTestCache(time.Minute, time.Minute, 10, f)
+
+	for i := 0; i < 2; i++ {
+		if _, err := cache.lookup(context.Background(), "revoked"); !errors.Is(err, errTokenInactive) {
+			t.Fatalf("err = %v, want errTokenInactive", err)
+		}
+	}
+	if got := f.calls.Load(); got != 1 {
+		t.Errorf("OP called %d times, want 1", got)
+	}
+
+	// Without a negative TTL every lookup asks the OP
+	f = &countingFetch{responses: map[string]map[string]interface{}{}}
+	cache = newTestCache(time.Minute, 0, 10, f)
+	cache.lookup(context.Background(), "revoked")
+	cache.lookup(context.Background(), "revoked")
+	if got := f.calls.Load(); got != 2 {
+		t.Errorf("OP called %d times, want 2", got)
+	}
+}
+
+func TestIntrospectionCacheDoesNotCacheFailures(t *testing.T) {
+	f := &countingFetch{err: errors.New("connection refused")}
+	cache := newTestCache(time.Minute, time.Minute, 10, f)
+
+	cache.lookup(context.Background(), "token")
+	cache.lookup(context.Background(), "token")
+	if got := f.calls.Load(); got != 2 {
+		t.Errorf("OP called %d times, want 2", got)
+	}
+}
+
+func TestIntrospectionCacheSharesConcurrentLookups(t *testing.T) {
+	f := &countingFetch{
+		responses: map[string]map[string]interface{}{"token": {"active": true}},
+		release:   make(chan struct{}),
+	}
+	cache := newTestCache(time.Minute, time.Minute, 10, f)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := cache.lookup(context.Background(), "token"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	// Let the lookups pile up behind the first before the OP answers
+	for {
+		cache.mu.Lock()
+		waiting := len(cache.inflight)
+		cache.mu.Unlock()
+		if waiting == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(f.release)
+	wg.Wait()
+
+	if got := f.calls.Load(); got != 1 {
+		t.Errorf("OP called %d times, want 1", got)
+	}
+}
+
+func TestIntrospectionCacheWaiterGivesUpWithItsContext(t *testing.T) {
+	f := &countingFetch{
+		responses: map[string]map[string]interface{}{"token": {"active": true}},
+		release:   make(chan struct{}),
+	}
+	cache := newTestCache(time.Minute, time.Minute, 10, f)
+
+	first := make(chan error, 1)
+	go func() {
+		_, err := cache.lookup(context.Background(), "token")
+		first <- err
+	}()
+	for f.calls.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// A request sharing the stuck call returns once its own context ends
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := cache.lookup(ctx, "token"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("err = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	close(f.release)
+	if err := <-first; err != nil {
+		t.Error(err)
+	}
+	if got := f.calls.Load(); got != 1 {
+		t.Errorf("OP called %d times, want 1", got)
+	}
+}
+
+func TestIntrospectionCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	f := &countingFetch{responses: map[string]map[string]interface{}{
+		"a": {"active": true}, "b": {"active": true}, "c": {"active": true},
+	}}
+	cache := newTestCache(time.Minute, time.Minute, 2, f)
+
+	cache.lookup(context.Background(), "a")
+	cache.lookup(context.Background(), "b")
+	cache.lookup(context.Background(), "a")
+	cache.lookup(context.Background(), "c") // evicts b
+	if len(cache.entries) != 2 {
+		t.Fatalf("cache holds %d entries, want 2", len(cache.entries))
+	}
+
+	calls := f.calls.Load()
+	cache.lookup(context.Background(), "a")
+	if f.calls.Load() != calls {
+		t.Error("recently used entry was evicted")
+	}
+	cache.lookup(context.Background(), "b")
+	if f.calls.Load() != calls+1 {
+		t.Error("least recently used entry was not evicted")
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// certificatePair is a server certificate chain and its private key
+type certificatePair struct {
+	certPath string
+	keyPath  string
+}
+
+// parseCertificatePairs reads "cert:key" pairs separated by spaces
+func parseCertificatePairs(value string) ([]certificatePair, error) {
+	var pairs []certificatePair
+	for _, field := range strings.Fields(value) {
+		certPath, keyPath, ok := strings.Cut(field, ":")
+		if !ok || certPath == "" || keyPath == "" {
+			return nil, fmt.Errorf("invalid certificate pair %q, want cert:key", field)
+		}
+		pairs = append(pairs, certificatePair{certPath: certPath, keyPath: keyPath})
+	}
+	return pairs, nil
+}
+
+// certificateStore holds the server certificates and the client CA pool,
+// reloading them when their files change. Handshakes pick up the current
+// files through GetCertificate and GetConfigForClient, so connections that
+// are already open carry on undisturbed. Files that fail to load leave the
+// previous certificates in force.
+type certificateStore struct {
+	caPath string
+	pairs  []certificatePair
+
+	certificates atomic.Pointer[[]*tls.Certificate]
+	clientCAs    atomic.Pointer[x509.CertPool]
+
+	mu       sync.Mutex
+	modTimes map[string]time.Time
+	// fileCAs come from caPath and directoryCAs from the participant
+	// directory; clients may chain to either
+	fileCAs      []*x509.Certificate
+	directoryCAs []*x509.Certificate
+}
+
+// loadCertificateStore reads the CA bundle and every certificate pair,
+// failing if any of them is invalid. The first pair is served to clients
+// that send no SNI or a name no certificate matches.
+func loadCertificateStore(caPath string, pairs []certificatePair) (*certificateStore, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no server certificates configured")
+	}
+	s := &certificateStore{caPath: caPath, pairs: pairs}
+	if err := s.reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// reload reads all the files again
+func (s *certificateStore) reload() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	modTimes := map[string]time.Time{}
+	for _, path := range s.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	fileCAs, err := loadCACertificates(s.caPath)
+	if err != nil {
+		return err
+	}
+	var certificates []*tls.Certificate
+	for _, pair := range s.pairs {
+		// Takes the whole chain from the certificate file and PKCS#1, PKCS#8
+		// or EC keys from the key file
+		cert, err := tls.LoadX509KeyPair(pair.certPath, pair.keyPath)
+		if err != nil {
+			return fmt.Errorf("unable to load %s: %w", pair.certPath, err)
+		}
+		certificates = append(certificates, &cert)
+		slog.Info("loaded server certificate",
+			slog.String("path", pair.certPath),
+			slog.String("subject", cert.Leaf.Subject.String()),
+			slog.Any("dnsNames", cert.Leaf.DNSNames),
+			slog.Time("notAfter", cert.Leaf.NotAfter),
+		)
+	}
+
+	s.certificates.Store(&certificates)
+	s.fileCAs = fileCAs
+	s.updateClientCAs()
+	s.modTimes = modTimes
+	return nil
+}
+
+// setDirectoryCAs replaces the CAs taken from the participant directory
+func (s *certificateStore) setDirectoryCAs(cas []*x509.Certificate) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.directoryCAs = cas
+	s.updateClientCAs()
+}
+
+// updateClientCAs rebuilds the client CA pool; s.mu must be held
+func (s *certificateStore) updateClientCAs() {
+	pool := x509.NewCertPool()
+	for _, cert := range s.fileCAs {
+		pool.AddCert(cert)
+	}
+	for _, cert := range s.directoryCAs {
+		pool.AddCert(cert)
+	}
+	s.clientCAs.Store(pool)
+}
+
+func (s *certificateStore) paths() []string {
+	paths := []string{s.caPath}
+	for _, pair := range s.pairs {
+		paths = append(paths, pair.certPath, pair.keyPath)
+	}
+	return paths
+}
+
+// loadCACertificates reads the CA certificates in a PEM bundle
+func loadCACertificates(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCACertificates(data, path)
+}
+
+// parseCACertificates returns the certificates in a PEM bundle read from
+// source. Blocks that are not certificates, such as the keys some tools
+// bundle alongside, are skipped.
+func parseCACertificates(data []byte, source string) ([]*x509.Certificate, error) {
+	var cas []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			slog.Warn("skipping PEM block in CA bundle", slog.String("source", source), slog.String("type", block.Type))
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid certificate in %s: %w", source, err)
+		}
+		cas = append(cas, cert)
+		slog.Info("loaded certificate", slog.String("subject", cert.Subject.String()))
+	}
+	if len(cas) == 0 {
+		return nil, fmt.Errorf("no certificates in %s", source)
+	}
+	return cas, nil
+}
+
+// changed reports whether any file has been modified since it was loaded
+func (s *certificateStore) changed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, path := range s.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if !info.ModTime().Equal(s.modTimes[path]) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch reloads the certificates whenever a file changes, checking every interval
+func (s *certificateStore) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if s.changed() {
+				if err := s.reload(); err != nil {
+					slog.Error("Failed to reload certificates, keeping the previous ones", slog.String("error", err.Error()))
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// getCertificate picks the first certificate the client supports for the
+// name it asked for, falling back to the first certificate
+func (s *certificateStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certificates := *s.certificates.Load()
+	for _, cert := range certificates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return certificates[0], nil
+}
+
+// tlsConfig returns a config that serves the store's current certificates
+// and verifies clients against its current CA pool, based on base
+func (s *certificateStore) tlsConfig(base *tls.Config) *tls.Config {
+	config := base.Clone()
+	config.GetCertificate = s.getCertificate
+	config.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		perClient := base.Clone()
+		perClient.GetCertificate = s.getCertificate
+		perClient.ClientCAs = s.clientCAs.Load()
+		return perClient, nil
+	}
+	config.ClientCAs = s.clientCAs.Load()
+	return config
+}
+
+// verifyConnection runs each check in turn, stopping at the first that
+// rejects the client's certificate
+func verifyConnection(checks ...func(tls.ConnectionState) error) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		for _, check := range checks {
+			if err := check(cs); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeServerCert issues a server certificate for name and writes it, with
+// any extra chain certificates, and its key in the given format to dir
+func writeServerCert(t *testing.T, dir, name string, serial int64, issuer *x509.Certificate, issuerKey crypto.Signer, keyFormat string, chain ...*x509.Certificate) certificatePair {
+	t.Helper()
+	var key crypto.Signer
+	var keyBlock *pem.Block
+	switch keyFormat {
+	case "pkcs1":
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, keyBlock = rsaKey, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	case "ec":
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, keyBlock = ecKey, &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	case "pkcs8":
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		der, err := x509.MarshalPKCS8PrivateKey(ecKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, keyBlock = ecKey, &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, issuer, key.Public(), issuerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	for _, cert := range chain {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})...)
+	}
+	pair := certificatePair{certPath: filepath.Join(dir, name+".crt"), keyPath: filepath.Join(dir, name+".key")}
+	writeFile(t, pair.certPath, certPEM)
+	writeFile(t, pair.keyPath, pem.EncodeToMemory(keyBlock))
+	return pair
+}
+
+// writeCABundle writes the CA certificates of pkis, with a key block to be skipped
+func writeCABundle(t *testing.T, path string, pkis ...*testPKI) {
+	t.Helper()
+	bundle := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("not a certificate")})
+	for _, pki := range pkis {
+		bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw})...)
+	}
+	writeFile(t, path, bundle)
+}
+
+// writeFile replaces a file, moving its modification time on so changes
+// are seen even on filesystems with coarse timestamps
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	modTime := time.Now()
+	if info, err := os.Stat(path); err == nil && !modTime.After(info.ModTime()) {
+		modTime = info.ModTime().Add(time.Second)
+	}
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, modTime, modTime)
+}
+
+// newIntermediate issues an intermediate CA under pki
+func newIntermediate(t *testing.T, pki *testPKI) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(100),
+		Subject:               pkix.Name{CommonName: "Test Intermediate"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, pki.ca, &key.PublicKey, pki.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return cert, key
+}
+
+// serveCertificateStore serves TLS from the store, asking for client
+// certificates and checking them with verifiers
+func serveCertificateStore(t *testing.T, store *certificateStore, verifiers ...func(tls.ConnectionState) error) *httptest.Server {
+	t.Helper()
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = store.tlsConfig(&tls.Config{
+		ClientAuth:       tls.VerifyClientCertIfGiven,
+		VerifyConnection: verifyConnection(verifiers...),
+	})
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+// handshake connects to ts as serverName and returns the chain it was served
+func handshake(t *testing.T, ts *httptest.Server, pki *testPKI, serverName string, certs ...tls.Certificate) ([]*x509.Certificate, error) {
+	t.Helper()
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs:      pki.pool,
+		ServerName:   serverName,
+		Certificates: certs,
+	}}}
+	resp, err := client.Get(ts.URL)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	return resp.TLS.PeerCertificates, nil
+}
+
+func TestLoadCertificateStoreKeyFormats(t *testing.T) {
+	pki := newTestPKI(t)
+	for _, format := range []string{"pkcs1", "ec", "pkcs8"} {
+		t.Run(format, func(t *testing.T) {
+			dir := t.TempDir()
+			caPath := filepath.Join(dir, "ca.crt")
+			writeCABundle(t, caPath, pki)
+			pair := writeServerCert(t, dir, "api.example", 1, pki.ca, pki.caKey, format)
+
+			store, err := loadCertificateStore(caPath, []certificatePair{pair})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ts := serveCertificateStore(t, store)
+			if _, err := handshake(t, ts, pki, "api.example"); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestLoadCertificateStoreRejectsInvalidFiles(t *testing.T) {
+	pki := newTestPKI(t)
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	writeCABundle(t, caPath, pki)
+	pair := writeServerCert(t, dir, "api.example", 1, pki.ca, pki.caKey, "ec")
+
+	emptyCA := filepath.Join(dir, "empty.crt")
+	writeCABundle(t, emptyCA)
+	if _, err := loadCertificateStore(emptyCA, []certificatePair{pair}); err == nil {
+		t.Error("expected a CA bundle without certificates to be rejected")
+	}
+	mismatched := certificatePair{certPath: pair.certPath, keyPath: writeServerCert(t, dir, "other.example", 2, pki.ca, pki.caKey, "ec").keyPath}
+	if _, err := loadCertificateStore(caPath, []certificatePair{mismatched}); err == nil {
+		t.Error("expected a key that does not match its certificate to be rejected")
+	}
+	if _, err := loadCertificateStore(caPath, nil); err == nil {
+		t.Error("expected a store without certificates to be rejected")
+	}
+	if _, err := parseCertificatePairs("a.crt:a.key b.crt"); err == nil {
+		t.Error("expected a pair without a key to be rejected")
+	}
+}
+
+func TestCertificateStoreSelectsBySNI(t *testing.T) {
+	pki := newTestPKI(t)
+	intermediate, intermediateKey := newIntermediate(t, pki)
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	writeCABundle(t, caPath, pki)
+	api := writeServerCert(t, dir, "api.example", 1, intermediate, intermediateKey, "ec", intermediate)
+	auth := writeServerCert(t, dir, "auth.example", 2, pki.ca, pki.caKey, "pkcs1")
+
+	store, err := loadCertificateStore(caPath, []certificatePair{api, auth})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveCertificateStore(t, store)
+
+	chain, err := handshake(t, ts, pki, "auth.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chain[0].Subject.CommonName != "auth.example" {
+		t.Errorf("served %s for auth.example", chain[0].Subject.CommonName)
+	}
+	// The intermediate is served alongside the leaf so clients can build the chain
+	chain, err = handshake(t, ts, pki, "api.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != 2 || chain[0].Subject.CommonName != "api.example" || chain[1].Subject.CommonName != "Test Intermediate" {
+		t.Errorf("unexpected chain for api.example: %v", chain)
+	}
+}
+
+func TestCertificateStoreReload(t *testing.T) {
+	pki := newTestPKI(t)
+	newCA := newTestPKI(t)
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	writeCABundle(t, caPath, pki)
+	pair := writeServerCert(t, dir, "api.example", 1, pki.ca, pki.caKey, "ec")
+
+	store, err := loadCertificateStore(caPath, []certificatePair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveCertificateStore(t, store)
+	if store.changed() {
+		t.Fatal("store reports changes before any file changed")
+	}
+	if _, err := handshake(t, ts, pki, "api.example", newCA.clientCert); err == nil {
+		t.Fatal("client certificate from an untrusted CA was accepted")
+	}
+
+	// Rotate the server certificate and trust the new CA
+	writeServerCert(t, dir, "api.example", 2, pki.ca, pki.caKey, "pkcs1")
+	writeCABundle(t, caPath, pki, newCA)
+	if !store.changed() {
+		t.Fatal("store did not notice the changed files")
+	}
+	if err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	chain, err := handshake(t, ts, pki, "api.example", newCA.clientCert)
+	if err != nil {
+		t.Fatalf("client certificate from the new CA was rejected: %v", err)
+	}
+	if chain[0].SerialNumber.Int64() != 2 {
+		t.Errorf("served serial %d, want the rotated certificate", chain[0].SerialNumber)
+	}
+
+	// A broken file leaves the previous certificates in force
+	writeFile(t, pair.keyPath, []byte("not a key"))
+	if err := store.reload(); err == nil {
+		t.Fatal("expected the broken key to fail to load")
+	}
+	if chain, err := handshake(t, ts, pki, "api.example"); err != nil || chain[0].SerialNumber.Int64() != 2 {
+		t.Errorf("previous certificate was not kept: %v", err)
+	}
+}
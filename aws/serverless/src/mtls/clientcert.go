@@ -0,0 +1,119 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Formats the client certificate can be passed upstream in
+const (
+	// clientCertLegacy is X-Client-Cert, the PEM with newlines replaced by
+	// spaces, and X-Client-DN
+	clientCertLegacy = "legacy"
+	// clientCertXFCC is the X-Forwarded-Client-Cert header used by Envoy
+	clientCertXFCC = "xfcc"
+	// clientCertRFC9440 is Client-Cert and Client-Cert-Chain (RFC 9440)
+	clientCertRFC9440 = "rfc9440"
+)
+
+// clientCertHeaderFormat is set from CLIENT_CERT_HEADER
+var clientCertHeaderFormat = clientCertLegacy
+
+// clientCertHeaders are only ever set by the proxy; copies sent by clients
+// are dropped so upstreams cannot be fooled into trusting a certificate that
+// was never presented
+var clientCertHeaders = []string{
+	"X-Client-Cert",
+	"X-Client-DN",
+	"X-Forwarded-Client-Cert",
+	"Client-Cert",
+	"Client-Cert-Chain",
+}
+
+// validClientCertHeaderFormat reports whether format is one the proxy knows
+func validClientCertHeaderFormat(format string) bool {
+	switch format {
+	case clientCertLegacy, clientCertXFCC, clientCertRFC9440:
+		return true
+	}
+	return false
+}
+
+// setClientCertHeaders replaces any client certificate headers on the
+// request with the certificate the client presented, if any
+func setClientCertHeaders(req *http.Request) {
+	for _, name := range clientCertHeaders {
+		req.Header.Del(name)
+	}
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return
+	}
+	// The leaf certificate is always first
+	clientCert := req.TLS.PeerCertificates[0]
+
+	switch clientCertHeaderFormat {
+	case clientCertXFCC:
+		req.Header.Set("X-Forwarded-Client-Cert", xfccElement(clientCert))
+	case clientCertRFC9440:
+		req.Header.Set("Client-Cert", structuredBinary(clientCert.Raw))
+		if chain := req.TLS.PeerCertificates[1:]; len(chain) > 0 {
+			members := make([]string, len(chain))
+			for i, cert := range chain {
+				members[i] = structuredBinary(cert.Raw)
+			}
+			req.Header.Set("Client-Cert-Chain", strings.Join(members, ", "))
+		}
+	default:
+		certPEM := pem.EncodeToMemory(&pem.Block{
+			Type:  "CERTIFICATE",
+			Bytes: clientCert.Raw,
+		})
+		req.Header.Set("X-Client-Cert", strings.ReplaceAll(string(certPEM), "\n", " "))
+		req.Header.Set("X-Client-DN", clientCert.Subject.String())
+	}
+}
+
+// xfccElement describes a certificate in the X-Forwarded-Client-Cert format:
+// its SHA-256 hash, the URL-encoded PEM, the subject and the URI and DNS SANs
+func xfccElement(cert *x509.Certificate) string {
+	hash := sha256.Sum256(cert.Raw)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	pairs := []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		// Percent-encoded throughout, so spaces are %20 rather than +
+		`Cert="` + strings.ReplaceAll(url.QueryEscape(string(certPEM)), "+", "%20") + `"`,
+		"Subject=" + xfccQuote(cert.Subject.String()),
+	}
+	for _, uri := range cert.URIs {
+		pairs = append(pairs, "URI="+xfccValue(uri.String()))
+	}
+	for _, name := range cert.DNSNames {
+		pairs = append(pairs, "DNS="+xfccValue(name))
+	}
+	return strings.Join(pairs, ";")
+}
+
+// xfccValue quotes a value only if it contains separators
+func xfccValue(value string) string {
+	if strings.ContainsAny(value, ",;=\" \t\\") {
+		return xfccQuote(value)
+	}
+	return value
+}
+
+// xfccQuote quotes a value, escaping the backslashes and quotes inside it
+func xfccQuote(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// structuredBinary encodes DER as a structured field byte sequence (RFC 8941)
+func structuredBinary(der []byte) string {
+	return ":" + base64.StdEncoding.EncodeToString(der) + ":"
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useClientCertHeaderFormat sets the header format for the test
+func useClientCertHeaderFormat(t *testing.T, format string) {
+	previous := clientCertHeaderFormat
+	clientCertHeaderFormat = format
+	t.Cleanup(func() { clientCertHeaderFormat = previous })
+}
+
+// spoofedRequest is a request carrying forged copies of every client
+// certificate header, presenting the given chain
+func spoofedRequest(chain ...*x509.Certificate) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "https://api.localhost/", nil)
+	for _, name := range clientCertHeaders {
+		req.Header.Set(name, "spoofed")
+	}
+	req.TLS = &tls.ConnectionState{PeerCertificates: chain}
+	return req
+}
+
+// issueSANCert issues a client certificate with URI and DNS SANs and a
+// subject that needs escaping
+func issueSANCert(t *testing.T, pki *testPKI) *x509.Certificate {
+	t.Helper()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	uri, _ := url.Parse("spiffe://participants/client")
+	cert := pki.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(20),
+		Subject:      pkix.Name{CommonName: `client "one", ltd`, Organization: []string{"Test Participant"}},
+		DNSNames:     []string{"client.example.com", "www.client.example.com"},
+		URIs:         []*url.URL{uri},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, key)
+	return cert.Leaf
+}
+
+func TestSetClientCertHeadersLegacy(t *testing.T) {
+	pki := newTestPKI(t)
+	useClientCertHeaderFormat(t, clientCertLegacy)
+	req := spoofedRequest(pki.clientCert.Leaf)
+	setClientCertHeaders(req)
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.clientCert.Leaf.Raw})
+	if req.Header.Get("X-Client-Cert") != strings.ReplaceAll(string(certPEM), "\n", " ") {
+		t.Errorf("X-Client-Cert does not carry the certificate: %q", req.Header.Get("X-Client-Cert"))
+	}
+	if req.Header.Get("X-Client-DN") != pki.clientCert.Leaf.Subject.String() {
+		t.Errorf("got X-Client-DN %q", req.Header.Get("X-Client-DN"))
+	}
+	for _, name := range []string{"X-Forwarded-Client-Cert", "Client-Cert", "Client-Cert-Chain"} {
+		if req.Header.Get(name) != "" {
+			t.Errorf("spoofed %s was forwarded", name)
+		}
+	}
+}
+
+func TestSetClientCertHeadersXFCC(t *testing.T) {
+	pki := newTestPKI(t)
+	cert := issueSANCert(t, pki)
+	useClientCertHeaderFormat(t, clientCertXFCC)
+	req := spoofedRequest(cert)
+	setClientCertHeaders(req)
+
+	xfcc := req.Header.Get("X-Forwarded-Client-Cert")
+	hash := sha256.Sum256(cert.Raw)
+	for _, want := range []string{
+		"Hash=" + hex.EncodeToString(hash[:]),
+		`Subject="` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(cert.Subject.String()) + `"`,
+		"URI=spiffe://participants/client",
+		"DNS=client.example.com;DNS=www.client.example.com",
+	} {
+		if !strings.Contains(xfcc, want) {
+			t.Errorf("XFCC %q does not contain %q", xfcc, want)
+		}
+	}
+
+	_, encoded, _ := strings.Cut(xfcc, `Cert="`)
+	encoded, _, _ = strings.Cut(encoded, `"`)
+	if strings.ContainsAny(encoded, "+ \n") {
+		t.Errorf("Cert is not fully percent-encoded: %q", encoded)
+	}
+	decoded, err := url.PathUnescape(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if block, _ := pem.Decode([]byte(decoded)); block == nil || string(block.Bytes) != string(cert.Raw) {
+		t.Error("Cert does not decode to the client certificate")
+	}
+	for _, name := range []string{"X-Client-Cert", "X-Client-DN", "Client-Cert", "Client-Cert-Chain"} {
+		if req.Header.Get(name) != "" {
+			t.Errorf("spoofed %s was forwarded", name)
+		}
+	}
+}
+
+func TestSetClientCertHeadersRFC9440(t *testing.T) {
+	pki := newTestPKI(t)
+	intermediate, _ := newIntermediate(t, pki)
+	useClientCertHeaderFormat(t, clientCertRFC9440)
+
+	req := spoofedRequest(pki.clientCert.Leaf, intermediate)
+	setClientCertHeaders(req)
+	if got, want := req.Header.Get("Client-Cert"), ":"+base64.StdEncoding.EncodeToString(pki.clientCert.Leaf.Raw)+":"; got != want {
+		t.Errorf("got Client-Cert %q, want %q", got, want)
+	}
+	if got, want := req.Header.Get("Client-Cert-Chain"), ":"+base64.StdEncoding.EncodeToString(intermediate.Raw)+":"; got != want {
+		t.Errorf("got Client-Cert-Chain %q, want %q", got, want)
+	}
+
+	// A leaf on its own has no chain to forward
+	req = spoofedRequest(pki.clientCert.Leaf)
+	setClientCertHeaders(req)
+	if req.Header.Get("Client-Cert-Chain") != "" || req.Header.Get("X-Forwarded-Client-Cert") != "" {
+		t.Errorf("spoofed headers were forwarded: %v", req.Header)
+	}
+}
+
+func TestProxyStripsSpoofedClientCertHeaders(t *testing.T) {
+	pki := newTestPKI(t)
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	useClientCertHeaderFormat(t, clientCertXFCC)
+	ts := newTestProxy(t, pki, routePolicy{}, upstream, discardLogger())
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL, nil)
+	for _, name := range clientCertHeaders {
+		req.Header.Set(name, "spoofed")
+	}
+	resp, err := testClient(ts).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	header := <-received
+	for _, name := range clientCertHeaders {
+		if header.Get(name) != "" {
+			t.Errorf("spoofed %s reached the upstream", name)
+		}
+	}
+}
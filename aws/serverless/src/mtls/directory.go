@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// oidUID is the subject attribute directory-issued transport certificates
+// carry the software statement ID in
+var oidUID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// maxDirectorySize bounds the participants list and trust anchors
+const maxDirectorySize = 50 << 20
+
+// directoryOrganisation is an organisation in the participant directory.
+// SoftwareStatements lists the clients it has registered.
+type directoryOrganisation struct {
+	OrganisationId     string                       `json:"OrganisationId"`
+	OrganisationName   string                       `json:"OrganisationName"`
+	Status             string                       `json:"Status"`
+	SoftwareStatements []directorySoftwareStatement `json:"SoftwareStatements"`
+}
+
+type directorySoftwareStatement struct {
+	SoftwareStatementId string `json:"SoftwareStatementId"`
+	ClientId            string `json:"ClientId"`
+	Status              string `json:"Status"`
+}
+
+// directorySnapshot is the directory as it was last fetched
+type directorySnapshot struct {
+	organisations map[string]directoryOrganisation
+}
+
+// participantDirectory decides which client certificates belong to active
+// participants. Directory-issued certificates name their organisation in the
+// subject OU and, for client certificates, their software statement in the
+// subject UID. The participants list and the trust anchors are read from an
+// https URL or a local file and refreshed periodically; a refresh that fails
+// keeps the previous copy. Only anchors that chain to anchorRoots are trusted,
+// so a compromised directory cannot add its own CA.
+type participantDirectory struct {
+	participantsSource string
+	anchorsSource      string
+	anchorRoots        *x509.CertPool
+	client             *http.Client
+	// onAnchors is handed the CA certificates published by the directory
+	onAnchors func([]*x509.Certificate)
+	// allowOrganisationCerts accepts certificates that name an active
+	// organisation but no software statement
+	allowOrganisationCerts bool
+
+	snapshot atomic.Pointer[directorySnapshot]
+}
+
+// loadParticipantDirectory reads the directory, failing if it cannot
+func loadParticipantDirectory(participantsSource, anchorsSource string, anchorRoots *x509.CertPool, client *http.Client, onAnchors func([]*x509.Certificate)) (*participantDirectory, error) {
+	if anchorsSource != "" && anchorRoots == nil {
+		return nil, errors.New("trust anchors need roots to be pinned to")
+	}
+	d := &participantDirectory{
+		participantsSource: participantsSource,
+		anchorsSource:      anchorsSource,
+		anchorRoots:        anchorRoots,
+		client:             client,
+		onAnchors:          onAnchors,
+	}
+	if err := d.refresh(); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// refresh fetches the participants and the trust anchors again
+func (d *participantDirectory) refresh() error {
+	data, err := d.read(d.participantsSource)
+	if err != nil {
+		return fmt.Errorf("unable to read participants: %w", err)
+	}
+	var organisations []directoryOrganisation
+	if err := json.Unmarshal(data, &organisations); err != nil {
+		return fmt.Errorf("invalid participants from %s: %w", d.participantsSource, err)
+	}
+
+	var anchors []*x509.Certificate
+	if d.anchorsSource != "" {
+		data, err := d.read(d.anchorsSource)
+		if err != nil {
+			return fmt.Errorf("unable to read trust anchors: %w", err)
+		}
+		anchors, err = parseTrustAnchors(data)
+		if err != nil {
+			return fmt.Errorf("invalid trust anchors from %s: %w", d.anchorsSource, err)
+		}
+		if anchors = d.pinned(anchors); len(anchors) == 0 {
+			return fmt.Errorf("no trust anchors from %s chain to the anchor roots", d.anchorsSource)
+		}
+	}
+
+	snapshot := &directorySnapshot{organisations: map[string]directoryOrganisation{}}
+	for _, org := range organisations {
+		snapshot.organisations[org.OrganisationId] = org
+	}
+	d.snapshot.Store(snapshot)
+	if d.onAnchors != nil && d.anchorsSource != "" {
+		d.onAnchors(anchors)
+	}
+	slog.Info("loaded participant directory",
+		slog.Int("organisations", len(organisations)),
+		slog.Int("trustAnchors", len(anchors)),
+	)
+	return nil
+}
+
+// pinned returns the anchors that chain to the anchor roots, through the
+// other anchors if need be
+func (d *participantDirectory) pinned(anchors []*x509.Certificate) []*x509.Certificate {
+	intermediates := x509.NewCertPool()
+	for _, anchor := range anchors {
+		intermediates.AddCert(anchor)
+	}
+	var pinned []*x509.Certificate
+	for _, anchor := range anchors {
+		_, err := anchor.Verify(x509.VerifyOptions{
+			Roots:         d.anchorRoots,
+			Intermediates: intermediates,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		})
+		if err != nil {
+			slog.Warn("Ignoring trust anchor that does not chain to the anchor roots",
+				slog.String("subject", anchor.Subject.String()),
+				slog.String("error", err.Error()),
+			)
+			continue
+		}
+		pinned = append(pinned, anchor)
+	}
+	return pinned
+}
+
+// read returns the contents of an https URL or a local file
+func (d *participantDirectory) read(source string) ([]byte, error) {
+	if strings.HasPrefix(source, "http://") {
+		return nil, fmt.Errorf("%s must be fetched over https", source)
+	}
+	if !strings.HasPrefix(source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(source, "file://"))
+	}
+	resp, err := d.client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %d", source, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxDirectorySize))
+}
+
+// parseTrustAnchors returns the CA certificates in the x5c chains of a JWKS
+// or in a PEM bundle
+func parseTrustAnchors(data []byte) ([]*x509.Certificate, error) {
+	var jwks struct {
+		Keys []struct {
+			X5c []string `json:"x5c"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		// Not a JWKS, so read it as PEM
+		return parseCACertificates(data, "trust anchors")
+	}
+	var anchors []*x509.Certificate
+	for _, key := range jwks.Keys {
+		for _, encoded := range key.X5c {
+			der, err := base64.StdEncoding.DecodeString(encoded)
+			if err != nil {
+				return nil, err
+			}
+			cert, err := x509.ParseCertificate(der)
+			if err != nil {
+				return nil, err
+			}
+			if cert.IsCA {
+				anchors = append(anchors, cert)
+			}
+		}
+	}
+	if len(anchors) == 0 {
+		return nil, errors.New("no CA certificates found")
+	}
+	return anchors, nil
+}
+
+// watch refreshes the directory every interval
+func (d *participantDirectory) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := d.refresh(); err != nil {
+				slog.Error("Failed to refresh participant directory, keeping the previous copy", slog.String("error", err.Error()))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// verifyConnection is a tls.Config VerifyConnection hook that rejects
+// certificates not bound to an active organisation or, when they name one,
+// an active software statement of that organisation. Unlike
+// VerifyPeerCertificate it also runs when a session is resumed.
+func (d *participantDirectory) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	leaf := cs.VerifiedChains[0][0]
+	if err := d.check(leaf); err != nil {
+		slog.Error("Rejected client certificate not registered in the directory",
+			slog.String("subject", leaf.Subject.String()),
+			slog.String("reason", err.Error()),
+		)
+		return err
+	}
+	return nil
+}
+
+// check finds the certificate's organisation and software statement
+func (d *participantDirectory) check(cert *x509.Certificate) error {
+	snapshot := d.snapshot.Load()
+	var org *directoryOrganisation
+	for _, unit := range cert.Subject.OrganizationalUnit {
+		if o, ok := snapshot.organisations[unit]; ok {
+			org = &o
+			break
+		}
+	}
+	if org == nil {
+		return errors.New("certificate does not name a registered organisation")
+	}
+	if !strings.EqualFold(org.Status, "Active") {
+		return fmt.Errorf("organisation %s is %s", org.OrganisationId, org.Status)
+	}
+
+	softwareStatementID, ok := subjectUID(cert)
+	if !ok {
+		if d.allowOrganisationCerts {
+			return nil
+		}
+		return errors.New("certificate does not name a software statement")
+	}
+	for _, ss := range org.SoftwareStatements {
+		if ss.SoftwareStatementId == softwareStatementID {
+			if !strings.EqualFold(ss.Status, "Active") {
+				return fmt.Errorf("software statement %s is %s", softwareStatementID, ss.Status)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("software statement %s is not registered to organisation %s", softwareStatementID, org.OrganisationId)
+}
+
+// subjectUID returns the UID attribute of a certificate's subject
+func subjectUID(cert *x509.Certificate) (string, bool) {
+	for _, name := range cert.Subject.Names {
+		if name.Type.Equal(oidUID) {
+			if value, ok := name.Value.(string); ok {
+				return value, true
+			}
+		}
+	}
+	return "", false
+}
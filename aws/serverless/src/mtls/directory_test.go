@@ -0,0 +1,232 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const (
+	testOrganisationID      = "72c165da-5c7e-4429-958f-c6b2dbd5d4fb"
+	testSoftwareStatementID = "d2b3c1f0-8a6e-4f57-9d0c-2f3a4b5c6d7e"
+)
+
+// issueParticipantCert issues a transport certificate for an organisation
+// and, when softwareStatementID is set, one of its software statements
+func (p *testPKI) issueParticipantCert(t *testing.T, serial int64, organisationID, softwareStatementID string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject := pkix.Name{CommonName: "participant.example.com", Organization: []string{"Test Participant"}, OrganizationalUnit: []string{organisationID}}
+	if softwareStatementID != "" {
+		subject.ExtraNames = []pkix.AttributeTypeAndValue{{Type: oidUID, Value: softwareStatementID}}
+	}
+	return p.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      subject,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, key)
+}
+
+func testParticipants(orgStatus, softwareStatementStatus string) []directoryOrganisation {
+	return []directoryOrganisation{{
+		OrganisationId:   testOrganisationID,
+		OrganisationName: "Test Participant",
+		Status:           orgStatus,
+		SoftwareStatements: []directorySoftwareStatement{
+			{SoftwareStatementId: testSoftwareStatementID, ClientId: "client", Status: softwareStatementStatus},
+		},
+	}}
+}
+
+// newDirectoryServer serves the participants and a JWKS of trust anchors,
+// failing every request while fail is set
+func newDirectoryServer(t *testing.T, participants *atomic.Value, anchors []*x509.Certificate, fail *atomic.Bool) *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/participants", func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		json.NewEncoder(w).Encode(participants.Load())
+	})
+	mux.HandleFunc("/anchors.jwks", func(w http.ResponseWriter, r *http.Request) {
+		var x5c []string
+		for _, cert := range anchors {
+			x5c = append(x5c, base64.StdEncoding.EncodeToString(cert.Raw))
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]interface{}{{"kty": "EC", "x5c": x5c}}})
+	})
+	ts := httptest.NewTLSServer(mux)
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestParticipantDirectoryCheck(t *testing.T) {
+	pki := newTestPKI(t)
+	organisationCert := pki.issueParticipantCert(t, 11, testOrganisationID, "")
+	tests := []struct {
+		name      string
+		orgStatus string
+		ssStatus  string
+		cert      tls.Certificate
+		allowOrg  bool
+		allowed   bool
+	}{
+		{"active organisation and software statement", "Active", "Active", pki.issueParticipantCert(t, 10, testOrganisationID, testSoftwareStatementID), false, true},
+		{"organisation certificate without software statement", "Active", "Active", organisationCert, false, false},
+		{"organisation certificate when allowed", "Active", "Active", organisationCert, true, true},
+		{"inactive organisation", "Inactive", "Active", pki.issueParticipantCert(t, 12, testOrganisationID, testSoftwareStatementID), false, false},
+		{"inactive organisation when organisation certificates are allowed", "Inactive", "Active", organisationCert, true, false},
+		{"inactive software statement", "Active", "Inactive", pki.issueParticipantCert(t, 13, testOrganisationID, testSoftwareStatementID), false, false},
+		{"unregistered software statement", "Active", "Active", pki.issueParticipantCert(t, 14, testOrganisationID, "unregistered"), false, false},
+		{"unknown organisation", "Active", "Active", pki.issueParticipantCert(t, 15, "unknown", ""), true, false},
+		{"certificate without organisation", "Active", "Active", pki.clientCert, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "participants.json")
+			data, _ := json.Marshal(testParticipants(tt.orgStatus, tt.ssStatus))
+			writeFile(t, path, data)
+			directory, err := loadParticipantDirectory("file://"+path, "", nil, http.DefaultClient, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			directory.allowOrganisationCerts = tt.allowOrg
+			err = directory.verifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{tt.cert.Leaf, pki.ca}}})
+			if (err == nil) != tt.allowed {
+				t.Errorf("got %v, want allowed=%v", err, tt.allowed)
+			}
+		})
+	}
+}
+
+func TestParticipantDirectoryRefresh(t *testing.T) {
+	pki := newTestPKI(t)
+	var participants atomic.Value
+	var fail atomic.Bool
+	participants.Store(testParticipants("Active", "Active"))
+	ts := newDirectoryServer(t, &participants, nil, &fail)
+	cert := pki.issueParticipantCert(t, 10, testOrganisationID, testSoftwareStatementID)
+	chains := [][]*x509.Certificate{{cert.Leaf, pki.ca}}
+
+	directory, err := loadParticipantDirectory(ts.URL+"/participants", "", nil, ts.Client(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := directory.verifyConnection(tls.ConnectionState{VerifiedChains: chains}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A failed refresh keeps the previous copy
+	fail.Store(true)
+	if err := directory.refresh(); err == nil {
+		t.Fatal("expected the refresh to fail")
+	}
+	if err := directory.verifyConnection(tls.ConnectionState{VerifiedChains: chains}); err != nil {
+		t.Errorf("previous directory was not kept: %v", err)
+	}
+
+	// Suspended organisations are rejected once the directory says so
+	fail.Store(false)
+	participants.Store(testParticipants("Suspended", "Active"))
+	if err := directory.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	if err := directory.verifyConnection(tls.ConnectionState{VerifiedChains: chains}); err == nil {
+		t.Error("certificate of a suspended organisation was accepted")
+	}
+
+	if _, err := loadParticipantDirectory(ts.URL+"/missing", "", nil, ts.Client(), nil); err == nil {
+		t.Error("expected a missing directory to fail to load")
+	}
+	plain := httptest.NewServer(ts.Config.Handler)
+	defer plain.Close()
+	if _, err := loadParticipantDirectory(plain.URL+"/participants", "", nil, plain.Client(), nil); err == nil {
+		t.Error("directory served over plain http was loaded")
+	}
+}
+
+func TestParticipantDirectoryTrustAnchors(t *testing.T) {
+	pki := newTestPKI(t)
+	directoryCA := newTestPKI(t)
+	rogueCA := newTestPKI(t)
+	var participants atomic.Value
+	var fail atomic.Bool
+	participants.Store(testParticipants("Active", "Active"))
+	ts := newDirectoryServer(t, &participants, []*x509.Certificate{directoryCA.ca, rogueCA.ca}, &fail)
+	anchorRoots := x509.NewCertPool()
+	anchorRoots.AddCert(directoryCA.ca)
+
+	dir := t.TempDir()
+	caPath := filepath.Join(dir, "ca.crt")
+	writeCABundle(t, caPath, pki)
+	store, err := loadCertificateStore(caPath, []certificatePair{writeServerCert(t, dir, "api.example", 1, pki.ca, pki.caKey, "ec")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadParticipantDirectory(ts.URL+"/participants", ts.URL+"/anchors.jwks", nil, ts.Client(), store.setDirectoryCAs); err == nil {
+		t.Fatal("trust anchors were loaded without roots to pin them to")
+	}
+	directory, err := loadParticipantDirectory(ts.URL+"/participants", ts.URL+"/anchors.jwks", anchorRoots, ts.Client(), store.setDirectoryCAs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveCertificateStore(t, store, directory.verifyConnection)
+
+	participant := directoryCA.issueParticipantCert(t, 10, testOrganisationID, testSoftwareStatementID)
+	if _, err := handshake(t, server, pki, "api.example", participant); err != nil {
+		t.Errorf("certificate issued by the directory CA was rejected: %v", err)
+	}
+	stranger := directoryCA.issueParticipantCert(t, 11, "unknown", "")
+	if _, err := handshake(t, server, pki, "api.example", stranger); err == nil {
+		t.Error("certificate of an unregistered organisation was accepted")
+	}
+	// A CA the directory publishes is only trusted if it chains to the roots
+	impostor := rogueCA.issueParticipantCert(t, 12, testOrganisationID, testSoftwareStatementID)
+	if _, err := handshake(t, server, pki, "api.example", impostor); err == nil {
+		t.Error("certificate issued by an unpinned directory CA was accepted")
+	}
+	rogue := newDirectoryServer(t, &participants, []*x509.Certificate{rogueCA.ca}, &fail)
+	if _, err := loadParticipantDirectory(rogue.URL+"/participants", rogue.URL+"/anchors.jwks", anchorRoots, rogue.Client(), nil); err == nil {
+		t.Error("directory without pinned trust anchors was loaded")
+	}
+
+	// The file CA bundle survives a reload alongside the directory's CAs
+	if err := store.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(t, server, pki, "api.example", participant); err != nil {
+		t.Errorf("directory CA was dropped by a reload: %v", err)
+	}
+}
+
+func TestParseTrustAnchors(t *testing.T) {
+	pki := newTestPKI(t)
+	leaf := base64.StdEncoding.EncodeToString(pki.clientCert.Certificate[0])
+	if _, err := parseTrustAnchors([]byte(`{"keys": [{"x5c": ["` + leaf + `"]}]}`)); err == nil {
+		t.Error("expected a JWKS without CA certificates to be rejected")
+	}
+	anchors, err := parseTrustAnchors(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: pki.ca.Raw}))
+	if err != nil || len(anchors) != 1 {
+		t.Errorf("got %d anchors from PEM: %v", len(anchors), err)
+	}
+}
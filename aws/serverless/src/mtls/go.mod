@@ -1,3 +1,8 @@
 module mtls
 
 go 1.23
+
+require (
+	github.com/go-jose/go-jose/v4 v4.0.5
+	golang.org/x/crypto v0.32.0
+)
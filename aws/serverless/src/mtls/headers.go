@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/netip"
+	"strings"
+)
+
+// proxyOwnedHeaders are set by the proxy for upstreams, which trust them.
+// Clients must never be able to supply them.
+var proxyOwnedHeaders = append([]string{
+	"X-Introspection-Response",
+	"X-User-Info-Response",
+	"Access_token",
+	// Some frameworks treat underscores and dashes alike, so the dashed
+	// spelling would reach upstreams as access_token
+	"Access-Token",
+	"X-Real-IP",
+}, clientCertHeaders...)
+
+// trustedProxies are the networks of proxies in front of this one, such as a
+// load balancer, whose forwarding headers are believed. Forwarding headers
+// from anyone else are dropped.
+var trustedProxies []netip.Prefix
+
+// parseTrustedProxies reads a list of CIDRs or addresses separated by commas
+// or spaces
+func parseTrustedProxies(value string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !strings.Contains(field, "/") {
+			addr, err := netip.ParseAddr(field)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q", field)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// isTrustedProxy reports whether addr belongs to a trusted proxy
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// fromTrustedProxy reports whether the request came straight from a trusted
+// proxy
+func fromTrustedProxy(r *http.Request) bool {
+	addr, err := netip.ParseAddr(getRemoteIP(r))
+	return err == nil && isTrustedProxy(addr)
+}
+
+// clientIP is the address of the client. Behind trusted proxies it is the
+// last address in X-Forwarded-For that is not one of them; the addresses
+// before it were supplied by the client and prove nothing.
+func clientIP(r *http.Request) string {
+	client := getRemoteIP(r)
+	if !fromTrustedProxy(r) {
+		return client
+	}
+	var hops []string
+	for _, value := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(value, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+		if err != nil {
+			break
+		}
+		client = addr.Unmap().String()
+		if !isTrustedProxy(addr) {
+			break
+		}
+	}
+	return client
+}
+
+// setForwardedHeaders tells the upstream who the client is and how it
+// connected. The inbound X-Forwarded-* headers are only carried on from
+// trusted proxies.
+func setForwardedHeaders(pr *httputil.ProxyRequest) {
+	trusted := fromTrustedProxy(pr.In)
+	if trusted {
+		pr.Out.Header["X-Forwarded-For"] = pr.In.Header["X-Forwarded-For"]
+	}
+	pr.SetXForwarded()
+	if trusted {
+		for _, name := range []string{"X-Forwarded-Host", "X-Forwarded-Proto"} {
+			if value := pr.In.Header.Get(name); value != "" {
+				pr.Out.Header.Set(name, value)
+			}
+		}
+	}
+	pr.Out.Header.Set("X-Real-IP", clientIP(pr.In))
+}
+
+// stripProxyHeaders removes every header the proxy owns from inbound
+// requests before anything enriches them, so upstreams only ever see values
+// the proxy set itself
+func stripProxyHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, name := range proxyOwnedHeaders {
+			r.Header.Del(name)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
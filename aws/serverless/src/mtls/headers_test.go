@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRoutesStripSpoofedProxyHeaders(t *testing.T) {
+	pki := newTestPKI(t)
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"bound": {"active": true, "client_id": "client", "cnf": map[string]interface{}{"x5t#S256": thumbprint(pki.clientCert)}},
+	})
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+
+	upstreams := []upstreamConfig{{URL: upstream.URL}}
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{
+		{Name: "auth", Host: "auth.example", Auth: authNone, Upstreams: upstreams},
+		{Name: "portal", Host: "portal.example", Auth: authMTLS, Upstreams: upstreams},
+		{Name: "api", Host: "api.example", Auth: authToken, Upstreams: upstreams},
+	}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+
+	tests := []struct {
+		name     string
+		host     string
+		withCert bool
+		token    string
+	}{
+		{name: "auth route without certificate", host: "auth.example"},
+		{name: "auth route with certificate", host: "auth.example", withCert: true},
+		{name: "mtls route", host: "portal.example", withCert: true},
+		{name: "token route", host: "api.example", withCert: true, token: "bound"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			req.Host = tt.host
+			for _, name := range proxyOwnedHeaders {
+				req.Header.Add(name, "spoofed")
+				req.Header.Add(name, "spoofed again")
+			}
+			// Sent exactly as spelt, not canonicalised
+			req.Header["access_token"] = []string{`{"active":true,"sub":"spoofed"}`}
+			req.Header["x-introspection-response"] = []string{"spoofed"}
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			client := testClient(ts)
+			if tt.withCert {
+				client = testClient(ts, pki.clientCert)
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", resp.StatusCode)
+			}
+
+			header := <-received
+			for name, values := range header {
+				for _, value := range values {
+					if strings.Contains(value, "spoofed") {
+						t.Errorf("spoofed %s reached the upstream: %q", name, value)
+					}
+				}
+			}
+			if tt.token != "" {
+				body, _ := base64.StdEncoding.DecodeString(header.Get("X-Introspection-Response"))
+				if !strings.Contains(string(body), `"client_id":"client"`) {
+					t.Errorf("introspection response was not forwarded: %q", body)
+				}
+			}
+			if tt.withCert && header.Get("X-Client-DN") != pki.clientCert.Leaf.Subject.String() {
+				t.Errorf("got X-Client-DN %q", header.Get("X-Client-DN"))
+			}
+		})
+	}
+}
+
+// useTrustedProxies trusts the given networks for the duration of the test
+func useTrustedProxies(t *testing.T, value string) {
+	t.Helper()
+	prefixes, err := parseTrustedProxies(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := trustedProxies
+	trustedProxies = prefixes
+	t.Cleanup(func() { trustedProxies = previous })
+}
+
+func TestParseTrustedProxies(t *testing.T) {
+	prefixes, err := parseTrustedProxies("10.0.0.0/8, 192.168.1.7 2001:db8::/32,10.1.2.3/16")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10.0.0.0/8", "192.168.1.7/32", "2001:db8::/32", "10.1.0.0/16"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("got %v", prefixes)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("got %s, want %s", prefix, want[i])
+		}
+	}
+	for _, value := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0"} {
+		if _, err := parseTrustedProxies(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8")
+	tests := []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor []string
+		want         string
+	}{
+		{"direct client", "203.0.113.9:4000", nil, "203.0.113.9"},
+		{"direct client claiming another address", "203.0.113.9:4000", []string{"198.51.100.1"}, "203.0.113.9"},
+		{"behind a trusted proxy", "10.0.0.1:4000", []string{"198.51.100.1"}, "198.51.100.1"},
+		{"behind two trusted proxies", "10.0.0.1:4000", []string{"198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"spoofed hops before the client", "10.0.0.1:4000", []string{"192.0.2.1, 198.51.100.1", "10.0.0.2"}, "198.51.100.1"},
+		{"only trusted hops", "10.0.0.1:4000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"garbage hop", "10.0.0.1:4000", []string{"198.51.100.1, unknown, 10.0.0.2"}, "10.0.0.2"},
+		{"trusted proxy without X-Forwarded-For", "10.0.0.1:4000", nil, "10.0.0.1"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwardedFor {
+			r.Header.Add("X-Forwarded-For", value)
+		}
+		if got := clientIP(r); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestRoutesHeaderHygiene(t *testing.T) {
+	pki := newTestPKI(t)
+	type received struct {
+		host   string
+		header http.Header
+	}
+	requests := make(chan received, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- received{host: r.Host, header: r.Header.Clone()}
+		w.Header().Set("Connection", "X-Internal")
+		w.Header().Set("X-Internal", "secret")
+		w.Header().Set("Keep-Alive", "timeout=5")
+	}))
+	t.Cleanup(upstream.Close)
+	upstreamHost := strings.TrimPrefix(upstream.URL, "http://")
+
+	preserveHost := false
+	upstreams := []upstreamConfig{{URL: upstream.URL}}
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{
+		{Name: "portal", Host: "portal.example", Auth: authMTLS, Upstreams: upstreams},
+		{Name: "backend", Host: "backend.example", Auth: authMTLS, PreserveHost: &preserveHost, Upstreams: upstreams},
+	}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+	client := testClient(ts, pki.clientCert)
+
+	tests := []struct {
+		name        string
+		host        string
+		trusted     string
+		wantHost    string
+		wantFor     string
+		wantReal    string
+		wantFwdHost string
+		wantProto   string
+	}{
+		{
+			name: "untrusted client", host: "portal.example", wantHost: "portal.example",
+			wantFor: "127.0.0.1", wantReal: "127.0.0.1", wantFwdHost: "portal.example", wantProto: "https",
+		},
+		{
+			name: "behind a trusted proxy", host: "portal.example", trusted: "127.0.0.1, 10.0.0.0/8", wantHost: "portal.example",
+			wantFor: "192.0.2.1, 198.51.100.1, 10.0.0.2, 127.0.0.1", wantReal: "198.51.100.1", wantFwdHost: "public.example", wantProto: "http",
+		},
+		{
+			name: "upstream's own host", host: "backend.example", wantHost: upstreamHost,
+			wantFor: "127.0.0.1", wantReal: "127.0.0.1", wantFwdHost: "backend.example", wantProto: "https",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useTrustedProxies(t, tt.trusted)
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			req.Host = tt.host
+			req.Header.Set("X-Forwarded-For", "192.0.2.1, 198.51.100.1, 10.0.0.2")
+			req.Header.Set("X-Forwarded-Host", "public.example")
+			req.Header.Set("X-Forwarded-Proto", "http")
+			req.Header.Set("Forwarded", "for=192.0.2.1;proto=http")
+			req.Header.Set("Connection", "X-Hop, X-Real-IP")
+			req.Header.Set("X-Hop", "spoofed")
+			req.Header.Set("Keep-Alive", "timeout=5")
+			req.Header.Set("Proxy-Authorization", "Basic c3Bvb2ZlZA==")
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", resp.StatusCode)
+			}
+			for _, name := range []string{"X-Internal", "Keep-Alive"} {
+				if resp.Header.Get(name) != "" {
+					t.Errorf("hop-by-hop response header %s reached the client", name)
+				}
+			}
+
+			got := <-requests
+			if got.host != tt.wantHost {
+				t.Errorf("upstream got Host %q, want %q", got.host, tt.wantHost)
+			}
+			for name, want := range map[string]string{
+				"X-Forwarded-For":   tt.wantFor,
+				"X-Real-IP":         tt.wantReal,
+				"X-Forwarded-Host":  tt.wantFwdHost,
+				"X-Forwarded-Proto": tt.wantProto,
+			} {
+				if values := got.header.Values(name); len(values) != 1 || values[0] != want {
+					t.Errorf("upstream got %s %q, want %q", name, values, want)
+				}
+			}
+			for _, name := range []string{"Forwarded", "X-Hop", "Keep-Alive", "Proxy-Authorization", "Host"} {
+				if _, ok := got.header[name]; ok {
+					t.Errorf("upstream got %s %q", name, got.header.Values(name))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// errKeysUnavailable is returned when the issuer's signing keys cannot be
+// fetched, in which case the token is introspected instead
+var errKeysUnavailable = errors.New("issuer signing keys are unavailable")
+
+// clockSkew is tolerated when checking exp, nbf and iat
+const clockSkew = 30 * time.Second
+
+// minKeyRefetchInterval stops tokens with unknown key IDs from making the
+// proxy fetch the JWKS on every request
+const minKeyRefetchInterval = time.Minute
+
+// jwtValidator verifies RFC 9068 JWT access tokens locally against the
+// issuer's published keys
+type jwtValidator struct {
+	issuer         string
+	audience       string
+	requiredScopes []string
+	// jwksURI is discovered from the issuer's metadata when empty
+	jwksURI         string
+	refreshInterval time.Duration
+	client          *http.Client
+
+	mu          sync.Mutex
+	keySet      *jose.JSONWebKeySet
+	fetchedAt   time.Time
+	attemptedAt time.Time
+	// fetching is closed when the fetch in progress, if any, completes
+	fetching chan struct{}
+}
+
+// jwtValidation is set when access tokens that are JWTs are validated locally
+var jwtValidation *jwtValidator
+
+func newJWTValidator(issuer, audience, jwksURI string, requiredScopes []string, refreshInterval time.Duration) *jwtValidator {
+	return &jwtValidator{
+		issuer:          strings.TrimSuffix(issuer, "/"),
+		audience:        audience,
+		requiredScopes:  requiredScopes,
+		jwksURI:         jwksURI,
+		refreshInterval: refreshInterval,
+		client:          introspectionClient,
+	}
+}
+
+// validateAccessToken checks a token locally when it is a JWT and local
+// validation is enabled, and otherwise asks the OP. Tokens are also sent to
+// the OP when the issuer's keys cannot be fetched.
+func validateAccessToken(ctx context.Context, token string) (map[string]interface{}, []byte, error) {
+	if jwtValidation != nil && isJWT(token) {
+		response, body, err := jwtValidation.validate(token)
+		if !errors.Is(err, errKeysUnavailable) {
+			return response, body, err
+		}
+		slog.Warn("Falling back to introspection", slog.String("error", err.Error()))
+	}
+	return introspect(ctx, token)
+}
+
+// isJWT reports whether a token looks like a compact JWS rather than an
+// opaque reference token
+func isJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// accessTokenAlgorithms are the signature algorithms accepted on access
+// tokens. HMAC is left out so a public key cannot be used as a shared secret.
+var accessTokenAlgorithms = []jose.SignatureAlgorithm{
+	jose.RS256, jose.RS384, jose.RS512,
+	jose.PS256, jose.PS384, jose.PS512,
+	jose.ES256, jose.ES384, jose.ES512,
+}
+
+// minRSAKeyBits is the smallest RSA key accepted for signing (RFC 7518 section 3.3)
+const minRSAKeyBits = 2048
+
+// validate verifies a JWT access token and returns its claims, marked active,
+// in the shape of an introspection response along with their JSON encoding
+func (v *jwtValidator) validate(token string) (map[string]interface{}, []byte, error) {
+	jws, err := jose.ParseSignedCompact(token, accessTokenAlgorithms)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errTokenInactive, err)
+	}
+	header := jws.Signatures[0].Protected
+	// RFC 9068 section 4: access tokens are typed so ID tokens cannot be replayed as them
+	typ, _ := header.ExtraHeaders[jose.HeaderType].(string)
+	if typ := strings.ToLower(typ); typ != "at+jwt" && typ != "application/at+jwt" {
+		return nil, nil, fmt.Errorf("%w: typ %q is not at+jwt", errTokenInactive, typ)
+	}
+
+	keys, err := v.keys(header.KeyID)
+	if err != nil {
+		return nil, nil, err
+	}
+	// Tokens without a kid are tried against every key that suits their alg
+	var payload []byte
+	err = fmt.Errorf("alg %q does not match the signing key", header.Algorithm)
+	for _, key := range keys {
+		if !suitsAlgorithm(key, header.Algorithm) {
+			continue
+		}
+		if payload, err = jws.Verify(key); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errTokenInactive, err)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, nil, fmt.Errorf("%w: invalid claims: %v", errTokenInactive, err)
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", errTokenInactive, err)
+	}
+
+	claims["active"] = true
+	body, err := json.Marshal(claims)
+	if err != nil {
+		return nil, nil, err
+	}
+	return claims, body, nil
+}
+
+// checkClaims applies the RFC 9068 section 4 validation rules. cnf is
+// checked against the client certificate by the route policy.
+func (v *jwtValidator) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.issuer {
+		return fmt.Errorf("iss %q does not match %q", iss, v.issuer)
+	}
+	if !hasAudience(claims["aud"], v.audience) {
+		return fmt.Errorf("aud does not contain %q", v.audience)
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("exp is missing")
+	}
+	if now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("token is not yet valid")
+	}
+	if iat, ok := claims["iat"].(float64); !ok || now.Add(clockSkew).Before(time.Unix(int64(iat), 0)) {
+		return errors.New("iat is missing or in the future")
+	}
+	for _, name := range []string{"sub", "client_id", "jti"} {
+		if value, _ := claims[name].(string); value == "" {
+			return fmt.Errorf("%s is missing", name)
+		}
+	}
+
+	granted := map[string]bool{}
+	if scope, ok := claims["scope"]; ok {
+		scopes, ok := scope.(string)
+		if !ok {
+			return errors.New("scope is not a string")
+		}
+		for _, s := range strings.Fields(scopes) {
+			granted[s] = true
+		}
+	}
+	for _, required := range v.requiredScopes {
+		if !granted[required] {
+			return fmt.Errorf("scope %q was not granted", required)
+		}
+	}
+	return nil
+}
+
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keys returns the issuer's public keys with the given ID, or all of them
+// when kid is empty. The JWKS is fetched again once it is older than the
+// refresh interval, or when the key is unknown, but never more than once a
+// minute.
+func (v *jwtValidator) keys(kid string) ([]jose.JSONWebKey, error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	keys := v.matching(kid)
+	if len(keys) > 0 && time.Since(v.fetchedAt) <= v.refreshInterval {
+		return keys, nil
+	}
+	fetching := v.fetching
+	switch {
+	case fetching == nil && time.Since(v.attemptedAt) >= minKeyRefetchInterval:
+		// Fetch without the lock so a slow issuer doesn't hold up requests
+		// that the keys we already have can serve
+		v.attemptedAt = time.Now()
+		fetching = make(chan struct{})
+		v.fetching = fetching
+		v.mu.Unlock()
+		keySet, err := v.fetchKeys()
+		v.mu.Lock()
+		if err != nil {
+			// Keep using the keys we have rather than failing every request
+			slog.Error("Failed to fetch issuer signing keys", slog.String("error", err.Error()))
+		} else {
+			v.keySet = keySet
+			v.fetchedAt = time.Now()
+		}
+		v.fetching = nil
+		close(fetching)
+	case fetching != nil && len(keys) == 0:
+		// Wait for the keys another request is fetching
+		v.mu.Unlock()
+		<-fetching
+		v.mu.Lock()
+	}
+	if v.keySet == nil {
+		return nil, errKeysUnavailable
+	}
+	if keys = v.matching(kid); len(keys) == 0 {
+		return nil, fmt.Errorf("%w: unknown signing key %q", errTokenInactive, kid)
+	}
+	return keys, nil
+}
+
+// matching returns the fetched keys with the given ID, or all of them when
+// kid is empty. v.mu must be held.
+func (v *jwtValidator) matching(kid string) []jose.JSONWebKey {
+	switch {
+	case v.keySet == nil:
+		return nil
+	case kid == "":
+		return v.keySet.Keys
+	}
+	return v.keySet.Key(kid)
+}
+
+// fetchKeys downloads the issuer's JWKS, discovering its location if needed
+func (v *jwtValidator) fetchKeys() (*jose.JSONWebKeySet, error) {
+	jwksURI := v.jwksURI
+	if jwksURI == "" {
+		var metadata struct {
+			Issuer  string `json:"issuer"`
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(v.issuer+"/.well-known/openid-configuration", &metadata); err != nil {
+			return nil, err
+		}
+		if strings.TrimSuffix(metadata.Issuer, "/") != v.issuer || metadata.JWKSURI == "" {
+			return nil, fmt.Errorf("discovery document does not describe issuer %q", v.issuer)
+		}
+		jwksURI = metadata.JWKSURI
+	}
+
+	// Keys are decoded one at a time so one the proxy cannot use does not
+	// hide the rest
+	var jwks struct {
+		Keys []json.RawMessage `json:"keys"`
+	}
+	if err := v.getJSON(jwksURI, &jwks); err != nil {
+		return nil, err
+	}
+	keySet := &jose.JSONWebKeySet{}
+	for _, raw := range jwks.Keys {
+		var key jose.JSONWebKey
+		if err := json.Unmarshal(raw, &key); err != nil {
+			slog.Warn("Skipping unusable key in issuer JWKS", slog.String("error", err.Error()))
+			continue
+		}
+		if err := checkSigningKey(key); err != nil {
+			slog.Warn("Skipping unusable key in issuer JWKS", slog.String("error", err.Error()))
+			continue
+		}
+		if key.Use == "" || key.Use == "sig" {
+			keySet.Keys = append(keySet.Keys, key.Public())
+		}
+	}
+	return keySet, nil
+}
+
+func (v *jwtValidator) getJSON(url string, out interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned non-200 status: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(out)
+}
+
+// checkSigningKey rejects keys too weak to trust a token signed with
+func checkSigningKey(key jose.JSONWebKey) error {
+	public := key.Public()
+	if !public.Valid() {
+		return fmt.Errorf("key %q is not a valid public key", key.KeyID)
+	}
+	if rsaKey, ok := public.Key.(*rsa.PublicKey); ok && rsaKey.N.BitLen() < minRSAKeyBits {
+		return fmt.Errorf("key %q has %d bits, less than %d", key.KeyID, rsaKey.N.BitLen(), minRSAKeyBits)
+	}
+	return nil
+}
+
+// ecdsaCurveBits is the curve each ECDSA algorithm is defined for (RFC 7518 section 3.4)
+var ecdsaCurveBits = map[string]int{"ES256": 256, "ES384": 384, "ES512": 521}
+
+// suitsAlgorithm reports whether a token signed with alg may be verified with
+// key, which must be of the right type and, when the JWK names one, for alg
+func suitsAlgorithm(key jose.JSONWebKey, alg string) bool {
+	if key.Algorithm != "" && key.Algorithm != alg {
+		return false
+	}
+	switch key := key.Key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") || strings.HasPrefix(alg, "PS")
+	case *ecdsa.PublicKey:
+		return ecdsaCurveBits[alg] == key.Curve.Params().BitSize
+	}
+	return false
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testAudience = "https://api.example.com"
+
+// testIssuerKeys are the keys a stub issuer publishes
+type testIssuerKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+	// kidPrefix distinguishes rotated keys
+	kidPrefix string
+}
+
+func newTestIssuerKeys(t *testing.T) testIssuerKeys {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testIssuerKeys{rsa: rsaKey, ec: ecKey}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func (k testIssuerKeys) jwks() map[string]interface{} {
+	return map[string]interface{}{"keys": []map[string]interface{}{
+		{"kty": "RSA", "kid": k.kidPrefix + "rsa-1", "use": "sig", "n": b64(k.rsa.N.Bytes()), "e": b64(big.NewInt(int64(k.rsa.E)).Bytes())},
+		{"kty": "EC", "kid": k.kidPrefix + "ec-1", "crv": "P-256", "x": b64(k.ec.X.FillBytes(make([]byte, 32))), "y": b64(k.ec.Y.FillBytes(make([]byte, 32)))},
+		{"kty": "RSA", "kid": k.kidPrefix + "enc-1", "use": "enc", "n": b64(k.rsa.N.Bytes()), "e": "AQAB"},
+	}}
+}
+
+// newTestIssuer serves discovery and a JWKS, counting JWKS fetches
+func newTestIssuer(t *testing.T, keys func() map[string]interface{}) (*httptest.Server, *atomic.Int32) {
+	var fetches atomic.Int32
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			json.NewEncoder(w).Encode(map[string]string{"issuer": ts.URL, "jwks_uri": ts.URL + "/jwks"})
+		case "/jwks":
+			fetches.Add(1)
+			json.NewEncoder(w).Encode(keys())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &fetches
+}
+
+// signTestJWT signs claims with alg, using the RSA key for RS and PS
+// algorithms and the EC key for ES256
+func signTestJWT(t *testing.T, keys testIssuerKeys, alg, kid, typ string, claims map[string]interface{}) string {
+	t.Helper()
+	fields := map[string]string{"alg": alg, "typ": typ}
+	if kid != "" {
+		fields["kid"] = kid
+	}
+	header, _ := json.Marshal(fields)
+	payload, _ := json.Marshal(claims)
+	signingInput := b64(header) + "." + b64(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+
+	var signature []byte
+	var err error
+	switch alg {
+	case "RS256":
+		signature, err = rsa.SignPKCS1v15(rand.Reader, keys.rsa, crypto.SHA256, digest[:])
+	case "PS256":
+		signature, err = rsa.SignPSS(rand.Reader, keys.rsa, crypto.SHA256, digest[:], &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+	case "ES256":
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, keys.ec, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	case "HS256":
+		// An attacker using the RSA public key as an HMAC secret
+		signature = digest[:]
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + b64(signature)
+}
+
+func accessTokenClaims(issuer string) map[string]interface{} {
+	now := time.Now().Unix()
+	return map[string]interface{}{
+		"iss":       issuer,
+		"aud":       []string{testAudience, "https://other.example.com"},
+		"sub":       "user-1",
+		"client_id": "client-1",
+		"jti":       "token-1",
+		"iat":       now,
+		"exp":       now + 300,
+		"scope":     "openid telephony",
+	}
+}
+
+func TestJWTValidatorValidate(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	issuer, _ := newTestIssuer(t, keys.jwks)
+	validator := newJWTValidator(issuer.URL, testAudience, "", []string{"telephony"}, time.Hour)
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		claims := accessTokenClaims(issuer.URL)
+		if value == nil {
+			delete(claims, name)
+		} else {
+			claims[name] = value
+		}
+		return claims
+	}
+
+	valid := accessTokenClaims(issuer.URL)
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"RS256", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", valid), true},
+		{"PS256", signTestJWT(t, keys, "PS256", "rsa-1", "application/at+jwt", valid), true},
+		{"ES256", signTestJWT(t, keys, "ES256", "ec-1", "at+jwt", valid), true},
+		{"ID token typ", signTestJWT(t, keys, "RS256", "rsa-1", "JWT", valid), false},
+		{"HS256 with the RSA key", signTestJWT(t, keys, "HS256", "rsa-1", "at+jwt", valid), false},
+		{"ES256 with the RSA key", signTestJWT(t, keys, "ES256", "rsa-1", "at+jwt", valid), false},
+		{"encryption key", signTestJWT(t, keys, "RS256", "enc-1", "at+jwt", valid), false},
+		{"unknown key", signTestJWT(t, keys, "RS256", "rsa-2", "at+jwt", valid), false},
+		{"other issuer", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("iss", "https://attacker.example.com")), false},
+		{"other audience", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("aud", "https://other.example.com")), false},
+		{"single audience", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("aud", testAudience)), true},
+		{"expired", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("exp", time.Now().Add(-time.Hour).Unix())), false},
+		{"not yet valid", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("nbf", time.Now().Add(time.Hour).Unix())), false},
+		{"no client_id", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("client_id", nil)), false},
+		{"missing scope", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", with("scope", "openid")), false},
+		{"tampered", signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", valid)[:40] + "x" + signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", valid)[41:], false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims, body, err := validator.validate(tt.token)
+			if !tt.valid {
+				if !errors.Is(err, errTokenInactive) {
+					t.Errorf("err = %v, want errTokenInactive", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if claims["active"] != true || claims["client_id"] != "client-1" {
+				t.Errorf("claims = %v", claims)
+			}
+			var decoded map[string]interface{}
+			if err := json.Unmarshal(body, &decoded); err != nil || decoded["active"] != true {
+				t.Errorf("body is not an active introspection response: %s", body)
+			}
+		})
+	}
+}
+
+func TestJWTValidatorRefetchesKeysOnRotation(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	rotated := newTestIssuerKeys(t)
+	rotated.kidPrefix = "rotated-"
+	var current atomic.Pointer[testIssuerKeys]
+	current.Store(&keys)
+	issuer, fetches := newTestIssuer(t, func() map[string]interface{} { return current.Load().jwks() })
+	validator := newJWTValidator(issuer.URL, testAudience, "", nil, time.Hour)
+
+	if _, _, err := validator.validate(signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", accessTokenClaims(issuer.URL))); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := validator.validate(signTestJWT(t, keys, "ES256", "ec-1", "at+jwt", accessTokenClaims(issuer.URL))); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("JWKS fetched %d times, want 1", got)
+	}
+
+	// A token signed with a new key is accepted once the minimum interval has passed
+	current.Store(&rotated)
+	token := signTestJWT(t, rotated, "RS256", "rotated-rsa-1", "at+jwt", accessTokenClaims(issuer.URL))
+	if _, _, err := validator.validate(token); !errors.Is(err, errTokenInactive) {
+		t.Fatalf("err = %v, want errTokenInactive within the refetch interval", err)
+	}
+	validator.attemptedAt = time.Now().Add(-minKeyRefetchInterval)
+	if _, _, err := validator.validate(token); err != nil {
+		t.Fatal(err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestJWTValidatorServesCachedKeysDuringRefresh(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	var hang atomic.Bool
+	release := make(chan struct{})
+	issuer, fetches := newTestIssuer(t, func() map[string]interface{} {
+		if hang.Load() {
+			<-release
+		}
+		return keys.jwks()
+	})
+	validator := newJWTValidator(issuer.URL, testAudience, "", nil, time.Hour)
+	token := signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", accessTokenClaims(issuer.URL))
+	if _, _, err := validator.validate(token); err != nil {
+		t.Fatal(err)
+	}
+
+	// The keys are due for a refresh and the issuer stops responding
+	hang.Store(true)
+	validator.fetchedAt = time.Now().Add(-2 * time.Hour)
+	validator.attemptedAt = time.Now().Add(-minKeyRefetchInterval)
+	refreshed := make(chan error, 1)
+	go func() {
+		_, _, err := validator.validate(token)
+		refreshed <- err
+	}()
+	for fetches.Load() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+
+	validated := make(chan error, 1)
+	go func() {
+		_, _, err := validator.validate(token)
+		validated <- err
+	}()
+	select {
+	case err := <-validated:
+		if err != nil {
+			t.Errorf("validation with cached keys failed: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("validation waited for the hung issuer")
+	}
+
+	close(release)
+	if err := <-refreshed; err != nil {
+		t.Error(err)
+	}
+	if got := fetches.Load(); got != 2 {
+		t.Errorf("JWKS fetched %d times, want 2", got)
+	}
+}
+
+func TestJWTValidatorKeySelection(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	weak := keys
+	var err error
+	if weak.rsa, err = rsa.GenerateKey(rand.Reader, 1024); err != nil {
+		t.Fatal(err)
+	}
+	issuer, _ := newTestIssuer(t, func() map[string]interface{} {
+		return map[string]interface{}{"keys": []map[string]interface{}{
+			{"kty": "RSA", "n": b64(keys.rsa.N.Bytes()), "e": "AQAB"},
+			{"kty": "EC", "crv": "P-256", "x": b64(keys.ec.X.FillBytes(make([]byte, 32))), "y": b64(keys.ec.Y.FillBytes(make([]byte, 32)))},
+			{"kty": "RSA", "kid": "weak", "n": b64(weak.rsa.N.Bytes()), "e": "AQAB"},
+			{"kty": "oct", "kid": "secret", "k": b64([]byte("a shared secret of at least 32 bytes"))},
+		}}
+	})
+	validator := newJWTValidator(issuer.URL, testAudience, "", nil, time.Hour)
+
+	claims := accessTokenClaims(issuer.URL)
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		// Keys without a kid do not hide one another
+		{"RS256 without kid", signTestJWT(t, keys, "RS256", "", "at+jwt", claims), true},
+		{"ES256 without kid", signTestJWT(t, keys, "ES256", "", "at+jwt", claims), true},
+		{"RSA key under 2048 bits", signTestJWT(t, weak, "RS256", "weak", "at+jwt", claims), false},
+		{"weak key without kid", signTestJWT(t, weak, "RS256", "", "at+jwt", claims), false},
+		{"symmetric key", signTestJWT(t, keys, "HS256", "secret", "at+jwt", claims), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := validator.validate(tt.token)
+			if tt.valid && err != nil {
+				t.Fatal(err)
+			}
+			if !tt.valid && !errors.Is(err, errTokenInactive) {
+				t.Errorf("err = %v, want errTokenInactive", err)
+			}
+		})
+	}
+}
+
+func TestValidateAccessTokenFallsBackToIntrospection(t *testing.T) {
+	keys := newTestIssuerKeys(t)
+	issuer, _ := newTestIssuer(t, keys.jwks)
+	jwt := signTestJWT(t, keys, "RS256", "rsa-1", "at+jwt", accessTokenClaims(issuer.URL))
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"opaque": {"active": true, "client_id": "client-1"},
+		jwt:      {"active": true, "client_id": "introspected"},
+	})
+
+	previous := jwtValidation
+	t.Cleanup(func() { jwtValidation = previous })
+
+	// Opaque tokens are always introspected
+	jwtValidation = newJWTValidator(issuer.URL, testAudience, "", nil, time.Hour)
+	if response, _, err := validateAccessToken(context.Background(), "opaque"); err != nil || response["client_id"] != "client-1" {
+		t.Errorf("opaque token: response = %v, err = %v", response, err)
+	}
+	if response, _, err := validateAccessToken(context.Background(), jwt); err != nil || response["client_id"] != "client-1" {
+		t.Errorf("JWT: response = %v, err = %v, want local validation", response, err)
+	}
+
+	// So are JWTs when the issuer's keys cannot be fetched
+	jwtValidation = newJWTValidator(issuer.URL, testAudience, issuer.URL+"/missing", nil, time.Hour)
+	if response, _, err := validateAccessToken(context.Background(), jwt); err != nil || response["client_id"] != "introspected" {
+		t.Errorf("JWT without keys: response = %v, err = %v, want introspection", response, err)
+	}
+}
+
+func TestRoutePolicyWithLocalJWTValidation(t *testing.T) {
+	pki := newTestPKI(t)
+	keys := newTestIssuerKeys(t)
+	issuer, _ := newTestIssuer(t, keys.jwks)
+	newIntrospectionServer(t, nil)
+
+	previous := jwtValidation
+	jwtValidation = newJWTValidator(issuer.URL, testAudience, "", nil, time.Hour)
+	t.Cleanup(func() { jwtValidation = previous })
+
+	claims := accessTokenClaims(issuer.URL)
+	claims["cnf"] = map[string]string{"x5t#S256": thumbprint(pki.clientCert)}
+	token := signTestJWT(t, keys, "ES256", "ec-1", "at+jwt", claims)
+
+	var introspectionHeader string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		introspectionHeader = r.Header.Get("X-Introspection-Response")
+	}))
+	defer upstream.Close()
+	ts := newTestProxy(t, pki, routePolicy{RequireClientCert: true, RequireAccessToken: true, RequireBoundToken: true}, upstream, discardLogger())
+
+	for _, certs := range [][]tls.Certificate{{pki.clientCert}, nil} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/au/v1.0/resource", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := testClient(ts, certs...).Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if want := map[bool]int{true: http.StatusOK, false: http.StatusUnauthorized}[len(certs) > 0]; resp.StatusCode != want {
+			t.Fatalf("with %d certificates: status = %d, want %d", len(certs), resp.StatusCode, want)
+		}
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(introspectionHeader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var response map[string]interface{}
+	json.Unmarshal(decoded, &response)
+	if response["active"] != true || response["jti"] != "token-1" || !strings.Contains(string(decoded), "x5t#S256") {
+		t.Errorf("X-Introspection-Response = %s", decoded)
+	}
+}
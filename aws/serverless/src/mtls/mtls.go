@@ -1,22 +1,26 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
-	"encoding/pem"
+	"errors"
 	"fmt"
 	"io"
-	"io/ioutil"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func getEnv(key, defaultValue string) string {
@@ -26,6 +30,49 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvBool reads a boolean environment variable, falling back to
+// defaultValue when it is unset or not a boolean
+func getEnvBool(key string, defaultValue bool) bool {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		slog.Warn("ignoring invalid boolean", slog.String("key", key), slog.String("value", value))
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvDuration reads a duration such as "30s" from the environment
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		slog.Warn("ignoring invalid duration", slog.String("key", key), slog.String("value", value))
+		return defaultValue
+	}
+	return parsed
+}
+
+// getEnvInt reads an integer from the environment
+func getEnvInt(key string, defaultValue int) int {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		slog.Warn("ignoring invalid integer", slog.String("key", key), slog.String("value", value))
+		return defaultValue
+	}
+	return parsed
+}
+
 func main() {
 	opts := &slog.HandlerOptions{
 		Level: slog.LevelDebug,
@@ -36,125 +83,120 @@ func main() {
 	log := slog.New(handler)
 	slog.SetDefault(log)
 
-	// Load environment variables with fallbacks
-	caCertPath := getEnv("CA_CERT_PATH", "certs/ca.crt")
-	serverCertPath := getEnv("SERVER_CERT_PATH", "certs/mtls.crt")
-	serverKeyPath := getEnv("SERVER_KEY_PATH", "certs/mtls.key")
-	authHostStr := getEnv("AUTH_HOST", "http://auth.localhost:3000")
-	apiHostStr := getEnv("API_HOST", "http://localhost:8080")
-
-	caBytes, err := os.ReadFile(caCertPath)
+	// The server certificates and the client CA bundle are reloaded when the
+	// files change or on SIGHUP. SNI_CERTIFICATES adds "cert:key" pairs for
+	// other names, chosen by the name the client asks for.
+	pairs := []certificatePair{{
+		certPath: getEnv("SERVER_CERT_PATH", "certs/mtls.crt"),
+		keyPath:  getEnv("SERVER_KEY_PATH", "certs/mtls.key"),
+	}}
+	sniPairs, err := parseCertificatePairs(getEnv("SNI_CERTIFICATES", ""))
 	if err != nil {
-		log.Error("unable to read ca.crt", slog.String("err", err.Error()))
+		log.Error("invalid SNI_CERTIFICATES", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	certificates, err := loadCertificateStore(getEnv("CA_CERT_PATH", "certs/ca.crt"), append(pairs, sniPairs...))
+	if err != nil {
+		log.Error("unable to load certificates", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	go certificates.watch(getEnvDuration("CERT_RELOAD_INTERVAL", 30*time.Second), nil)
+
+	// Upstreams that understand the standard formats can take the client
+	// certificate as XFCC or RFC 9440 headers instead of X-Client-Cert
+	clientCertHeaderFormat = getEnv("CLIENT_CERT_HEADER", clientCertLegacy)
+	if !validClientCertHeaderFormat(clientCertHeaderFormat) {
+		log.Error("CLIENT_CERT_HEADER must be legacy, xfcc or rfc9440", slog.String("value", clientCertHeaderFormat))
 		os.Exit(1)
 	}
-	caCertPool := x509.NewCertPool()
-	for block, rest := pem.Decode(caBytes); block != nil; block, rest = pem.Decode(rest) {
-		switch block.Type {
-		case "CERTIFICATE":
-			cert, err := x509.ParseCertificate(block.Bytes)
-			if err != nil {
-				panic(err)
-			}
-			caCertPool.AddCert(cert)
-			log.Info("loaded certificate", slog.String("subject", cert.Subject.String()))
 
-		default:
-			panic("unknown block type " + block.Type)
+	// Introspection results are reused until the TTL or the token's exp,
+	// whichever comes first; a TTL of 0 disables caching
+	introspections = newIntrospectionCache(
+		getEnvDuration("INTROSPECTION_CACHE_TTL", time.Minute),
+		getEnvDuration("INTROSPECTION_CACHE_NEGATIVE_TTL", 10*time.Second),
+		getEnvInt("INTROSPECTION_CACHE_SIZE", 10000),
+	)
+	// Upstreams and the OP get dial, TLS handshake and response header
+	// timeouts, a retry for requests that are safe to repeat, and a circuit
+	// breaker per backend, set by UPSTREAM_* and INTROSPECTION_*
+	upstreamTransport = newResilientTransport(loadTransportConfig("UPSTREAM", defaultTransportConfig()), isIdempotent)
+	introspectionClient = newOPClient(
+		loadTransportConfig("INTROSPECTION", defaultTransportConfig()),
+		getEnvDuration("INTROSPECTION_TIMEOUT", 10*time.Second),
+	)
+
+	// JWT access tokens (RFC 9068) can be validated against the issuer's keys
+	// instead of being introspected; opaque tokens are always introspected
+	if getEnv("ACCESS_TOKEN_VALIDATION", "introspection") == "jwt" {
+		jwtValidation = newJWTValidator(
+			getEnv("ISSUER", "https://auth.localhost"),
+			getEnv("ACCESS_TOKEN_AUDIENCE", "https://api.localhost"),
+			getEnv("JWKS_URI", ""),
+			strings.Fields(getEnv("ACCESS_TOKEN_REQUIRED_SCOPES", "")),
+			getEnvDuration("JWKS_REFRESH_INTERVAL", 15*time.Minute),
+		)
+	}
+
+	// Scope, client and certificate requirements per API route, reloaded when
+	// the file changes or on SIGHUP
+	var policies *policyFile
+	if policyPath := getEnv("POLICY_FILE", ""); policyPath != "" {
+		policies, err = loadPolicyFile(policyPath)
+		if err != nil {
+			log.Error("unable to load access policy", slog.String("err", err.Error()))
+			os.Exit(1)
 		}
+		go policies.watch(getEnvDuration("POLICY_RELOAD_INTERVAL", 10*time.Second), nil)
 	}
 
-	serverCertBytes, err := os.ReadFile(serverCertPath)
+	// Forwarding headers are believed only from TRUSTED_PROXIES, a list of
+	// CIDRs such as the load balancer's subnet
+	trustedProxies, err = parseTrustedProxies(getEnv("TRUSTED_PROXIES", ""))
 	if err != nil {
-		log.Error("unable to read mtls.crt", slog.String("err", err.Error()))
+		log.Error("invalid TRUSTED_PROXIES", slog.String("err", err.Error()))
 		os.Exit(1)
 	}
-	matlsBlock, _ := pem.Decode(serverCertBytes)
-	if matlsBlock == nil {
-		log.Error("unable to decode mtls.crt")
-		os.Exit(1)
-	}
-	serverBytes := matlsBlock.Bytes
 
-	serverKeyBytes, err := os.ReadFile(serverKeyPath)
+	// Routes marked for audit record every call to AUDIT_SINK (stdout or
+	// file), with the AUDIT_FIELDS of request bodies hashed or masked.
+	// AUDIT_HASH_CHAIN links the records so tampering can be detected.
+	auditLog, err = newAuditSink(getEnv("AUDIT_SINK", ""), getEnv("AUDIT_FILE", "audit.log"), getEnvBool("AUDIT_HASH_CHAIN", false))
 	if err != nil {
-		log.Error("unable to read mtls.key", slog.String("err", err.Error()))
+		log.Error("unable to open audit log", slog.String("err", err.Error()))
 		os.Exit(1)
 	}
-	serverKeyBlock, _ := pem.Decode(serverKeyBytes)
-	if serverKeyBlock == nil {
-		log.Error("unable to decode mtls.key")
+	redaction := getEnv("AUDIT_REDACTION", auditHash)
+	if redaction != auditHash && redaction != auditMask {
+		log.Error("AUDIT_REDACTION must be hash or mask", slog.String("value", redaction))
 		os.Exit(1)
 	}
-	serverKey, err := x509.ParsePKCS8PrivateKey(serverKeyBlock.Bytes)
-	if err != nil {
-		log.Error("unable to parse mtls.key", slog.String("err", err.Error()))
+	hashKey := getEnv("AUDIT_HASH_KEY", "")
+	if auditLog != nil && redaction == auditHash && hashKey == "" {
+		log.Error("AUDIT_HASH_KEY must be set when AUDIT_REDACTION is hash")
 		os.Exit(1)
 	}
+	auditRedaction = newAuditRedactor(
+		strings.Fields(getEnv("AUDIT_FIELDS", "phoneNumber accountNumber emailAddress")),
+		redaction,
+		[]byte(hashKey),
+	)
 
-	go http.ListenAndServe(":8181", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("<html><body><h1>It works!</h1></body></html>"))
-	}))
-
-	mux := http.NewServeMux()
-	// Auth Host
-	authHost, err := url.Parse(authHostStr)
+	// Hosts and paths are routed to upstreams by ROUTES_FILE; without one the
+	// auth and API routes come from AUTH_HOST, API_HOST and friends
+	routes, err := loadRoutingConfig(getEnv("ROUTES_FILE", ""))
 	if err != nil {
-		log.Error("unable to upstream url", slog.String("err", err.Error()))
+		log.Error("unable to load routes", slog.String("err", err.Error()))
 		os.Exit(1)
 	}
-	// Create reverse proxies with custom director to add headers
-	authProxy := httputil.NewSingleHostReverseProxy(authHost)
-
-	// Add custom Director to set required headers
-	authProxy.Director = func(req *http.Request) {
-		setCustomHeaders(req, authHost)
-	}
-
-	// Ensure the externalAuthHost has a trailing slash
-	externalAuthHost := getEnv("EXTERNAL_AUTH_HOST", "auth.localhost")
-	if !strings.HasSuffix(externalAuthHost, "/") {
-		externalAuthHost = externalAuthHost + "/"
-	}
-
-	// Use path.Join to ensure safe joining
-	mux.Handle(externalAuthHost, accessLogger(log, authProxy))
-
-	// Api Host
-	// apiHost, _ := url.Parse(os.Getenv("API_GATEWAY_URI"))
-	apiHost, _ := url.Parse(apiHostStr)
+	mux, err := newRouter(routes, log, policies)
 	if err != nil {
-		log.Error("unable to upstream url", slog.String("err", err.Error()))
+		log.Error("invalid routes", slog.String("err", err.Error()))
 		os.Exit(1)
 	}
-	// Create reverse proxies with custom director to add headers
-	apiProxy := httputil.NewSingleHostReverseProxy(apiHost)
-
-	// Add custom Director to set required headers
-	apiProxy.Director = func(req *http.Request) {
-		setCustomHeaders(req, apiHost)
-	}
-	apiProxyHandler := accessLogger(log, apiProxy)
-	apiProxyHandler = enforceAccessTokenMiddleware(apiProxyHandler)
-
-	// Ensure the externalAuthHost has a trailing slash
-	internalApiHost := getEnv("INTERNAL_AUTH_HOST", "api.localhost")
-	if !strings.HasSuffix(internalApiHost, "/") {
-		internalApiHost = internalApiHost + "/"
-	}
-
-	mux.Handle(internalApiHost, apiProxyHandler)
 
 	tlsConfig := &tls.Config{
-		Certificates: []tls.Certificate{{
-			Certificate: [][]byte{
-				serverBytes,
-			},
-			PrivateKey: serverKey,
-		}},
 		InsecureSkipVerify: true,
-		ClientCAs:          caCertPool,
 		ClientAuth:         tls.VerifyClientCertIfGiven,
 		MinVersion:         tls.VersionTLS12,
 		MaxVersion:         tls.VersionTLS13,
@@ -166,6 +208,8 @@ func main() {
 			tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
 			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
 			tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
 			//TLS 1.3 these are actually ignored, but kept here to provide clarity on what's enabled by default.
 			tls.TLS_CHACHA20_POLY1305_SHA256,
 			tls.TLS_AES_128_GCM_SHA256,
@@ -173,76 +217,174 @@ func main() {
 		},
 	}
 
-	server := http.Server{
+	// Client certificates can be checked against OCSP and CRLs during the
+	// handshake; REVOCATION_FAIL_MODE decides what happens when neither answers
+	var verifiers []func(tls.ConnectionState) error
+
+	// Client certificates must belong to an active organisation and software
+	// statement in the participant directory, whose CAs are trusted alongside
+	// CA_CERT_PATH when they chain to the roots in DIRECTORY_ANCHOR_ROOTS.
+	// DIRECTORY_ALLOW_ORGANISATION_CERTS also accepts certificates that only
+	// name an organisation.
+	var directory *participantDirectory
+	if source := getEnv("DIRECTORY_PARTICIPANTS", ""); source != "" {
+		var anchorRoots *x509.CertPool
+		if path := getEnv("DIRECTORY_ANCHOR_ROOTS", ""); path != "" {
+			roots, err := loadCACertificates(path)
+			if err != nil {
+				log.Error("unable to load directory anchor roots", slog.String("err", err.Error()))
+				os.Exit(1)
+			}
+			anchorRoots = x509.NewCertPool()
+			for _, root := range roots {
+				anchorRoots.AddCert(root)
+			}
+		}
+		directory, err = loadParticipantDirectory(
+			source,
+			getEnv("DIRECTORY_TRUST_ANCHORS", ""),
+			anchorRoots,
+			&http.Client{Timeout: getEnvDuration("DIRECTORY_TIMEOUT", 10*time.Second)},
+			certificates.setDirectoryCAs,
+		)
+		if err != nil {
+			log.Error("unable to load participant directory", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		directory.allowOrganisationCerts = getEnvBool("DIRECTORY_ALLOW_ORGANISATION_CERTS", false)
+		go directory.watch(getEnvDuration("DIRECTORY_REFRESH_INTERVAL", time.Hour), nil)
+		verifiers = append(verifiers, directory.verifyConnection)
+	}
+
+	var revocation *revocationChecker
+	if getEnvBool("REVOCATION_CHECK", false) {
+		failMode := getEnv("REVOCATION_FAIL_MODE", "open")
+		if failMode != "open" && failMode != "closed" {
+			log.Error("REVOCATION_FAIL_MODE must be open or closed", slog.String("value", failMode))
+			os.Exit(1)
+		}
+		revocation, err = newRevocationChecker(
+			getEnvBool("REVOCATION_OCSP", true),
+			getEnv("OCSP_RESPONDER_URL", ""),
+			getEnvBool("REVOCATION_FETCH_CRLS", true),
+			strings.Fields(getEnv("CRL_FILES", "")),
+			failMode == "closed",
+			getEnvDuration("REVOCATION_TIMEOUT", 5*time.Second),
+		)
+		if err != nil {
+			log.Error("unable to load CRLs", slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		go revocation.watch(getEnvDuration("CRL_RELOAD_INTERVAL", time.Hour), nil)
+		verifiers = append(verifiers, revocation.verifyConnection)
+	}
+	if len(verifiers) > 0 {
+		tlsConfig.VerifyConnection = verifyConnection(verifiers...)
+	}
+	tlsConfig = certificates.tlsConfig(tlsConfig)
+
+	// SIGHUP reloads certificates, the directory, CRLs and the access policy
+	// without dropping connections
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := certificates.reload(); err != nil {
+				log.Error("unable to reload certificates", slog.String("err", err.Error()))
+			}
+			if directory != nil {
+				if err := directory.refresh(); err != nil {
+					log.Error("unable to refresh participant directory", slog.String("err", err.Error()))
+				}
+			}
+			if revocation != nil {
+				if err := revocation.loadCRLFiles(); err != nil {
+					log.Error("unable to reload CRLs", slog.String("err", err.Error()))
+				}
+			}
+			if policies != nil {
+				if err := policies.reload(); err != nil {
+					log.Error("unable to reload access policy", slog.String("err", err.Error()))
+				}
+			}
+		}
+	}()
+
+	// /readyz checks every upstream and the OP accept connections
+	ready, err := newReadiness(routes, getEnv("INTROSPECTION_URL", defaultIntrospectionURL), getEnvDuration("READINESS_TIMEOUT", 2*time.Second))
+	if err != nil {
+		log.Error("invalid readiness checks", slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+
+	// SIGTERM and SIGINT stop new connections and drain open ones
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+
+	server := &http.Server{
 		Handler:   mux,
 		ErrorLog:  logger,
 		TLSConfig: tlsConfig,
 	}
-	ln, err := net.Listen("tcp", fmt.Sprintf(":%d", 443))
+	listenAddr := getEnv("LISTEN_ADDR", ":"+getEnv("PORT", "443"))
+	ln, err := net.Listen("tcp", listenAddr)
 	if err != nil {
+		log.Error("unable to listen", slog.String("addr", listenAddr), slog.String("err", err.Error()))
+		os.Exit(1)
+	}
+	log.Info("listening", slog.String("addr", ln.Addr().String()))
+
+	// The admin listener serves health checks and metrics in plain HTTP, so
+	// it must not be exposed outside the cluster; an empty ADMIN_ADDR turns
+	// it off
+	var admin *http.Server
+	var adminLn net.Listener
+	if adminAddr := getEnv("ADMIN_ADDR", ":8181"); adminAddr != "" {
+		adminLn, err = net.Listen("tcp", adminAddr)
+		if err != nil {
+			log.Error("unable to listen for admin", slog.String("addr", adminAddr), slog.String("err", err.Error()))
+			os.Exit(1)
+		}
+		admin = &http.Server{Handler: adminHandler(ready), ErrorLog: logger, ReadHeaderTimeout: 10 * time.Second}
+		log.Info("admin listening", slog.String("addr", adminLn.Addr().String()))
+	}
+
+	err = serveUntilSignal(log, server, tls.NewListener(ln, tlsConfig), admin, adminLn, ready, stop,
+		getEnvDuration("SHUTDOWN_DELAY", 5*time.Second),
+		getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+	)
+	if err != nil {
+		log.Error("server error", slog.String("err", err.Error()))
 		os.Exit(1)
 	}
-	slog.Info("Listening on port 443")
-	slog.Error("server error", slog.String("err", server.Serve(tls.NewListener(ln, tlsConfig)).Error()))
 }
 
+// statusRecorder records the status and size of a response
 type statusRecorder struct {
 	http.ResponseWriter
 	status int
+	bytes  int64
 }
 
 func (rec *statusRecorder) WriteHeader(code int) {
-	rec.status = code
+	if rec.status == 0 {
+		rec.status = code
+	}
 	rec.ResponseWriter.WriteHeader(code)
 }
 
-func singleJoiningSlash(a, b string) string {
-	if a == "" || b == "" {
-		return a + b
-	}
-	aslash := a[len(a)-1] == '/'
-	bslash := b[0] == '/'
-	switch {
-	case aslash && bslash:
-		return a + b[1:]
-	case !aslash && !bslash:
-		return a + "/" + b
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
 	}
-	return a + b
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
 }
 
-func setCustomHeaders(req *http.Request, target *url.URL) {
-	req.Header.Set("X-Forwarded-Proto", "https") // Adjust to "https" if using HTTPS
-	req.Header.Set("Host", req.Host)
-	req.Header.Set("X-Real-IP", getRemoteIP(req))
-	req.Header.Set("X-Forwarded-For", getForwardedFor(req))
-
-	// Extract and set the client's certificate and DN
-	if len(req.TLS.PeerCertificates) > 0 {
-		// The TLS Block Ensures that the correct ordering has taken place and that the leaf certificate will be at block 0
-		clientCert := req.TLS.PeerCertificates[0]
-		certPEM := pem.EncodeToMemory(&pem.Block{
-			Type:  "CERTIFICATE",
-			Bytes: clientCert.Raw,
-		})
-		// Base64 encode the certificate to ensure it's valid for HTTP headers
-		certPEMString := strings.ReplaceAll(string(certPEM), "\n", " ")
-		req.Header.Set("X-Client-Cert", string(certPEMString))
-		req.Header.Set("X-Client-DN", clientCert.Subject.String())
-	}
-
-	req.URL.Scheme = target.Scheme
-	req.URL.Host = target.Host
-	req.URL.Path = singleJoiningSlash(target.Path, req.URL.Path)
-	if target.RawQuery == "" || req.URL.RawQuery == "" {
-		req.URL.RawQuery = target.RawQuery + req.URL.RawQuery
-	} else {
-		req.URL.RawQuery = target.RawQuery + "&" + req.URL.RawQuery
-	}
-	if _, ok := req.Header["User-Agent"]; !ok {
-		// explicitly disable User-Agent so it's not set to default value
-		req.Header.Set("User-Agent", "")
-	}
+// Unwrap lets http.ResponseController reach the connection for flushing
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
 }
 
 func getRemoteIP(req *http.Request) string {
@@ -253,18 +395,51 @@ func getRemoteIP(req *http.Request) string {
 	return ip
 }
 
-func getForwardedFor(req *http.Request) string {
-	forwardedFor := req.Header.Get("X-Forwarded-For")
-	if forwardedFor != "" {
-		return forwardedFor + ", " + getRemoteIP(req)
+// accessDetails is what the handlers inside accessLogger learned about a
+// request: the upstream rewriteUpstream sent it to and the binding of the
+// token enforceRoutePolicy accepted
+type accessDetails struct {
+	upstream     string
+	tokenBinding string
+}
+
+// accessDetailsKey is the context key for the request's accessDetails
+type accessDetailsKey struct{}
+
+// accessDetailsFromContext returns the details accessLogger is collecting
+// for the request, if it is logged
+func accessDetailsFromContext(ctx context.Context) (*accessDetails, bool) {
+	details, ok := ctx.Value(accessDetailsKey{}).(*accessDetails)
+	return details, ok
+}
+
+// rewriteUpstream is the Rewrite hook of the reverse proxies. It sends the
+// request to target with the proxy's headers and the request's trace. By the
+// time it runs the proxy has removed hop-by-hop headers, including those
+// named in Connection, and every inbound Forwarded and X-Forwarded-* header.
+func rewriteUpstream(pr *httputil.ProxyRequest, target *url.URL, preserveHost bool) {
+	pr.SetURL(target)
+	if preserveHost {
+		// Upstreams see the host the client asked for rather than their own
+		pr.Out.Host = pr.In.Host
+	}
+	setForwardedHeaders(pr)
+	// Pass on the client's certificate in the configured format
+	setClientCertHeaders(pr.Out)
+	setTraceHeaders(pr.In.Context(), pr.Out.Header)
+	if details, ok := accessDetailsFromContext(pr.In.Context()); ok {
+		details.upstream = pr.Out.URL.String()
 	}
-	return getRemoteIP(req)
 }
 
+// accessLogger logs every request once it has been answered, with the
+// upstream the proxy sent it to
 func accessLogger(log *slog.Logger, h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		details := &accessDetails{}
 		rec := &statusRecorder{ResponseWriter: w}
-		h.ServeHTTP(rec, r)
+		h.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), accessDetailsKey{}, details)))
 		attrs := []slog.Attr{
 			slog.String("remoteIP", r.RemoteAddr),
 			slog.String("host", r.Host),
@@ -274,29 +449,22 @@ func accessLogger(log *slog.Logger, h http.Handler) http.Handler {
 			slog.String("status", fmt.Sprintf("%d", rec.status)),
 			slog.String("userAgent", r.UserAgent()),
 			slog.String("referer", r.Referer()),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("latency", time.Since(start)),
 		}
-		if _, ok := h.(*httputil.ReverseProxy); ok {
-			h.(*httputil.ReverseProxy).Director(r)
-			attrs = append(attrs, slog.String("target", fmt.Sprintf("proxy:%s", r.URL.String())))
+		if requestID, ok := requestIDFromContext(r.Context()); ok {
+			attrs = append(attrs, slog.String("requestID", requestID))
 		}
-		log.LogAttrs(r.Context(), slog.LevelInfo, "access log", attrs...)
-	})
-}
-
-func enforceAccessTokenMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		accessToken := getAccessToken(r)
-		if accessToken == "" {
-			slog.Error("No Authorization header, returning 401")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		if trace, ok := traceContextFromContext(r.Context()); ok {
+			attrs = append(attrs, slog.String("traceID", trace.traceID))
+		}
+		if details.tokenBinding != "" {
+			attrs = append(attrs, slog.String("tokenBinding", details.tokenBinding))
 		}
-		if !introspectAndAddHeaders(r, accessToken) {
-			slog.Error("Introspection failed, returning 401")
-			http.Error(w, "Unauthorized", http.StatusUnauthorized)
-			return
+		if details.upstream != "" {
+			attrs = append(attrs, slog.String("target", "proxy:"+details.upstream))
 		}
-		next.ServeHTTP(w, r)
+		log.LogAttrs(r.Context(), slog.LevelInfo, "access log", attrs...)
 	})
 }
 
@@ -311,115 +479,123 @@ func getAccessToken(req *http.Request) string {
 	return ""
 }
 
-func introspectAndAddHeaders(req *http.Request, token string) bool {
+// errTokenInactive is returned when the OP reports the token is not active
+var errTokenInactive = errors.New("token is not active")
 
-	introspectionURL := getEnv("INTROSPECTION_URL", "http://localhost:3000/token/introspection")
+// defaultIntrospectionURL is the OP's introspection endpoint when
+// INTROSPECTION_URL is not set
+const defaultIntrospectionURL = "http://localhost:3000/token/introspection"
+
+// errIntrospectionUnavailable is returned when the OP could not answer, as
+// opposed to answering that the token is not valid
+var errIntrospectionUnavailable = errors.New("introspection endpoint unavailable")
+
+// introspectionClient is shared by the introspection and user info calls so
+// connections to the OP are reused
+var introspectionClient = newOPClient(defaultTransportConfig(), 10*time.Second)
+
+// introspect asks the OP whether the token is active (RFC 7662) and returns
+// the decoded response along with its raw body
+func introspect(ctx context.Context, token string) (map[string]interface{}, []byte, error) {
+
+	introspectionURL := getEnv("INTROSPECTION_URL", defaultIntrospectionURL)
 	clientID := getEnv("CLIENT_ID", "client")
 	clientSecret := getEnv("CLIENT_SECRET", "12345678")
 
 	data := url.Values{}
 	data.Set("token", token)
 
-	client := &http.Client{}
-	introspectionReq, err := http.NewRequest("POST", introspectionURL, strings.NewReader(data.Encode()))
+	introspectionReq, err := http.NewRequestWithContext(ctx, "POST", introspectionURL, strings.NewReader(data.Encode()))
 	if err != nil {
-		slog.Error("Failed to create introspection request", slog.String("error", err.Error()))
-		return false
+		return nil, nil, fmt.Errorf("failed to create introspection request: %w", err)
 	}
 
 	introspectionReq.SetBasicAuth(clientID, clientSecret)
 	introspectionReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	setTraceHeaders(ctx, introspectionReq.Header)
 
-	resp, err := client.Do(introspectionReq)
+	resp, err := introspectionClient.Do(introspectionReq)
 	if err != nil {
-		slog.Error("Failed to introspect token", slog.String("error", err.Error()))
-		return false
+		return nil, nil, fmt.Errorf("%w: failed to introspect token: %v", errIntrospectionUnavailable, err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return nil, nil, fmt.Errorf("%w: token introspection returned %s", errIntrospectionUnavailable, resp.Status)
+	}
 	if resp.StatusCode != http.StatusOK {
-		slog.Error("Token introspection returned non-200 status", slog.String("status", resp.Status))
-		return false
+		return nil, nil, fmt.Errorf("token introspection returned non-200 status: %s", resp.Status)
 	}
 
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		slog.Error("Failed to read introspection response body", slog.String("error", err.Error()))
-		return false
+		return nil, nil, fmt.Errorf("failed to read introspection response body: %w", err)
 	}
 
 	var introspectionResponse map[string]interface{}
 	if err := json.Unmarshal(body, &introspectionResponse); err != nil {
-		slog.Error("Failed to unmarshal introspection response", slog.String("error", err.Error()))
-		return false
+		return nil, nil, fmt.Errorf("failed to unmarshal introspection response: %w", err)
 	}
 
 	if active, ok := introspectionResponse["active"].(bool); !ok || !active {
-		slog.Error("Token is not active")
-		return false
+		return nil, nil, errTokenInactive
 	}
 
-	// Check x5t#S256 against client certificate's SHA-256 thumbprint
-	if cnf, ok := introspectionResponse["cnf"].(map[string]interface{}); ok {
-		if x5tS256, ok := cnf["x5t#S256"].(string); ok {
-			if !verifyCertificateThumbprint(req, x5tS256) {
-				slog.Error("Client certificate thumbprint verification failed")
-				return false
-			}
-		}
-	}
+	return introspectionResponse, body, nil
+}
 
+// addIntrospectionHeaders passes the introspection response, and user info
+// when the token has a subject, to the upstream
+func addIntrospectionHeaders(req *http.Request, result *introspectionResult) {
 	// Base64 encode the introspection response and set as header
-	introspectionResponseBase64 := base64.StdEncoding.EncodeToString(body)
+	introspectionResponseBase64 := base64.StdEncoding.EncodeToString(result.body)
 	req.Header.Set("X-Introspection-Response", introspectionResponseBase64)
 	//To be compliant with the lambda - to be removed
-	req.Header.Set("access_token", string(body))
+	req.Header.Set("access_token", string(result.body))
 
-	// Check for 'sub' property and fetch user info if present
-	if _, ok := introspectionResponse["sub"].(string); ok {
-		fetchAndAddUserInfo(req, token)
+	if result.userInfo != nil {
+		// Base64 encode the user info response and set as header
+		userInfoResponseBase64 := base64.StdEncoding.EncodeToString(result.userInfo)
+		req.Header.Set("X-User-Info-Response", userInfoResponseBase64)
 	}
-
-	return true
 }
 
-func fetchAndAddUserInfo(req *http.Request, token string) {
+// fetchUserInfo returns the OP's user info response for the token, or nil if
+// it could not be fetched
+func fetchUserInfo(ctx context.Context, token string) []byte {
 	userInfoURL := getEnv("USER_INFO_URL", "http://auth/me")
 
-	client := &http.Client{}
-	userInfoReq, err := http.NewRequest("GET", userInfoURL, nil)
+	userInfoReq, err := http.NewRequestWithContext(ctx, "GET", userInfoURL, nil)
 	if err != nil {
 		slog.Error("Failed to create user info request", slog.String("error", err.Error()))
-		return
+		return nil
 	}
 
 	userInfoReq.Header.Set("Authorization", "Bearer "+token)
+	setTraceHeaders(ctx, userInfoReq.Header)
 
-	resp, err := client.Do(userInfoReq)
+	resp, err := introspectionClient.Do(userInfoReq)
 	if err != nil {
 		slog.Error("Failed to fetch user info", slog.String("error", err.Error()))
-		return
+		return nil
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		slog.Error("User info request returned non-200 status", slog.String("status", resp.Status))
-		return
+		return nil
 	}
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		slog.Error("Failed to read user info response body", slog.String("error", err.Error()))
-		return
+		return nil
 	}
-
-	// Base64 encode the user info response and set as header
-	userInfoResponseBase64 := base64.StdEncoding.EncodeToString(body)
-	req.Header.Set("X-User-Info-Response", userInfoResponseBase64)
+	return body
 }
 
 func verifyCertificateThumbprint(req *http.Request, x5tS256 string) bool {
-	if len(req.TLS.PeerCertificates) == 0 {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
 		return false
 	}
 
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// accessPolicy decides which callers may use which API routes. Rules match
+// on path and method; the most specific matching path wins. Requests that
+// match no rule are allowed unless Default is "deny".
+type accessPolicy struct {
+	Default string       `json:"default,omitempty"`
+	Rules   []accessRule `json:"rules"`
+}
+
+// accessRule lists what a caller needs to use the matching requests. Path is
+// an exact path, or a prefix when it ends in "/*". Every scope is required;
+// client_ids and subject_dns, when set, list the callers allowed.
+type accessRule struct {
+	Path       string   `json:"path"`
+	Methods    []string `json:"methods,omitempty"`
+	Scopes     []string `json:"scopes,omitempty"`
+	ClientIDs  []string `json:"client_ids,omitempty"`
+	SubjectDNs []string `json:"subject_dns,omitempty"`
+}
+
+// policyDecision explains a denied request
+type policyDecision struct {
+	allowed bool
+	reason  string
+	scopes  []string
+}
+
+// validate checks a policy for mistakes that would otherwise silently
+// allow or deny requests
+func (p *accessPolicy) validate() error {
+	if p.Default != "" && p.Default != "allow" && p.Default != "deny" {
+		return fmt.Errorf("default must be allow or deny, not %q", p.Default)
+	}
+	for i, rule := range p.Rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return fmt.Errorf("rule %d: path %q must start with /", i, rule.Path)
+		}
+		if strings.Contains(strings.TrimSuffix(rule.Path, "/*"), "*") {
+			return fmt.Errorf("rule %d: path %q may only end in /*", i, rule.Path)
+		}
+	}
+	return nil
+}
+
+// match returns the rule for the request, preferring exact paths and then
+// the longest prefix
+func (p *accessPolicy) match(method, requestPath string) (*accessRule, bool) {
+	var best *accessRule
+	bestLength := -1
+	for i := range p.Rules {
+		rule := &p.Rules[i]
+		if len(rule.Methods) > 0 && !containsFold(rule.Methods, method) {
+			continue
+		}
+		length := -1
+		if prefix, ok := strings.CutSuffix(rule.Path, "*"); ok {
+			if strings.HasPrefix(requestPath, prefix) {
+				length = len(prefix)
+			}
+		} else if requestPath == rule.Path {
+			// An exact path outranks any prefix of the same request
+			length = len(requestPath) + 1
+		}
+		if length > bestLength {
+			best, bestLength = rule, length
+		}
+	}
+	return best, best != nil
+}
+
+// decide applies the policy to a request authorised by auth
+func (p *accessPolicy) decide(r *http.Request, auth tokenAuth) policyDecision {
+	rule, ok := p.match(r.Method, path.Clean("/"+r.URL.Path))
+	if !ok {
+		if p.Default == "deny" {
+			return policyDecision{reason: "no policy rule matches the request"}
+		}
+		return policyDecision{allowed: true}
+	}
+
+	var response map[string]interface{}
+	if auth.result != nil {
+		response = auth.result.response
+	}
+	granted := map[string]bool{}
+	if scope, ok := response["scope"].(string); ok {
+		for _, s := range strings.Fields(scope) {
+			granted[s] = true
+		}
+	}
+	for _, required := range rule.Scopes {
+		if !granted[required] {
+			return policyDecision{reason: "scope " + required + " was not granted", scopes: rule.Scopes}
+		}
+	}
+	if len(rule.ClientIDs) > 0 {
+		clientID, _ := response["client_id"].(string)
+		if !contains(rule.ClientIDs, clientID) {
+			return policyDecision{reason: "client " + clientID + " is not allowed", scopes: rule.Scopes}
+		}
+	}
+	if len(rule.SubjectDNs) > 0 {
+		if !hasClientCert(r) || !contains(rule.SubjectDNs, r.TLS.PeerCertificates[0].Subject.String()) {
+			return policyDecision{reason: "certificate subject is not allowed", scopes: rule.Scopes}
+		}
+	}
+	return policyDecision{allowed: true}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// policyFile holds the policy loaded from a file and reloads it when the
+// file changes. A policy that fails to load leaves the previous one in force.
+type policyFile struct {
+	path   string
+	policy atomic.Pointer[accessPolicy]
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// loadPolicyFile reads the policy at path, failing if it is not valid
+func loadPolicyFile(path string) (*policyFile, error) {
+	f := &policyFile{path: path}
+	if err := f.reload(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// reload reads the policy file again
+func (f *policyFile) reload() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var policy accessPolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return fmt.Errorf("invalid policy file %s: %w", f.path, err)
+	}
+	if err := policy.validate(); err != nil {
+		return fmt.Errorf("invalid policy file %s: %w", f.path, err)
+	}
+	f.policy.Store(&policy)
+	f.modTime = info.ModTime()
+	slog.Info("loaded access policy", slog.String("path", f.path), slog.Int("rules", len(policy.Rules)))
+	return nil
+}
+
+// changed reports whether the file has been modified since it was loaded
+func (f *policyFile) changed() bool {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return !info.ModTime().Equal(f.modTime)
+}
+
+// watch reloads the policy whenever the file changes, checking every interval
+func (f *policyFile) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if f.changed() {
+				if err := f.reload(); err != nil {
+					slog.Error("Failed to reload access policy, keeping the previous one", slog.String("error", err.Error()))
+				}
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// enforceAccessPolicy rejects requests the policy does not allow with 403
+// and an insufficient_scope challenge (RFC 6750 section 3.1). It runs after
+// the route policy has validated the access token.
+func enforceAccessPolicy(policies *policyFile, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth, _ := tokenAuthFromContext(r.Context())
+		decision := policies.policy.Load().decide(r, auth)
+		if !decision.allowed {
+			slog.Error("Access policy denied request, returning 403",
+				slog.String("path", r.URL.Path),
+				slog.String("method", r.Method),
+				slog.String("reason", decision.reason),
+			)
+			challenge := `Bearer error="insufficient_scope"`
+			if len(decision.scopes) > 0 {
+				challenge += `, scope="` + strings.Join(decision.scopes, " ") + `"`
+			}
+			w.Header().Set("WWW-Authenticate", challenge)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writePolicy writes a policy file to dir and returns its path
+func writePolicy(t *testing.T, dir, policy string) string {
+	t.Helper()
+	path := filepath.Join(dir, "policy.json")
+	if err := os.WriteFile(path, []byte(policy), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAccessPolicyMatch(t *testing.T) {
+	policy := accessPolicy{Rules: []accessRule{
+		{Path: "/au/v1.0/*", Scopes: []string{"api"}},
+		{Path: "/au/v1.0/confirmation-of-telephony/*", Methods: []string{"POST"}, Scopes: []string{"telephony"}},
+		{Path: "/au/v1.0/confirmation-of-telephony/threat-score", Methods: []string{"POST"}, Scopes: []string{"threat-score"}},
+	}}
+
+	tests := []struct {
+		method, path string
+		scope        string
+	}{
+		{"POST", "/au/v1.0/confirmation-of-telephony/threat-score", "threat-score"},
+		{"POST", "/au/v1.0/confirmation-of-telephony/other", "telephony"},
+		{"post", "/au/v1.0/confirmation-of-telephony/other", "telephony"},
+		{"GET", "/au/v1.0/confirmation-of-telephony/other", "api"},
+		{"GET", "/au/v1.0/banking/accounts", "api"},
+		{"GET", "/health", ""},
+	}
+	for _, tt := range tests {
+		rule, ok := policy.match(tt.method, tt.path)
+		if tt.scope == "" {
+			if ok {
+				t.Errorf("%s %s matched %s", tt.method, tt.path, rule.Path)
+			}
+			continue
+		}
+		if !ok || rule.Scopes[0] != tt.scope {
+			t.Errorf("%s %s matched %v, want the rule requiring %s", tt.method, tt.path, rule, tt.scope)
+		}
+	}
+}
+
+func TestLoadPolicyFileRejectsInvalidPolicies(t *testing.T) {
+	for name, policy := range map[string]string{
+		"malformed":        `{"rules": [`,
+		"relative path":    `{"rules": [{"path": "au/v1.0/*"}]}`,
+		"wildcard inside":  `{"rules": [{"path": "/au/*/threat-score"}]}`,
+		"unknown default":  `{"default": "maybe", "rules": []}`,
+		"missing the file": "",
+	} {
+		path := filepath.Join(t.TempDir(), "missing.json")
+		if policy != "" {
+			path = writePolicy(t, t.TempDir(), policy)
+		}
+		if _, err := loadPolicyFile(path); err == nil {
+			t.Errorf("%s: policy loaded", name)
+		}
+	}
+}
+
+func TestPolicyFileReloadsOnChange(t *testing.T) {
+	dir := t.TempDir()
+	path := writePolicy(t, dir, `{"rules": [{"path": "/a/*", "scopes": ["a"]}]}`)
+	policies, err := loadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go policies.watch(10*time.Millisecond, stop)
+
+	waitForPolicy := func(scope string) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			if rule, ok := policies.policy.Load().match("GET", "/a/b"); ok && rule.Scopes[0] == scope {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("policy requiring %s was not loaded", scope)
+	}
+
+	// Make sure the new file has a different modification time
+	writePolicy(t, dir, `{"rules": [{"path": "/a/*", "scopes": ["b"]}]}`)
+	os.Chtimes(path, time.Now().Add(time.Second), time.Now().Add(time.Second))
+	waitForPolicy("b")
+
+	// A broken policy leaves the last good one in force
+	writePolicy(t, dir, `{"rules": [`)
+	os.Chtimes(path, time.Now().Add(2*time.Second), time.Now().Add(2*time.Second))
+	time.Sleep(50 * time.Millisecond)
+	waitForPolicy("b")
+}
+
+func TestEnforceAccessPolicy(t *testing.T) {
+	pki := newTestPKI(t)
+	partner := pki.issueClientCert(t, "partner.example.com", 3)
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"telephony": {"active": true, "client_id": "client-1", "scope": "openid telco_threat_score"},
+		"openid":    {"active": true, "client_id": "client-1", "scope": "openid"},
+		"partner":   {"active": true, "client_id": "partner", "scope": "bank"},
+	})
+	path := writePolicy(t, t.TempDir(), `{
+		"default": "deny",
+		"rules": [
+			{"path": "/au/v1.0/confirmation-of-telephony/*", "methods": ["POST"], "scopes": ["telco_threat_score"]},
+			{"path": "/au/v1.0/confirmation-of-bank-account/*", "scopes": ["bank"], "client_ids": ["partner"]},
+			{"path": "/au/v1.0/partner/*", "subject_dns": ["CN=partner.example.com,O=Test Participant"]}
+		]
+	}`)
+	policies, err := loadPolicyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer upstream.Close()
+	ts := serveTestTLS(t, pki, enforceRoutePolicy(
+		routePolicy{RequireAccessToken: true},
+		enforceAccessPolicy(policies, newTestReverseProxy(upstream)),
+	))
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		token     string
+		cert      tls.Certificate
+		status    int
+		challenge string
+	}{
+		{"scope granted", "POST", "/au/v1.0/confirmation-of-telephony/threat-score", "telephony", pki.clientCert, http.StatusOK, ""},
+		{"scope missing", "POST", "/au/v1.0/confirmation-of-telephony/threat-score", "openid", pki.clientCert, http.StatusForbidden, `Bearer error="insufficient_scope", scope="telco_threat_score"`},
+		{"dot segments do not escape the rule", "POST", "/au/v1.0/other/../confirmation-of-telephony/threat-score", "openid", pki.clientCert, http.StatusForbidden, `Bearer error="insufficient_scope", scope="telco_threat_score"`},
+		{"client allowed", "GET", "/au/v1.0/confirmation-of-bank-account/score", "partner", pki.clientCert, http.StatusOK, ""},
+		{"client not allowed", "GET", "/au/v1.0/confirmation-of-bank-account/score", "telephony", pki.clientCert, http.StatusForbidden, `Bearer error="insufficient_scope", scope="bank"`},
+		{"subject allowed", "GET", "/au/v1.0/partner/report", "openid", partner, http.StatusOK, ""},
+		{"subject not allowed", "GET", "/au/v1.0/partner/report", "openid", pki.clientCert, http.StatusForbidden, `Bearer error="insufficient_scope"`},
+		{"no rule", "GET", "/au/v1.0/unlisted", "telephony", pki.clientCert, http.StatusForbidden, `Bearer error="insufficient_scope"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, ts.URL+tt.path, strings.NewReader("{}"))
+			req.URL.Opaque = tt.path
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			resp, err := testClient(ts, tt.cert).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if got := resp.Header.Get("WWW-Authenticate"); got != tt.challenge {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.challenge)
+			}
+		})
+	}
+}
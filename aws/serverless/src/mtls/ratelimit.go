@@ -0,0 +1,274 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Rate limit keys
+const (
+	// rateLimitByClient limits each client_id, falling back to the
+	// certificate for requests without a token
+	rateLimitByClient = "client"
+	// rateLimitByCertificate limits each client certificate
+	rateLimitByCertificate = "certificate"
+)
+
+// Reasons a request is rate limited
+const (
+	reasonRateLimited   = "rate limit exceeded"
+	reasonQuotaExceeded = "daily quota exceeded"
+)
+
+// maxRateLimitBuckets is how many clients a route tracks. Beyond it the route
+// forgets those whose buckets have refilled and, failing that, the client it
+// heard from least recently.
+const maxRateLimitBuckets = 10000
+
+// rateLimitMetrics are published through expvar as rate_limit
+var rateLimitMetrics = expvar.NewMap("rate_limit")
+
+// rateLimitConfig limits how often each client may call a route. Requests
+// refill a token bucket at requests_per_second up to burst; daily_quota caps
+// the requests per UTC day.
+type rateLimitConfig struct {
+	RequestsPerSecond float64 `json:"requests_per_second,omitempty"`
+	Burst             int     `json:"burst,omitempty"`
+	DailyQuota        int64   `json:"daily_quota,omitempty"`
+	Key               string  `json:"key,omitempty"`
+}
+
+// quotaStore counts requests per key and day. The in-memory store suits a
+// single proxy; replicas that must share quotas need a shared backend.
+type quotaStore interface {
+	// increment adds a request to the key's count for day and returns the
+	// new count
+	increment(ctx context.Context, key, day string) (int64, error)
+}
+
+// quotas counts the daily quota of every route
+var quotas quotaStore = newMemoryQuotaStore()
+
+// memoryQuotaStore keeps the current day's counts in memory
+type memoryQuotaStore struct {
+	mu     sync.Mutex
+	day    string
+	counts map[string]int64
+}
+
+func newMemoryQuotaStore() *memoryQuotaStore {
+	return &memoryQuotaStore{counts: map[string]int64{}}
+}
+
+func (s *memoryQuotaStore) increment(_ context.Context, key, day string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if day != s.day {
+		// Yesterday's counts are no longer needed
+		s.day = day
+		s.counts = map[string]int64{}
+	}
+	s.counts[key]++
+	return s.counts[key], nil
+}
+
+// rateLimiter holds a route's token buckets
+type rateLimiter struct {
+	route  string
+	rate   float64
+	burst  float64
+	quota  int64
+	key    string
+	quotas quotaStore
+	now    func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// rateLimitDecision is the outcome of a request against the limits
+type rateLimitDecision struct {
+	allowed    bool
+	remaining  int
+	reset      time.Duration
+	retryAfter time.Duration
+	reason     string
+}
+
+// newRateLimiter checks a route's limits and builds its limiter
+func newRateLimiter(route string, config rateLimitConfig) (*rateLimiter, error) {
+	if config.RequestsPerSecond < 0 || config.Burst < 0 || config.DailyQuota < 0 {
+		return nil, fmt.Errorf("route %s: rate limits cannot be negative", route)
+	}
+	if config.RequestsPerSecond == 0 && config.DailyQuota == 0 {
+		return nil, fmt.Errorf("route %s: rate_limit needs requests_per_second or daily_quota", route)
+	}
+	switch config.Key {
+	case "":
+		config.Key = rateLimitByClient
+	case rateLimitByClient, rateLimitByCertificate:
+	default:
+		return nil, fmt.Errorf("route %s: rate_limit key must be client or certificate, not %q", route, config.Key)
+	}
+	burst := float64(config.Burst)
+	if burst == 0 {
+		burst = math.Max(1, math.Ceil(config.RequestsPerSecond))
+	}
+	return &rateLimiter{
+		route:   route,
+		rate:    config.RequestsPerSecond,
+		burst:   burst,
+		quota:   config.DailyQuota,
+		key:     config.Key,
+		quotas:  quotas,
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+	}, nil
+}
+
+// clientKey identifies the caller: its client_id, or the thumbprint of its
+// certificate, or failing both its address
+func (l *rateLimiter) clientKey(r *http.Request) string {
+	if l.key == rateLimitByClient {
+		if auth, ok := tokenAuthFromContext(r.Context()); ok && auth.result != nil {
+			if clientID, ok := auth.result.response["client_id"].(string); ok && clientID != "" {
+				return "client:" + clientID
+			}
+		}
+	}
+	if hasClientCert(r) {
+		hash := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		return "x5t#S256:" + base64.RawURLEncoding.EncodeToString(hash[:])
+	}
+	return "ip:" + clientIP(r)
+}
+
+// take spends a token from the key's bucket
+func (l *rateLimiter) take(key string) rateLimitDecision {
+	if l.rate == 0 {
+		return rateLimitDecision{allowed: true, remaining: -1}
+	}
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.sweep(now)
+		}
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.evictOldest()
+		}
+		bucket = &tokenBucket{tokens: l.burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate)
+	bucket.updated = now
+
+	decision := rateLimitDecision{allowed: bucket.tokens >= 1}
+	if decision.allowed {
+		bucket.tokens--
+	} else {
+		decision.retryAfter = l.refillTime(1 - bucket.tokens)
+		decision.reason = reasonRateLimited
+	}
+	decision.remaining = int(bucket.tokens)
+	decision.reset = l.refillTime(l.burst - bucket.tokens)
+	return decision
+}
+
+// refillTime is how long the bucket takes to gain tokens
+func (l *rateLimiter) refillTime(tokens float64) time.Duration {
+	return time.Duration(tokens / l.rate * float64(time.Second))
+}
+
+// sweep forgets buckets that have refilled, as they hold no state
+func (l *rateLimiter) sweep(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// evictOldest forgets the bucket that was used least recently
+func (l *rateLimiter) evictOldest() {
+	var oldestKey string
+	var oldest time.Time
+	for key, bucket := range l.buckets {
+		if oldestKey == "" || bucket.updated.Before(oldest) {
+			oldestKey, oldest = key, bucket.updated
+		}
+	}
+	delete(l.buckets, oldestKey)
+	rateLimitMetrics.Add("evicted", 1)
+}
+
+// countQuota adds the request to the key's daily quota. A quota backend that
+// cannot be reached lets requests through rather than blocking every client.
+func (l *rateLimiter) countQuota(ctx context.Context, key string) rateLimitDecision {
+	if l.quota == 0 {
+		return rateLimitDecision{allowed: true}
+	}
+	now := l.now().UTC()
+	count, err := l.quotas.increment(ctx, l.route+"|"+key, now.Format(time.DateOnly))
+	if err != nil {
+		slog.Error("Failed to count daily quota, allowing request", slog.String("error", err.Error()))
+		return rateLimitDecision{allowed: true}
+	}
+	if count > l.quota {
+		midnight := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, time.UTC)
+		return rateLimitDecision{retryAfter: midnight.Sub(now), reason: reasonQuotaExceeded}
+	}
+	return rateLimitDecision{allowed: true}
+}
+
+// enforceRateLimit answers 429 with Retry-After once a client has used up
+// its bucket or its daily quota, and reports the bucket in the RateLimit
+// headers. It runs after the route policy so the client_id is known.
+func enforceRateLimit(limiter *rateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := limiter.clientKey(r)
+		decision := limiter.take(key)
+		if decision.remaining >= 0 {
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(int(limiter.burst)))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(decision.remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(decision.reset.Seconds()))))
+		}
+		if decision.allowed {
+			decision = limiter.countQuota(r.Context(), key)
+		}
+		if !decision.allowed {
+			if decision.reason == reasonQuotaExceeded {
+				rateLimitMetrics.Add("quota_exceeded", 1)
+			} else {
+				rateLimitMetrics.Add("limited", 1)
+			}
+			slog.Error("Rate limited request, returning 429",
+				slog.String("route", limiter.route),
+				slog.String("client", key),
+				slog.String("reason", decision.reason),
+			)
+			retryAfter := math.Max(1, math.Ceil(decision.retryAfter.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter)))
+			http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testRateLimiter builds a limiter with its own quota store whose clock is *now
+func testRateLimiter(t *testing.T, config rateLimitConfig, now *time.Time) *rateLimiter {
+	t.Helper()
+	limiter, err := newRateLimiter("api", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	limiter.quotas = newMemoryQuotaStore()
+	limiter.now = func() time.Time { return *now }
+	return limiter
+}
+
+// failingQuotaStore is a shared backend that cannot be reached
+type failingQuotaStore struct{}
+
+func (failingQuotaStore) increment(context.Context, string, string) (int64, error) {
+	return 0, errors.New("connection refused")
+}
+
+func TestNewRateLimiterValidation(t *testing.T) {
+	for name, config := range map[string]rateLimitConfig{
+		"no limits":      {Burst: 5},
+		"negative rate":  {RequestsPerSecond: -1},
+		"negative quota": {DailyQuota: -1},
+		"unknown key":    {RequestsPerSecond: 1, Key: "ip"},
+	} {
+		if _, err := newRateLimiter("api", config); err == nil {
+			t.Errorf("%s: expected the limits to be rejected", name)
+		}
+	}
+	limiter, err := newRateLimiter("api", rateLimitConfig{RequestsPerSecond: 2.5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limiter.burst != 3 || limiter.key != rateLimitByClient {
+		t.Errorf("got burst %v and key %q, want defaults of 3 and client", limiter.burst, limiter.key)
+	}
+}
+
+func TestRateLimiterTokenBucket(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter := testRateLimiter(t, rateLimitConfig{RequestsPerSecond: 2, Burst: 3}, &now)
+
+	for i := 0; i < 3; i++ {
+		if d := limiter.take("client:a"); !d.allowed || d.remaining != 2-i {
+			t.Fatalf("request %d: got %+v", i, d)
+		}
+	}
+	d := limiter.take("client:a")
+	if d.allowed || d.retryAfter != 500*time.Millisecond || d.reset != 1500*time.Millisecond {
+		t.Fatalf("burst exhausted: got %+v", d)
+	}
+	if !limiter.take("client:b").allowed {
+		t.Error("another client shared the bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if !limiter.take("client:a").allowed {
+		t.Error("bucket did not refill")
+	}
+	if limiter.take("client:a").allowed {
+		t.Error("bucket refilled too fast")
+	}
+
+	// Idle clients are forgotten once their buckets are full again
+	now = now.Add(time.Minute)
+	limiter.sweep(now)
+	if len(limiter.buckets) != 0 {
+		t.Errorf("%d buckets left after sweeping", len(limiter.buckets))
+	}
+}
+
+func TestRateLimiterBucketCap(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	limiter := testRateLimiter(t, rateLimitConfig{RequestsPerSecond: 0.001, Burst: 1}, &now)
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		limiter.take(fmt.Sprintf("ip:%d", i))
+		now = now.Add(time.Millisecond)
+	}
+
+	// None has refilled, so the client heard from least recently makes way
+	limiter.take("ip:new")
+	if len(limiter.buckets) != maxRateLimitBuckets {
+		t.Fatalf("got %d buckets, want %d", len(limiter.buckets), maxRateLimitBuckets)
+	}
+	if _, ok := limiter.buckets["ip:0"]; ok {
+		t.Error("the oldest bucket was kept")
+	}
+	for _, key := range []string{"ip:1", fmt.Sprintf("ip:%d", maxRateLimitBuckets-1), "ip:new"} {
+		if _, ok := limiter.buckets[key]; !ok {
+			t.Errorf("bucket %s was evicted", key)
+		}
+	}
+}
+
+func TestRateLimiterDailyQuota(t *testing.T) {
+	now := time.Date(2024, 5, 1, 23, 59, 0, 0, time.UTC)
+	limiter := testRateLimiter(t, rateLimitConfig{DailyQuota: 2}, &now)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if !limiter.countQuota(ctx, "client:a").allowed {
+			t.Fatalf("request %d was over quota", i)
+		}
+	}
+	d := limiter.countQuota(ctx, "client:a")
+	if d.allowed || d.retryAfter != time.Minute {
+		t.Fatalf("over quota: got %+v", d)
+	}
+	if !limiter.countQuota(ctx, "client:b").allowed {
+		t.Error("another client shared the quota")
+	}
+
+	now = now.Add(time.Minute)
+	if !limiter.countQuota(ctx, "client:a").allowed {
+		t.Error("quota did not reset at midnight UTC")
+	}
+
+	limiter.quotas = failingQuotaStore{}
+	if !limiter.countQuota(ctx, "client:a").allowed {
+		t.Error("an unreachable quota backend blocked the request")
+	}
+}
+
+func TestEnforceRateLimit(t *testing.T) {
+	pki := newTestPKI(t)
+	bound := map[string]interface{}{"x5t#S256": thumbprint(pki.clientCert)}
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"first":  {"active": true, "client_id": "first", "cnf": bound},
+		"second": {"active": true, "client_id": "second", "cnf": bound},
+	})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+	previous := quotas
+	quotas = newMemoryQuotaStore()
+	t.Cleanup(func() { quotas = previous })
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{{
+		Name: "api", Host: "api.example", Auth: authToken,
+		RateLimit: &rateLimitConfig{RequestsPerSecond: 0.01, Burst: 2, DailyQuota: 3},
+		Upstreams: []upstreamConfig{{URL: upstream.URL}},
+	}}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+	client := testClient(ts, pki.clientCert)
+
+	call := func(token string) *http.Response {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req.Host = "api.example"
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	for i, want := range []string{"1", "0"} {
+		resp := call("first")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("request %d: got status %d", i, resp.StatusCode)
+		}
+		if resp.Header.Get("RateLimit-Limit") != "2" || resp.Header.Get("RateLimit-Remaining") != want {
+			t.Errorf("request %d: got RateLimit headers %v", i, resp.Header)
+		}
+	}
+	resp := call("first")
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want 429", resp.StatusCode)
+	}
+	if retryAfter, _ := strconv.Atoi(resp.Header.Get("Retry-After")); retryAfter < 90 || retryAfter > 100 {
+		t.Errorf("got Retry-After %q", resp.Header.Get("Retry-After"))
+	}
+
+	// The same certificate with another client_id has its own bucket
+	if resp := call("second"); resp.StatusCode != http.StatusOK {
+		t.Errorf("second client got status %d", resp.StatusCode)
+	}
+	// Unauthenticated requests are rejected before they count
+	if resp := call("unknown"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("invalid token got status %d", resp.StatusCode)
+	}
+}
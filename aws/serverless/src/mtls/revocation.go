@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// Revocation statuses
+const (
+	revocationGood    = "good"
+	revocationRevoked = "revoked"
+	revocationUnknown = "unknown"
+)
+
+// maxRevocationResponseSize bounds CRLs and OCSP responses read from the network
+const maxRevocationResponseSize = 10 << 20
+
+var errCertificateRevoked = errors.New("certificate has been revoked")
+
+// revocationChecker rejects client certificates that have been revoked,
+// asking the OCSP responder first and falling back to CRLs. When neither can
+// say whether a certificate is revoked the handshake fails if failClosed is
+// set and succeeds otherwise. Responses are cached until their next update.
+type revocationChecker struct {
+	ocspEnabled bool
+	ocspURL     string
+	fetchCRLs   bool
+	crlFiles    []string
+	failClosed  bool
+	defaultTTL  time.Duration
+	client      *http.Client
+	now         func() time.Time
+
+	mu        sync.Mutex
+	ocspCache map[string]ocspCacheEntry
+	// fileCRLs are loaded from crlFiles, dpCRLs from distribution points
+	fileCRLs []*x509.RevocationList
+	dpCRLs   map[string]*x509.RevocationList
+}
+
+type ocspCacheEntry struct {
+	status    string
+	expiresAt time.Time
+}
+
+// newRevocationChecker builds a checker. ocspURL, when set, overrides the
+// responder named in certificates.
+func newRevocationChecker(ocspEnabled bool, ocspURL string, fetchCRLs bool, crlFiles []string, failClosed bool, timeout time.Duration) (*revocationChecker, error) {
+	c := &revocationChecker{
+		ocspEnabled: ocspEnabled,
+		ocspURL:     ocspURL,
+		fetchCRLs:   fetchCRLs,
+		crlFiles:    crlFiles,
+		failClosed:  failClosed,
+		defaultTTL:  time.Hour,
+		client:      &http.Client{Timeout: timeout},
+		now:         time.Now,
+		ocspCache:   map[string]ocspCacheEntry{},
+		dpCRLs:      map[string]*x509.RevocationList{},
+	}
+	if err := c.loadCRLFiles(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// loadCRLFiles reads the configured CRL files, PEM or DER encoded
+func (c *revocationChecker) loadCRLFiles() error {
+	var crls []*x509.RevocationList
+	for _, path := range c.crlFiles {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, der := range crlBlocks(data) {
+			crl, err := x509.ParseRevocationList(der)
+			if err != nil {
+				return fmt.Errorf("invalid CRL in %s: %w", path, err)
+			}
+			crls = append(crls, crl)
+		}
+	}
+	c.mu.Lock()
+	c.fileCRLs = crls
+	c.mu.Unlock()
+	if len(c.crlFiles) > 0 {
+		slog.Info("loaded CRLs", slog.Int("crls", len(crls)))
+	}
+	return nil
+}
+
+// crlBlocks returns the DER CRLs in a PEM file, or the data itself if it is not PEM
+func crlBlocks(data []byte) [][]byte {
+	var blocks [][]byte
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type == "X509 CRL" {
+			blocks = append(blocks, block.Bytes)
+		}
+	}
+	if len(blocks) == 0 {
+		blocks = append(blocks, data)
+	}
+	return blocks
+}
+
+// watch reloads the CRL files every interval
+func (c *revocationChecker) watch(interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := c.loadCRLFiles(); err != nil {
+				slog.Error("Failed to reload CRLs, keeping the previous ones", slog.String("error", err.Error()))
+			}
+		case <-stop:
+			return
+		}
+	}
+}
+
+// verifyConnection is a tls.Config VerifyConnection hook. It runs after the
+// chain has been verified, and again whenever a session is resumed so a
+// certificate revoked since the full handshake is not let back in, and checks
+// every certificate in the chain but the root.
+func (c *revocationChecker) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.VerifiedChains) == 0 {
+		return nil
+	}
+	chain := cs.VerifiedChains[0]
+	for i := 0; i+1 < len(chain); i++ {
+		cert, issuer := chain[i], chain[i+1]
+		switch status := c.status(cert, issuer); status {
+		case revocationRevoked:
+			slog.Error("Rejected revoked client certificate",
+				slog.String("subject", cert.Subject.String()),
+				slog.String("serial", cert.SerialNumber.String()),
+			)
+			return errCertificateRevoked
+		case revocationUnknown:
+			if c.failClosed {
+				slog.Error("Rejected client certificate with unknown revocation status",
+					slog.String("subject", cert.Subject.String()),
+					slog.String("serial", cert.SerialNumber.String()),
+				)
+				return fmt.Errorf("unable to check revocation of %s", cert.Subject)
+			}
+			slog.Warn("Accepted client certificate with unknown revocation status",
+				slog.String("subject", cert.Subject.String()),
+				slog.String("serial", cert.SerialNumber.String()),
+			)
+		}
+	}
+	return nil
+}
+
+// status asks OCSP and then the CRLs whether cert has been revoked
+func (c *revocationChecker) status(cert, issuer *x509.Certificate) string {
+	if c.ocspEnabled {
+		if status := c.ocspStatus(cert, issuer); status != revocationUnknown {
+			return status
+		}
+	}
+	return c.crlStatus(cert, issuer)
+}
+
+// ocspStatus returns the cached OCSP status of cert or asks its responder
+func (c *revocationChecker) ocspStatus(cert, issuer *x509.Certificate) string {
+	responder := c.ocspURL
+	if responder == "" && len(cert.OCSPServer) > 0 {
+		responder = cert.OCSPServer[0]
+	}
+	if responder == "" {
+		return revocationUnknown
+	}
+
+	hash := sha256.New()
+	hash.Write(issuer.Raw)
+	hash.Write(cert.SerialNumber.Bytes())
+	key := hex.EncodeToString(hash.Sum(nil))
+	now := c.now()
+	c.mu.Lock()
+	entry, ok := c.ocspCache[key]
+	c.mu.Unlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry.status
+	}
+
+	response, err := c.fetchOCSP(responder, cert, issuer)
+	if err != nil {
+		slog.Error("OCSP request failed", slog.String("responder", responder), slog.String("error", err.Error()))
+		return revocationUnknown
+	}
+	if !response.NextUpdate.IsZero() && now.After(response.NextUpdate) {
+		slog.Error("OCSP response is stale", slog.String("responder", responder))
+		return revocationUnknown
+	}
+
+	var status string
+	switch response.Status {
+	case ocsp.Good:
+		status = revocationGood
+	case ocsp.Revoked:
+		status = revocationRevoked
+	default:
+		status = revocationUnknown
+	}
+	expiresAt := response.NextUpdate
+	if expiresAt.IsZero() || expiresAt.After(now.Add(c.defaultTTL)) {
+		expiresAt = now.Add(c.defaultTTL)
+	}
+	c.mu.Lock()
+	c.ocspCache[key] = ocspCacheEntry{status: status, expiresAt: expiresAt}
+	c.mu.Unlock()
+	return status
+}
+
+// fetchOCSP posts an OCSP request for cert and checks the response was
+// signed by its issuer or a responder the issuer delegated to
+func (c *revocationChecker) fetchOCSP(responder string, cert, issuer *x509.Certificate) (*ocsp.Response, error) {
+	request, err := ocsp.CreateRequest(cert, issuer, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Post(responder, "application/ocsp-request", bytes.NewReader(request))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("responder returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	return ocsp.ParseResponseForCert(body, cert, issuer)
+}
+
+// crlStatus looks for cert in a current CRL signed by its issuer, from the
+// configured files or the certificate's distribution points
+func (c *revocationChecker) crlStatus(cert, issuer *x509.Certificate) string {
+	now := c.now()
+	c.mu.Lock()
+	crls := append([]*x509.RevocationList{}, c.fileCRLs...)
+	for _, dp := range cert.CRLDistributionPoints {
+		if crl, ok := c.dpCRLs[dp]; ok && (crl.NextUpdate.IsZero() || now.Before(crl.NextUpdate)) {
+			crls = append(crls, crl)
+		}
+	}
+	c.mu.Unlock()
+
+	if crl := currentCRL(crls, issuer, now); crl != nil {
+		return crlEntryStatus(crl, cert)
+	}
+	if !c.fetchCRLs {
+		return revocationUnknown
+	}
+	for _, dp := range cert.CRLDistributionPoints {
+		crl, err := c.fetchCRL(dp)
+		if err != nil {
+			slog.Error("CRL download failed", slog.String("url", dp), slog.String("error", err.Error()))
+			continue
+		}
+		if currentCRL([]*x509.RevocationList{crl}, issuer, now) == nil {
+			slog.Error("CRL is stale or not signed by the issuer", slog.String("url", dp))
+			continue
+		}
+		c.mu.Lock()
+		c.dpCRLs[dp] = crl
+		c.mu.Unlock()
+		return crlEntryStatus(crl, cert)
+	}
+	return revocationUnknown
+}
+
+// currentCRL returns the first CRL issued by issuer that has not passed its
+// next update
+func currentCRL(crls []*x509.RevocationList, issuer *x509.Certificate, now time.Time) *x509.RevocationList {
+	for _, crl := range crls {
+		if !bytes.Equal(crl.RawIssuer, issuer.RawSubject) {
+			continue
+		}
+		if !crl.NextUpdate.IsZero() && now.After(crl.NextUpdate) {
+			continue
+		}
+		if crl.CheckSignatureFrom(issuer) != nil {
+			continue
+		}
+		return crl
+	}
+	return nil
+}
+
+func crlEntryStatus(crl *x509.RevocationList, cert *x509.Certificate) string {
+	for _, entry := range crl.RevokedCertificateEntries {
+		if entry.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+			return revocationRevoked
+		}
+	}
+	return revocationGood
+}
+
+// fetchCRL downloads a CRL from a distribution point
+func (c *revocationChecker) fetchCRL(url string) (*x509.RevocationList, error) {
+	resp, err := c.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("distribution point returned %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxRevocationResponseSize))
+	if err != nil {
+		return nil, err
+	}
+	blocks := crlBlocks(body)
+	return x509.ParseRevocationList(blocks[0])
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// issueRevocableCert issues a client certificate that names an OCSP
+// responder and a CRL distribution point
+func (p *testPKI) issueRevocableCert(t *testing.T, serial int64, ocspURL, crlURL string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "revocable.example.com", Organization: []string{"Test Participant"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if ocspURL != "" {
+		template.OCSPServer = []string{ocspURL}
+	}
+	if crlURL != "" {
+		template.CRLDistributionPoints = []string{crlURL}
+	}
+	return p.issue(t, template, key)
+}
+
+// crl signs a CRL revoking the given serials
+func (p *testPKI) crl(t *testing.T, nextUpdate time.Time, revoked ...int64) []byte {
+	t.Helper()
+	template := &x509.RevocationList{
+		Number:     big.NewInt(1),
+		ThisUpdate: time.Now().Add(-time.Minute),
+		NextUpdate: nextUpdate,
+	}
+	for _, serial := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   big.NewInt(serial),
+			RevocationTime: time.Now().Add(-time.Minute),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, p.ca, p.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// newOCSPResponder answers OCSP requests signed by the CA, revoking the
+// given serials, and counts the requests it receives
+func newOCSPResponder(t *testing.T, pki *testPKI, requests *atomic.Int32, revoked ...int64) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		body, _ := io.ReadAll(r.Body)
+		request, err := ocsp.ParseRequest(body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		template := ocsp.Response{
+			Status:       ocsp.Good,
+			SerialNumber: request.SerialNumber,
+			ThisUpdate:   time.Now().Add(-time.Minute),
+			NextUpdate:   time.Now().Add(time.Hour),
+		}
+		for _, serial := range revoked {
+			if request.SerialNumber.Cmp(big.NewInt(serial)) == 0 {
+				template.Status = ocsp.Revoked
+				template.RevokedAt = time.Now().Add(-time.Minute)
+			}
+		}
+		response, err := ocsp.CreateResponse(pki.ca, pki.ca, template, pki.caKey)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/ocsp-response")
+		w.Write(response)
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func newTestRevocationChecker(t *testing.T, fetchCRLs bool, crlFiles []string, failClosed bool) *revocationChecker {
+	t.Helper()
+	checker, err := newRevocationChecker(true, "", fetchCRLs, crlFiles, failClosed, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checker
+}
+
+func verifyWith(checker *revocationChecker, pki *testPKI, cert tls.Certificate) error {
+	return checker.verifyConnection(tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert.Leaf, pki.ca}}})
+}
+
+func TestRevocationOCSP(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests atomic.Int32
+	responder := newOCSPResponder(t, pki, &requests, 11)
+	good := pki.issueRevocableCert(t, 10, responder.URL, "")
+	revoked := pki.issueRevocableCert(t, 11, responder.URL, "")
+
+	checker := newTestRevocationChecker(t, false, nil, true)
+	if err := verifyWith(checker, pki, good); err != nil {
+		t.Errorf("good certificate rejected: %v", err)
+	}
+	if err := verifyWith(checker, pki, revoked); err != errCertificateRevoked {
+		t.Errorf("got %v, want errCertificateRevoked", err)
+	}
+
+	// Responses are cached until their next update
+	verifyWith(checker, pki, good)
+	verifyWith(checker, pki, revoked)
+	if n := requests.Load(); n != 2 {
+		t.Errorf("responder was asked %d times, want 2", n)
+	}
+	checker.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	verifyWith(checker, pki, good)
+	if n := requests.Load(); n != 3 {
+		t.Errorf("responder was asked %d times after the cache expired, want 3", n)
+	}
+}
+
+func TestRevocationOCSPRejectsResponsesFromOtherSigners(t *testing.T) {
+	pki := newTestPKI(t)
+	other := newTestPKI(t)
+	var requests atomic.Int32
+	responder := newOCSPResponder(t, other, &requests)
+	cert := pki.issueRevocableCert(t, 10, responder.URL, "")
+
+	checker := newTestRevocationChecker(t, false, nil, true)
+	if err := verifyWith(checker, pki, cert); err == nil {
+		t.Fatal("expected a response signed by another CA to be ignored")
+	}
+}
+
+func TestRevocationCRLFile(t *testing.T) {
+	pki := newTestPKI(t)
+	good := pki.issueRevocableCert(t, 10, "", "")
+	revoked := pki.issueRevocableCert(t, 11, "", "")
+
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	crl := pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: pki.crl(t, time.Now().Add(time.Hour), 11)})
+	if err := os.WriteFile(path, crl, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	checker := newTestRevocationChecker(t, false, []string{path}, true)
+	if err := verifyWith(checker, pki, good); err != nil {
+		t.Errorf("good certificate rejected: %v", err)
+	}
+	if err := verifyWith(checker, pki, revoked); err != errCertificateRevoked {
+		t.Errorf("got %v, want errCertificateRevoked", err)
+	}
+
+	// A stale CRL says nothing
+	checker.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if err := verifyWith(checker, pki, good); err == nil {
+		t.Error("expected a stale CRL to leave the status unknown")
+	}
+
+	// A CRL from another CA says nothing about this one's certificates
+	other := newTestPKI(t)
+	os.WriteFile(path, other.crl(t, time.Now().Add(time.Hour), 11), 0o600)
+	checker = newTestRevocationChecker(t, false, []string{path}, true)
+	if err := verifyWith(checker, pki, revoked); err == errCertificateRevoked || err == nil {
+		t.Errorf("got %v, want an unknown status", err)
+	}
+}
+
+func TestRevocationCRLDistributionPoint(t *testing.T) {
+	pki := newTestPKI(t)
+	var downloads atomic.Int32
+	crl := pki.crl(t, time.Now().Add(time.Hour), 11)
+	dp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downloads.Add(1)
+		w.Write(crl)
+	}))
+	t.Cleanup(dp.Close)
+	good := pki.issueRevocableCert(t, 10, "", dp.URL)
+	revoked := pki.issueRevocableCert(t, 11, "", dp.URL)
+
+	checker := newTestRevocationChecker(t, true, nil, true)
+	if err := verifyWith(checker, pki, good); err != nil {
+		t.Errorf("good certificate rejected: %v", err)
+	}
+	if err := verifyWith(checker, pki, revoked); err != errCertificateRevoked {
+		t.Errorf("got %v, want errCertificateRevoked", err)
+	}
+	if n := downloads.Load(); n != 1 {
+		t.Errorf("CRL was downloaded %d times, want 1", n)
+	}
+}
+
+func TestRevocationFailMode(t *testing.T) {
+	pki := newTestPKI(t)
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(broken.Close)
+	cert := pki.issueRevocableCert(t, 10, broken.URL, broken.URL)
+
+	if err := verifyWith(newTestRevocationChecker(t, true, nil, false), pki, cert); err != nil {
+		t.Errorf("fail open rejected the certificate: %v", err)
+	}
+	if err := verifyWith(newTestRevocationChecker(t, true, nil, true), pki, cert); err == nil {
+		t.Error("fail closed accepted the certificate")
+	}
+}
+
+func TestRevocationHandshake(t *testing.T) {
+	pki := newTestPKI(t)
+	var requests atomic.Int32
+	responder := newOCSPResponder(t, pki, &requests, 11)
+	good := pki.issueRevocableCert(t, 10, responder.URL, "")
+	revoked := pki.issueRevocableCert(t, 11, responder.URL, "")
+
+	checker := newTestRevocationChecker(t, false, nil, true)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{
+		ClientCAs:        pki.pool,
+		ClientAuth:       tls.VerifyClientCertIfGiven,
+		VerifyConnection: checker.verifyConnection,
+	}
+	ts.StartTLS()
+	t.Cleanup(ts.Close)
+
+	resp, err := testClient(ts, good).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("good certificate was rejected: %v", err)
+	}
+	resp.Body.Close()
+	resp, err = testClient(ts).Get(ts.URL)
+	if err != nil {
+		t.Fatalf("connection without a certificate was rejected: %v", err)
+	}
+	resp.Body.Close()
+	if _, err := testClient(ts, revoked).Get(ts.URL); err == nil {
+		t.Fatal("revoked certificate completed the handshake")
+	}
+}
+
+func TestRevocationResumedSession(t *testing.T) {
+	pki := newTestPKI(t)
+	dir := t.TempDir()
+	crlPath := filepath.Join(dir, "ca.crl")
+	writeFile(t, crlPath, pki.crl(t, time.Now().Add(time.Hour)))
+	checker := newTestRevocationChecker(t, false, []string{crlPath}, true)
+
+	caPath := filepath.Join(dir, "ca.crt")
+	writeCABundle(t, caPath, pki)
+	store, err := loadCertificateStore(caPath, []certificatePair{writeServerCert(t, dir, "api.example", 1, pki.ca, pki.caKey, "ec")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := serveCertificateStore(t, store, checker.verifyConnection)
+
+	cert := pki.issueRevocableCert(t, 10, "", "")
+	client := &http.Client{Transport: &http.Transport{
+		DisableKeepAlives: true,
+		TLSClientConfig: &tls.Config{
+			RootCAs:            pki.pool,
+			ServerName:         "api.example",
+			Certificates:       []tls.Certificate{cert},
+			ClientSessionCache: tls.NewLRUClientSessionCache(1),
+		},
+	}}
+	get := func() (*http.Response, error) {
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return resp, err
+	}
+	if _, err := get(); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := get()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resp.TLS.DidResume {
+		t.Fatal("second connection did not resume the session")
+	}
+
+	// A session established before the certificate was revoked is not resumed
+	writeFile(t, crlPath, pki.crl(t, time.Now().Add(time.Hour), 10))
+	if err := checker.loadCRLFiles(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := get(); err == nil {
+		t.Error("revoked certificate resumed its session")
+	}
+}
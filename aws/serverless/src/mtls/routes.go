@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Route auth modes
+const (
+	// authNone proxies requests as they are, for example to the authorization server
+	authNone = "none"
+	// authMTLS requires a client certificate
+	authMTLS = "mtls"
+	// authToken requires an access token, by default bound to a client certificate
+	authToken = "token"
+)
+
+// routingConfig is the routing table, loaded from ROUTES_FILE
+type routingConfig struct {
+	Routes []routeConfig `json:"routes"`
+}
+
+// routeConfig sends requests for a host, and optionally a path prefix under
+// it, to one of its upstreams
+type routeConfig struct {
+	Name       string `json:"name"`
+	Host       string `json:"host"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Auth       string `json:"auth"`
+	// RequireClientCert and RequireBoundToken apply to token routes and
+	// default to true
+	RequireClientCert *bool `json:"require_client_cert,omitempty"`
+	RequireBoundToken *bool `json:"require_bound_token,omitempty"`
+	// Timeout bounds the whole exchange with the upstream, such as "30s"
+	Timeout   string           `json:"timeout,omitempty"`
+	RateLimit *rateLimitConfig `json:"rate_limit,omitempty"`
+	// PreserveHost sends upstreams the Host the client asked for rather than
+	// the upstream's own, and defaults to true
+	PreserveHost *bool `json:"preserve_host,omitempty"`
+	// Audit writes a record of every call to the audit sink
+	Audit           bool             `json:"audit,omitempty"`
+	RequestHeaders  *headerRewrite   `json:"request_headers,omitempty"`
+	ResponseHeaders *headerRewrite   `json:"response_headers,omitempty"`
+	Upstreams       []upstreamConfig `json:"upstreams"`
+}
+
+// headerRewrite sets and removes headers on the way to or from the upstream
+type headerRewrite struct {
+	Set    map[string]string `json:"set,omitempty"`
+	Remove []string          `json:"remove,omitempty"`
+}
+
+// upstreamConfig is a backend for a route. Requests are spread across a
+// route's upstreams in proportion to their weights, so a canary can take a
+// small share of traffic.
+type upstreamConfig struct {
+	URL    string `json:"url"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+// route is a routeConfig ready to serve
+type route struct {
+	config       routeConfig
+	policy       routePolicy
+	preserveHost bool
+	timeout      time.Duration
+	limiter      *rateLimiter
+	upstreams    []*url.URL
+	weights      []int
+	total        int
+}
+
+// loadRoutingConfig reads the routing table from path or, when path is
+// empty, builds the auth and API routes from the environment
+func loadRoutingConfig(path string) (routingConfig, error) {
+	if path == "" {
+		return defaultRoutingConfig(), nil
+	}
+	var config routingConfig
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, fmt.Errorf("invalid routes file %s: %w", path, err)
+	}
+	return config, nil
+}
+
+// defaultRoutingConfig is the original pair of routes: the authorization
+// server, open to all, and the API, behind certificate-bound tokens
+func defaultRoutingConfig() routingConfig {
+	authMode := authNone
+	if getEnvBool("AUTH_REQUIRE_CLIENT_CERT", false) {
+		authMode = authMTLS
+	}
+	requireClientCert := getEnvBool("API_REQUIRE_CLIENT_CERT", true)
+	requireBoundToken := getEnvBool("API_REQUIRE_BOUND_TOKEN", true)
+	var apiRateLimit *rateLimitConfig
+	if rps, quota := getEnvInt("API_RATE_LIMIT", 0), getEnvInt("API_DAILY_QUOTA", 0); rps > 0 || quota > 0 {
+		apiRateLimit = &rateLimitConfig{
+			RequestsPerSecond: float64(rps),
+			Burst:             getEnvInt("API_RATE_LIMIT_BURST", 0),
+			DailyQuota:        int64(quota),
+		}
+	}
+	return routingConfig{Routes: []routeConfig{
+		{
+			Name:      "auth",
+			Host:      getEnv("EXTERNAL_AUTH_HOST", "auth.localhost"),
+			Auth:      authMode,
+			Upstreams: []upstreamConfig{{URL: getEnv("AUTH_HOST", "http://auth.localhost:3000")}},
+		},
+		{
+			Name:              "api",
+			Host:              getEnv("INTERNAL_AUTH_HOST", "api.localhost"),
+			Auth:              authToken,
+			RequireClientCert: &requireClientCert,
+			RequireBoundToken: &requireBoundToken,
+			RateLimit:         apiRateLimit,
+			Audit:             true,
+			Upstreams:         []upstreamConfig{{URL: getEnv("API_HOST", "http://localhost:8080")}},
+		},
+	}}
+}
+
+// newRoute checks a route's configuration and prepares it to serve
+func newRoute(config routeConfig) (*route, error) {
+	if config.Name == "" {
+		return nil, fmt.Errorf("route for host %q has no name", config.Host)
+	}
+	config.Host = strings.TrimSuffix(config.Host, "/")
+	if config.Host == "" || strings.ContainsAny(config.Host, "/{}") {
+		return nil, fmt.Errorf("route %s: invalid host %q", config.Name, config.Host)
+	}
+	if config.PathPrefix == "" {
+		config.PathPrefix = "/"
+	}
+	if !strings.HasPrefix(config.PathPrefix, "/") || strings.ContainsAny(config.PathPrefix, "{}") {
+		return nil, fmt.Errorf("route %s: path_prefix %q must start with /", config.Name, config.PathPrefix)
+	}
+	if !strings.HasSuffix(config.PathPrefix, "/") {
+		config.PathPrefix += "/"
+	}
+	r := &route{config: config, preserveHost: config.PreserveHost == nil || *config.PreserveHost}
+
+	switch config.Auth {
+	case authNone:
+	case authMTLS:
+		r.policy = routePolicy{RequireClientCert: true}
+	case authToken:
+		r.policy = routePolicy{
+			RequireClientCert:  config.RequireClientCert == nil || *config.RequireClientCert,
+			RequireAccessToken: true,
+			RequireBoundToken:  config.RequireBoundToken == nil || *config.RequireBoundToken,
+		}
+	default:
+		return nil, fmt.Errorf("route %s: auth must be none, mtls or token, not %q", config.Name, config.Auth)
+	}
+
+	if config.Timeout != "" {
+		timeout, err := time.ParseDuration(config.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("route %s: invalid timeout %q", config.Name, config.Timeout)
+		}
+		r.timeout = timeout
+	}
+
+	if config.RateLimit != nil {
+		limiter, err := newRateLimiter(config.Name, *config.RateLimit)
+		if err != nil {
+			return nil, err
+		}
+		r.limiter = limiter
+	}
+
+	if len(config.Upstreams) == 0 {
+		return nil, fmt.Errorf("route %s has no upstreams", config.Name)
+	}
+	for _, upstream := range config.Upstreams {
+		target, err := url.Parse(upstream.URL)
+		if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, fmt.Errorf("route %s: invalid upstream url %q", config.Name, upstream.URL)
+		}
+		weight := upstream.Weight
+		if weight == 0 {
+			weight = 1
+		}
+		if weight < 0 {
+			return nil, fmt.Errorf("route %s: upstream %s has a negative weight", config.Name, upstream.URL)
+		}
+		r.upstreams = append(r.upstreams, target)
+		r.weights = append(r.weights, weight)
+		r.total += weight
+	}
+	return r, nil
+}
+
+// pattern is the ServeMux pattern the route is mounted on
+func (r *route) pattern() string {
+	return r.config.Host + r.config.PathPrefix
+}
+
+// pick chooses an upstream at random in proportion to the weights
+func (r *route) pick() *url.URL {
+	if len(r.upstreams) == 1 {
+		return r.upstreams[0]
+	}
+	n := rand.IntN(r.total)
+	for i, weight := range r.weights {
+		if n < weight {
+			return r.upstreams[i]
+		}
+		n -= weight
+	}
+	return r.upstreams[len(r.upstreams)-1]
+}
+
+// apply rewrites headers as configured
+func (h *headerRewrite) apply(header http.Header) {
+	if h == nil {
+		return
+	}
+	for _, name := range h.Remove {
+		header.Del(name)
+	}
+	for name, value := range h.Set {
+		header.Set(name, value)
+	}
+}
+
+// handler builds the proxy for the route, wrapped in its auth requirements
+// and limits and, for token routes, the access policy. Headers the proxy owns are
+// stripped from the request first.
+func (r *route) handler(log *slog.Logger, policies *policyFile) http.Handler {
+	proxy := &httputil.ReverseProxy{
+		Transport:    upstreamTransport,
+		ErrorHandler: proxyErrorHandler(r.config.Name),
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			rewriteUpstream(pr, r.pick(), r.preserveHost)
+			r.config.RequestHeaders.apply(pr.Out.Header)
+		},
+		ModifyResponse: func(resp *http.Response) error {
+			r.config.ResponseHeaders.apply(resp.Header)
+			return nil
+		},
+	}
+
+	var h http.Handler = proxy
+	if policies != nil && r.policy.RequireAccessToken {
+		h = enforceAccessPolicy(policies, h)
+	}
+	if r.timeout > 0 {
+		h = withTimeout(r.timeout, h)
+	}
+	if r.limiter != nil {
+		h = enforceRateLimit(r.limiter, h)
+	}
+	// Rejected requests are logged, and audited, too, so both wrap the policy
+	if auditLog == nil || !r.config.Audit {
+		return stripProxyHeaders(traceRequests(accessLogger(log, enforceRoutePolicy(r.policy, h))))
+	}
+	h = enforceRoutePolicy(r.policy, recordAuditIdentity(h))
+	return stripProxyHeaders(traceRequests(accessLogger(log, auditRequests(r.config.Name, auditLog, auditRedaction, h))))
+}
+
+// withTimeout cancels the upstream request once the timeout has passed
+func withTimeout(timeout time.Duration, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// newRouter mounts every route on a mux keyed by host and path prefix
+func newRouter(config routingConfig, log *slog.Logger, policies *policyFile) (*http.ServeMux, error) {
+	mux := http.NewServeMux()
+	seen := map[string]string{}
+	for _, rc := range config.Routes {
+		r, err := newRoute(rc)
+		if err != nil {
+			return nil, err
+		}
+		if other, ok := seen[r.pattern()]; ok {
+			return nil, fmt.Errorf("routes %s and %s both match %s", other, r.config.Name, r.pattern())
+		}
+		seen[r.pattern()] = r.config.Name
+		mux.Handle(r.pattern(), r.handler(log, policies))
+		log.Info("mounted route",
+			slog.String("name", r.config.Name),
+			slog.String("pattern", r.pattern()),
+			slog.String("auth", r.config.Auth),
+			slog.Int("upstreams", len(r.upstreams)),
+		)
+	}
+	return mux, nil
+}
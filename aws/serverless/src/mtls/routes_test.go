@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newNamedUpstream answers every request with its name and echoes the
+// X-Service header back
+func newNamedUpstream(t *testing.T, name string) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Upstream", name)
+		w.Header().Set("X-Service", r.Header.Get("X-Service"))
+		w.Header().Set("Server", "upstream")
+		w.Write([]byte(name))
+	}))
+	t.Cleanup(ts.Close)
+	return ts
+}
+
+func TestNewRouteValidation(t *testing.T) {
+	upstreams := []upstreamConfig{{URL: "http://api:8080"}}
+	tests := map[string]routeConfig{
+		"missing name":    {Host: "api.localhost", Auth: authNone, Upstreams: upstreams},
+		"missing host":    {Name: "api", Auth: authNone, Upstreams: upstreams},
+		"host with path":  {Name: "api", Host: "api.localhost/v1", Auth: authNone, Upstreams: upstreams},
+		"relative prefix": {Name: "api", Host: "api.localhost", PathPrefix: "v1/", Auth: authNone, Upstreams: upstreams},
+		"unknown auth":    {Name: "api", Host: "api.localhost", Auth: "basic", Upstreams: upstreams},
+		"invalid timeout": {Name: "api", Host: "api.localhost", Auth: authNone, Timeout: "soon", Upstreams: upstreams},
+		"no upstreams":    {Name: "api", Host: "api.localhost", Auth: authNone},
+		"relative url":    {Name: "api", Host: "api.localhost", Auth: authNone, Upstreams: []upstreamConfig{{URL: "api:8080"}}},
+		"negative weight": {Name: "api", Host: "api.localhost", Auth: authNone, Upstreams: []upstreamConfig{{URL: "http://api:8080", Weight: -1}}},
+		"missing auth":    {Name: "api", Host: "api.localhost", Upstreams: upstreams},
+	}
+	for name, config := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := newRoute(config); err == nil {
+				t.Fatal("expected the route to be rejected")
+			}
+		})
+	}
+
+	r, err := newRoute(routeConfig{Name: "api", Host: "api.localhost", PathPrefix: "/v1", Auth: authToken, Upstreams: upstreams})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.pattern() != "api.localhost/v1/" {
+		t.Errorf("got pattern %q", r.pattern())
+	}
+	if !r.policy.RequireClientCert || !r.policy.RequireAccessToken || !r.policy.RequireBoundToken {
+		t.Errorf("token routes should default to certificate-bound tokens, got %+v", r.policy)
+	}
+}
+
+func TestNewRouterRejectsDuplicatePatterns(t *testing.T) {
+	upstreams := []upstreamConfig{{URL: "http://api:8080"}}
+	config := routingConfig{Routes: []routeConfig{
+		{Name: "one", Host: "api.localhost", PathPrefix: "/v1", Auth: authNone, Upstreams: upstreams},
+		{Name: "two", Host: "api.localhost", PathPrefix: "/v1/", Auth: authNone, Upstreams: upstreams},
+	}}
+	if _, err := newRouter(config, discardLogger(), nil); err == nil {
+		t.Fatal("expected duplicate routes to be rejected")
+	}
+}
+
+func TestLoadRoutingConfig(t *testing.T) {
+	config, err := loadRoutingConfig("routes.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newRouter(config, discardLogger(), nil); err != nil {
+		t.Fatalf("example routes are invalid: %v", err)
+	}
+	// Nothing on the API host is reachable with a client certificate alone
+	for _, r := range config.Routes {
+		if r.Host == "api.localhost" && r.Auth != authToken {
+			t.Errorf("route %s uses %q auth, want %q", r.Name, r.Auth, authToken)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "routes.json")
+	os.WriteFile(path, []byte(`{"routes": [`), 0o600)
+	if _, err := loadRoutingConfig(path); err == nil {
+		t.Fatal("expected malformed routes to be rejected")
+	}
+}
+
+func TestDefaultRoutingConfig(t *testing.T) {
+	t.Setenv("EXTERNAL_AUTH_HOST", "auth.example")
+	t.Setenv("INTERNAL_AUTH_HOST", "api.example")
+	t.Setenv("AUTH_HOST", "http://op:3000")
+	t.Setenv("API_HOST", "http://api:8080")
+	t.Setenv("API_REQUIRE_BOUND_TOKEN", "false")
+
+	config, err := loadRoutingConfig("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := newRoute(config.Routes[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := newRoute(config.Routes[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if auth.pattern() != "auth.example/" || auth.policy != (routePolicy{}) || auth.upstreams[0].Host != "op:3000" {
+		t.Errorf("unexpected auth route %+v", auth)
+	}
+	want := routePolicy{RequireClientCert: true, RequireAccessToken: true}
+	if api.pattern() != "api.example/" || api.policy != want || api.upstreams[0].Host != "api:8080" {
+		t.Errorf("unexpected api route %+v", api)
+	}
+}
+
+func TestRoutePickHonoursWeights(t *testing.T) {
+	r, err := newRoute(routeConfig{
+		Name: "api", Host: "api.localhost", Auth: authNone,
+		Upstreams: []upstreamConfig{
+			{URL: "http://stable:8080", Weight: 9},
+			{URL: "http://canary:8080", Weight: 1},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const picks = 10000
+	canary := 0
+	for i := 0; i < picks; i++ {
+		if r.pick().Host == "canary:8080" {
+			canary++
+		}
+	}
+	if share := float64(canary) / picks; math.Abs(share-0.1) > 0.02 {
+		t.Errorf("canary took %.3f of traffic, want about 0.1", share)
+	}
+}
+
+func TestRouterRoutesByHostAndPath(t *testing.T) {
+	pki := newTestPKI(t)
+	client := pki.issueClientCert(t, "client", 1)
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"bound": {"active": true, "client_id": "client", "cnf": map[string]interface{}{"x5t#S256": thumbprint(client)}},
+	})
+	auth := newNamedUpstream(t, "auth")
+	telephony := newNamedUpstream(t, "telephony")
+	portal := newNamedUpstream(t, "portal")
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	config := routingConfig{Routes: []routeConfig{
+		{Name: "auth", Host: "auth.example", Auth: authNone, Upstreams: []upstreamConfig{{URL: auth.URL}}},
+		{
+			Name: "telephony", Host: "api.example", PathPrefix: "/telephony", Auth: authToken,
+			RequestHeaders:  &headerRewrite{Set: map[string]string{"X-Service": "telephony"}},
+			ResponseHeaders: &headerRewrite{Remove: []string{"Server"}, Set: map[string]string{"X-Route": "telephony"}},
+			Upstreams:       []upstreamConfig{{URL: telephony.URL}},
+		},
+		{Name: "portal", Host: "api.example", Auth: authMTLS, Upstreams: []upstreamConfig{{URL: portal.URL}}},
+		{Name: "slow", Host: "slow.example", Auth: authNone, Timeout: "50ms", Upstreams: []upstreamConfig{{URL: slow.URL}}},
+	}}
+	mux, err := newRouter(config, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+
+	tests := []struct {
+		name     string
+		host     string
+		path     string
+		token    string
+		withCert bool
+		status   int
+		upstream string
+	}{
+		{name: "auth without certificate", host: "auth.example", path: "/token", status: http.StatusOK, upstream: "auth"},
+		{name: "token route", host: "api.example", path: "/telephony/score", token: "bound", withCert: true, status: http.StatusOK, upstream: "telephony"},
+		{name: "token route without token", host: "api.example", path: "/telephony/score", withCert: true, status: http.StatusUnauthorized},
+		{name: "mtls route", host: "api.example", path: "/accounts", withCert: true, status: http.StatusOK, upstream: "portal"},
+		{name: "mtls route without certificate", host: "api.example", path: "/accounts", status: http.StatusUnauthorized},
+		{name: "unknown host", host: "other.example", path: "/", status: http.StatusNotFound},
+		{name: "upstream timeout", host: "slow.example", path: "/", status: http.StatusGatewayTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := testClient(ts)
+			if tt.withCert {
+				c = testClient(ts, client)
+			}
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+tt.path, nil)
+			req.Host = tt.host
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			resp, err := c.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got status %d, want %d: %s", resp.StatusCode, tt.status, body)
+			}
+			if tt.upstream != "" && resp.Header.Get("X-Upstream") != tt.upstream {
+				t.Errorf("routed to %q, want %q", resp.Header.Get("X-Upstream"), tt.upstream)
+			}
+			if tt.upstream == "telephony" {
+				if resp.Header.Get("X-Service") != "telephony" {
+					t.Error("request header was not set")
+				}
+				if resp.Header.Get("Server") != "" || resp.Header.Get("X-Route") != "telephony" {
+					t.Errorf("response headers were not rewritten: %v", resp.Header)
+				}
+			}
+		})
+	}
+}
+
+// logLines passes each line written to it on to a channel
+type logLines chan []byte
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- append([]byte(nil), p...)
+	return len(p), nil
+}
+
+func TestRouterAccessLogsRejectedRequests(t *testing.T) {
+	pki := newTestPKI(t)
+	newIntrospectionServer(t, map[string]map[string]interface{}{
+		"bound": {"active": true, "client_id": "client", "cnf": map[string]interface{}{"x5t#S256": thumbprint(pki.clientCert)}},
+	})
+	upstream := newNamedUpstream(t, "api")
+	previous := quotas
+	quotas = newMemoryQuotaStore()
+	t.Cleanup(func() { quotas = previous })
+	lines := make(logLines, 10)
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{{
+		Name: "api", Host: "api.example", Auth: authToken,
+		RateLimit: &rateLimitConfig{RequestsPerSecond: 0.01, Burst: 1},
+		Upstreams: []upstreamConfig{{URL: upstream.URL}},
+	}}}, slog.New(slog.NewJSONHandler(lines, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Skip the routes being mounted
+	for len(lines) > 0 {
+		<-lines
+	}
+	ts := serveTestTLS(t, pki, mux)
+	client := testClient(ts, pki.clientCert)
+
+	for _, tt := range []struct {
+		token  string
+		status int
+	}{
+		{"", http.StatusUnauthorized},
+		{"bound", http.StatusOK},
+		{"bound", http.StatusTooManyRequests},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+		req.Host = "api.example"
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Fatalf("got status %d, want %d", resp.StatusCode, tt.status)
+		}
+
+		var entry map[string]interface{}
+		select {
+		case line := <-lines:
+			if err := json.Unmarshal(line, &entry); err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no access log entry for a %d", tt.status)
+		}
+		if entry["status"] != strconv.Itoa(tt.status) || entry["requestID"] != resp.Header.Get(requestIDHeader) {
+			t.Errorf("got access log entry %v for a %d with request ID %s", entry, tt.status, resp.Header.Get(requestIDHeader))
+		}
+	}
+}
+
+func TestHeaderRewriteRemovesBeforeSetting(t *testing.T) {
+	header := http.Header{"X-Service": {"spoofed"}, "X-Debug": {"1"}}
+	(&headerRewrite{Remove: []string{"x-debug", "X-Service"}, Set: map[string]string{"X-Service": "bank"}}).apply(header)
+	if header.Get("X-Debug") != "" || header.Get("X-Service") != "bank" {
+		t.Errorf("got %v", header)
+	}
+	var none *headerRewrite
+	none.apply(header)
+	if header.Get("X-Service") != "bank" {
+		t.Error("nil rewrite changed headers")
+	}
+}
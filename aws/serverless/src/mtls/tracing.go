@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// requestIDHeader carries the request ID from clients, to upstreams and back
+const requestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds request IDs taken from clients, as they are logged
+const maxRequestIDLength = 128
+
+// traceContext is a W3C Trace Context (traceparent) with the proxy's own span
+type traceContext struct {
+	traceID string
+	spanID  string
+	flags   string
+}
+
+// traceparent formats the context for the traceparent header, naming the
+// proxy's span as the parent of the next hop
+func (t traceContext) traceparent() string {
+	return "00-" + t.traceID + "-" + t.spanID + "-" + t.flags
+}
+
+// parseTraceparent reads a traceparent header. Versions after 00 may add
+// fields, which are ignored.
+func parseTraceparent(value string) (traceContext, bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) < 4 {
+		return traceContext{}, false
+	}
+	version, traceID, parentID, flags := parts[0], parts[1], parts[2], parts[3]
+	if !isLowerHex(version, 2) || version == "ff" || (version == "00" && len(parts) != 4) {
+		return traceContext{}, false
+	}
+	if !isLowerHex(traceID, 32) || traceID == strings.Repeat("0", 32) {
+		return traceContext{}, false
+	}
+	if !isLowerHex(parentID, 16) || parentID == strings.Repeat("0", 16) {
+		return traceContext{}, false
+	}
+	if !isLowerHex(flags, 2) {
+		return traceContext{}, false
+	}
+	return traceContext{traceID: traceID, spanID: parentID, flags: flags}, true
+}
+
+func isLowerHex(s string, length int) bool {
+	if len(s) != length {
+		return false
+	}
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validRequestID accepts client request IDs that are safe to log and forward
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// randomHex returns n random bytes as hex
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newRequestID returns a random 128-bit identifier
+func newRequestID() string {
+	return randomHex(16)
+}
+
+// requestIDKey is the context key for the request ID
+type requestIDKey struct{}
+
+func requestIDFromContext(ctx context.Context) (string, bool) {
+	id, ok := ctx.Value(requestIDKey{}).(string)
+	return id, ok
+}
+
+// traceContextKey is the context key for the request's trace context
+type traceContextKey struct{}
+
+func traceContextFromContext(ctx context.Context) (traceContext, bool) {
+	trace, ok := ctx.Value(traceContextKey{}).(traceContext)
+	return trace, ok
+}
+
+// traceRequests gives every request an ID, taken from X-Request-ID when the
+// client sent a usable one, and joins the client's trace or starts a new
+// one. The ID is returned to the client in X-Request-ID.
+func traceRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID(requestID) {
+			requestID = newRequestID()
+		}
+		trace, ok := parseTraceparent(r.Header.Get("traceparent"))
+		if ok {
+			trace.spanID = randomHex(8)
+		} else {
+			// tracestate belongs to the trace that could not be read
+			r.Header.Del("tracestate")
+			trace = traceContext{traceID: randomHex(16), spanID: randomHex(8), flags: "00"}
+		}
+
+		w.Header().Set(requestIDHeader, requestID)
+		ctx := context.WithValue(r.Context(), requestIDKey{}, requestID)
+		ctx = context.WithValue(ctx, traceContextKey{}, trace)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// setTraceHeaders passes the request ID and trace of ctx on to an upstream
+// or the OP
+func setTraceHeaders(ctx context.Context, header http.Header) {
+	if requestID, ok := requestIDFromContext(ctx); ok {
+		header.Set(requestIDHeader, requestID)
+	}
+	if trace, ok := traceContextFromContext(ctx); ok {
+		header.Set("traceparent", trace.traceparent())
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseTraceparent(t *testing.T) {
+	const traceID, parentID = "4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"00-" + traceID + "-" + parentID + "-01", true},
+		{"01-" + traceID + "-" + parentID + "-01-future", true},
+		{"00-" + traceID + "-" + parentID + "-01-extra", false},
+		{"ff-" + traceID + "-" + parentID + "-01", false},
+		{"00-" + strings.ToUpper(traceID) + "-" + parentID + "-01", false},
+		{"00-" + strings.Repeat("0", 32) + "-" + parentID + "-01", false},
+		{"00-" + traceID + "-" + strings.Repeat("0", 16) + "-01", false},
+		{"00-" + traceID + "-" + parentID, false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		trace, ok := parseTraceparent(tt.value)
+		if ok != tt.ok {
+			t.Errorf("%q: got ok %v", tt.value, ok)
+			continue
+		}
+		if ok && (trace.traceID != traceID || trace.spanID != parentID || trace.flags != "01") {
+			t.Errorf("%q: got %+v", tt.value, trace)
+		}
+	}
+}
+
+func TestTraceRequests(t *testing.T) {
+	pki := newTestPKI(t)
+	introspected := make(chan http.Header, 1)
+	op := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		introspected <- r.Header.Clone()
+		body, _ := json.Marshal(map[string]interface{}{
+			"active": true, "client_id": "client", "cnf": map[string]interface{}{"x5t#S256": thumbprint(pki.clientCert)},
+		})
+		w.Write(body)
+	}))
+	t.Cleanup(op.Close)
+	t.Setenv("INTROSPECTION_URL", op.URL)
+	// Every request introspects, so each one reaches the OP
+	useIntrospectionCache(t, newIntrospectionCache(0, 0, 100))
+
+	received := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	}))
+	t.Cleanup(upstream.Close)
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{{
+		Name: "api", Host: "api.example", Auth: authToken,
+		Upstreams: []upstreamConfig{{URL: upstream.URL}},
+	}}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+	client := testClient(ts, pki.clientCert)
+
+	const inboundTrace = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	tests := []struct {
+		name        string
+		requestID   string
+		traceparent string
+		wantID      string
+		joinsTrace  bool
+	}{
+		{name: "client IDs", requestID: "abc-123", traceparent: inboundTrace, wantID: "abc-123", joinsTrace: true},
+		{name: "no IDs"},
+		{name: "unusable IDs", requestID: "not an id", traceparent: "00-nonsense"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			req.Host = "api.example"
+			req.Header.Set("Authorization", "Bearer token")
+			if tt.requestID != "" {
+				req.Header.Set(requestIDHeader, tt.requestID)
+			}
+			if tt.traceparent != "" {
+				req.Header.Set("traceparent", tt.traceparent)
+				req.Header.Set("tracestate", "vendor=value")
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("got status %d", resp.StatusCode)
+			}
+
+			header, op := <-received, <-introspected
+			requestID := resp.Header.Get(requestIDHeader)
+			if tt.wantID != "" && requestID != tt.wantID {
+				t.Errorf("got request ID %q, want %q", requestID, tt.wantID)
+			}
+			if !validRequestID(requestID) || requestID == tt.requestID && tt.wantID == "" {
+				t.Errorf("got request ID %q", requestID)
+			}
+			if header.Get(requestIDHeader) != requestID || op.Get(requestIDHeader) != requestID {
+				t.Errorf("request ID %q was not passed on: upstream %q, OP %q", requestID, header.Get(requestIDHeader), op.Get(requestIDHeader))
+			}
+
+			trace, ok := parseTraceparent(header.Get("traceparent"))
+			if !ok {
+				t.Fatalf("upstream got traceparent %q", header.Get("traceparent"))
+			}
+			if op.Get("traceparent") != header.Get("traceparent") {
+				t.Errorf("OP got traceparent %q, upstream %q", op.Get("traceparent"), header.Get("traceparent"))
+			}
+			inbound, _ := parseTraceparent(tt.traceparent)
+			if joined := trace.traceID == inbound.traceID; joined != tt.joinsTrace {
+				t.Errorf("got trace %s for inbound %q", trace.traceID, tt.traceparent)
+			}
+			if trace.spanID == inbound.spanID {
+				t.Error("the proxy did not add its own span")
+			}
+			if got := header.Get("tracestate"); tt.joinsTrace != (got == "vendor=value") {
+				t.Errorf("got tracestate %q", got)
+			}
+		})
+	}
+}
+
+func TestAccessLoggerTarget(t *testing.T) {
+	pki := newTestPKI(t)
+	paths := make(chan string, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths <- r.URL.Path
+		w.Write([]byte("ok"))
+	}))
+	t.Cleanup(upstream.Close)
+
+	var logs bytes.Buffer
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{{
+		Name: "portal", Host: "portal.example", Auth: authMTLS,
+		Upstreams: []upstreamConfig{{URL: upstream.URL + "/base"}},
+	}}}, slog.New(slog.NewJSONHandler(&logs, nil)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logs.Reset()
+	ts := serveTestTLS(t, pki, mux)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/accounts?page=2", nil)
+	req.Host = "portal.example"
+	req.Header.Set(requestIDHeader, "abc-123")
+	start := time.Now()
+	resp, err := testClient(ts, pki.clientCert).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := <-paths; got != "/base/accounts" {
+		t.Errorf("upstream got path %q", got)
+	}
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+		t.Fatalf("no access log entry: %v", err)
+	}
+	if want := "proxy:" + upstream.URL + "/base/accounts?page=2"; entry["target"] != want {
+		t.Errorf("target = %v, want %s", entry["target"], want)
+	}
+	if entry["requestID"] != "abc-123" || entry["bytes"] != float64(2) || entry["status"] != "200" {
+		t.Errorf("got entry %v", entry)
+	}
+	if latency, _ := entry["latency"].(float64); latency <= 0 || time.Duration(latency) > time.Since(start) {
+		t.Errorf("got latency %v", entry["latency"])
+	}
+	if _, ok := entry["traceID"].(string); !ok {
+		t.Errorf("no traceID in %v", entry)
+	}
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// errCircuitOpen is returned without calling an upstream whose breaker is open
+var errCircuitOpen = errors.New("circuit breaker open")
+
+// upstreamMetrics are published through expvar as upstream
+var upstreamMetrics = expvar.NewMap("upstream")
+
+// transportConfig bounds how long the proxy waits on a backend and how it
+// copes when the backend fails
+type transportConfig struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	IdleConnTimeout       time.Duration
+	// Retries is how many times a failed request is tried again, when it is
+	// safe to repeat
+	Retries      int
+	RetryBackoff time.Duration
+	// BreakerFailures consecutive failures open a backend's breaker, which
+	// lets a single request through after BreakerCooldown; 0 disables it
+	BreakerFailures int
+	BreakerCooldown time.Duration
+}
+
+func defaultTransportConfig() transportConfig {
+	return transportConfig{
+		DialTimeout:           5 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 30 * time.Second,
+		IdleConnTimeout:       90 * time.Second,
+		Retries:               1,
+		RetryBackoff:          50 * time.Millisecond,
+		BreakerFailures:       5,
+		BreakerCooldown:       30 * time.Second,
+	}
+}
+
+// loadTransportConfig reads the settings for a kind of backend, such as
+// UPSTREAM or INTROSPECTION, from <prefix>_DIAL_TIMEOUT and friends
+func loadTransportConfig(prefix string, defaults transportConfig) transportConfig {
+	return transportConfig{
+		DialTimeout:           getEnvDuration(prefix+"_DIAL_TIMEOUT", defaults.DialTimeout),
+		TLSHandshakeTimeout:   getEnvDuration(prefix+"_TLS_HANDSHAKE_TIMEOUT", defaults.TLSHandshakeTimeout),
+		ResponseHeaderTimeout: getEnvDuration(prefix+"_RESPONSE_HEADER_TIMEOUT", defaults.ResponseHeaderTimeout),
+		IdleConnTimeout:       getEnvDuration(prefix+"_IDLE_CONN_TIMEOUT", defaults.IdleConnTimeout),
+		Retries:               getEnvInt(prefix+"_RETRIES", defaults.Retries),
+		RetryBackoff:          getEnvDuration(prefix+"_RETRY_BACKOFF", defaults.RetryBackoff),
+		BreakerFailures:       getEnvInt(prefix+"_BREAKER_FAILURES", defaults.BreakerFailures),
+		BreakerCooldown:       getEnvDuration(prefix+"_BREAKER_COOLDOWN", defaults.BreakerCooldown),
+	}
+}
+
+// upstreamTransport carries every proxied request
+var upstreamTransport http.RoundTripper = newResilientTransport(defaultTransportConfig(), isIdempotent)
+
+// resilientTransport retries requests that failed and can safely be
+// repeated, and stops calling backends that keep failing
+type resilientTransport struct {
+	next      http.RoundTripper
+	config    transportConfig
+	retryable func(*http.Request) bool
+	now       func() time.Time
+
+	mu       sync.Mutex
+	breakers map[string]*circuitBreaker
+}
+
+func newResilientTransport(config transportConfig, retryable func(*http.Request) bool) *resilientTransport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = (&net.Dialer{Timeout: config.DialTimeout, KeepAlive: 30 * time.Second}).DialContext
+	transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	transport.IdleConnTimeout = config.IdleConnTimeout
+	return &resilientTransport{
+		next:      transport,
+		config:    config,
+		retryable: retryable,
+		now:       time.Now,
+		breakers:  map[string]*circuitBreaker{},
+	}
+}
+
+// newOPClient is a client for the OP. Introspection and user info only read,
+// so they are retried whatever their method.
+func newOPClient(config transportConfig, timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: newResilientTransport(config, func(*http.Request) bool { return true }),
+	}
+}
+
+// isIdempotent reports whether a request may be sent twice, going by its
+// method or an Idempotency-Key, as net/http itself does
+func isIdempotent(r *http.Request) bool {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, ok := r.Header["Idempotency-Key"]
+	return ok
+}
+
+// breaker returns the circuit breaker of the backend at host
+func (t *resilientTransport) breaker(host string) *circuitBreaker {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	b, ok := t.breakers[host]
+	if !ok {
+		b = &circuitBreaker{threshold: t.config.BreakerFailures, cooldown: t.config.BreakerCooldown, now: t.now}
+		t.breakers[host] = b
+	}
+	return b
+}
+
+func (t *resilientTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	breaker := t.breaker(req.URL.Host)
+	// Bodies can only be sent again if they can be read again
+	canRetry := t.config.Retries > 0 && t.retryable(req) && (req.Body == nil || req.Body == http.NoBody || req.GetBody != nil)
+	for attempt := 0; ; attempt++ {
+		if !breaker.allow() {
+			upstreamMetrics.Add("circuit_open", 1)
+			return nil, fmt.Errorf("%s: %w", req.URL.Host, errCircuitOpen)
+		}
+		resp, err := t.next.RoundTrip(req)
+		failed := err != nil || isUnavailableStatus(resp.StatusCode)
+		// A client that gave up is not the backend's fault
+		if !errors.Is(req.Context().Err(), context.Canceled) {
+			breaker.record(!failed)
+		}
+		if !failed || !canRetry || attempt >= t.config.Retries || req.Context().Err() != nil {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		upstreamMetrics.Add("retries", 1)
+		slog.Warn("Retrying upstream request",
+			slog.String("host", req.URL.Host),
+			slog.Int("attempt", attempt+1),
+		)
+		select {
+		case <-time.After(t.config.RetryBackoff * time.Duration(attempt+1)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+	}
+}
+
+// isUnavailableStatus reports whether a backend's answer means it could not
+// serve the request, rather than that the request was wrong
+func isUnavailableStatus(status int) bool {
+	return status == http.StatusBadGateway || status == http.StatusServiceUnavailable || status == http.StatusGatewayTimeout
+}
+
+// Circuit breaker states
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker opens after threshold consecutive failures. Once the
+// cooldown has passed a single probe is let through, whose outcome closes
+// the breaker or opens it again. A probe that never reports back is replaced
+// after another cooldown.
+type circuitBreaker struct {
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu       sync.Mutex
+	state    int
+	failures int
+	openedAt time.Time
+}
+
+func (b *circuitBreaker) allow() bool {
+	if b.threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state, b.openedAt = breakerHalfOpen, b.now()
+		return true
+	case breakerHalfOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			// The probe has not come back yet
+			return false
+		}
+		b.openedAt = b.now()
+		return true
+	}
+	return true
+}
+
+func (b *circuitBreaker) record(success bool) {
+	if b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if success {
+		b.state, b.failures = breakerClosed, 0
+		return
+	}
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			upstreamMetrics.Add("breaker_opened", 1)
+		}
+		b.state, b.openedAt = breakerOpen, b.now()
+	}
+}
+
+// errorResponse is the body of the errors the proxy answers for upstreams
+type errorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	RequestID        string `json:"request_id,omitempty"`
+}
+
+// writeJSONError answers with status and a JSON body naming the request
+func writeJSONError(w http.ResponseWriter, r *http.Request, status int, description string) {
+	body := errorResponse{ErrorDescription: description}
+	switch status {
+	case http.StatusServiceUnavailable:
+		body.Error = "service_unavailable"
+	case http.StatusGatewayTimeout:
+		body.Error = "gateway_timeout"
+	default:
+		body.Error = "bad_gateway"
+	}
+	body.RequestID, _ = requestIDFromContext(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// upstreamErrorStatus picks the status for a request the upstream failed
+func upstreamErrorStatus(err error) (int, string) {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, errCircuitOpen):
+		return http.StatusServiceUnavailable, "The upstream service is unavailable"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return http.StatusGatewayTimeout, "The upstream service did not respond in time"
+	}
+	return http.StatusBadGateway, "The upstream service could not be reached"
+}
+
+// proxyErrorHandler is the ErrorHandler of a route's reverse proxy
+func proxyErrorHandler(route string) func(http.ResponseWriter, *http.Request, error) {
+	return func(w http.ResponseWriter, r *http.Request, err error) {
+		status, description := upstreamErrorStatus(err)
+		upstreamMetrics.Add(fmt.Sprintf("errors_%d", status), 1)
+		slog.Error("Upstream request failed",
+			slog.String("route", route),
+			slog.Int("status", status),
+			slog.String("error", err.Error()),
+		)
+		writeJSONError(w, r, status, description)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useUpstreamTransport proxies with a transport built from config for the
+// duration of the test
+func useUpstreamTransport(t *testing.T, config transportConfig) {
+	previous := upstreamTransport
+	upstreamTransport = newResilientTransport(config, isIdempotent)
+	t.Cleanup(func() { upstreamTransport = previous })
+}
+
+// flakyServer fails the first failures requests with 503, counting every
+// request and the bodies it was sent
+func flakyServer(t *testing.T, failures int32) (*httptest.Server, *atomic.Int32, chan string) {
+	var calls atomic.Int32
+	bodies := make(chan string, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies <- string(body)
+		if calls.Add(1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	t.Cleanup(ts.Close)
+	return ts, &calls, bodies
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	b := &circuitBreaker{threshold: 2, cooldown: 10 * time.Second, now: func() time.Time { return now }}
+
+	b.record(false)
+	if !b.allow() {
+		t.Fatal("breaker opened before the threshold")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Fatal("breaker did not open at the threshold")
+	}
+
+	now = now.Add(10 * time.Second)
+	if !b.allow() {
+		t.Fatal("no probe after the cooldown")
+	}
+	if b.allow() {
+		t.Error("a second probe was let through")
+	}
+	b.record(false)
+	if b.allow() {
+		t.Error("breaker closed after a failed probe")
+	}
+
+	now = now.Add(10 * time.Second)
+	b.allow()
+	// The probe never reports back
+	now = now.Add(10 * time.Second)
+	if !b.allow() {
+		t.Fatal("a lost probe kept the breaker half open")
+	}
+	b.record(true)
+	for i := 0; i < 3; i++ {
+		if !b.allow() {
+			t.Fatal("breaker did not close after a successful probe")
+		}
+	}
+}
+
+func TestResilientTransportRetries(t *testing.T) {
+	config := defaultTransportConfig()
+	config.RetryBackoff = time.Millisecond
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		key    bool
+		calls  int32
+		status int
+	}{
+		{name: "GET", method: http.MethodGet, calls: 2, status: http.StatusOK},
+		{name: "POST", method: http.MethodPost, body: `{"phoneNumber":"+61400111222"}`, calls: 1, status: http.StatusServiceUnavailable},
+		{name: "POST with Idempotency-Key", method: http.MethodPost, body: `{"phoneNumber":"+61400111222"}`, key: true, calls: 2, status: http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ts, calls, bodies := flakyServer(t, 1)
+			client := &http.Client{Transport: newResilientTransport(config, isIdempotent)}
+			req, _ := http.NewRequest(tt.method, ts.URL, strings.NewReader(tt.body))
+			if tt.key {
+				req.Header.Set("Idempotency-Key", "abc")
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != tt.status || calls.Load() != tt.calls {
+				t.Fatalf("got status %d after %d calls, want %d after %d", resp.StatusCode, calls.Load(), tt.status, tt.calls)
+			}
+			for i := int32(0); i < tt.calls; i++ {
+				if body := <-bodies; body != tt.body {
+					t.Errorf("call %d sent body %q", i, body)
+				}
+			}
+		})
+	}
+}
+
+func TestResilientTransportBreaker(t *testing.T) {
+	ts, calls, _ := flakyServer(t, 100)
+	config := defaultTransportConfig()
+	config.Retries = 0
+	config.BreakerFailures = 2
+	client := &http.Client{Transport: newResilientTransport(config, isIdempotent)}
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Get(ts.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+	if _, err := client.Get(ts.URL); !errors.Is(err, errCircuitOpen) {
+		t.Fatalf("got %v, want the breaker to be open", err)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("upstream called %d times, want 2", calls.Load())
+	}
+}
+
+func TestProxyErrorResponses(t *testing.T) {
+	pki := newTestPKI(t)
+	config := defaultTransportConfig()
+	config.Retries = 0
+	config.BreakerFailures = 1
+	config.ResponseHeaderTimeout = 50 * time.Millisecond
+	useUpstreamTransport(t, config)
+
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	down.Close()
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(time.Second):
+		case <-r.Context().Done():
+		}
+	}))
+	t.Cleanup(slow.Close)
+
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{
+		{Name: "down", Host: "down.example", Auth: authNone, Upstreams: []upstreamConfig{{URL: down.URL}}},
+		{Name: "slow", Host: "slow.example", Auth: authNone, Upstreams: []upstreamConfig{{URL: slow.URL}}},
+	}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+
+	tests := []struct {
+		name   string
+		host   string
+		status int
+		error  string
+	}{
+		{name: "unreachable", host: "down.example", status: http.StatusBadGateway, error: "bad_gateway"},
+		{name: "breaker open", host: "down.example", status: http.StatusServiceUnavailable, error: "service_unavailable"},
+		{name: "response header timeout", host: "slow.example", status: http.StatusGatewayTimeout, error: "gateway_timeout"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+			req.Host = tt.host
+			resp, err := testClient(ts).Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != tt.status || resp.Header.Get("Content-Type") != "application/json" {
+				t.Fatalf("got status %d with %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+			}
+			var body errorResponse
+			if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Error != tt.error || body.RequestID == "" || body.RequestID != resp.Header.Get(requestIDHeader) {
+				t.Errorf("got body %+v", body)
+			}
+		})
+	}
+}
+
+func TestIntrospectionUnavailable(t *testing.T) {
+	pki := newTestPKI(t)
+	var calls atomic.Int32
+	op := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(op.Close)
+	t.Setenv("INTROSPECTION_URL", op.URL)
+	useIntrospectionCache(t, newIntrospectionCache(time.Minute, time.Minute, 100))
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	t.Cleanup(upstream.Close)
+
+	mux, err := newRouter(routingConfig{Routes: []routeConfig{{
+		Name: "api", Host: "api.example", Auth: authToken, Upstreams: []upstreamConfig{{URL: upstream.URL}},
+	}}}, discardLogger(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := serveTestTLS(t, pki, mux)
+
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/", nil)
+	req.Host = "api.example"
+	req.Header.Set("Authorization", "Bearer token")
+	resp, err := testClient(ts, pki.clientCert).Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("got status %d, want 503 rather than treating the token as invalid", resp.StatusCode)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("OP called %d times, want a retry", calls.Load())
+	}
+}
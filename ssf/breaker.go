@@ -0,0 +1,243 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"ssf/secevent"
+)
+
+// Reasons sent when the transmitter pauses or re-enables a stream on its own
+const (
+	reasonDeliveryFailure   = "delivery_failure"
+	reasonDeliveryRecovered = "delivery_recovered"
+)
+
+// maxRetryBackoff caps the exponential backoff between delivery attempts
+const maxRetryBackoff = 30 * time.Second
+
+// streamBreaker tracks delivery health for one stream. It is owned by the
+// stream's worker goroutine so needs no locking. SETs are held in buffer
+// while the breaker is open or while the stream is paused.
+type streamBreaker struct {
+	failures int
+	open     bool
+	held     bool
+	stream   StreamConfig
+	buffer   []outboundSET
+}
+
+type deliveryOutcome int
+
+const (
+	delivered deliveryOutcome = iota
+	tripped
+	interrupted
+)
+
+// deliverWithRetry retries a SET with exponential backoff until it is
+// delivered, the stream's failure budget is spent or the transmitter stops
+func (t *Transmitter) deliverWithRetry(b *streamBreaker, out outboundSET) deliveryOutcome {
+	for {
+		err := t.attempt(out)
+		if err == nil {
+			b.failures = 0
+			return delivered
+		}
+		if t.ctx.Err() != nil {
+			return interrupted
+		}
+
+		b.failures++
+		log.Printf("Error delivering SET to stream %s at %s (failure %d of %d): %v",
+			out.stream.StreamID, out.stream.EventsEndpoint, b.failures, t.config.FailureBudget, err)
+		if b.failures >= t.config.FailureBudget {
+			return tripped
+		}
+
+		select {
+		case <-time.After(t.retryBackoff(b.failures)):
+		case <-t.ctx.Done():
+			return interrupted
+		}
+	}
+}
+
+func (t *Transmitter) retryBackoff(failures int) time.Duration {
+	backoff := t.config.RetryBackoff
+	for i := 1; i < failures && backoff < maxRetryBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > maxRetryBackoff {
+		backoff = maxRetryBackoff
+	}
+	return backoff
+}
+
+// trip pauses a stream whose failure budget is spent, holding the failed SET
+// at the front of its buffer
+func (t *Transmitter) trip(b *streamBreaker, out outboundSET) {
+	b.open = true
+	b.stream = out.stream
+	b.buffer = append([]outboundSET{out}, b.buffer...)
+	log.Printf("Pausing stream %s after %d consecutive delivery failures", out.stream.StreamID, b.failures)
+	t.notifyStatus(out.stream.StreamID, "paused", reasonDeliveryFailure)
+}
+
+// holdStream holds new SETs while the stream cannot take them. While the
+// breaker is open the receiver is probed with verification events, and while
+// the stream is paused its status is looked up again, every ProbeInterval.
+// The receiver re-enabling the stream closes the breaker at once. Once the
+// stream can take SETs again the held ones are released. It returns false if
+// the transmitter stops.
+func (t *Transmitter) holdStream(queue *streamQueue, b *streamBreaker) bool {
+	timer := time.NewTimer(t.config.ProbeInterval)
+	defer timer.Stop()
+
+	for {
+		select {
+		case out := <-queue.sets:
+			if b.open || !out.streamEvent {
+				t.hold(b, out)
+				continue
+			}
+			// A paused stream still hears about changes to itself
+			if t.send(b, out) == interrupted {
+				b.buffer = append(b.buffer, out)
+				return false
+			}
+		case <-timer.C:
+			if b.open {
+				if err := t.probe(b.stream); err != nil {
+					if t.ctx.Err() != nil {
+						return false
+					}
+					log.Printf("Verification probe for paused stream %s failed: %v", b.stream.StreamID, err)
+					timer.Reset(t.config.ProbeInterval)
+					continue
+				}
+				log.Printf("Receiver for stream %s recovered, delivering %d held SETs", b.stream.StreamID, len(b.buffer))
+				b.open = false
+				b.failures = 0
+				t.notifyStatus(b.stream.StreamID, "enabled", reasonDeliveryRecovered)
+			} else if status, found := t.streamStatus(b.stream); found && status == "paused" {
+				timer.Reset(t.config.ProbeInterval)
+				continue
+			}
+
+			if !t.release(b) {
+				return false
+			}
+			if !b.open && !b.held {
+				return true
+			}
+			timer.Reset(t.config.ProbeInterval)
+		case <-queue.resumed:
+			if b.open {
+				log.Printf("Stream %s re-enabled, delivering %d held SETs", b.stream.StreamID, len(b.buffer))
+			}
+			b.open = false
+			b.failures = 0
+			if !t.release(b) {
+				return false
+			}
+			if !b.open && !b.held {
+				return true
+			}
+			if !timer.Stop() {
+				select {
+				case <-timer.C:
+				default:
+				}
+			}
+			timer.Reset(t.config.ProbeInterval)
+		case <-queue.removed:
+			return true
+		case <-t.ctx.Done():
+			return false
+		}
+	}
+}
+
+// release sends the held SETs, holding them again if the stream is still
+// paused or the breaker trips. Stream events go first, so the receiver hears
+// the stream was paused before the SETs held meanwhile; the rest go oldest
+// first. It returns false if the transmitter stops, leaving what was not sent
+// in the buffer.
+func (t *Transmitter) release(b *streamBreaker) bool {
+	held := b.buffer
+	b.buffer, b.held = nil, false
+	sort.SliceStable(held, func(i, j int) bool { return held[i].streamEvent && !held[j].streamEvent })
+	for i, out := range held {
+		if b.open {
+			b.buffer = append(b.buffer, held[i:]...)
+			return true
+		}
+		if t.send(b, out) == interrupted {
+			b.buffer = append(b.buffer, held[i:]...)
+			return false
+		}
+	}
+	return true
+}
+
+// hold buffers a SET for a paused stream. Once the buffer is full the oldest
+// SET is dropped, though never a stream event.
+func (t *Transmitter) hold(b *streamBreaker, out outboundSET) {
+	b.stream = out.stream
+	b.buffer = append(b.buffer, out)
+	if len(b.buffer) <= t.config.MaxBuffered {
+		return
+	}
+	for i, held := range b.buffer {
+		if !held.streamEvent {
+			log.Printf("Dropping oldest held SET for paused stream %s, buffer is full", out.stream.StreamID)
+			b.buffer = append(b.buffer[:i], b.buffer[i+1:]...)
+			t.done()
+			return
+		}
+	}
+}
+
+// pausedForDeliveryFailure reports whether the stream's last status change
+// was the transmitter pausing it because its receiver kept failing
+func pausedForDeliveryFailure(streamConfig StreamConfig) bool {
+	if streamConfig.Status != "paused" || len(streamConfig.StatusHistory) == 0 {
+		return false
+	}
+	last := streamConfig.StatusHistory[len(streamConfig.StatusHistory)-1]
+	return last.InitiatedBy == initiatedByTransmitter && last.Reason != nil && *last.Reason == reasonDeliveryFailure
+}
+
+// probe sends a transmitter initiated verification event (SSF 7.1.4.1),
+// which carries no state
+func (t *Transmitter) probe(streamConfig StreamConfig) error {
+	claims := streamEventClaims(streamConfig.StreamID, secevent.VerificationType, secevent.Verification{})
+	set, err := signEventForStream(claims, streamConfig)
+	if err != nil {
+		return err
+	}
+	return t.attempt(outboundSET{stream: streamConfig, set: set})
+}
+
+// keepBuffered moves the SETs held for a paused stream to the unsent list
+func (t *Transmitter) keepBuffered(b *streamBreaker) {
+	for _, out := range b.buffer {
+		t.keepUnsent(out)
+	}
+	b.buffer = nil
+}
+
+// notifyStatus reports a transmitter initiated status change without blocking
+// the stream's worker, since the notification is itself queued on the stream
+func (t *Transmitter) notifyStatus(streamID, status, reason string) {
+	if t.config.OnStatusChange == nil {
+		return
+	}
+	t.workers.Add(1)
+	go func() {
+		defer t.workers.Done()
+		t.config.OnStatusChange(streamID, status, reason)
+	}()
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"ssf/secevent"
+)
+
+// flakyReceiver stands in for deliverSET, failing every delivery until it is
+// marked healthy and recording the SETs it accepts
+type flakyReceiver struct {
+	t        testing.TB
+	healthy  atomic.Bool
+	attempts atomic.Int32
+
+	mu       sync.Mutex
+	received []map[string]interface{}
+}
+
+func (fr *flakyReceiver) deliver(ctx context.Context, streamConfig StreamConfig, set string) error {
+	fr.attempts.Add(1)
+	if !fr.healthy.Load() {
+		return errors.New("receiver unavailable")
+	}
+	claims := decodeSETClaims(fr.t, set)
+	fr.mu.Lock()
+	fr.received = append(fr.received, claims)
+	fr.mu.Unlock()
+	return nil
+}
+
+// seqs returns the "seq" claim of accepted SETs, with -1 for verification events
+func (fr *flakyReceiver) seqs() []float64 {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var seqs []float64
+	for _, claims := range fr.received {
+		if seq, ok := claims["seq"].(float64); ok {
+			seqs = append(seqs, seq)
+			continue
+		}
+		events, _ := claims["events"].(map[string]interface{})
+		if _, ok := events[secevent.VerificationType]; ok {
+			seqs = append(seqs, -1)
+		}
+	}
+	return seqs
+}
+
+type statusNotice struct {
+	streamID, status, reason string
+}
+
+// newBreakerTestTransmitter returns a transmitter delivering to receiver that
+// reports its status changes on the returned channel
+func newBreakerTestTransmitter(receiver *flakyReceiver, config TransmitterConfig) (*Transmitter, chan statusNotice) {
+	notices := make(chan statusNotice, 8)
+	config.MaxPerHost = 1
+	config.QueueSize = 16
+	config.RetryBackoff = time.Millisecond
+	config.OnStatusChange = func(streamID, status, reason string) {
+		notices <- statusNotice{streamID, status, reason}
+	}
+	tr := NewTransmitter(config)
+	tr.deliver = receiver.deliver
+	return tr, notices
+}
+
+func waitForNotice(t *testing.T, notices chan statusNotice) statusNotice {
+	t.Helper()
+	select {
+	case notice := <-notices:
+		return notice
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a stream status change")
+		return statusNotice{}
+	}
+}
+
+func TestBreakerPausesStreamAndRecoversInOrder(t *testing.T) {
+	receiver := &flakyReceiver{t: t}
+	tr, notices := newBreakerTestTransmitter(receiver, TransmitterConfig{
+		FailureBudget: 3,
+		ProbeInterval: 10 * time.Millisecond,
+	})
+	defer tr.Shutdown(context.Background())
+
+	stream := testStreams("https://receiver.example.com", 1)
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 0}, stream))
+
+	notice := waitForNotice(t, notices)
+	assert.Equal(t, statusNotice{"stream-0", "paused", reasonDeliveryFailure}, notice)
+	assert.GreaterOrEqual(t, receiver.attempts.Load(), int32(3))
+
+	// Events emitted while paused are held rather than attempted
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": i}, stream))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	assert.Error(t, tr.Flush(ctx), "held SETs must stay pending while the stream is paused")
+	cancel()
+	assert.Empty(t, receiver.seqs())
+
+	receiver.healthy.Store(true)
+	notice = waitForNotice(t, notices)
+	assert.Equal(t, statusNotice{"stream-0", "enabled", reasonDeliveryRecovered}, notice)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, []float64{-1, 0, 1, 2, 3}, receiver.seqs())
+}
+
+func TestBreakerDropsOldestWhenBufferIsFull(t *testing.T) {
+	receiver := &flakyReceiver{t: t}
+	tr, notices := newBreakerTestTransmitter(receiver, TransmitterConfig{
+		FailureBudget: 1,
+		ProbeInterval: time.Hour,
+		MaxBuffered:   2,
+	})
+
+	stream := testStreams("https://receiver.example.com", 1)
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 0}, stream))
+	waitForNotice(t, notices)
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": i}, stream))
+	}
+
+	// Shutting down while paused persists what is still held, oldest first
+	outbox := &memoryOutbox{}
+	tr.config.Outbox = outbox
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	tr.Shutdown(ctx)
+
+	var seqs []float64
+	for _, p := range outbox.pending {
+		seqs = append(seqs, decodeSETClaims(t, p.SET)["seq"].(float64))
+	}
+	assert.Equal(t, []float64{2, 3}, seqs)
+}
+
+func TestRetryBackoffIsCapped(t *testing.T) {
+	tr := NewTransmitter(TransmitterConfig{RetryBackoff: time.Second})
+	defer tr.Shutdown(context.Background())
+
+	assert.Equal(t, time.Second, tr.retryBackoff(1))
+	assert.Equal(t, 4*time.Second, tr.retryBackoff(3))
+	assert.Equal(t, maxRetryBackoff, tr.retryBackoff(20))
+}
+
+func TestTransmitterPauseIsRecordedInStatusHistory(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	sent := captureTransmitter(t)
+
+	assert.NoError(t, store.Create(context.Background(), StreamConfig{
+		StreamID:       "test-stream",
+		EventsEndpoint: "https://receiver.example.com/events",
+		Status:         "enabled",
+	}))
+
+	transmitterStatusChange("test-stream", "paused", reasonDeliveryFailure)
+
+	sets := sent()
+	assert.Len(t, sets, 1)
+	assert.Equal(t, map[string]interface{}{"status": "paused", "reason": reasonDeliveryFailure}, streamUpdate(t, sets[0]))
+
+	rec := httptest.NewRecorder()
+	newRouter().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream-config/test-stream", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var streamConfig StreamConfig
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &streamConfig))
+	assert.Equal(t, "paused", streamConfig.Status)
+	if assert.Len(t, streamConfig.StatusHistory, 1) {
+		change := streamConfig.StatusHistory[0]
+		assert.Equal(t, "paused", change.Status)
+		assert.Equal(t, reasonDeliveryFailure, *change.Reason)
+		assert.Equal(t, initiatedByTransmitter, change.InitiatedBy)
+		assert.False(t, change.ChangedAt.IsZero())
+	}
+}
+
+// events describes each SET the receiver accepted, in order
+func (fr *flakyReceiver) events() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	var events []string
+	for _, claims := range fr.received {
+		if seq, ok := claims["seq"].(float64); ok {
+			events = append(events, fmt.Sprintf("seq %v", seq))
+			continue
+		}
+		setEvents, _ := claims["events"].(map[string]interface{})
+		if update, ok := setEvents[secevent.StreamUpdatedType].(map[string]interface{}); ok {
+			events = append(events, fmt.Sprintf("%v", update["status"]))
+			continue
+		}
+		if _, ok := setEvents[secevent.VerificationType]; ok {
+			events = append(events, "verification")
+		}
+	}
+	return events
+}
+
+func TestBreakerSendsPausedNoticeBeforeHeldSETs(t *testing.T) {
+	receiver := &flakyReceiver{t: t}
+	tr, notices := newBreakerTestTransmitter(receiver, TransmitterConfig{
+		FailureBudget: 1,
+		ProbeInterval: 10 * time.Millisecond,
+	})
+	defer tr.Shutdown(context.Background())
+	stream := testStreams("https://receiver.example.com", 1)
+
+	// Status changes are announced on the stream itself, as transmitterStatusChange does
+	notify := tr.config.OnStatusChange
+	tr.config.OnStatusChange = func(streamID, status, reason string) {
+		claims := streamEventClaims(streamID, secevent.StreamUpdatedType, secevent.StreamUpdated{Status: status, Reason: reason})
+		set, err := signEventForStream(claims, stream[0])
+		assert.NoError(t, err)
+		assert.NoError(t, tr.EnqueueStreamEvent(context.Background(), stream[0], set))
+		notify(streamID, status, reason)
+	}
+
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 0}, stream))
+	assert.Equal(t, "paused", waitForNotice(t, notices).status)
+	for i := 1; i <= 2; i++ {
+		assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": i}, stream))
+	}
+
+	receiver.healthy.Store(true)
+	assert.Equal(t, "enabled", waitForNotice(t, notices).status)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, []string{"verification", "paused", "seq 0", "seq 1", "seq 2", "enabled"}, receiver.events())
+}
+
+func TestBreakerClosesWhenReceiverReEnablesStream(t *testing.T) {
+	receiver := &flakyReceiver{t: t}
+	tr, notices := newBreakerTestTransmitter(receiver, TransmitterConfig{
+		FailureBudget: 1,
+		ProbeInterval: time.Hour,
+	})
+	defer tr.Shutdown(context.Background())
+
+	stream := testStreams("https://receiver.example.com", 1)
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 0}, stream))
+	waitForNotice(t, notices)
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 1}, stream))
+
+	receiver.healthy.Store(true)
+	tr.Resume("stream-0")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.Flush(ctx), "held SETs must be sent without waiting for a probe")
+	assert.Equal(t, []float64{0, 1}, receiver.seqs())
+}
+
+func TestReopenBreakersProbesStreamsPausedBeforeRestart(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	receiver := &flakyReceiver{t: t}
+	receiver.healthy.Store(true)
+	tr, notices := newBreakerTestTransmitter(receiver, TransmitterConfig{ProbeInterval: 10 * time.Millisecond})
+	previous := transmitter
+	transmitter = tr
+	t.Cleanup(func() {
+		tr.Shutdown(context.Background())
+		transmitter = previous
+	})
+
+	for _, change := range []StatusChange{
+		{Status: "paused", Reason: newReason(reasonDeliveryFailure), InitiatedBy: initiatedByTransmitter},
+		{Status: "paused", Reason: newReason("Maintenance"), InitiatedBy: initiatedByReceiver},
+	} {
+		assert.NoError(t, store.Create(context.Background(), StreamConfig{
+			StreamID:       "paused-by-" + change.InitiatedBy,
+			EventsEndpoint: "https://receiver.example.com/events",
+			Status:         change.Status,
+			StatusHistory:  []StatusChange{change},
+		}))
+	}
+
+	assert.NoError(t, reopenBreakers(context.Background()))
+	assert.Equal(t, statusNotice{"paused-by-transmitter", "enabled", reasonDeliveryRecovered}, waitForNotice(t, notices))
+	assert.Equal(t, []string{"verification"}, receiver.events(), "only the stream the transmitter paused is probed")
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redactedValue replaces secrets when a stream configuration is returned to a caller
+const redactedValue = "REDACTED"
+
+// DeliveryConfig holds the credentials the transmitter presents to a receiver's
+// events_endpoint when pushing SETs (RFC 8935). AuthorizationHeader and OAuth
+// are mutually exclusive; ClientCert may be combined with either.
+type DeliveryConfig struct {
+	AuthorizationHeader string                  `json:"authorization_header,omitempty" bson:"authorization_header,omitempty"`
+	OAuth               *OAuthClientCredentials `json:"oauth,omitempty" bson:"oauth,omitempty"`
+	ClientCert          *ClientCertRef          `json:"client_cert,omitempty" bson:"client_cert,omitempty"`
+}
+
+// OAuthClientCredentials configures an OAuth 2.0 client credentials grant used
+// to obtain a bearer token for the receiver
+type OAuthClientCredentials struct {
+	TokenURL     string `json:"token_url" bson:"token_url"`
+	ClientID     string `json:"client_id" bson:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty" bson:"client_secret,omitempty"`
+	Scope        string `json:"scope,omitempty" bson:"scope,omitempty"`
+}
+
+// ClientCertRef names the certificate, key and CA bundle used for mutual TLS
+// with the receiver. The names are relative to clientCertDir; a receiver can
+// never point the transmitter at any other file.
+type ClientCertRef struct {
+	CertFile string `json:"cert_file" bson:"cert_file"`
+	KeyFile  string `json:"key_file" bson:"key_file"`
+	CAFile   string `json:"ca_file,omitempty" bson:"ca_file,omitempty"`
+}
+
+var deliveryTimeout = 10 * time.Second
+
+// clientCertDir is the directory, provisioned by the operator, holding the
+// files streams may reference for mutual TLS. It is loaded from
+// SSF_CLIENT_CERT_DIR in main; when it is empty client_cert is refused.
+var clientCertDir string
+
+// clientCertPath resolves a file named by a ClientCertRef inside clientCertDir
+func clientCertPath(name string) (string, error) {
+	if clientCertDir == "" {
+		return "", fmt.Errorf("delivery client_cert is not enabled on this transmitter")
+	}
+	if !filepath.IsLocal(name) {
+		return "", fmt.Errorf("delivery client_cert file %q must be a relative path inside the certificate directory", name)
+	}
+	return filepath.Join(clientCertDir, name), nil
+}
+
+// Validate checks that the delivery configuration is internally consistent
+func (d *DeliveryConfig) Validate() error {
+	if d == nil {
+		return nil
+	}
+	if d.AuthorizationHeader != "" && d.OAuth != nil {
+		return fmt.Errorf("delivery may specify authorization_header or oauth, not both")
+	}
+	if d.OAuth != nil {
+		if d.OAuth.TokenURL == "" || d.OAuth.ClientID == "" {
+			return fmt.Errorf("delivery oauth requires token_url and client_id")
+		}
+		if _, err := url.ParseRequestURI(d.OAuth.TokenURL); err != nil {
+			return fmt.Errorf("delivery oauth token_url is invalid: %v", err)
+		}
+	}
+	if d.ClientCert != nil {
+		if d.ClientCert.CertFile == "" || d.ClientCert.KeyFile == "" {
+			return fmt.Errorf("delivery client_cert requires cert_file and key_file")
+		}
+		for _, name := range []string{d.ClientCert.CertFile, d.ClientCert.KeyFile, d.ClientCert.CAFile} {
+			if name == "" {
+				continue
+			}
+			if _, err := clientCertPath(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// seal encrypts the secret fields of the delivery configuration in place
+func (d *DeliveryConfig) seal() error {
+	if d == nil {
+		return nil
+	}
+	var err error
+	if d.AuthorizationHeader, err = sealSecret(d.AuthorizationHeader); err != nil {
+		return err
+	}
+	if d.OAuth != nil {
+		if d.OAuth.ClientSecret, err = sealSecret(d.OAuth.ClientSecret); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// redacted returns a copy of the delivery configuration that is safe to return or log
+func (d *DeliveryConfig) redacted() *DeliveryConfig {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	if out.AuthorizationHeader != "" {
+		out.AuthorizationHeader = redactedValue
+	}
+	if d.OAuth != nil {
+		oauth := *d.OAuth
+		if oauth.ClientSecret != "" {
+			oauth.ClientSecret = redactedValue
+		}
+		out.OAuth = &oauth
+	}
+	if d.ClientCert != nil {
+		ref := *d.ClientCert
+		out.ClientCert = &ref
+	}
+	return &out
+}
+
+// redactStreamConfig strips receiver credentials from a stream configuration
+func redactStreamConfig(streamConfig StreamConfig) StreamConfig {
+	streamConfig.Delivery = streamConfig.Delivery.redacted()
+	return streamConfig
+}
+
+// deliverSET pushes a signed SET to the stream's events_endpoint using the
+// stream's delivery credentials
+func deliverSET(ctx context.Context, streamConfig StreamConfig, set string) error {
+	httpClient, err := deliveryClient(streamConfig.Delivery)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, streamConfig.EventsEndpoint, strings.NewReader(set))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/jwt")
+	req.Header.Set("Accept", "application/json")
+
+	authorization, err := deliveryAuthorization(ctx, httpClient, streamConfig.StreamID, streamConfig.Delivery)
+	if err != nil {
+		return err
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("stream endpoint responded with status: %s", resp.Status)
+	}
+	return nil
+}
+
+// deliveryAuthorization resolves the Authorization header value for a delivery
+func deliveryAuthorization(ctx context.Context, httpClient *http.Client, streamID string, d *DeliveryConfig) (string, error) {
+	if d == nil {
+		return "", nil
+	}
+	if d.AuthorizationHeader != "" {
+		header, err := openSecret(d.AuthorizationHeader)
+		if err != nil {
+			return "", fmt.Errorf("failed to open authorization_header: %v", err)
+		}
+		return header, nil
+	}
+	if d.OAuth != nil {
+		token, err := clientCredentialsToken(ctx, httpClient, streamID, d.OAuth)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	}
+	return "", nil
+}
+
+type cachedToken struct {
+	accessToken string
+	expiresAt   time.Time
+}
+
+var (
+	tokenCacheMu sync.Mutex
+	tokenCache   = map[string]cachedToken{}
+)
+
+// clientCredentialsToken fetches, and caches until shortly before expiry, an
+// access token for the receiver using the client credentials grant. Tokens
+// are cached per stream and sealed secret, so a stream registered with
+// someone else's client_id never gets their token without their secret.
+func clientCredentialsToken(ctx context.Context, httpClient *http.Client, streamID string, creds *OAuthClientCredentials) (string, error) {
+	secretHash := sha256.Sum256([]byte(creds.ClientSecret))
+	cacheKey := streamID + "|" + hex.EncodeToString(secretHash[:])
+
+	tokenCacheMu.Lock()
+	cached, ok := tokenCache[cacheKey]
+	tokenCacheMu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.accessToken, nil
+	}
+
+	clientSecret, err := openSecret(creds.ClientSecret)
+	if err != nil {
+		return "", fmt.Errorf("failed to open oauth client_secret: %v", err)
+	}
+
+	data := url.Values{}
+	data.Set("grant_type", "client_credentials")
+	if creds.Scope != "" {
+		data.Set("scope", creds.Scope)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, creds.TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create token request: %v", err)
+	}
+	req.SetBasicAuth(url.QueryEscape(creds.ClientID), url.QueryEscape(clientSecret))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to request access token: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint responded with status: %s", resp.Status)
+	}
+
+	var tokenResponse struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", fmt.Errorf("failed to decode token response: %v", err)
+	}
+	if tokenResponse.AccessToken == "" {
+		return "", fmt.Errorf("token response did not contain an access_token")
+	}
+
+	// Refresh a little early so a token never expires in flight
+	lifetime := time.Duration(tokenResponse.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		lifetime = 5 * time.Minute
+	}
+	tokenCacheMu.Lock()
+	tokenCache[cacheKey] = cachedToken{
+		accessToken: tokenResponse.AccessToken,
+		expiresAt:   time.Now().Add(lifetime * 9 / 10),
+	}
+	tokenCacheMu.Unlock()
+
+	return tokenResponse.AccessToken, nil
+}
+
+var (
+	defaultDeliveryClient = newDeliveryHTTPClient(nil)
+
+	tlsClientsMu sync.Mutex
+	tlsClients   = map[ClientCertRef]*http.Client{}
+)
+
+// newDeliveryHTTPClient builds a client that only dials addresses allowed by
+// the endpoint policy and never follows redirects
+func newDeliveryHTTPClient(tlsConfig *tls.Config) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 5 * time.Second,
+		Control: dialControl,
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 8,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{
+		Transport: transport,
+		Timeout:   deliveryTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// deliveryClient returns the HTTP client used to reach the receiver, presenting
+// a client certificate when the stream is configured for mutual TLS
+func deliveryClient(d *DeliveryConfig) (*http.Client, error) {
+	if d == nil || d.ClientCert == nil {
+		return defaultDeliveryClient, nil
+	}
+
+	// Clients are cached by the files they were loaded from
+	files, err := d.ClientCert.resolve()
+	if err != nil {
+		return nil, err
+	}
+	tlsClientsMu.Lock()
+	defer tlsClientsMu.Unlock()
+	if httpClient, ok := tlsClients[files]; ok {
+		return httpClient, nil
+	}
+	httpClient, err := createTLSClient(files)
+	if err != nil {
+		return nil, err
+	}
+	tlsClients[files] = httpClient
+	return httpClient, nil
+}
+
+// resolve returns the reference with each file resolved inside clientCertDir
+func (ref ClientCertRef) resolve() (ClientCertRef, error) {
+	var resolved ClientCertRef
+	var err error
+	if resolved.CertFile, err = clientCertPath(ref.CertFile); err != nil {
+		return ClientCertRef{}, err
+	}
+	if resolved.KeyFile, err = clientCertPath(ref.KeyFile); err != nil {
+		return ClientCertRef{}, err
+	}
+	if ref.CAFile != "" {
+		if resolved.CAFile, err = clientCertPath(ref.CAFile); err != nil {
+			return ClientCertRef{}, err
+		}
+	}
+	return resolved, nil
+}
+
+// createTLSClient loads the files named by a resolved ClientCertRef
+func createTLSClient(files ClientCertRef) (*http.Client, error) {
+	cert, err := tls.LoadX509KeyPair(files.CertFile, files.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate and key: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if files.CAFile != "" {
+		caCert, err := os.ReadFile(files.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA certificate: %v", err)
+		}
+		caCertPool := x509.NewCertPool()
+		if !caCertPool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("failed to append CA certificate")
+		}
+		tlsConfig.RootCAs = caCertPool
+	}
+
+	return newDeliveryHTTPClient(tlsConfig), nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func useTestSecretsKey(t *testing.T) {
+	previous := secretsKey
+	secretsKey = []byte("0123456789abcdef0123456789abcdef")
+	t.Cleanup(func() { secretsKey = previous })
+}
+
+func TestSealAndOpenSecret(t *testing.T) {
+	useTestSecretsKey(t)
+
+	sealed, err := sealSecret("Bearer receiver-token")
+	assert.NoError(t, err)
+	assert.True(t, strings.HasPrefix(sealed, sealedPrefix))
+	assert.NotContains(t, sealed, "receiver-token")
+
+	opened, err := openSecret(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer receiver-token", opened)
+
+	// A receiver supplying a sealed value gets it back as is, never decrypted
+	resealed, err := sealSecret(sealed)
+	assert.NoError(t, err)
+	assert.NotEqual(t, sealed, resealed)
+	opened, err = openSecret(resealed)
+	assert.NoError(t, err)
+	assert.Equal(t, sealed, opened)
+}
+
+func TestSealSecretWithoutKey(t *testing.T) {
+	previous := secretsKey
+	secretsKey = nil
+	defer func() { secretsKey = previous }()
+
+	_, err := sealSecret("Bearer receiver-token")
+	assert.Error(t, err)
+}
+
+func TestSigningKeysMustBeConfigured(t *testing.T) {
+	t.Setenv("SSF_SIGNING_SECRET", "")
+	_, err := loadSigningSecret()
+	assert.Error(t, err, "no secret")
+	t.Setenv("SSF_SIGNING_SECRET", "too-short")
+	_, err = loadSigningSecret()
+	assert.Error(t, err, "short secret")
+
+	t.Setenv("SSF_SET_SIGNING_KEY", "")
+	_, err = loadSETSigningKey()
+	assert.Error(t, err, "no SET key")
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+	t.Setenv("SSF_SET_SIGNING_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+	loaded, err := loadSETSigningKey()
+	if assert.NoError(t, err) {
+		assert.Equal(t, "ES256", loaded.Algorithm)
+		assert.NotEmpty(t, loaded.KeyID)
+	}
+
+	p384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	der, err = x509.MarshalECPrivateKey(p384)
+	assert.NoError(t, err)
+	t.Setenv("SSF_SET_SIGNING_KEY", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})))
+	_, err = loadSETSigningKey()
+	assert.Error(t, err, "P-384 key")
+}
+
+func TestDeliveryConfigValidate(t *testing.T) {
+	assert.NoError(t, (*DeliveryConfig)(nil).Validate())
+	assert.NoError(t, (&DeliveryConfig{AuthorizationHeader: "Bearer abc"}).Validate())
+	assert.Error(t, (&DeliveryConfig{
+		AuthorizationHeader: "Bearer abc",
+		OAuth:               &OAuthClientCredentials{TokenURL: "https://as.example.com/token", ClientID: "ssf"},
+	}).Validate())
+	assert.Error(t, (&DeliveryConfig{OAuth: &OAuthClientCredentials{ClientID: "ssf"}}).Validate())
+	assert.Error(t, (&DeliveryConfig{ClientCert: &ClientCertRef{CertFile: "client.crt"}}).Validate())
+}
+
+func TestDeliveryConfigValidateClientCertPaths(t *testing.T) {
+	previous := clientCertDir
+	t.Cleanup(func() { clientCertDir = previous })
+
+	clientCertDir = ""
+	assert.Error(t, (&DeliveryConfig{ClientCert: &ClientCertRef{CertFile: "client.crt", KeyFile: "client.key"}}).Validate(),
+		"client_cert must be refused when no directory is configured")
+
+	clientCertDir = t.TempDir()
+	assert.NoError(t, (&DeliveryConfig{ClientCert: &ClientCertRef{CertFile: "client.crt", KeyFile: "keys/client.key", CAFile: "ca.crt"}}).Validate())
+	for _, ref := range []ClientCertRef{
+		{CertFile: "/etc/ssl/private/server.crt", KeyFile: "client.key"},
+		{CertFile: "client.crt", KeyFile: "../../etc/shadow"},
+		{CertFile: "client.crt", KeyFile: "client.key", CAFile: "/etc/passwd"},
+	} {
+		assert.Error(t, (&DeliveryConfig{ClientCert: &ref}).Validate(), "%+v", ref)
+	}
+}
+
+func TestRedactStreamConfig(t *testing.T) {
+	streamConfig := StreamConfig{
+		StreamID: "test-stream",
+		Delivery: &DeliveryConfig{
+			AuthorizationHeader: "Bearer abc",
+		},
+	}
+
+	redacted := redactStreamConfig(streamConfig)
+	assert.Equal(t, redactedValue, redacted.Delivery.AuthorizationHeader)
+	assert.Equal(t, "Bearer abc", streamConfig.Delivery.AuthorizationHeader, "original must not be modified")
+}
+
+func TestDeliverSETWithAuthorizationHeader(t *testing.T) {
+	allowLocalEndpoints(t)
+	useTestSecretsKey(t)
+
+	var received string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	delivery := &DeliveryConfig{AuthorizationHeader: "Bearer receiver-token"}
+	assert.NoError(t, delivery.seal())
+
+	err := deliverSET(context.Background(), StreamConfig{EventsEndpoint: ts.URL, Delivery: delivery}, "set")
+	assert.NoError(t, err)
+	assert.Equal(t, "Bearer receiver-token", received)
+}
+
+func TestDeliverSETWithOAuthClientCredentials(t *testing.T) {
+	allowLocalEndpoints(t)
+	useTestSecretsKey(t)
+
+	tokenRequests := 0
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokenRequests++
+		clientID, clientSecret, ok := r.BasicAuth()
+		assert.True(t, ok)
+		assert.Equal(t, "ssf-transmitter", clientID)
+		assert.Equal(t, "s3cret", clientSecret)
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "client_credentials", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "ssf.events", r.PostForm.Get("scope"))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": "issued-token",
+			"token_type":   "Bearer",
+			"expires_in":   300,
+		})
+	}))
+	defer as.Close()
+
+	var received []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer receiver.Close()
+
+	delivery := &DeliveryConfig{OAuth: &OAuthClientCredentials{
+		TokenURL:     as.URL,
+		ClientID:     "ssf-transmitter",
+		ClientSecret: "s3cret",
+		Scope:        "ssf.events",
+	}}
+	assert.NoError(t, delivery.seal())
+	assert.NotEqual(t, "s3cret", delivery.OAuth.ClientSecret)
+
+	streamConfig := StreamConfig{EventsEndpoint: receiver.URL, Delivery: delivery}
+	assert.NoError(t, deliverSET(context.Background(), streamConfig, "set-1"))
+	assert.NoError(t, deliverSET(context.Background(), streamConfig, "set-2"))
+
+	assert.Equal(t, []string{"Bearer issued-token", "Bearer issued-token"}, received)
+	assert.Equal(t, 1, tokenRequests, "token should be cached between deliveries")
+}
+
+func TestClientCredentialsTokenIsCachedPerStream(t *testing.T) {
+	allowLocalEndpoints(t)
+	useTestSecretsKey(t)
+
+	// The authorization server only issues a token for the right secret
+	as := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, clientSecret, _ := r.BasicAuth(); clientSecret != "victim-secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "victim-token", "expires_in": 300})
+	}))
+	defer as.Close()
+
+	var received []string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = append(received, r.Header.Get("Authorization"))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer receiver.Close()
+
+	stream := func(streamID, clientSecret string) StreamConfig {
+		delivery := &DeliveryConfig{OAuth: &OAuthClientCredentials{
+			TokenURL:     as.URL,
+			ClientID:     "shared-client",
+			ClientSecret: clientSecret,
+		}}
+		assert.NoError(t, delivery.seal())
+		return StreamConfig{StreamID: streamID, EventsEndpoint: receiver.URL, Delivery: delivery}
+	}
+	victim := stream("stream-victim", "victim-secret")
+	attacker := stream("stream-attacker", "guessed-secret")
+
+	assert.NoError(t, deliverSET(context.Background(), victim, "set-1"))
+	assert.Error(t, deliverSET(context.Background(), attacker, "set-2"), "the victim's cached token must not be reused")
+	assert.Equal(t, []string{"Bearer victim-token"}, received)
+}
+
+func TestDeliverSETWithClientCertificate(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	dir := t.TempDir()
+	previous := clientCertDir
+	clientCertDir = dir
+	t.Cleanup(func() { clientCertDir = previous })
+	caCert, caKey := writeTestCA(t, dir)
+	writeTestLeaf(t, dir, "client", caCert, caKey, x509.ExtKeyUsageClientAuth)
+
+	caPool := x509.NewCertPool()
+	caPool.AddCert(caCert)
+
+	var peerCN string
+	receiver := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		peerCN = r.TLS.PeerCertificates[0].Subject.CommonName
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	receiver.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: caPool}
+	receiver.StartTLS()
+	defer receiver.Close()
+
+	// Trust the receiver's self-signed test certificate alongside the test CA
+	receiverCA := filepath.Join(dir, "receiver-ca.crt")
+	assert.NoError(t, os.WriteFile(receiverCA, pem.EncodeToMemory(&pem.Block{
+		Type:  "CERTIFICATE",
+		Bytes: receiver.Certificate().Raw,
+	}), 0o600))
+
+	streamConfig := StreamConfig{
+		EventsEndpoint: receiver.URL,
+		Delivery: &DeliveryConfig{ClientCert: &ClientCertRef{
+			CertFile: "client.crt",
+			KeyFile:  "client.key",
+			CAFile:   "receiver-ca.crt",
+		}},
+	}
+	assert.NoError(t, deliverSET(context.Background(), streamConfig, "set"))
+	assert.Equal(t, "client", peerCN)
+}
+
+func TestDeliverSETRejectsNon2xx(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer receiver.Close()
+
+	err := deliverSET(context.Background(), StreamConfig{EventsEndpoint: receiver.URL}, "set")
+	assert.Error(t, err)
+}
+
+// writeTestCA creates a self-signed CA certificate in dir as ca.crt
+func writeTestCA(t *testing.T, dir string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ca.crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	return cert, key
+}
+
+// writeTestLeaf issues a certificate signed by the test CA and writes name.crt and name.key to dir
+func writeTestLeaf(t *testing.T, dir, name string, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usage x509.ExtKeyUsage) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600))
+}
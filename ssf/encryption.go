@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"ssf/sectoken"
+)
+
+// EncryptionConfig asks the transmitter to nest each SET for the stream in a
+// JWE encrypted to a key the receiver publishes in a JWKS. KeyID selects the
+// key when the JWKS holds several.
+type EncryptionConfig struct {
+	JWKSURI string `json:"jwks_uri" bson:"jwks_uri"`
+	KeyID   string `json:"kid,omitempty" bson:"kid,omitempty"`
+}
+
+// receiverKeysTTL is how long a receiver's JWKS is reused before it is
+// fetched again, so rotated keys are picked up
+var receiverKeysTTL = 10 * time.Minute
+
+// maxJWKSSize bounds the JWKS document read from a receiver
+const maxJWKSSize = 64 << 10
+
+type cachedKeySet struct {
+	keys      jose.JSONWebKeySet
+	fetchedAt time.Time
+}
+
+var (
+	receiverKeysMu sync.Mutex
+	receiverKeys   = map[string]cachedKeySet{}
+)
+
+// Validate checks that the encryption configuration names a usable JWKS URI
+func (e *EncryptionConfig) Validate() error {
+	if e == nil {
+		return nil
+	}
+	if e.JWKSURI == "" {
+		return fmt.Errorf("encryption requires jwks_uri")
+	}
+	if _, err := url.ParseRequestURI(e.JWKSURI); err != nil {
+		return fmt.Errorf("encryption jwks_uri is invalid: %v", err)
+	}
+	return nil
+}
+
+// receiverEncryptionKey returns the public key SETs for the stream are
+// encrypted to, fetching the receiver's JWKS if it is not cached
+func receiverEncryptionKey(ctx context.Context, e *EncryptionConfig) (jose.JSONWebKey, error) {
+	receiverKeysMu.Lock()
+	cached, ok := receiverKeys[e.JWKSURI]
+	receiverKeysMu.Unlock()
+
+	if !ok || time.Since(cached.fetchedAt) > receiverKeysTTL {
+		keys, err := fetchReceiverKeys(ctx, e.JWKSURI)
+		if err != nil {
+			return jose.JSONWebKey{}, err
+		}
+		cached = cachedKeySet{keys: keys, fetchedAt: time.Now()}
+		receiverKeysMu.Lock()
+		receiverKeys[e.JWKSURI] = cached
+		receiverKeysMu.Unlock()
+	}
+	return selectEncryptionKey(cached.keys, e.KeyID)
+}
+
+// fetchReceiverKeys downloads a receiver's JWKS using the same address policy
+// as SET delivery
+func fetchReceiverKeys(ctx context.Context, jwksURI string) (jose.JSONWebKeySet, error) {
+	var keys jose.JSONWebKeySet
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, jwksURI, nil)
+	if err != nil {
+		return keys, fmt.Errorf("failed to create JWKS request: %v", err)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := defaultDeliveryClient.Do(req)
+	if err != nil {
+		return keys, fmt.Errorf("failed to fetch receiver JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return keys, fmt.Errorf("receiver JWKS responded with status: %s", resp.Status)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxJWKSSize)).Decode(&keys); err != nil {
+		return keys, fmt.Errorf("failed to decode receiver JWKS: %v", err)
+	}
+	return keys, nil
+}
+
+// selectEncryptionKey picks the RSA or EC public key with the given kid, or
+// the first such key meant for encryption if kid is empty
+func selectEncryptionKey(keys jose.JSONWebKeySet, kid string) (jose.JSONWebKey, error) {
+	for _, key := range keys.Keys {
+		if kid != "" && key.KeyID != kid {
+			continue
+		}
+		if key.Use != "" && key.Use != "enc" {
+			continue
+		}
+		switch key.Key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+			return key, nil
+		}
+	}
+	if kid != "" {
+		return jose.JSONWebKey{}, fmt.Errorf("receiver JWKS has no RSA or EC encryption key with kid %q", kid)
+	}
+	return jose.JSONWebKey{}, fmt.Errorf("receiver JWKS has no RSA or EC encryption key")
+}
+
+// encryptSETForStream nests a signed SET in a JWE if the stream asks for encryption
+func encryptSETForStream(set, jti string, streamConfig StreamConfig) (string, error) {
+	if streamConfig.Encryption == nil {
+		return set, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+	key, err := receiverEncryptionKey(ctx, streamConfig.Encryption)
+	if err != nil {
+		return "", err
+	}
+	return sectoken.Encrypt(set, key, jti)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+
+	"ssf/secevent"
+	"ssf/sectoken"
+	"ssf/ssfclient"
+)
+
+// newJWKSServer publishes keys as a receiver's JWKS and forgets any cached copy
+func newJWKSServer(t *testing.T, keys ...jose.JSONWebKey) *httptest.Server {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: keys})
+	}))
+	t.Cleanup(func() {
+		ts.Close()
+		receiverKeysMu.Lock()
+		delete(receiverKeys, ts.URL)
+		receiverKeysMu.Unlock()
+	})
+	return ts
+}
+
+func TestSelectEncryptionKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	keys := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{
+		{Key: []byte("symmetric-keys-are-never-used-for-encryption"), KeyID: "oct"},
+		{Key: &rsaKey.PublicKey, KeyID: "sig", Use: "sig"},
+		{Key: &ecKey.PublicKey, KeyID: "ec", Use: "enc"},
+		{Key: &rsaKey.PublicKey, KeyID: "rsa"},
+	}}
+
+	key, err := selectEncryptionKey(keys, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "ec", key.KeyID)
+
+	key, err = selectEncryptionKey(keys, "rsa")
+	assert.NoError(t, err)
+	assert.Equal(t, "rsa", key.KeyID)
+
+	_, err = selectEncryptionKey(keys, "sig")
+	assert.Error(t, err, "signing key")
+	_, err = selectEncryptionKey(keys, "oct")
+	assert.Error(t, err, "symmetric key")
+	_, err = selectEncryptionKey(keys, "missing")
+	assert.Error(t, err)
+}
+
+func TestRegisterStreamConfigRejectsUnusableEncryptionKey(t *testing.T) {
+	useMemoryStreamStore(t)
+	allowLocalEndpoints(t)
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwks := newJWKSServer(t, jose.JSONWebKey{Key: &key.PublicKey, KeyID: "sig", Use: "sig"})
+
+	for name, encryption := range map[string]string{
+		"missing jwks_uri": `{}`,
+		"signing key only": `{"jwks_uri": "` + jwks.URL + `"}`,
+		"unknown kid":      `{"jwks_uri": "` + jwks.URL + `", "kid": "enc-2"}`,
+	} {
+		body := `{"events_supported": ["event1"], "delivery_method": "urn:ietf:rfc:8936", "encryption": ` + encryption + `}`
+		rec := httptest.NewRecorder()
+		registerStreamConfig(rec, httptest.NewRequest(http.MethodPost, "/stream-config", strings.NewReader(body)))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, name)
+	}
+}
+
+func TestEncryptedSETsAreDeliveredToPollStream(t *testing.T) {
+	useMemoryStreamStore(t)
+	useTransmitter(t)
+	useMemoryPollStore(t)
+	allowLocalEndpoints(t)
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+	useIssuer(t, ts.URL)
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwks := newJWKSServer(t, jose.JSONWebKey{Key: &key.PublicKey, KeyID: "enc-1", Use: "enc"})
+
+	ctx := context.Background()
+	client := ssfclient.New(ts.URL)
+	stream, err := client.CreateStream(ctx, ssfclient.StreamRequest{
+		EventsSupported: []string{secevent.VerificationType},
+		DeliveryMethod:  secevent.PollDeliveryMethod,
+		Encryption:      &ssfclient.Encryption{JWKSURI: jwks.URL, KeyID: "enc-1"},
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, &ssfclient.Encryption{JWKSURI: jwks.URL, KeyID: "enc-1"}, stream.Encryption)
+
+	resp, err := client.Poll(ctx, stream, secevent.PollRequest{ReturnImmediately: true})
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Sets, 1) {
+		for jti, token := range resp.Sets {
+			// The poll queue tracks the SET by the jti replicated into the JWE header
+			assert.True(t, sectoken.IsEncrypted(token))
+			_, err := client.VerifySET(ctx, stream.StreamID, token)
+			assert.Error(t, err, "no decryption key")
+
+			client.DecryptionKey = key
+			set, err := client.VerifySET(ctx, stream.StreamID, token)
+			if assert.NoError(t, err) {
+				assert.Equal(t, jti, set.JTI)
+				assert.Equal(t, secevent.StreamSubject(stream.StreamID), *set.SubID)
+			}
+		}
+	}
+}
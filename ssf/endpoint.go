@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+	"os"
+	"syscall"
+	"time"
+)
+
+// endpointPolicy controls which receiver endpoints the transmitter is allowed
+// to contact. The zero value is the production policy: https only and no
+// private, loopback or link-local destinations.
+type endpointPolicy struct {
+	// AllowHTTP permits plain http endpoints (development only)
+	AllowHTTP bool
+	// AllowPrivate permits endpoints that resolve to non-public addresses (development only)
+	AllowPrivate bool
+}
+
+// hostResolver is the subset of net.Resolver used to validate endpoint hosts
+type hostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+var (
+	eventsEndpointPolicy endpointPolicy
+	endpointResolver     hostResolver = net.DefaultResolver
+)
+
+// Ranges that are not covered by the netip helpers but must never be reachable
+// from the transmitter
+var blockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// loadEndpointPolicy reads the development overrides from the environment
+func loadEndpointPolicy() endpointPolicy {
+	return endpointPolicy{
+		AllowHTTP:    os.Getenv("SSF_DEV_ALLOW_HTTP_ENDPOINTS") == "true",
+		AllowPrivate: os.Getenv("SSF_DEV_ALLOW_PRIVATE_ENDPOINTS") == "true",
+	}
+}
+
+// validateEndpoint checks a receiver supplied URL against the endpoint policy,
+// resolving its host to make sure it does not point inside our network
+func validateEndpoint(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid endpoint %q: %v", rawURL, err)
+	}
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !eventsEndpointPolicy.AllowHTTP {
+			return fmt.Errorf("endpoint %q must use https", rawURL)
+		}
+	default:
+		return fmt.Errorf("endpoint %q has unsupported scheme %q", rawURL, u.Scheme)
+	}
+	if u.User != nil {
+		return fmt.Errorf("endpoint %q must not contain credentials", rawURL)
+	}
+	host := u.Hostname()
+	if host == "" {
+		return fmt.Errorf("endpoint %q has no host", rawURL)
+	}
+	if eventsEndpointPolicy.AllowPrivate {
+		return nil
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		if isBlockedAddr(ip) {
+			return fmt.Errorf("endpoint %q resolves to a non-public address", rawURL)
+		}
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	addrs, err := endpointResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return fmt.Errorf("unable to resolve endpoint host %q: %v", host, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("endpoint host %q has no addresses", host)
+	}
+	// Every address must be public, otherwise a later lookup could pick the private one
+	for _, addr := range addrs {
+		ip, ok := netip.AddrFromSlice(addr.IP)
+		if !ok || isBlockedAddr(ip) {
+			return fmt.Errorf("endpoint %q resolves to a non-public address", rawURL)
+		}
+	}
+	return nil
+}
+
+// isBlockedAddr reports whether ip is a private, loopback, link-local or
+// otherwise non-routable address
+func isBlockedAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, prefix := range blockedPrefixes {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// dialControl re-checks the address actually being dialled so that DNS
+// rebinding between validation and delivery cannot reach internal hosts
+func dialControl(network, address string, _ syscall.RawConn) error {
+	if eventsEndpointPolicy.AllowPrivate {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return fmt.Errorf("refusing to dial unresolved address %q", address)
+	}
+	if isBlockedAddr(ip) {
+		return fmt.Errorf("refusing to dial non-public address %s", ip)
+	}
+	return nil
+}
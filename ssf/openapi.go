@@ -0,0 +1,18 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec documents every route registered by newRouter. The contract
+// tests in openapi_test.go keep it in step with the handlers.
+//
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+// serveOpenAPISpec returns the OpenAPI document for the management API
+func serveOpenAPISpec(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/getkin/kin-openapi/routers/legacy"
+	"github.com/go-chi/chi/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// contractServer is the base URL declared in openapi.yaml
+const contractServer = "http://localhost:8080"
+
+func loadOpenAPISpec(t *testing.T) *openapi3.T {
+	t.Helper()
+	doc, err := openapi3.NewLoader().LoadFromData(openAPISpec)
+	if err != nil {
+		t.Fatalf("failed to load openapi.yaml: %v", err)
+	}
+	if err := doc.Validate(context.Background()); err != nil {
+		t.Fatalf("openapi.yaml is invalid: %v", err)
+	}
+	return doc
+}
+
+func TestOpenAPISpecCoversEveryRoute(t *testing.T) {
+	doc := loadOpenAPISpec(t)
+
+	router, ok := newRouter().(chi.Routes)
+	if !ok {
+		t.Fatal("newRouter does not return a chi router")
+	}
+	documented := 0
+	err := chi.Walk(router, func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		path := doc.Paths.Find(route)
+		if assert.NotNil(t, path, "route %s is not documented", route) {
+			assert.NotNil(t, path.GetOperation(method), "%s %s is not documented", method, route)
+		}
+		documented++
+		return nil
+	})
+	assert.NoError(t, err)
+
+	operations := 0
+	for _, path := range doc.Paths.Map() {
+		operations += len(path.Operations())
+	}
+	assert.Equal(t, operations, documented, "openapi.yaml documents routes the router does not serve")
+}
+
+// contractCase is one request made against the router. Cases that are
+// expected to fail validation only have their response checked.
+type contractCase struct {
+	name        string
+	method      string
+	path        string
+	contentType string
+	bearer      string
+	body        string
+	invalid     bool
+	status      int
+}
+
+func TestHandlersMatchOpenAPISpec(t *testing.T) {
+	useMemoryStreamStore(t)
+	useTestSecretsKey(t)
+	useEndpointPolicy(t, endpointPolicy{})
+	useStubResolver(t, stubResolver{"receiver.example.com": {"93.184.216.34"}})
+	useMemoryPollStore(t)
+	captureTransmitter(t)
+
+	openapi3filter.RegisterBodyDecoder("application/jwt", openapi3filter.FileBodyDecoder)
+	t.Cleanup(func() { openapi3filter.UnregisterBodyDecoder("application/jwt") })
+
+	doc := loadOpenAPISpec(t)
+	specRouter, err := legacy.NewRouter(doc)
+	assert.NoError(t, err)
+	handler := newRouter()
+
+	serve := func(c contractCase) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(c.method, contractServer+c.path, strings.NewReader(c.body))
+		if c.contentType != "" {
+			req.Header.Set("Content-Type", c.contentType)
+		}
+		if c.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+c.bearer)
+		}
+		route, pathParams, err := specRouter.FindRoute(req)
+		if !assert.NoError(t, err, c.name) {
+			return httptest.NewRecorder()
+		}
+		input := &openapi3filter.RequestValidationInput{
+			Request:    req,
+			PathParams: pathParams,
+			Route:      route,
+			Options:    &openapi3filter.Options{AuthenticationFunc: openapi3filter.NoopAuthenticationFunc},
+		}
+		if !c.invalid {
+			assert.NoError(t, openapi3filter.ValidateRequest(context.Background(), input), c.name)
+			assertJWTClaimsMatch(t, doc, route, c)
+			req.Body = io.NopCloser(strings.NewReader(c.body))
+		}
+
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		assert.Equal(t, c.status, rec.Code, c.name)
+
+		err = openapi3filter.ValidateResponse(context.Background(), &openapi3filter.ResponseValidationInput{
+			RequestValidationInput: input,
+			Status:                 rec.Code,
+			Header:                 rec.Header(),
+			Body:                   io.NopCloser(bytes.NewReader(rec.Body.Bytes())),
+			Options:                &openapi3filter.Options{IncludeResponseStatus: true},
+		})
+		assert.NoError(t, err, c.name)
+		return rec
+	}
+
+	rec := serve(contractCase{
+		name:        "create stream",
+		method:      http.MethodPost,
+		path:        "/stream-config",
+		contentType: "application/json",
+		body:        `{"events_supported": ["event1"], "events_endpoint": "https://receiver.example.com/events", "delivery": {"authorization_header": "Bearer abc"}}`,
+		status:      http.StatusCreated,
+	})
+	var created StreamConfig
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	streamPath := "/stream-config/" + created.StreamID
+
+	rec = serve(contractCase{
+		name:        "create poll stream",
+		method:      http.MethodPost,
+		path:        "/stream-config",
+		contentType: "application/json",
+		body:        `{"events_supported": ["event1"], "delivery_method": "urn:ietf:rfc:8936"}`,
+		status:      http.StatusCreated,
+	})
+	var polled StreamConfig
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &polled))
+	pollPath := "/ssf/poll/" + polled.StreamID
+
+	// Management JWTs are signed with the secret of the stream they are for
+	jwtBody := func(streamID string, claims map[string]interface{}) string {
+		return mustSignWith(t, streamID, claims, streamSecret(streamID))
+	}
+	subject := map[string]interface{}{"format": "email", "email": "example.user@example.com"}
+
+	for _, c := range []contractCase{
+		{name: "create stream without events_endpoint", method: http.MethodPost, path: "/stream-config",
+			contentType: "application/json", body: `{"events_supported": ["event1"]}`, invalid: true, status: http.StatusBadRequest},
+		{name: "create stream with private endpoint", method: http.MethodPost, path: "/stream-config",
+			contentType: "application/json", body: `{"events_supported": ["event1"], "events_endpoint": "https://169.254.169.254/events"}`, status: http.StatusBadRequest},
+		{name: "get stream", method: http.MethodGet, path: streamPath, status: http.StatusOK},
+		{name: "get missing stream", method: http.MethodGet, path: "/stream-config/missing", status: http.StatusNotFound},
+		{name: "pause stream", method: http.MethodPut, path: streamPath, contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"status": "paused", "reason": "Maintenance"}), status: http.StatusOK},
+		{name: "update stream with invalid status", method: http.MethodPut, path: streamPath, contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"status": "invalid-status"}), invalid: true, status: http.StatusBadRequest},
+		{name: "update stream with JSON body", method: http.MethodPut, path: streamPath, contentType: "application/json",
+			body: `{"status": "paused"}`, invalid: true, status: http.StatusBadRequest},
+		{name: "update missing stream", method: http.MethodPut, path: "/stream-config/missing", contentType: "application/jwt",
+			body: jwtBody("missing", map[string]interface{}{"status": "enabled"}), status: http.StatusNotFound},
+		{name: "add subject", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": subject, "verified": true}), status: http.StatusOK},
+		{name: "add phone number subject", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": map[string]interface{}{"format": "phone_number", "phone_number": "+61400000000"}}), status: http.StatusOK},
+		{name: "add iss_sub subject", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": map[string]interface{}{"format": "iss_sub", "iss": "https://idp.example.com", "sub": "user-1"}}), status: http.StatusOK},
+		{name: "add subject missing its identifier", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": map[string]interface{}{"format": "opaque"}}), invalid: true, status: http.StatusBadRequest},
+		{name: "add subject with non-string member", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": map[string]interface{}{"format": "email", "email": 42}}), invalid: true, status: http.StatusBadRequest},
+		{name: "add subject with bad signature", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: mustSignWith(t, created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": subject}, "wrong-secret-of-at-least-thirty-two-bytes"), status: http.StatusUnauthorized},
+		{name: "add subject to missing stream", method: http.MethodPost, path: "/ssf/subjects:add", contentType: "application/jwt",
+			body: jwtBody("missing", map[string]interface{}{"stream_id": "missing", "subject": subject}), status: http.StatusNotFound},
+		{name: "remove subject", method: http.MethodPost, path: "/ssf/subjects:remove", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": subject}), status: http.StatusNoContent},
+		{name: "remove subject without stream_id", method: http.MethodPost, path: "/ssf/subjects:remove", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"subject": subject}), invalid: true, status: http.StatusBadRequest},
+		{name: "request verification", method: http.MethodPost, path: "/ssf/verify", contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "state": "abc"}), status: http.StatusNoContent},
+		{name: "request verification for missing stream", method: http.MethodPost, path: "/ssf/verify", contentType: "application/jwt",
+			body: jwtBody("missing", map[string]interface{}{"stream_id": "missing"}), status: http.StatusNotFound},
+		{name: "poll", method: http.MethodPost, path: pollPath, contentType: "application/json",
+			bearer: jwtBody(polled.StreamID, map[string]interface{}{"stream_id": polled.StreamID}),
+			body:   `{"maxEvents": 10, "returnImmediately": true, "ack": ["unknown-jti"]}`, status: http.StatusOK},
+		{name: "poll with token for another stream", method: http.MethodPost, path: pollPath, contentType: "application/json",
+			bearer: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID}),
+			body:   `{"returnImmediately": true}`, status: http.StatusUnauthorized},
+		{name: "poll a push stream", method: http.MethodPost, path: "/ssf/poll/" + created.StreamID, contentType: "application/json",
+			bearer: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID}),
+			body:   `{"returnImmediately": true}`, status: http.StatusBadRequest},
+		{name: "get transmitter configuration", method: http.MethodGet, path: "/.well-known/ssf-configuration", status: http.StatusOK},
+		{name: "get transmitter keys", method: http.MethodGet, path: "/ssf/jwks.json", status: http.StatusOK},
+		{name: "get openapi document", method: http.MethodGet, path: "/openapi.yaml", status: http.StatusOK},
+		{name: "delete stream with token for another stream", method: http.MethodDelete, path: streamPath, contentType: "application/jwt",
+			body: jwtBody(polled.StreamID, map[string]interface{}{"stream_id": polled.StreamID}), status: http.StatusUnauthorized},
+		{name: "delete stream", method: http.MethodDelete, path: streamPath, contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID}), status: http.StatusNoContent},
+		{name: "delete missing stream", method: http.MethodDelete, path: streamPath, contentType: "application/jwt",
+			body: jwtBody(created.StreamID, map[string]interface{}{"stream_id": created.StreamID}), status: http.StatusNotFound},
+	} {
+		serve(c)
+	}
+}
+
+// assertJWTClaimsMatch validates the payload of a JWT request body against
+// the schema named by the operation's x-jwt-claims extension
+func assertJWTClaimsMatch(t *testing.T, doc *openapi3.T, route *routers.Route, c contractCase) {
+	t.Helper()
+	ref, ok := route.Operation.Extensions["x-jwt-claims"].(string)
+	if !ok {
+		return
+	}
+	schema, ok := doc.Components.Schemas[strings.TrimPrefix(ref, "#/components/schemas/")]
+	if !assert.True(t, ok, "%s: unknown x-jwt-claims schema %s", c.name, ref) {
+		return
+	}
+
+	parts := strings.Split(c.body, ".")
+	if !assert.Len(t, parts, 3, c.name) {
+		return
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	assert.NoError(t, err, c.name)
+	var claims interface{}
+	assert.NoError(t, json.Unmarshal(payload, &claims), c.name)
+	assert.NoError(t, schema.Value.VisitJSON(claims), c.name)
+}
+
+func mustSignWith(t *testing.T, streamID string, claims map[string]interface{}, secret string) string {
+	t.Helper()
+	token, err := generateTestJWT(streamID, claims, secret)
+	assert.NoError(t, err)
+	return token
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// pendingSET is a SET that was queued but not delivered when the transmitter
+// stopped. The stream configuration is kept so the SET can be delivered
+// without looking the stream up again.
+type pendingSET struct {
+	Stream      StreamConfig `bson:"stream"`
+	SET         string       `bson:"set"`
+	StreamEvent bool         `bson:"stream_event,omitempty"`
+	QueuedAt    time.Time    `bson:"queued_at"`
+	Seq         int          `bson:"seq"`
+}
+
+// eventOutbox persists undelivered SETs across restarts
+type eventOutbox interface {
+	// Save stores SETs in delivery order
+	Save(ctx context.Context, pending []pendingSET) error
+	// Drain removes and returns every stored SET in delivery order
+	Drain(ctx context.Context) ([]pendingSET, error)
+}
+
+// mongoOutbox stores pending SETs in a MongoDB collection
+type mongoOutbox struct {
+	collection *mongo.Collection
+}
+
+func newMongoOutbox(collection *mongo.Collection) *mongoOutbox {
+	return &mongoOutbox{collection: collection}
+}
+
+func (o *mongoOutbox) Save(ctx context.Context, pending []pendingSET) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	docs := make([]interface{}, len(pending))
+	for i, p := range pending {
+		docs[i] = p
+	}
+	_, err := o.collection.InsertMany(ctx, docs)
+	return err
+}
+
+// Drain claims documents one at a time with FindOneAndDelete so that two
+// instances starting together never deliver the same SET twice
+func (o *mongoOutbox) Drain(ctx context.Context) ([]pendingSET, error) {
+	opts := options.FindOneAndDelete().SetSort(bson.D{{Key: "queued_at", Value: 1}, {Key: "seq", Value: 1}})
+
+	var drained []pendingSET
+	for {
+		var p pendingSET
+		err := o.collection.FindOneAndDelete(ctx, bson.M{}, opts).Decode(&p)
+		if err == mongo.ErrNoDocuments {
+			return drained, nil
+		}
+		if err != nil {
+			return drained, err
+		}
+		drained = append(drained, p)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// memoryOutbox is an in-process eventOutbox shared between transmitter instances in tests
+type memoryOutbox struct {
+	mu      sync.Mutex
+	pending []pendingSET
+}
+
+func (o *memoryOutbox) Save(ctx context.Context, pending []pendingSET) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending = append(o.pending, pending...)
+	return nil
+}
+
+func (o *memoryOutbox) Drain(ctx context.Context) ([]pendingSET, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	drained := o.pending
+	o.pending = nil
+	return drained, nil
+}
+
+func TestNoEventLostAcrossRestart(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	// The receiver is slow until the first instance has gone away
+	receiver := &recordingReceiver{t: t, received: map[string][]float64{}}
+	slow := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		select {
+		case <-slow:
+		case <-time.After(20 * time.Millisecond):
+		case <-r.Context().Done():
+			// The transmitter gave up on this request, so it must not count as delivered
+			return
+		}
+		receiver.record(r.URL.Path, body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	outbox := &memoryOutbox{}
+	streams := testStreams(ts.URL, 5)
+	events := make([]map[string]interface{}, 20)
+	for i := range events {
+		events[i] = map[string]interface{}{"event_type": "test", "seq": i}
+	}
+
+	first := NewTransmitter(TransmitterConfig{MaxPerHost: 2, QueueSize: len(events), Outbox: outbox})
+	assert.NoError(t, first.EmitBatch(context.Background(), events, streams))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, first.Shutdown(ctx), context.DeadlineExceeded)
+	assert.NotEmpty(t, outbox.pending, "undelivered events should be persisted")
+
+	// A new instance picks up the persisted events and the receiver recovers
+	close(slow)
+	second := NewTransmitter(TransmitterConfig{MaxPerHost: 2, QueueSize: len(events), Outbox: outbox})
+	defer second.Shutdown(context.Background())
+	assert.NoError(t, second.Restore(context.Background()))
+
+	flushCtx, flushCancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer flushCancel()
+	assert.NoError(t, second.Flush(flushCtx))
+	assert.Empty(t, outbox.pending)
+
+	// Every event arrives on every stream, in order; a SET interrupted mid-flight
+	// may legitimately be delivered twice, so collapse adjacent duplicates
+	for _, stream := range streams {
+		path := stream.EventsEndpoint[len(ts.URL):]
+		var seqs []float64
+		for _, seq := range receiver.received[path] {
+			if len(seqs) == 0 || seqs[len(seqs)-1] != seq {
+				seqs = append(seqs, seq)
+			}
+		}
+		assert.Len(t, seqs, len(events), path)
+		for i, seq := range seqs {
+			assert.Equal(t, float64(i), seq, "out of order delivery on %s", path)
+		}
+	}
+}
+
+func TestRestoreReturnsUnqueuedEventsToOutbox(t *testing.T) {
+	stream := StreamConfig{StreamID: "full-stream", EventsEndpoint: "https://receiver.example.com/events"}
+	outbox := &memoryOutbox{}
+	for i := 0; i < 5; i++ {
+		outbox.pending = append(outbox.pending, pendingSET{Stream: stream, SET: fmt.Sprintf("set-%d", i), Seq: i})
+	}
+
+	// The receiver never answers, so the queue of one fills up
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 1, QueueSize: 1, Outbox: outbox})
+	tr.deliver = func(ctx context.Context, streamConfig StreamConfig, set string) error {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tr.Restore(ctx), context.DeadlineExceeded)
+
+	// Whatever did not make it into the queue is back in the outbox, in order
+	var returned []string
+	for _, p := range outbox.pending {
+		returned = append(returned, p.SET)
+	}
+	assert.Equal(t, []string{"set-2", "set-3", "set-4"}, returned)
+
+	shutdownCtx, shutdownCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shutdownCancel()
+	tr.Shutdown(shutdownCtx)
+}
+
+func TestShutdownStopsServerAndPersistsQueuedEvents(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	blocked := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		select {
+		case <-blocked:
+		case <-r.Context().Done():
+		}
+	}))
+	defer ts.Close()
+	defer close(blocked)
+
+	outbox := &memoryOutbox{}
+	previous := transmitter
+	transmitter = NewTransmitter(TransmitterConfig{MaxPerHost: 1, QueueSize: 4, Outbox: outbox})
+	defer func() { transmitter = previous }()
+
+	sendStreamUpdatedEvent(StreamConfig{StreamID: "test-stream", Status: "paused", EventsEndpoint: ts.URL}, nil)
+	sendStreamUpdatedEvent(StreamConfig{StreamID: "test-stream", Status: "enabled", EventsEndpoint: ts.URL}, nil)
+
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	shutdown(ctx, server.Config)
+
+	_, err := http.Get(server.URL)
+	assert.Error(t, err, "management API should no longer accept requests")
+
+	assert.Len(t, outbox.pending, 2)
+	for i, status := range []string{"paused", "enabled"} {
+		set := capturedSET{streamID: "test-stream", claims: decodeSETClaims(t, outbox.pending[i].SET)}
+		assert.Equal(t, status, streamUpdate(t, set)["status"])
+	}
+
+	// New events are refused once the transmitter has stopped
+	err = transmitter.Enqueue(context.Background(), StreamConfig{StreamID: "test-stream", EventsEndpoint: ts.URL}, "set")
+	assert.ErrorIs(t, err, errTransmitterStopped)
+}
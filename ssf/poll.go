@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ssf/secevent"
+	"ssf/sectoken"
+)
+
+// pollWait bounds how long a poll that did not ask to return immediately is
+// held open waiting for SETs
+var pollWait = 30 * time.Second
+
+// maxPolledSETs is the number of unacknowledged SETs held per poll stream
+// before the oldest are dropped
+const maxPolledSETs = 1000
+
+// defaultPollMaxEvents is returned when a poll does not set maxEvents
+const defaultPollMaxEvents = 100
+
+// polledSET is a SET held until a receiver acknowledges it
+type polledSET struct {
+	StreamID string    `bson:"stream_id"`
+	JTI      string    `bson:"jti"`
+	SET      string    `bson:"set"`
+	QueuedAt time.Time `bson:"queued_at"`
+}
+
+// pollStore keeps the SETs of poll streams until their receivers acknowledge
+// them. A poll SET counts as delivered once it is stored, so the store must
+// survive restarts.
+type pollStore interface {
+	// Add stores a SET, dropping the stream's oldest SETs beyond max
+	Add(ctx context.Context, p polledSET, max int) error
+	// Next returns up to max of the stream's SETs, oldest first, and whether
+	// more are waiting
+	Next(ctx context.Context, streamID string, max int) ([]polledSET, bool, error)
+	// Acknowledge removes the stream's SETs with the given jtis
+	Acknowledge(ctx context.Context, streamID string, jtis []string) error
+	// Drop removes every SET held for the stream
+	Drop(ctx context.Context, streamID string) error
+}
+
+// pollQueue holds SETs for streams using poll delivery (RFC 8936) until
+// the receiver acknowledges them, waking polls waiting for SETs
+type pollQueue struct {
+	store pollStore
+
+	mu      sync.Mutex
+	arrived map[string]chan struct{}
+}
+
+// polledSETs holds the SETs of every poll stream
+var polledSETs *pollQueue
+
+func newPollQueue(store pollStore) *pollQueue {
+	return &pollQueue{
+		store:   store,
+		arrived: map[string]chan struct{}{},
+	}
+}
+
+// add stores a SET for the stream and wakes any poll waiting on it
+func (q *pollQueue) add(ctx context.Context, streamID, set string) error {
+	jti, err := sectoken.UnverifiedJTI(set)
+	if err != nil {
+		return err
+	}
+	p := polledSET{StreamID: streamID, JTI: jti, SET: set, QueuedAt: time.Now().UTC()}
+	if err := q.store.Add(ctx, p, maxPolledSETs); err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if arrived, ok := q.arrived[streamID]; ok {
+		close(arrived)
+		delete(q.arrived, streamID)
+	}
+	return nil
+}
+
+// acknowledge removes the SETs the receiver has acknowledged or rejected
+func (q *pollQueue) acknowledge(ctx context.Context, streamID string, jtis []string) error {
+	if len(jtis) == 0 {
+		return nil
+	}
+	return q.store.Acknowledge(ctx, streamID, jtis)
+}
+
+// next returns up to max unacknowledged SETs, oldest first, and a channel
+// that is closed when another SET arrives
+func (q *pollQueue) next(ctx context.Context, streamID string, max int) (map[string]string, bool, <-chan struct{}, error) {
+	// Wait on the channel before reading so a SET added in between still wakes the poll
+	q.mu.Lock()
+	arrived, ok := q.arrived[streamID]
+	if !ok {
+		arrived = make(chan struct{})
+		q.arrived[streamID] = arrived
+	}
+	q.mu.Unlock()
+
+	pending, more, err := q.store.Next(ctx, streamID, max)
+	if err != nil {
+		return nil, false, nil, err
+	}
+	sets := make(map[string]string, len(pending))
+	for _, p := range pending {
+		sets[p.JTI] = p.SET
+	}
+	return sets, more, arrived, nil
+}
+
+// drop discards everything held for a stream
+func (q *pollQueue) drop(ctx context.Context, streamID string) error {
+	q.mu.Lock()
+	delete(q.arrived, streamID)
+	q.mu.Unlock()
+	return q.store.Drop(ctx, streamID)
+}
+
+// mongoPollStore keeps poll SETs in a MongoDB collection
+type mongoPollStore struct {
+	collection *mongo.Collection
+}
+
+func newMongoPollStore(collection *mongo.Collection) *mongoPollStore {
+	return &mongoPollStore{collection: collection}
+}
+
+// oldestFirst orders a stream's SETs by when they were queued
+var oldestFirst = bson.D{{Key: "queued_at", Value: 1}, {Key: "_id", Value: 1}}
+
+func (s *mongoPollStore) Add(ctx context.Context, p polledSET, max int) error {
+	if _, err := s.collection.InsertOne(ctx, p); err != nil {
+		return err
+	}
+	count, err := s.collection.CountDocuments(ctx, bson.M{"stream_id": p.StreamID})
+	if err != nil || count <= int64(max) {
+		return err
+	}
+
+	log.Printf("Dropping %d oldest unacknowledged SETs for poll stream %s, queue is full", count-int64(max), p.StreamID)
+	opts := options.Find().SetSort(oldestFirst).SetLimit(count - int64(max)).SetProjection(bson.M{"_id": 1})
+	cursor, err := s.collection.Find(ctx, bson.M{"stream_id": p.StreamID}, opts)
+	if err != nil {
+		return err
+	}
+	var oldest []struct {
+		ID interface{} `bson:"_id"`
+	}
+	if err := cursor.All(ctx, &oldest); err != nil {
+		return err
+	}
+	ids := make([]interface{}, len(oldest))
+	for i, o := range oldest {
+		ids[i] = o.ID
+	}
+	_, err = s.collection.DeleteMany(ctx, bson.M{"_id": bson.M{"$in": ids}})
+	return err
+}
+
+func (s *mongoPollStore) Next(ctx context.Context, streamID string, max int) ([]polledSET, bool, error) {
+	opts := options.Find().SetSort(oldestFirst).SetLimit(int64(max) + 1)
+	cursor, err := s.collection.Find(ctx, bson.M{"stream_id": streamID}, opts)
+	if err != nil {
+		return nil, false, err
+	}
+	var pending []polledSET
+	if err := cursor.All(ctx, &pending); err != nil {
+		return nil, false, err
+	}
+	if len(pending) > max {
+		return pending[:max], true, nil
+	}
+	return pending, false, nil
+}
+
+func (s *mongoPollStore) Acknowledge(ctx context.Context, streamID string, jtis []string) error {
+	_, err := s.collection.DeleteMany(ctx, bson.M{"stream_id": streamID, "jti": bson.M{"$in": jtis}})
+	return err
+}
+
+func (s *mongoPollStore) Drop(ctx context.Context, streamID string) error {
+	_, err := s.collection.DeleteMany(ctx, bson.M{"stream_id": streamID})
+	return err
+}
+
+// deliverToStream hands a SET to the stream's delivery method: pushed to the
+// receiver for RFC 8935 streams, or held for the receiver to poll for RFC 8936
+func deliverToStream(ctx context.Context, streamConfig StreamConfig, set string) error {
+	if streamConfig.DeliveryMethod == secevent.PollDeliveryMethod {
+		return polledSETs.add(ctx, streamConfig.StreamID, set)
+	}
+	return deliverSET(ctx, streamConfig, set)
+}
+
+// pollEvents handles an RFC 8936 poll. The receiver authenticates with a
+// bearer JWT, signed with the stream's management secret, whose stream_id
+// claim names the stream being polled.
+func pollEvents(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "stream_id")
+
+	claims, err := parseToken(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), streamID)
+	if err != nil {
+		http.Error(w, "Invalid JWT: "+err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if claimed, _ := claims["stream_id"].(string); claimed != streamID {
+		http.Error(w, "JWT is not valid for this stream", http.StatusUnauthorized)
+		return
+	}
+
+	var pollRequest secevent.PollRequest
+	if err := json.NewDecoder(r.Body).Decode(&pollRequest); err != nil {
+		http.Error(w, "Invalid poll request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamConfig, err := streams.Get(ctx, streamID)
+	if err != nil {
+		if err == errStreamNotFound {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching stream configuration: %v", err)
+		http.Error(w, "Failed to fetch stream configuration", http.StatusInternalServerError)
+		return
+	}
+	if streamConfig.DeliveryMethod != secevent.PollDeliveryMethod {
+		http.Error(w, "Stream does not use poll delivery", http.StatusBadRequest)
+		return
+	}
+
+	// Acknowledged and rejected SETs are both finished with (RFC 8936 2.4)
+	done := pollRequest.Ack
+	for jti, setErr := range pollRequest.SetErrs {
+		log.Printf("Receiver rejected SET %s on stream %s: %s %s", jti, streamID, setErr.Err, setErr.Description)
+		done = append(done, jti)
+	}
+	if err := polledSETs.acknowledge(ctx, streamID, done); err != nil {
+		log.Printf("Error acknowledging SETs on poll stream %s: %v", streamID, err)
+		http.Error(w, "Failed to acknowledge SETs", http.StatusInternalServerError)
+		return
+	}
+
+	maxEvents := pollRequest.MaxEvents
+	if maxEvents <= 0 {
+		maxEvents = defaultPollMaxEvents
+	}
+
+	sets, more, arrived, err := polledSETs.next(ctx, streamID, maxEvents)
+	if err == nil && len(sets) == 0 && !pollRequest.ReturnImmediately {
+		timer := time.NewTimer(pollWait)
+		defer timer.Stop()
+		select {
+		case <-arrived:
+			sets, more, _, err = polledSETs.next(r.Context(), streamID, maxEvents)
+		case <-timer.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if err != nil {
+		log.Printf("Error reading SETs for poll stream %s: %v", streamID, err)
+		http.Error(w, "Failed to read SETs", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secevent.PollResponse{Sets: sets, MoreAvailable: more})
+}
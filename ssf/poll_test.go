@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"ssf/secevent"
+	"ssf/ssfclient"
+)
+
+// memoryPollStore is an in-process pollStore, shared between poll queues in
+// tests the way a MongoDB collection is shared across restarts
+type memoryPollStore struct {
+	mu   sync.Mutex
+	sets map[string][]polledSET
+}
+
+func newMemoryPollStore() *memoryPollStore {
+	return &memoryPollStore{sets: map[string][]polledSET{}}
+}
+
+// useMemoryPollStore swaps the poll queue for one backed by a memoryPollStore
+func useMemoryPollStore(t testing.TB) *memoryPollStore {
+	store := newMemoryPollStore()
+	previous := polledSETs
+	polledSETs = newPollQueue(store)
+	t.Cleanup(func() { polledSETs = previous })
+	return store
+}
+
+func (s *memoryPollStore) Add(ctx context.Context, p polledSET, max int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sets := append(s.sets[p.StreamID], p)
+	if len(sets) > max {
+		sets = sets[len(sets)-max:]
+	}
+	s.sets[p.StreamID] = sets
+	return nil
+}
+
+func (s *memoryPollStore) Next(ctx context.Context, streamID string, max int) ([]polledSET, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending := s.sets[streamID]
+	if len(pending) > max {
+		return append([]polledSET(nil), pending[:max]...), true, nil
+	}
+	return append([]polledSET(nil), pending...), false, nil
+}
+
+func (s *memoryPollStore) Acknowledge(ctx context.Context, streamID string, jtis []string) error {
+	done := make(map[string]bool, len(jtis))
+	for _, jti := range jtis {
+		done[jti] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []polledSET
+	for _, p := range s.sets[streamID] {
+		if !done[p.JTI] {
+			kept = append(kept, p)
+		}
+	}
+	s.sets[streamID] = kept
+	return nil
+}
+
+func (s *memoryPollStore) Drop(ctx context.Context, streamID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sets, streamID)
+	return nil
+}
+
+func TestPolledSETsSurviveRestart(t *testing.T) {
+	useMemoryStreamStore(t)
+	useTransmitter(t)
+	store := useMemoryPollStore(t)
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+	useIssuer(t, ts.URL)
+
+	ctx := context.Background()
+	client := ssfclient.New(ts.URL)
+	stream, err := client.CreateStream(ctx, ssfclient.StreamRequest{
+		EventsSupported: []string{secevent.VerificationType},
+		DeliveryMethod:  secevent.PollDeliveryMethod,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NoError(t, client.RequestVerification(ctx, stream.StreamID, "before-restart"))
+	states := func(resp *secevent.PollResponse) []string {
+		var states []string
+		for _, token := range resp.Sets {
+			set, err := client.VerifySET(ctx, stream.StreamID, token)
+			if !assert.NoError(t, err) {
+				continue
+			}
+			var verification secevent.Verification
+			if ok, _ := set.Event(secevent.VerificationType, &verification); ok {
+				states = append(states, verification.State)
+			}
+		}
+		return states
+	}
+
+	// The SETs were handed out but never acknowledged when the transmitter restarted
+	resp, err := client.Poll(ctx, stream, secevent.PollRequest{ReturnImmediately: true})
+	assert.NoError(t, err)
+	assert.Len(t, resp.Sets, 2)
+	polledSETs = newPollQueue(store)
+
+	again, err := client.Poll(ctx, stream, secevent.PollRequest{ReturnImmediately: true})
+	assert.NoError(t, err)
+	assert.Equal(t, resp.Sets, again.Sets)
+	assert.Equal(t, []string{"before-restart"}, states(again))
+
+	// Only acknowledging removes them
+	var ack []string
+	for jti := range again.Sets {
+		ack = append(ack, jti)
+	}
+	_, err = client.Poll(ctx, stream, secevent.PollRequest{ReturnImmediately: true, Ack: ack})
+	assert.NoError(t, err)
+	pending, _, err := store.Next(ctx, stream.StreamID, maxPolledSETs)
+	assert.NoError(t, err)
+	assert.Empty(t, pending)
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"ssf/secevent"
+	"ssf/ssfclient"
+)
+
+// useIssuer points the transmitter's issuer, and so its advertised endpoints, at baseURL
+func useIssuer(t *testing.T, baseURL string) {
+	previous := transmitterIssuer
+	transmitterIssuer = baseURL
+	t.Cleanup(func() { transmitterIssuer = previous })
+}
+
+// useTransmitter swaps in a transmitter using the default delivery path
+func useTransmitter(t *testing.T) {
+	previous := transmitter
+	transmitter = NewTransmitter(TransmitterConfig{MaxPerHost: 1, QueueSize: 16})
+	t.Cleanup(func() {
+		transmitter.Shutdown(context.Background())
+		transmitter = previous
+	})
+}
+
+// pollAll polls until a verification event carrying state arrives,
+// acknowledging and returning every verified SET
+func pollAll(t *testing.T, client *ssfclient.Client, stream *ssfclient.Stream, state string) []*secevent.SET {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var received []*secevent.SET
+	var ack []string
+	for {
+		resp, err := client.Poll(ctx, stream, secevent.PollRequest{MaxEvents: 1, Ack: ack})
+		if !assert.NoError(t, err) {
+			return received
+		}
+		ack = nil
+		for jti, token := range resp.Sets {
+			set, err := client.VerifySET(ctx, stream.StreamID, token)
+			if !assert.NoError(t, err) {
+				return received
+			}
+			assert.Equal(t, jti, set.JTI)
+			received = append(received, set)
+			ack = append(ack, jti)
+
+			var verification secevent.Verification
+			if ok, _ := set.Event(secevent.VerificationType, &verification); ok && verification.State == state {
+				_, err := client.Poll(ctx, stream, secevent.PollRequest{ReturnImmediately: true, Ack: ack})
+				assert.NoError(t, err)
+				return received
+			}
+		}
+	}
+}
+
+func TestClientManagesPollStream(t *testing.T) {
+	useMemoryStreamStore(t)
+	useTransmitter(t)
+	useMemoryPollStore(t)
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+	useIssuer(t, ts.URL)
+
+	ctx := context.Background()
+	client := ssfclient.New(ts.URL)
+
+	metadata, err := client.Discover(ctx)
+	assert.NoError(t, err)
+	assert.Contains(t, metadata.DeliveryMethodsSupported, secevent.PollDeliveryMethod)
+	assert.Equal(t, ts.URL+"/ssf/verify", metadata.VerificationEndpoint)
+	assert.Equal(t, ts.URL+"/ssf/jwks.json", metadata.JWKSURI)
+
+	stream, err := client.CreateStream(ctx, ssfclient.StreamRequest{
+		EventsSupported: []string{secevent.StreamUpdatedType},
+		DeliveryMethod:  secevent.PollDeliveryMethod,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, ts.URL+"/ssf/poll/"+stream.StreamID, stream.EventsEndpoint)
+	assert.NotEmpty(t, stream.ManagementSecret)
+
+	subject := secevent.SubjectID{Format: "email", Email: "example.user@example.com"}
+	assert.NoError(t, client.AddSubject(ctx, stream.StreamID, subject, true))
+	assert.NoError(t, client.RequestVerification(ctx, stream.StreamID, "state-1"))
+
+	// Events arrive in order and carry the shared event types
+	received := pollAll(t, client, stream, "state-1")
+	var reasons []string
+	for _, set := range received {
+		assert.Equal(t, secevent.StreamSubject(stream.StreamID), *set.SubID)
+		var update secevent.StreamUpdated
+		if ok, err := set.Event(secevent.StreamUpdatedType, &update); ok {
+			assert.NoError(t, err)
+			reasons = append(reasons, update.Reason)
+		}
+	}
+	assert.Equal(t, []string{reasonStreamCreated, reasonSubjectAdded}, reasons)
+	assert.Len(t, received, 3)
+
+	// Everything was acknowledged
+	resp, err := client.Poll(ctx, stream, secevent.PollRequest{ReturnImmediately: true})
+	assert.NoError(t, err)
+	assert.Empty(t, resp.Sets)
+
+	assert.NoError(t, client.UpdateStatus(ctx, stream.StreamID, "paused", "Maintenance"))
+	assert.NoError(t, client.RemoveSubject(ctx, stream.StreamID, subject))
+	updated, err := client.GetStream(ctx, stream.StreamID)
+	assert.NoError(t, err)
+	assert.Equal(t, "paused", updated.Status)
+	assert.Empty(t, updated.Subjects)
+	if assert.Len(t, updated.StatusHistory, 2) {
+		assert.Equal(t, initiatedByReceiver, updated.StatusHistory[1].InitiatedBy)
+	}
+
+	assert.NoError(t, client.DeleteStream(ctx, stream.StreamID))
+	_, err = client.GetStream(ctx, stream.StreamID)
+	var apiErr *ssfclient.Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+	}
+}
+
+func TestClientManagesNonEmailSubjects(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	useTransmitter(t)
+	useMemoryPollStore(t)
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+	useIssuer(t, ts.URL)
+
+	ctx := context.Background()
+	client := ssfclient.New(ts.URL)
+	stream, err := client.CreateStream(ctx, ssfclient.StreamRequest{
+		EventsSupported: []string{secevent.StreamUpdatedType},
+		DeliveryMethod:  secevent.PollDeliveryMethod,
+	})
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	subjects := []secevent.SubjectID{
+		{Format: "phone_number", PhoneNumber: "+61400000000"},
+		{Format: "opaque", ID: "customer-42"},
+		{Format: "iss_sub", Iss: "https://idp.example.com", Sub: "user-1"},
+	}
+	for _, subject := range subjects {
+		assert.NoError(t, client.AddSubject(ctx, stream.StreamID, subject, true), subject.Format)
+	}
+	stored, err := store.Get(ctx, stream.StreamID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Subject{Subject(subjects[0]), Subject(subjects[1]), Subject(subjects[2])}, stored.Subjects)
+
+	assert.NoError(t, client.RemoveSubject(ctx, stream.StreamID, subjects[1]))
+	stored, err = store.Get(ctx, stream.StreamID)
+	assert.NoError(t, err)
+	assert.Equal(t, []Subject{Subject(subjects[0]), Subject(subjects[2])}, stored.Subjects)
+
+	// A subject missing the member its format needs is rejected
+	err = client.AddSubject(ctx, stream.StreamID, secevent.SubjectID{Format: "iss_sub", Iss: "https://idp.example.com"}, true)
+	assert.Error(t, err)
+}
+
+func TestPollWaitsForEvents(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	useTransmitter(t)
+	useMemoryPollStore(t)
+	ts := httptest.NewServer(newRouter())
+	defer ts.Close()
+	useIssuer(t, ts.URL)
+
+	streamConfig := StreamConfig{
+		StreamID:       "poll-stream",
+		EventsEndpoint: ts.URL + "/ssf/poll/poll-stream",
+		DeliveryMethod: secevent.PollDeliveryMethod,
+		Status:         "enabled",
+	}
+	assert.NoError(t, store.Create(context.Background(), streamConfig))
+
+	client := ssfclient.New(ts.URL)
+	client.SetStreamSecret(streamConfig.StreamID, streamSecret(streamConfig.StreamID))
+	stream := &ssfclient.Stream{StreamID: streamConfig.StreamID, EventsEndpoint: streamConfig.EventsEndpoint, DeliveryMethod: streamConfig.DeliveryMethod}
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sendStreamEvent(streamConfig, secevent.VerificationType, secevent.Verification{State: "late"})
+	}()
+
+	ctx := context.Background()
+	resp, err := client.Poll(ctx, stream, secevent.PollRequest{})
+	assert.NoError(t, err)
+	if assert.Len(t, resp.Sets, 1) {
+		for _, token := range resp.Sets {
+			set, err := client.VerifySET(ctx, stream.StreamID, token)
+			assert.NoError(t, err)
+			var verification secevent.Verification
+			ok, _ := set.Event(secevent.VerificationType, &verification)
+			assert.True(t, ok)
+			assert.Equal(t, "late", verification.State)
+		}
+	}
+}
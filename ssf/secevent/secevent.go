@@ -0,0 +1,108 @@
+// Package secevent holds the Shared Signals Framework wire types shared by the
+// transmitter and by receivers using ssfclient: event types and payloads,
+// Security Event Token claims, transmitter metadata and RFC 8936 polling.
+package secevent
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Event types defined by SSF
+const (
+	StreamUpdatedType = "https://schemas.openid.net/secevent/ssf/event-type/stream-updated"
+	VerificationType  = "https://schemas.openid.net/secevent/ssf/event-type/verification"
+)
+
+// Delivery methods defined by SSF
+const (
+	PushDeliveryMethod = "urn:ietf:rfc:8935"
+	PollDeliveryMethod = "urn:ietf:rfc:8936"
+)
+
+// SubjectID identifies the subject of an event (RFC 9493). Only the members
+// relevant to Format are set.
+type SubjectID struct {
+	Format      string `json:"format"`
+	ID          string `json:"id,omitempty"`
+	Email       string `json:"email,omitempty"`
+	PhoneNumber string `json:"phone_number,omitempty"`
+	Iss         string `json:"iss,omitempty"`
+	Sub         string `json:"sub,omitempty"`
+}
+
+// StreamSubject returns the opaque subject identifying a stream itself, used
+// as the sub_id of stream-updated and verification events
+func StreamSubject(streamID string) SubjectID {
+	return SubjectID{Format: "opaque", ID: streamID}
+}
+
+// StreamUpdated is the payload of a stream-updated event (SSF 7.1.5)
+type StreamUpdated struct {
+	Status string `json:"status"`
+	Reason string `json:"reason,omitempty"`
+}
+
+// Verification is the payload of a verification event (SSF 7.1.4.1). State
+// is only set when the receiver asked for the event.
+type Verification struct {
+	State string `json:"state,omitempty"`
+}
+
+// SET is the claims set of a Security Event Token (RFC 8417). Event payloads
+// are kept raw and decoded on demand with Event.
+type SET struct {
+	Issuer   string                     `json:"iss"`
+	IssuedAt int64                      `json:"iat"`
+	JTI      string                     `json:"jti"`
+	SubID    *SubjectID                 `json:"sub_id,omitempty"`
+	Events   map[string]json.RawMessage `json:"events"`
+}
+
+// Event decodes the payload of eventType into v, reporting whether the SET
+// carries that event
+func (s *SET) Event(eventType string, v interface{}) (bool, error) {
+	raw, ok := s.Events[eventType]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, fmt.Errorf("invalid %s event: %v", eventType, err)
+	}
+	return true, nil
+}
+
+// TransmitterMetadata is served at /.well-known/ssf-configuration (SSF 6.1)
+type TransmitterMetadata struct {
+	SpecVersion              string   `json:"spec_version,omitempty"`
+	Issuer                   string   `json:"issuer"`
+	JWKSURI                  string   `json:"jwks_uri,omitempty"`
+	DeliveryMethodsSupported []string `json:"delivery_methods_supported,omitempty"`
+	ConfigurationEndpoint    string   `json:"configuration_endpoint,omitempty"`
+	StatusEndpoint           string   `json:"status_endpoint,omitempty"`
+	AddSubjectEndpoint       string   `json:"add_subject_endpoint,omitempty"`
+	RemoveSubjectEndpoint    string   `json:"remove_subject_endpoint,omitempty"`
+	VerificationEndpoint     string   `json:"verification_endpoint,omitempty"`
+	DefaultSubjects          string   `json:"default_subjects,omitempty"`
+}
+
+// PollRequest is the body of an RFC 8936 poll. SETs listed in Ack or SetErrs
+// are removed from the transmitter's queue.
+type PollRequest struct {
+	MaxEvents         int                 `json:"maxEvents,omitempty"`
+	ReturnImmediately bool                `json:"returnImmediately"`
+	Ack               []string            `json:"ack,omitempty"`
+	SetErrs           map[string]SetError `json:"setErrs,omitempty"`
+}
+
+// SetError reports why a receiver rejected a SET (RFC 8935 section 2.3)
+type SetError struct {
+	Err         string `json:"err"`
+	Description string `json:"description,omitempty"`
+}
+
+// PollResponse is the body of an RFC 8936 poll response, with SETs keyed by jti
+type PollResponse struct {
+	Sets          map[string]string `json:"sets"`
+	MoreAvailable bool              `json:"moreAvailable,omitempty"`
+}
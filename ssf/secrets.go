@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+)
+
+// sealedPrefix marks a value that has been encrypted by sealSecret, so that
+// openSecret knows to decrypt it.
+const sealedPrefix = "enc:v1:"
+
+// secretsKey is the AES-256 key used to encrypt receiver credentials before
+// they are written to MongoDB. It is loaded from SSF_SECRETS_KEY in main.
+var secretsKey []byte
+
+// loadSecretsKey decodes the base64 encoded 32 byte key held in SSF_SECRETS_KEY
+func loadSecretsKey() ([]byte, error) {
+	encoded := os.Getenv("SSF_SECRETS_KEY")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("SSF_SECRETS_KEY is not valid base64: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("SSF_SECRETS_KEY must decode to 32 bytes, got %d", len(key))
+	}
+	return key, nil
+}
+
+// sealSecret encrypts a secret with AES-GCM for storage at rest. Values that
+// already look sealed are sealed again: they come from the receiver, and
+// passing them through would have the transmitter decrypt a secret copied
+// from another stream and send it to this receiver.
+func sealSecret(plaintext string) (string, error) {
+	if plaintext == "" {
+		return plaintext, nil
+	}
+	gcm, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return sealedPrefix + base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// openSecret decrypts a value produced by sealSecret
+func openSecret(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	gcm, err := secretsCipher()
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, sealedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed to decode sealed secret: %v", err)
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", fmt.Errorf("sealed secret is too short")
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt sealed secret: %v", err)
+	}
+	return string(plaintext), nil
+}
+
+func secretsCipher() (cipher.AEAD, error) {
+	if len(secretsKey) == 0 {
+		return nil, fmt.Errorf("SSF_SECRETS_KEY is not configured")
+	}
+	block, err := aes.NewCipher(secretsKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// minSigningSecretLength is the smallest HS256 key allowed (RFC 7518 3.2)
+const minSigningSecretLength = 32
+
+// signingSecret is the key each stream's management secret is derived from.
+// It never leaves the transmitter.
+var signingSecret string
+
+// loadSigningSecret reads SSF_SIGNING_SECRET, the key management secrets are derived from
+func loadSigningSecret() (string, error) {
+	secret := os.Getenv("SSF_SIGNING_SECRET")
+	if secret == "" {
+		return "", fmt.Errorf("SSF_SIGNING_SECRET is not set")
+	}
+	if len(secret) < minSigningSecretLength {
+		return "", fmt.Errorf("SSF_SIGNING_SECRET must be at least %d bytes, got %d", minSigningSecretLength, len(secret))
+	}
+	return secret, nil
+}
+
+// streamSecret derives the HS256 key a stream's receiver signs management
+// requests and polls with. It is returned once, when the stream is created,
+// and is only valid for that stream.
+func streamSecret(streamID string) string {
+	mac := hmac.New(sha256.New, []byte(signingSecret))
+	mac.Write([]byte("ssf-stream-management:" + streamID))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// setSigningKey is the private key every SET is signed with. Its public half
+// is published at jwks_uri for receivers to verify SETs.
+var setSigningKey jose.JSONWebKey
+
+// loadSETSigningKey reads the PEM encoded P-256 private key in SSF_SET_SIGNING_KEY
+func loadSETSigningKey() (jose.JSONWebKey, error) {
+	encoded := os.Getenv("SSF_SET_SIGNING_KEY")
+	if encoded == "" {
+		return jose.JSONWebKey{}, fmt.Errorf("SSF_SET_SIGNING_KEY is not set")
+	}
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return jose.JSONWebKey{}, fmt.Errorf("SSF_SET_SIGNING_KEY is not PEM encoded")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return jose.JSONWebKey{}, fmt.Errorf("SSF_SET_SIGNING_KEY is invalid: %v", err)
+	}
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok || ecKey.Curve != elliptic.P256() {
+		return jose.JSONWebKey{}, fmt.Errorf("SSF_SET_SIGNING_KEY must be a P-256 key")
+	}
+	return newSETSigningKey(ecKey)
+}
+
+// newSETSigningKey wraps an ES256 key as a JWK whose kid is its thumbprint, so
+// that a rotated key gets a new kid
+func newSETSigningKey(key *ecdsa.PrivateKey) (jose.JSONWebKey, error) {
+	jwk := jose.JSONWebKey{Key: key, Algorithm: string(jose.ES256), Use: "sig"}
+	thumbprint, err := jwk.Thumbprint(crypto.SHA256)
+	if err != nil {
+		return jose.JSONWebKey{}, err
+	}
+	jwk.KeyID = base64.RawURLEncoding.EncodeToString(thumbprint)
+	return jwk, nil
+}
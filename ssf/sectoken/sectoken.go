@@ -0,0 +1,221 @@
+// Package sectoken signs, verifies, encrypts and decrypts the JOSE objects
+// exchanged with the SSF transmitter: HS256 signed management request JWTs,
+// keyed with a secret of the stream they manage, and ES256 signed Security
+// Event Tokens, optionally nested in a JWE for the receiver.
+package sectoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/go-jose/go-jose/v4/jwt"
+)
+
+// Token types set in the "typ" header
+const (
+	// SETType marks a Security Event Token (RFC 8417 section 2.3)
+	SETType = "secevent+jwt"
+	// JWTType marks a management request JWT
+	JWTType = "JWT"
+)
+
+// ErrMissingExpiry is returned by Verify for a JWT without an exp claim
+var ErrMissingExpiry = errors.New("token has no exp claim")
+
+// Signature algorithms accepted when verifying management JWTs and SETs.
+// SETs are signed with the transmitter's private key so that receivers, who
+// only hold its public key, cannot forge them.
+var (
+	signatureAlgorithms    = []jose.SignatureAlgorithm{jose.HS256}
+	setSignatureAlgorithms = []jose.SignatureAlgorithm{jose.ES256}
+)
+
+// Key management and content encryption algorithms accepted for nested SETs
+var (
+	keyAlgorithms     = []jose.KeyAlgorithm{jose.RSA_OAEP_256, jose.ECDH_ES_A256KW}
+	contentEncryption = []jose.ContentEncryption{jose.A256GCM}
+)
+
+// Sign serializes claims as an HS256 signed compact JWS with the given typ
+func Sign(claims interface{}, key []byte, typ string) (string, error) {
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.HS256, Key: key},
+		(&jose.SignerOptions{}).WithType(jose.ContentType(typ)),
+	)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+// Expected names who must have issued a token and who it must be for.
+// Management JWTs are issued by a stream, identified by its stream_id, to the
+// transmitter's issuer URL; SETs are issued by the transmitter to a stream.
+type Expected struct {
+	Issuer   string
+	Audience string
+}
+
+// validate checks the registered claims of a verified token against e
+func (e Expected) validate(registered jwt.Claims) error {
+	if e.Issuer == "" || e.Audience == "" {
+		return fmt.Errorf("expected issuer and audience must be set")
+	}
+	return registered.Validate(jwt.Expected{Issuer: e.Issuer, AnyAudience: jwt.Audience{e.Audience}})
+}
+
+// Verify checks an HS256 signed JWT, its iss and aud claims against expected
+// and its exp, nbf and iat claims, then decodes its claims into out. The JWT
+// must have an exp claim, so a captured request cannot be replayed forever.
+func Verify(token string, key []byte, expected Expected, out interface{}) error {
+	parsed, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil {
+		return err
+	}
+	var registered jwt.Claims
+	if err := parsed.Claims(key, &registered, out); err != nil {
+		return err
+	}
+	if registered.Expiry == nil {
+		return ErrMissingExpiry
+	}
+	return expected.validate(registered)
+}
+
+// SignSET serializes claims as an ES256 signed SET. key must be a P-256
+// private key with a kid, which receivers use to find the matching public key
+// in the transmitter's JWKS.
+func SignSET(claims interface{}, key jose.JSONWebKey) (string, error) {
+	if key.KeyID == "" {
+		return "", fmt.Errorf("SET signing key has no kid")
+	}
+	signer, err := jose.NewSigner(
+		jose.SigningKey{Algorithm: jose.ES256, Key: key},
+		(&jose.SignerOptions{}).WithType(SETType),
+	)
+	if err != nil {
+		return "", err
+	}
+	return jwt.Signed(signer).Claims(claims).Serialize()
+}
+
+// VerifySET checks an ES256 signed SET against the transmitter's public keys,
+// its iss and aud claims against expected and its exp, nbf and iat claims,
+// then decodes its claims into out. The error wraps jose.ErrJWKSKidNotFound
+// if keys has no key for the SET's kid.
+func VerifySET(token string, keys jose.JSONWebKeySet, expected Expected, out interface{}) error {
+	parsed, err := jwt.ParseSigned(token, setSignatureAlgorithms)
+	if err != nil {
+		return err
+	}
+	var registered jwt.Claims
+	if err := parsed.Claims(keys, &registered, out); err != nil {
+		return err
+	}
+	return expected.validate(registered)
+}
+
+// UnverifiedClaims decodes the claims of an HS256 signed JWT without checking
+// its signature. It is only for choosing the key the token must then be
+// verified with.
+func UnverifiedClaims(token string, out interface{}) error {
+	parsed, err := jwt.ParseSigned(token, signatureAlgorithms)
+	if err != nil {
+		return err
+	}
+	return parsed.UnsafeClaimsWithoutVerification(out)
+}
+
+// IsEncrypted reports whether a token is a compact JWE rather than a JWS
+func IsEncrypted(token string) bool {
+	return strings.Count(token, ".") == 4
+}
+
+// Encrypt nests a signed token in a JWE for the receiver's public key. jti
+// is replicated into the JWE header (RFC 7519 section 5.3) so the token can
+// be tracked, for example by an RFC 8936 poll queue, without decrypting it.
+func Encrypt(jws string, key jose.JSONWebKey, jti string) (string, error) {
+	alg := jose.KeyAlgorithm(key.Algorithm)
+	if alg == "" {
+		switch key.Key.(type) {
+		case *rsa.PublicKey:
+			alg = jose.RSA_OAEP_256
+		case *ecdsa.PublicKey:
+			alg = jose.ECDH_ES_A256KW
+		default:
+			return "", fmt.Errorf("unsupported encryption key type %T", key.Key)
+		}
+	}
+	if !supportedKeyAlgorithm(alg) {
+		return "", fmt.Errorf("unsupported key encryption algorithm %s", alg)
+	}
+
+	opts := (&jose.EncrypterOptions{}).WithContentType("JWT").WithType(SETType)
+	if jti != "" {
+		opts = opts.WithHeader("jti", jti)
+	}
+	encrypter, err := jose.NewEncrypter(jose.A256GCM, jose.Recipient{Algorithm: alg, Key: key.Key, KeyID: key.KeyID}, opts)
+	if err != nil {
+		return "", err
+	}
+	jwe, err := encrypter.Encrypt([]byte(jws))
+	if err != nil {
+		return "", err
+	}
+	return jwe.CompactSerialize()
+}
+
+// Decrypt opens a JWE with the receiver's private key and returns the nested token
+func Decrypt(token string, key interface{}) (string, error) {
+	jwe, err := jose.ParseEncrypted(token, keyAlgorithms, contentEncryption)
+	if err != nil {
+		return "", err
+	}
+	nested, err := jwe.Decrypt(key)
+	if err != nil {
+		return "", err
+	}
+	return string(nested), nil
+}
+
+// UnverifiedJTI returns the jti of a token this service created, from the
+// payload of a JWS or the replicated header of a JWE. The signature is not
+// checked, so it must not be used on tokens received from elsewhere.
+func UnverifiedJTI(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	var part string
+	switch len(parts) {
+	case 3:
+		part = parts[1]
+	case 5:
+		part = parts[0]
+	default:
+		return "", fmt.Errorf("token is neither a compact JWS nor a compact JWE")
+	}
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return "", fmt.Errorf("invalid token encoding: %v", err)
+	}
+	var claims struct {
+		JTI string `json:"jti"`
+	}
+	if err := json.Unmarshal(decoded, &claims); err != nil || claims.JTI == "" {
+		return "", fmt.Errorf("token has no jti")
+	}
+	return claims.JTI, nil
+}
+
+func supportedKeyAlgorithm(alg jose.KeyAlgorithm) bool {
+	for _, supported := range keyAlgorithms {
+		if alg == supported {
+			return true
+		}
+	}
+	return false
+}
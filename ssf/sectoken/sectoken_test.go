@@ -0,0 +1,200 @@
+package sectoken
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+var testKey = []byte("test-secret-of-at-least-32-bytes")
+
+// testExpected is who the test tokens are issued by and for
+var testExpected = Expected{Issuer: "stream-1", Audience: "https://tr.example.com"}
+
+func TestSignAndVerify(t *testing.T) {
+	token, err := Sign(map[string]interface{}{"jti": "abc", "iat": time.Now().Unix(), "exp": time.Now().Add(time.Minute).Unix(), "iss": "stream-1", "aud": "https://tr.example.com"}, testKey, JWTType)
+	assert.NoError(t, err)
+
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	assert.NoError(t, err)
+	var h map[string]string
+	assert.NoError(t, json.Unmarshal(header, &h))
+	assert.Equal(t, map[string]string{"alg": "HS256", "typ": JWTType}, h)
+
+	var claims map[string]interface{}
+	assert.NoError(t, Verify(token, testKey, testExpected, &claims))
+	assert.Equal(t, "abc", claims["jti"])
+
+	jti, err := UnverifiedJTI(token)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", jti)
+
+	assert.Error(t, Verify(token, []byte("another-secret-of-at-least-32-bytes"), testExpected, &claims))
+}
+
+func TestVerifyChecksIssuerAndAudience(t *testing.T) {
+	for name, c := range map[string]struct {
+		claims   map[string]interface{}
+		expected Expected
+	}{
+		"issued by another stream": {map[string]interface{}{"iss": "stream-2", "aud": "https://tr.example.com"}, testExpected},
+		"for another transmitter":  {map[string]interface{}{"iss": "stream-1", "aud": "https://other.example.com"}, testExpected},
+		"without iss":              {map[string]interface{}{"aud": "https://tr.example.com"}, testExpected},
+		"without aud":              {map[string]interface{}{"iss": "stream-1"}, testExpected},
+		"nothing expected":         {map[string]interface{}{"iss": "stream-1", "aud": "https://tr.example.com"}, Expected{}},
+	} {
+		token, err := Sign(c.claims, testKey, JWTType)
+		assert.NoError(t, err)
+		var claims map[string]interface{}
+		assert.Error(t, Verify(token, testKey, c.expected, &claims), name)
+	}
+
+	token, err := Sign(map[string]interface{}{"iss": "stream-1", "aud": []string{"https://other.example.com", "https://tr.example.com"}, "exp": time.Now().Add(time.Minute).Unix()}, testKey, JWTType)
+	assert.NoError(t, err)
+	var claims map[string]interface{}
+	assert.NoError(t, Verify(token, testKey, testExpected, &claims), "one of several audiences")
+}
+
+func TestSignRejectsShortKey(t *testing.T) {
+	_, err := Sign(map[string]interface{}{}, []byte("short"), JWTType)
+	assert.Error(t, err)
+}
+
+func TestVerifyRejectsExpiredToken(t *testing.T) {
+	token, err := Sign(map[string]interface{}{"exp": time.Now().Add(-time.Hour).Unix(), "iss": "stream-1", "aud": "https://tr.example.com"}, testKey, JWTType)
+	assert.NoError(t, err)
+
+	var claims map[string]interface{}
+	assert.Error(t, Verify(token, testKey, testExpected, &claims))
+}
+
+func TestVerifyRejectsTokenWithoutExpiry(t *testing.T) {
+	token, err := Sign(map[string]interface{}{"iat": time.Now().Unix(), "iss": "stream-1", "aud": "https://tr.example.com"}, testKey, JWTType)
+	assert.NoError(t, err)
+
+	var claims map[string]interface{}
+	assert.ErrorIs(t, Verify(token, testKey, testExpected, &claims), ErrMissingExpiry)
+}
+
+func TestVerifyRejectsOtherAlgorithms(t *testing.T) {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(`{"jti":"abc"}`))
+	for _, alg := range []string{"none", "HS512", "RS256"} {
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"` + alg + `"}`))
+		var claims map[string]interface{}
+		assert.Error(t, Verify(header+"."+payload+".", testKey, testExpected, &claims), alg)
+	}
+}
+
+func TestSignAndVerifySET(t *testing.T) {
+	newKey := func(kid string) jose.JSONWebKey {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		return jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+	}
+	key, other := newKey("set-1"), newKey("set-2")
+	keys := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{key.Public(), other.Public()}}
+
+	setClaims := map[string]interface{}{"jti": "abc", "iss": "https://tr.example.com", "aud": "stream-1"}
+	setExpected := Expected{Issuer: "https://tr.example.com", Audience: "stream-1"}
+	token, err := SignSET(setClaims, key)
+	assert.NoError(t, err)
+	header, err := base64.RawURLEncoding.DecodeString(strings.Split(token, ".")[0])
+	assert.NoError(t, err)
+	var h map[string]string
+	assert.NoError(t, json.Unmarshal(header, &h))
+	assert.Equal(t, map[string]string{"alg": "ES256", "kid": "set-1", "typ": SETType}, h)
+
+	var claims map[string]interface{}
+	assert.NoError(t, VerifySET(token, keys, setExpected, &claims))
+	assert.Equal(t, "abc", claims["jti"])
+	assert.Error(t, VerifySET(token, keys, Expected{Issuer: "https://tr.example.com", Audience: "stream-2"}, &claims), "SET for another stream")
+
+	// A key published under another kid does not verify it
+	forged, err := SignSET(setClaims, jose.JSONWebKey{Key: other.Key, KeyID: "set-1"})
+	assert.NoError(t, err)
+	assert.Error(t, VerifySET(forged, keys, setExpected, &claims))
+
+	rotated, err := SignSET(setClaims, newKey("set-3"))
+	assert.NoError(t, err)
+	assert.ErrorIs(t, VerifySET(rotated, keys, setExpected, &claims), jose.ErrJWKSKidNotFound)
+
+	_, err = SignSET(map[string]interface{}{}, jose.JSONWebKey{Key: key.Key})
+	assert.Error(t, err, "key without kid")
+
+	// Management JWTs, signed with a secret a receiver holds, are not SETs
+	hmac, err := Sign(setClaims, testKey, SETType)
+	assert.NoError(t, err)
+	assert.Error(t, VerifySET(hmac, keys, setExpected, &claims))
+}
+
+func TestUnverifiedClaims(t *testing.T) {
+	token, err := Sign(map[string]interface{}{"stream_id": "stream-1"}, testKey, JWTType)
+	assert.NoError(t, err)
+	var claims struct {
+		StreamID string `json:"stream_id"`
+	}
+	assert.NoError(t, UnverifiedClaims(token, &claims))
+	assert.Equal(t, "stream-1", claims.StreamID)
+
+	assert.Error(t, UnverifiedClaims("not-a-token", &claims))
+}
+
+func TestEncryptAndDecrypt(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+
+	keys := map[string]struct {
+		public  interface{}
+		private interface{}
+	}{
+		"RSA": {&rsaKey.PublicKey, rsaKey},
+		"EC":  {&ecKey.PublicKey, ecKey},
+	}
+	for name, key := range keys {
+		jws, err := Sign(map[string]interface{}{"jti": "abc"}, testKey, SETType)
+		assert.NoError(t, err)
+
+		jwe, err := Encrypt(jws, jose.JSONWebKey{Key: key.public, KeyID: "enc-1"}, "abc")
+		if !assert.NoError(t, err, name) {
+			continue
+		}
+		assert.True(t, IsEncrypted(jwe), name)
+		assert.False(t, IsEncrypted(jws), name)
+
+		jti, err := UnverifiedJTI(jwe)
+		assert.NoError(t, err, name)
+		assert.Equal(t, "abc", jti, name)
+
+		nested, err := Decrypt(jwe, key.private)
+		assert.NoError(t, err, name)
+		assert.Equal(t, jws, nested, name)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	jwe, err := Encrypt("a.b.c", jose.JSONWebKey{Key: &rsaKey.PublicKey}, "")
+	assert.NoError(t, err)
+	_, err = Decrypt(jwe, other)
+	assert.Error(t, err)
+}
+
+func TestEncryptRejectsUnsupportedKeys(t *testing.T) {
+	_, err := Encrypt("a.b.c", jose.JSONWebKey{Key: []byte("symmetric")}, "abc")
+	assert.Error(t, err)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	_, err = Encrypt("a.b.c", jose.JSONWebKey{Key: &rsaKey.PublicKey, Algorithm: string(jose.RSA1_5)}, "abc")
+	assert.Error(t, err, "RSA1_5 is not accepted")
+}
@@ -1,40 +1,122 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/go-chi/chi/v5"
-	"go.mongodb.org/mongo-driver/bson"
+	"github.com/go-jose/go-jose/v4"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ssf/secevent"
+	"ssf/sectoken"
 )
 
 // Subject structure representing a subject in an event stream
 type Subject struct {
 	Format      string `json:"format" bson:"format"`
+	ID          string `json:"id,omitempty" bson:"id,omitempty"`
 	Email       string `json:"email,omitempty" bson:"email,omitempty"`
 	PhoneNumber string `json:"phone_number,omitempty" bson:"phone_number,omitempty"`
+	Iss         string `json:"iss,omitempty" bson:"iss,omitempty"`
+	Sub         string `json:"sub,omitempty" bson:"sub,omitempty"`
+}
+
+// subjectFormatMembers lists the members each supported subject identifier
+// format requires (RFC 9493 section 3.2)
+var subjectFormatMembers = map[string][]string{
+	"email":        {"email"},
+	"phone_number": {"phone_number"},
+	"opaque":       {"id"},
+	"iss_sub":      {"iss", "sub"},
+}
+
+// subjectFromClaims reads the subject of a subjects:add or subjects:remove
+// request, which must be a subject identifier of a supported format with
+// the members that format requires
+func subjectFromClaims(claims map[string]interface{}) (Subject, error) {
+	subjectMap, ok := claims["subject"].(map[string]interface{})
+	if !ok {
+		return Subject{}, errors.New("missing or invalid subject")
+	}
+	members := map[string]string{}
+	for name, value := range subjectMap {
+		s, ok := value.(string)
+		if !ok {
+			return Subject{}, fmt.Errorf("subject member %s must be a string", name)
+		}
+		members[name] = s
+	}
+	required, ok := subjectFormatMembers[members["format"]]
+	if !ok {
+		return Subject{}, fmt.Errorf("unsupported subject format %q", members["format"])
+	}
+	for _, name := range required {
+		if members[name] == "" {
+			return Subject{}, fmt.Errorf("%s subject requires %s", members["format"], name)
+		}
+	}
+	id := secevent.SubjectID{
+		Format:      members["format"],
+		ID:          members["id"],
+		Email:       members["email"],
+		PhoneNumber: members["phone_number"],
+		Iss:         members["iss"],
+		Sub:         members["sub"],
+	}
+	return Subject(id), nil
 }
 
 type StreamConfig struct {
-	StreamID        string    `json:"stream_id" bson:"stream_id"`
-	EventsSupported []string  `json:"events_supported" bson:"events_supported"`
-	EventsEndpoint  string    `json:"events_endpoint" bson:"events_endpoint"`
-	Status          string    `json:"status" bson:"status"`
-	Subjects        []Subject `json:"subjects,omitempty" bson:"subjects,omitempty"`
-	Reason          *string   `json:"reason,omitempty" bson:"reason,omitempty"`
+	StreamID        string            `json:"stream_id" bson:"stream_id"`
+	EventsSupported []string          `json:"events_supported" bson:"events_supported"`
+	EventsEndpoint  string            `json:"events_endpoint" bson:"events_endpoint"`
+	Status          string            `json:"status" bson:"status"`
+	Subjects        []Subject         `json:"subjects,omitempty" bson:"subjects,omitempty"`
+	Reason          *string           `json:"reason,omitempty" bson:"reason,omitempty"`
+	Delivery        *DeliveryConfig   `json:"delivery,omitempty" bson:"delivery,omitempty"`
+	DeliveryMethod  string            `json:"delivery_method,omitempty" bson:"delivery_method,omitempty"`
+	Encryption      *EncryptionConfig `json:"encryption,omitempty" bson:"encryption,omitempty"`
+	StatusHistory   []StatusChange    `json:"status_history,omitempty" bson:"status_history,omitempty"`
+	// ManagementSecret is only sent in the response to creating the stream
+	ManagementSecret string `json:"management_secret,omitempty" bson:"-"`
+}
+
+// StatusChange records a change to a stream's status and who made it
+type StatusChange struct {
+	Status      string    `json:"status" bson:"status"`
+	Reason      *string   `json:"reason,omitempty" bson:"reason,omitempty"`
+	InitiatedBy string    `json:"initiated_by" bson:"initiated_by"`
+	ChangedAt   time.Time `json:"changed_at" bson:"changed_at"`
 }
 
+// Parties that can change a stream's status
+const (
+	initiatedByReceiver    = "receiver"
+	initiatedByTransmitter = "transmitter"
+)
+
+// maxStatusHistory is the number of status changes kept per stream
+const maxStatusHistory = 50
+
+// Reasons sent with transmitter initiated stream-updated events
+const (
+	reasonStreamCreated  = "stream_created"
+	reasonStreamDeleted  = "stream_deleted"
+	reasonSubjectAdded   = "subject_added"
+	reasonSubjectRemoved = "subject_removed"
+)
+
 type StreamUpdatedEvent struct {
 	EventType string  `json:"event_type"`
 	SubID     string  `json:"sub_id"`
@@ -45,6 +127,9 @@ type StreamUpdatedEvent struct {
 var (
 	client     *mongo.Client
 	collection *mongo.Collection
+
+	// transmitterIssuer is the "iss" of every SET sent by this service
+	transmitterIssuer = "http://localhost:8080"
 )
 
 var (
@@ -70,31 +155,71 @@ func main() {
 		mongoURI = "mongodb://localhost:27017"
 	}
 
+	// Load the key used to encrypt receiver credentials at rest
+	var err error
+	secretsKey, err = loadSecretsKey()
+	if err != nil {
+		log.Fatalf("Error loading secrets key: %v", err)
+	}
+	if secretsKey == nil {
+		log.Println("SSF_SECRETS_KEY is not set, streams with delivery credentials will be rejected")
+	}
+
+	// Streams may only reference client certificates the operator put here
+	clientCertDir = os.Getenv("SSF_CLIENT_CERT_DIR")
+
+	signingSecret, err = loadSigningSecret()
+	if err != nil {
+		log.Fatalf("Error loading signing secret: %v", err)
+	}
+	setSigningKey, err = loadSETSigningKey()
+	if err != nil {
+		log.Fatalf("Error loading SET signing key: %v", err)
+	}
+
+	if issuer := os.Getenv("SSF_ISSUER"); issuer != "" {
+		transmitterIssuer = issuer
+	}
+
+	// Development overrides for receiver endpoint validation
+	eventsEndpointPolicy = loadEndpointPolicy()
+	if eventsEndpointPolicy.AllowHTTP || eventsEndpointPolicy.AllowPrivate {
+		log.Printf("WARNING: insecure events endpoint policy in use: %+v", eventsEndpointPolicy)
+	}
+
 	// Initialize MongoDB connection
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
-	var err error
 	client, err = mongo.Connect(ctx, options.Client().ApplyURI(mongoURI))
 	if err != nil {
 		log.Fatalf("Error connecting to MongoDB: %v", err)
 	}
-	defer client.Disconnect(ctx)
 
 	// Get the collection for storing stream configurations
 	collection = client.Database("signals_db").Collection("streams")
 
-	// Set up router
-	r := chi.NewRouter()
-	r.Post("/stream-config", registerStreamConfig)
-	r.Put("/stream-config/{stream_id}", updateStreamStatus)
-	r.Get("/stream-config/{stream_id}", getStreamStatus)
-	r.Post("/ssf/subjects:add", addSubjectToStream)         // Add subject
-	r.Post("/ssf/subjects:remove", removeSubjectFromStream) // Remove subject
+	// Undelivered SETs are parked in the outbox on shutdown and picked up again here
+	transmitterConfig := loadTransmitterConfig()
+	transmitterConfig.Outbox = newMongoOutbox(client.Database("signals_db").Collection("pending_events"))
+	transmitterConfig.OnStatusChange = transmitterStatusChange
+	transmitterConfig.StreamStatus = currentStreamStatus
+	transmitter = NewTransmitter(transmitterConfig)
+
+	// SETs for poll streams are held here until their receivers acknowledge them
+	polledSETs = newPollQueue(newMongoPollStore(client.Database("signals_db").Collection("polled_events")))
+	if err := reopenBreakers(ctx); err != nil {
+		log.Printf("Error resuming probes of paused streams: %v", err)
+	}
+	restoreCtx, cancelRestore := context.WithTimeout(context.Background(), restoreTimeout)
+	if err := transmitter.Restore(restoreCtx); err != nil {
+		log.Printf("Error restoring undelivered events: %v", err)
+	}
+	cancelRestore()
 
 	// Set up HTTP server
 	server := &http.Server{
 		Addr:    ":8080",
-		Handler: r,
+		Handler: newRouter(),
 	}
 
 	// Start server in a goroutine
@@ -109,23 +234,69 @@ func main() {
 	waitForShutdown(server)
 }
 
+// newRouter wires the SSF management API
+func newRouter() http.Handler {
+	r := chi.NewRouter()
+	r.Post("/stream-config", registerStreamConfig)
+	r.Put("/stream-config/{stream_id}", updateStreamStatus)
+	r.Get("/stream-config/{stream_id}", getStreamStatus)
+	r.Delete("/stream-config/{stream_id}", deleteStream)
+	r.Post("/ssf/subjects:add", addSubjectToStream)         // Add subject
+	r.Post("/ssf/subjects:remove", removeSubjectFromStream) // Remove subject
+	r.Post("/ssf/verify", requestVerification)
+	r.Post("/ssf/poll/{stream_id}", pollEvents)
+	r.Get("/.well-known/ssf-configuration", transmitterConfiguration)
+	r.Get("/ssf/jwks.json", transmitterKeys)
+	r.Get("/openapi.yaml", serveOpenAPISpec)
+	return r
+}
+
 func waitForShutdown(server *http.Server) {
-	// Wait for interrupt signal to gracefully shutdown the server
+	// Wait for SIGINT, or SIGTERM from ECS, to gracefully shutdown the server
 	quit := make(chan os.Signal, 1)
-	signal.Notify(quit, os.Interrupt)
-	<-quit
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
+	sig := <-quit
 
-	log.Println("Shutting down server...")
+	log.Printf("Received %s, shutting down server...", sig)
 
-	// The context is used to inform the server it has 5 seconds to finish the request it is currently handling
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	// The whole shutdown must finish inside the orchestrator's stop timeout
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
 	defer cancel()
 
+	shutdown(ctx, server)
+
+	log.Println("Server exiting")
+}
+
+// shutdown stops accepting management requests, drains queued SETs (persisting
+// whatever cannot be delivered before ctx expires) and closes MongoDB
+func shutdown(ctx context.Context, server *http.Server) {
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Printf("Server forced to shutdown: %v", err)
+		server.Close()
 	}
 
-	log.Println("Server exiting")
+	// Give queued SETs the remaining time to be delivered, cancelling any still in flight
+	if err := transmitter.Shutdown(ctx); err != nil {
+		log.Printf("Transmitter stopped before all events were delivered: %v", err)
+	}
+
+	if client != nil {
+		disconnectCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := client.Disconnect(disconnectCtx); err != nil {
+			log.Printf("Error disconnecting from MongoDB: %v", err)
+		}
+	}
+}
+
+// shutdownTimeout reads SSF_SHUTDOWN_TIMEOUT, defaulting to 25s so that the
+// service finishes inside ECS's default 30s stop timeout
+func shutdownTimeout() time.Duration {
+	if d, err := time.ParseDuration(os.Getenv("SSF_SHUTDOWN_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return 25 * time.Second
 }
 
 func registerStreamConfig(w http.ResponseWriter, r *http.Request) {
@@ -135,30 +306,101 @@ func registerStreamConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Validate required fields
-	if len(streamConfig.EventsSupported) == 0 || streamConfig.EventsEndpoint == "" {
+	// Streams are pushed to the receiver unless it asks to poll
+	if streamConfig.DeliveryMethod == "" {
+		streamConfig.DeliveryMethod = secevent.PushDeliveryMethod
+	}
+	if streamConfig.DeliveryMethod != secevent.PushDeliveryMethod && streamConfig.DeliveryMethod != secevent.PollDeliveryMethod {
+		http.Error(w, "Unsupported delivery_method", http.StatusBadRequest)
+		return
+	}
+	poll := streamConfig.DeliveryMethod == secevent.PollDeliveryMethod
+
+	// Validate required fields. A poll stream's endpoint is supplied by the transmitter.
+	if len(streamConfig.EventsSupported) == 0 || (!poll && streamConfig.EventsEndpoint == "") {
 		http.Error(w, "Missing required fields", http.StatusBadRequest)
 		return
 	}
+	if poll && streamConfig.Delivery != nil {
+		http.Error(w, "delivery credentials only apply to push streams", http.StatusBadRequest)
+		return
+	}
+
+	// Validate and encrypt the receiver's delivery credentials before storing them
+	if err := streamConfig.Delivery.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := streamConfig.Encryption.Validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Refuse endpoints that would let a receiver point the transmitter at internal hosts
+	if !poll {
+		if err := validateEndpoint(r.Context(), streamConfig.EventsEndpoint); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if streamConfig.Delivery != nil && streamConfig.Delivery.OAuth != nil {
+		if err := validateEndpoint(r.Context(), streamConfig.Delivery.OAuth.TokenURL); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	// Fetch the receiver's key now so a stream that could never be sent a SET is refused
+	if streamConfig.Encryption != nil {
+		if err := validateEndpoint(r.Context(), streamConfig.Encryption.JWKSURI); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if _, err := receiverEncryptionKey(r.Context(), streamConfig.Encryption); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if err := streamConfig.Delivery.seal(); err != nil {
+		http.Error(w, "Failed to register stream configuration", http.StatusInternalServerError)
+		log.Printf("Error encrypting delivery credentials: %v", err)
+		return
+	}
 
 	// Set initial status to "enabled"
 	streamConfig.Status = "enabled"
 	streamConfig.StreamID = generateStreamID()
+	if poll {
+		streamConfig.EventsEndpoint = transmitterIssuer + "/ssf/poll/" + streamConfig.StreamID
+	}
+	streamConfig.StatusHistory = []StatusChange{{
+		Status:      streamConfig.Status,
+		Reason:      newReason(reasonStreamCreated),
+		InitiatedBy: initiatedByTransmitter,
+		ChangedAt:   time.Now().UTC(),
+	}}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
 	// Store the stream configuration in MongoDB
-	_, err := collection.InsertOne(ctx, streamConfig)
-	if err != nil {
+	if err := streams.Create(ctx, streamConfig); err != nil {
 		http.Error(w, "Failed to register stream configuration", http.StatusInternalServerError)
 		log.Printf("Error registering stream configuration: %v", err)
 		return
 	}
 
 	log.Printf("Stream configuration registered with StreamID: %s", streamConfig.StreamID)
+
+	// Let the receiver confirm the new stream is reachable and enabled
+	sendStreamUpdatedEvent(streamConfig, newReason(reasonStreamCreated))
+
+	// The receiver signs its management requests and polls with this secret
+	created := redactStreamConfig(streamConfig)
+	created.ManagementSecret = streamSecret(streamConfig.StreamID)
+
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(streamConfig)
+	json.NewEncoder(w).Encode(created)
 }
 
 func updateStreamStatus(w http.ResponseWriter, r *http.Request) {
@@ -169,47 +411,27 @@ func updateStreamStatus(w http.ResponseWriter, r *http.Request) {
 		Reason *string `json:"reason,omitempty"`
 	}
 
-	// Parse and validate the JWT
-	tokenString, err := ioutil.ReadAll(r.Body)
+	// Parse and validate the JWT, signed with the stream's management secret
+	claims, err := parseJWT(r, streamID)
 	if err != nil {
-		http.Error(w, "Invalid request payload", http.StatusBadRequest)
-		log.Println("Error reading request body:", err)
-		return
-	}
-
-	token, err := jwt.Parse(string(tokenString), func(token *jwt.Token) (interface{}, error) {
-		// Ensure that the signing method is HMAC (HS256)
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte("your-signing-secret"), nil
-	})
-
-	if err != nil || !token.Valid {
 		http.Error(w, "Invalid token", http.StatusBadRequest)
 		log.Println("Error parsing token:", err)
 		return
 	}
 
 	// Extract claims from the token
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		status, ok := claims["status"].(string)
-		if !ok {
-			http.Error(w, "Missing or invalid status", http.StatusBadRequest)
-			log.Println("Missing or invalid status in JWT")
-			return
-		}
-
-		updateRequest.Status = status
-		if reason, ok := claims["reason"].(string); ok {
-			updateRequest.Reason = &reason
-		}
-	} else {
-		http.Error(w, "Invalid token claims", http.StatusBadRequest)
-		log.Println("Invalid token claims")
+	status, ok := claims["status"].(string)
+	if !ok {
+		http.Error(w, "Missing or invalid status", http.StatusBadRequest)
+		log.Println("Missing or invalid status in JWT")
 		return
 	}
 
+	updateRequest.Status = status
+	if reason, ok := claims["reason"].(string); ok {
+		updateRequest.Reason = &reason
+	}
+
 	// Validate the status field
 	if err := ValidateStatus(updateRequest.Status); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
@@ -221,52 +443,34 @@ func updateStreamStatus(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	// Fetch the current stream configuration for logging before update
-	var currentStreamConfig StreamConfig
-	err = collection.FindOne(ctx, bson.M{"stream_id": streamID}).Decode(&currentStreamConfig)
+	currentStreamConfig, err := streams.Get(ctx, streamID)
 	if err != nil {
 		http.Error(w, "Stream not found", http.StatusNotFound)
 		log.Printf("Error finding stream configuration with stream_id %s: %v", streamID, err)
 		return
 	}
-	log.Printf("Stream configuration before update: %+v", currentStreamConfig)
+	log.Printf("Stream configuration before update: %+v", redactStreamConfig(currentStreamConfig))
 
-	// Update the stream status in MongoDB
-	filter := bson.M{"stream_id": streamID}
-	update := bson.M{"$set": bson.M{"status": updateRequest.Status}}
-
-	if updateRequest.Reason != nil {
-		update["$set"].(bson.M)["reason"] = updateRequest.Reason
-	} else {
-		update["$unset"] = bson.M{"reason": ""}
-	}
-
-	result, err := collection.UpdateOne(ctx, filter, update)
-	if err != nil {
-		http.Error(w, "Failed to update stream status", http.StatusInternalServerError)
-		log.Println("Error updating stream status in MongoDB:", err)
-		return
-	}
-
-	// Check if the document was modified
-	if result.MatchedCount == 0 {
+	// Update the stream status in MongoDB and send the stream-updated event
+	updatedStreamConfig, err := changeStreamStatus(ctx, streamID, StatusChange{
+		Status:      updateRequest.Status,
+		Reason:      updateRequest.Reason,
+		InitiatedBy: initiatedByReceiver,
+		ChangedAt:   time.Now().UTC(),
+	})
+	if err == errStreamNotFound {
 		http.Error(w, "No document found to update", http.StatusNotFound)
 		log.Printf("No document found for stream_id %s", streamID)
 		return
 	}
-
-	// Fetch the updated stream configuration
-	var updatedStreamConfig StreamConfig
-	err = collection.FindOne(ctx, filter).Decode(&updatedStreamConfig)
 	if err != nil {
-		http.Error(w, "Failed to fetch updated stream configuration", http.StatusInternalServerError)
-		log.Println("Error fetching updated stream configuration:", err)
+		http.Error(w, "Failed to update stream status", http.StatusInternalServerError)
+		log.Println("Error updating stream status in MongoDB:", err)
 		return
 	}
-	log.Printf("Stream configuration after update: %+v", updatedStreamConfig)
-
-	// Send the stream-updated event
-	sendStreamUpdatedEvent(updatedStreamConfig, updateRequest.Reason)
+	log.Printf("Stream configuration after update: %+v", redactStreamConfig(updatedStreamConfig))
 
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Stream status updated and event sent"))
 }
@@ -278,10 +482,9 @@ func getStreamStatus(w http.ResponseWriter, r *http.Request) {
 	defer cancel()
 
 	// Find the stream configuration by stream_id
-	var streamConfig StreamConfig
-	err := collection.FindOne(ctx, bson.M{"stream_id": streamID}).Decode(&streamConfig)
+	streamConfig, err := streams.Get(ctx, streamID)
 	if err != nil {
-		if err == mongo.ErrNoDocuments {
+		if err == errStreamNotFound {
 			http.Error(w, "Stream configuration not found", http.StatusNotFound)
 			return
 		}
@@ -292,186 +495,370 @@ func getStreamStatus(w http.ResponseWriter, r *http.Request) {
 
 	// Return the stream status
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(streamConfig)
+	json.NewEncoder(w).Encode(redactStreamConfig(streamConfig))
 }
 
 // addSubjectToStream handles adding a subject to a stream as per SSF 7.1.3.1
 func addSubjectToStream(w http.ResponseWriter, r *http.Request) {
-	// Parse the JWT from the request body
-	claims, err := parseJWT(r, "your-signing-secret") // Use your actual signing secret
-	if err != nil {
-		http.Error(w, "Invalid JWT: "+err.Error(), http.StatusUnauthorized)
-		return
-	}
-
-	// Extract the stream_id and subject from the claims
-	streamID, ok := claims["stream_id"].(string)
-	if !ok {
+	// Parse the JWT from the request body, signed with the stream's management secret
+	claims, streamID, err := parseClaimedStreamJWT(r)
+	if err == errMissingStreamID {
 		http.Error(w, "Missing or invalid stream_id in JWT", http.StatusBadRequest)
 		return
 	}
-
-	subjectMap, ok := claims["subject"].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Missing or invalid subject in JWT", http.StatusBadRequest)
+	if err != nil {
+		http.Error(w, "Invalid JWT: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	subject := Subject{
-		Format: subjectMap["format"].(string),
-		Email:  subjectMap["email"].(string), // Assuming it's an email subject
+	// Extract the subject from the claims
+	subject, err := subjectFromClaims(claims)
+	if err != nil {
+		http.Error(w, "Invalid subject in JWT: "+err.Error(), http.StatusBadRequest)
+		return
 	}
 
 	// Update MongoDB to add the subject to the stream
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{"stream_id": streamID}
-	update := bson.M{"$push": bson.M{"subjects": subject}}
-
-	result := collection.FindOneAndUpdate(ctx, filter, update)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
+	streamConfig, err := streams.AddSubject(ctx, streamID, subject)
+	if err != nil {
+		if err == errStreamNotFound {
 			http.Error(w, "Stream not found", http.StatusNotFound)
 			return
 		}
-		log.Printf("Error adding subject to stream: %v", result.Err())
+		log.Printf("Error adding subject to stream: %v", err)
 		http.Error(w, "Failed to add subject to stream", http.StatusInternalServerError)
 		return
 	}
 
+	sendStreamUpdatedEvent(streamConfig, newReason(reasonSubjectAdded))
+
 	w.WriteHeader(http.StatusOK)
 }
 
 // removeSubjectFromStream handles removing a subject from a stream as per SSF 7.1.3.2
 func removeSubjectFromStream(w http.ResponseWriter, r *http.Request) {
-	// Parse the JWT from the request body
-	claims, err := parseJWT(r, "your-signing-secret") // Use your actual signing secret
+	// Parse the JWT from the request body, signed with the stream's management secret
+	claims, streamID, err := parseClaimedStreamJWT(r)
+	if err == errMissingStreamID {
+		http.Error(w, "Missing or invalid stream_id in JWT", http.StatusBadRequest)
+		return
+	}
 	if err != nil {
 		http.Error(w, "Invalid JWT: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	// Extract the stream_id and subject from the claims
-	streamID, ok := claims["stream_id"].(string)
-	if !ok {
-		http.Error(w, "Missing or invalid stream_id in JWT", http.StatusBadRequest)
+	// Extract the subject from the claims
+	subject, err := subjectFromClaims(claims)
+	if err != nil {
+		http.Error(w, "Invalid subject in JWT: "+err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	subjectMap, ok := claims["subject"].(map[string]interface{})
-	if !ok {
-		http.Error(w, "Missing or invalid subject in JWT", http.StatusBadRequest)
+	// Remove the subject from the stream in MongoDB
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamConfig, err := streams.RemoveSubject(ctx, streamID, subject)
+	if err != nil {
+		if err == errStreamNotFound {
+			http.Error(w, "Stream not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error removing subject from stream: %v", err)
+		http.Error(w, "Failed to remove subject from stream", http.StatusInternalServerError)
+		return
+	}
+
+	sendStreamUpdatedEvent(streamConfig, newReason(reasonSubjectRemoved))
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// requestVerification handles a receiver's request for a verification event
+// as per SSF 7.1.4.2. The request is a JWT carrying stream_id and an optional
+// state, which is echoed back in the event.
+func requestVerification(w http.ResponseWriter, r *http.Request) {
+	claims, streamID, err := parseClaimedStreamJWT(r)
+	if err == errMissingStreamID {
+		http.Error(w, "Missing or invalid stream_id in JWT", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Invalid JWT: "+err.Error(), http.StatusUnauthorized)
 		return
 	}
 
-	subject := Subject{
-		Format: subjectMap["format"].(string),
-		Email:  subjectMap["email"].(string), // Assuming it's an email subject
+	var event secevent.Verification
+	if state, ok := claims["state"]; ok {
+		if event.State, ok = state.(string); !ok {
+			http.Error(w, "Invalid state in JWT", http.StatusBadRequest)
+			return
+		}
 	}
 
-	// Remove the subject from the stream in MongoDB
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	filter := bson.M{"stream_id": streamID}
-	update := bson.M{"$pull": bson.M{"subjects": subject}}
-
-	result := collection.FindOneAndUpdate(ctx, filter, update)
-	if result.Err() != nil {
-		if result.Err() == mongo.ErrNoDocuments {
+	streamConfig, err := streams.Get(ctx, streamID)
+	if err != nil {
+		if err == errStreamNotFound {
 			http.Error(w, "Stream not found", http.StatusNotFound)
 			return
 		}
-		log.Printf("Error removing subject from stream: %v", result.Err())
-		http.Error(w, "Failed to remove subject from stream", http.StatusInternalServerError)
+		log.Printf("Error fetching stream configuration: %v", err)
+		http.Error(w, "Failed to fetch stream configuration", http.StatusInternalServerError)
 		return
 	}
 
+	sendStreamEvent(streamConfig, secevent.VerificationType, event)
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func sendStreamUpdatedEvent(streamConfig StreamConfig, reason *string) {
-	// Create the payload for the event
-	eventPayload := map[string]interface{}{
-		"event_type": "https://schemas.openid.net/secevent/ssf/event-type/stream-updated",
-		"sub_id":     streamConfig.StreamID, // 'sub_id' as defined in SSF, Section 7.1.2
-		"status":     streamConfig.Status,   // 'status' as per SSF, Section 7.1.2
-		"iat":        time.Now().Unix(),     // 'iat' is used for token issued at time
-	}
+// transmitterConfiguration serves the transmitter metadata (SSF 6.1)
+func transmitterConfiguration(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(secevent.TransmitterMetadata{
+		SpecVersion:              "1_0",
+		Issuer:                   transmitterIssuer,
+		JWKSURI:                  transmitterIssuer + "/ssf/jwks.json",
+		DeliveryMethodsSupported: []string{secevent.PushDeliveryMethod, secevent.PollDeliveryMethod},
+		ConfigurationEndpoint:    transmitterIssuer + "/stream-config",
+		StatusEndpoint:           transmitterIssuer + "/stream-config",
+		AddSubjectEndpoint:       transmitterIssuer + "/ssf/subjects:add",
+		RemoveSubjectEndpoint:    transmitterIssuer + "/ssf/subjects:remove",
+		VerificationEndpoint:     transmitterIssuer + "/ssf/verify",
+		DefaultSubjects:          "NONE",
+	})
+}
 
-	// If reason is provided, include it
-	if reason != nil {
-		eventPayload["reason"] = *reason
+// transmitterKeys serves the public key receivers verify SETs with
+func transmitterKeys(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jose.JSONWebKeySet{Keys: []jose.JSONWebKey{setSigningKey.Public()}})
+}
+
+// deleteStream handles deleting a stream as per SSF 7.1.1.5. The request is a
+// JWT whose stream_id claim names the stream being deleted. The receiver is
+// told the stream is disabled before it is removed.
+func deleteStream(w http.ResponseWriter, r *http.Request) {
+	streamID := chi.URLParam(r, "stream_id")
+
+	if _, err := parseStreamJWT(r, streamID); err != nil {
+		http.Error(w, "Invalid JWT: "+err.Error(), http.StatusUnauthorized)
+		return
 	}
 
-	// Generate the SET (JWT) by signing the event payload
-	set, err := generateSecureEventToken(eventPayload, "your-signing-secret") // Use your secret key for signing
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	streamConfig, err := streams.Get(ctx, streamID)
 	if err != nil {
-		log.Printf("Error generating SET: %v", err)
+		if err == errStreamNotFound {
+			http.Error(w, "Stream configuration not found", http.StatusNotFound)
+			return
+		}
+		log.Printf("Error fetching stream configuration: %v", err)
+		http.Error(w, "Failed to fetch stream configuration", http.StatusInternalServerError)
 		return
 	}
 
-	// Send the SET to the event endpoint
-	req, err := http.NewRequest("POST", streamConfig.EventsEndpoint, bytes.NewBuffer([]byte(set)))
-	if err != nil {
-		log.Printf("Error creating request: %v", err)
+	// A poll receiver could never collect the final event, so it is only pushed
+	poll := streamConfig.DeliveryMethod == secevent.PollDeliveryMethod
+	if !poll {
+		streamConfig.Status = "disabled"
+		sendStreamUpdatedEvent(streamConfig, newReason(reasonStreamDeleted))
+	}
+
+	if err := streams.Delete(ctx, streamID); err != nil && err != errStreamNotFound {
+		log.Printf("Error deleting stream configuration: %v", err)
+		http.Error(w, "Failed to delete stream configuration", http.StatusInternalServerError)
 		return
 	}
-	req.Header.Set("Content-Type", "application/jwt")
+	transmitter.Remove(streamID)
+	if poll {
+		if err := polledSETs.drop(ctx, streamID); err != nil {
+			log.Printf("Error dropping SETs held for poll stream %s: %v", streamID, err)
+		}
+	}
+
+	log.Printf("Stream configuration deleted with StreamID: %s", streamID)
+	w.WriteHeader(http.StatusNoContent)
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// changeStreamStatus updates a stream's status and notifies its receiver. It
+// is used both for receiver requested updates and for transmitter initiated
+// ones, so every status change produces a stream-updated event.
+func changeStreamStatus(ctx context.Context, streamID string, change StatusChange) (StreamConfig, error) {
+	streamConfig, err := streams.UpdateStatus(ctx, streamID, change)
 	if err != nil {
-		log.Printf("Error sending stream-updated event to endpoint %s: %v", streamConfig.EventsEndpoint, err)
-		return
+		return streamConfig, err
+	}
+	sendStreamUpdatedEvent(streamConfig, change.Reason)
+	// The receiver is back, so there is no need to wait for a probe
+	if change.Status == "enabled" && change.InitiatedBy == initiatedByReceiver {
+		transmitter.Resume(streamID)
 	}
-	defer resp.Body.Close()
+	return streamConfig, nil
+}
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Stream endpoint responded with status: %s", resp.Status)
+// reopenBreakers has the transmitter probe the streams it paused for
+// delivery failures before a restart, which would otherwise stay paused. It
+// runs before undelivered SETs are restored so those are held for them.
+func reopenBreakers(ctx context.Context) error {
+	paused, err := streams.ListByStatus(ctx, "paused")
+	if err != nil {
+		return err
 	}
+	for _, streamConfig := range paused {
+		if pausedForDeliveryFailure(streamConfig) {
+			transmitter.Reopen(streamConfig)
+			log.Printf("Probing stream %s, paused after delivery failures", streamConfig.StreamID)
+		}
+	}
+	return nil
 }
 
-func generateSecureEventToken(eventPayload map[string]interface{}, secret string) (string, error) {
-	// Create a new token using the HS256 signing method
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims(eventPayload))
+// transmitterStatusChange records a status change the transmitter made on its
+// own, such as pausing a stream whose receiver keeps failing, and notifies the
+// receiver with a stream-updated event
+func transmitterStatusChange(streamID, status, reason string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Sign the token using the secret
-	tokenString, err := token.SignedString([]byte(secret))
+	_, err := changeStreamStatus(ctx, streamID, StatusChange{
+		Status:      status,
+		Reason:      newReason(reason),
+		InitiatedBy: initiatedByTransmitter,
+		ChangedAt:   time.Now().UTC(),
+	})
 	if err != nil {
-		return "", err
+		log.Printf("Error changing status of stream %s to %s: %v", streamID, status, err)
+		return
 	}
+	log.Printf("Stream %s %s by transmitter: %s", streamID, status, reason)
+}
+
+// currentStreamStatus looks up a stream's status for the transmitter
+func currentStreamStatus(ctx context.Context, streamID string) (string, error) {
+	streamConfig, err := streams.Get(ctx, streamID)
+	return streamConfig.Status, err
+}
 
-	return tokenString, nil
+// sendStreamUpdatedEvent queues a stream-updated SET (SSF 7.1.5) for the stream's receiver
+func sendStreamUpdatedEvent(streamConfig StreamConfig, reason *string) {
+	// The event carries the stream's status and optional reason
+	event := secevent.StreamUpdated{Status: streamConfig.Status}
+	if reason != nil {
+		event.Reason = *reason
+	}
+	sendStreamEvent(streamConfig, secevent.StreamUpdatedType, event)
 }
 
-func parseJWT(r *http.Request, secret string) (jwt.MapClaims, error) {
+// sendStreamEvent queues a SET about the stream itself for the stream's receiver
+func sendStreamEvent(streamConfig StreamConfig, eventType string, event interface{}) {
+	// Generate the SET (JWT) by signing the event payload
+	set, err := signEventForStream(streamEventClaims(streamConfig.StreamID, eventType, event), streamConfig)
+	if err != nil {
+		log.Printf("Error generating SET: %v", err)
+		return
+	}
+
+	// Queue the SET for delivery to the event endpoint
+	ctx, cancel := context.WithTimeout(context.Background(), deliveryTimeout)
+	defer cancel()
+
+	if err := transmitter.EnqueueStreamEvent(ctx, streamConfig, set); err != nil {
+		log.Printf("Error queueing %s event for endpoint %s: %v", eventType, streamConfig.EventsEndpoint, err)
+	}
+}
+
+// streamEventClaims builds the claims of a SET about a stream, which always
+// has the stream itself as an opaque sub_id
+func streamEventClaims(streamID, eventType string, event interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    transmitterIssuer,
+		"iat":    time.Now().Unix(),
+		"sub_id": secevent.StreamSubject(streamID),
+		"events": map[string]interface{}{
+			eventType: event,
+		},
+	}
+}
+
+func generateSecureEventToken(eventPayload map[string]interface{}) (string, error) {
+	// Sign the payload as an ES256 JWS typed as a SET (RFC 8417)
+	return sectoken.SignSET(eventPayload, setSigningKey)
+}
+
+// errMissingStreamID is returned for a management JWT that does not name the
+// stream it is for
+var errMissingStreamID = errors.New("missing or invalid stream_id in JWT")
+
+func parseJWT(r *http.Request, streamID string) (map[string]interface{}, error) {
 	// Read the request body to get the JWT token
 	tokenString, err := ioutil.ReadAll(r.Body)
 	if err != nil {
 		return nil, err
 	}
+	return parseToken(string(tokenString), streamID)
+}
 
-	// Parse the JWT token
-	token, err := jwt.Parse(string(tokenString), func(token *jwt.Token) (interface{}, error) {
-		// Ensure that the signing method is HMAC (HS256)
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return []byte(secret), nil
-	})
-
+// parseStreamJWT verifies the JWT in the request body and checks that its
+// stream_id claim names the stream the request is for
+func parseStreamJWT(r *http.Request, streamID string) (map[string]interface{}, error) {
+	claims, err := parseJWT(r, streamID)
 	if err != nil {
 		return nil, err
 	}
+	if _, ok := claims["stream_id"]; !ok {
+		return nil, errMissingStreamID
+	}
+	return claims, nil
+}
+
+// parseClaimedStreamJWT verifies the JWT in the request body for the stream
+// named by its stream_id claim, returning its claims and the stream's ID
+func parseClaimedStreamJWT(r *http.Request) (map[string]interface{}, string, error) {
+	tokenString, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	// The claim only selects the key; parseToken checks it once it is verified
+	var unverified struct {
+		StreamID string `json:"stream_id"`
+	}
+	if err := sectoken.UnverifiedClaims(string(tokenString), &unverified); err != nil {
+		return nil, "", err
+	}
+	if unverified.StreamID == "" {
+		return nil, "", errMissingStreamID
+	}
+	claims, err := parseToken(string(tokenString), unverified.StreamID)
+	return claims, unverified.StreamID, err
+}
 
-	// Extract and return the claims (payload)
-	if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-		return claims, nil
-	} else {
-		return nil, fmt.Errorf("invalid token")
+// parseToken verifies a management JWT with the secret of the stream it is
+// for and returns its claims. It must be issued by that stream to this
+// transmitter, and a stream_id claim must also name that stream.
+func parseToken(tokenString, streamID string) (map[string]interface{}, error) {
+	var claims map[string]interface{}
+	expected := sectoken.Expected{Issuer: streamID, Audience: transmitterIssuer}
+	if err := sectoken.Verify(tokenString, []byte(streamSecret(streamID)), expected, &claims); err != nil {
+		return nil, err
+	}
+	if claimed, ok := claims["stream_id"]; ok && claimed != streamID {
+		return nil, fmt.Errorf("token is not valid for stream %s", streamID)
 	}
+	return claims, nil
+}
+
+func newReason(reason string) *string {
+	return &reason
 }
 
 func generateStreamID() string {
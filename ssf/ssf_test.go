@@ -3,21 +3,43 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"encoding/json"
-	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/go-jose/go-jose/v4"
 	"github.com/stretchr/testify/assert"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+
+	"ssf/secevent"
+	"ssf/sectoken"
 )
 
+func TestMain(m *testing.M) {
+	// SETs are signed with a key generated for the test run, and stream
+	// management secrets derived from a fixed test secret
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		log.Fatalf("Error generating SET signing key: %v", err)
+	}
+	if setSigningKey, err = newSETSigningKey(key); err != nil {
+		log.Fatalf("Error generating SET signing key: %v", err)
+	}
+	signingSecret = "test-signing-secret-of-at-least-32-bytes"
+	os.Exit(m.Run())
+}
+
 func TestStreamConfig(t *testing.T) {
 	streamConfig := StreamConfig{
 		StreamID:        "test-stream",
@@ -61,6 +83,8 @@ func TestMongoDBConnection(t *testing.T) {
 	assert.NoError(t, err)
 }
 func TestSendStreamUpdatedEvent(t *testing.T) {
+	allowLocalEndpoints(t)
+
 	// Create a test server to mock the stream endpoint
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		body, err := ioutil.ReadAll(r.Body)
@@ -68,25 +92,19 @@ func TestSendStreamUpdatedEvent(t *testing.T) {
 		defer r.Body.Close()
 
 		// Verify that the body is a valid JWT (Secure Event Token)
-		token, err := jwt.Parse(string(body), func(token *jwt.Token) (interface{}, error) {
-			// Verify the signing method
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte("your-signing-secret"), nil // Use your secret key
-		})
-		assert.NoError(t, err)
-		assert.NotNil(t, token)
-
-		// Check that the token contains the correct claims
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			assert.Equal(t, "https://schemas.openid.net/secevent/ssf/event-type/stream-updated", claims["event_type"])
-			assert.Equal(t, "test-sub-id", claims["sub_id"])
-			assert.Equal(t, "enabled", claims["status"])
-			assert.Equal(t, "test-reason", claims["reason"])
-		} else {
-			t.Error("Invalid token claims")
-		}
+		var claims map[string]interface{}
+		keys := jose.JSONWebKeySet{Keys: []jose.JSONWebKey{setSigningKey.Public()}}
+		expected := sectoken.Expected{Issuer: transmitterIssuer, Audience: "test-sub-id"}
+		assert.NoError(t, sectoken.VerifySET(string(body), keys, expected, &claims))
+
+		// Check that the token follows the SSF stream-updated schema (SSF 7.1.5)
+		assert.Equal(t, map[string]interface{}{"format": "opaque", "id": "test-sub-id"}, claims["sub_id"])
+		assert.NotEmpty(t, claims["jti"])
+		assert.Equal(t, transmitterIssuer, claims["iss"])
+		events := claims["events"].(map[string]interface{})
+		event := events["https://schemas.openid.net/secevent/ssf/event-type/stream-updated"].(map[string]interface{})
+		assert.Equal(t, "enabled", event["status"])
+		assert.Equal(t, "test-reason", event["reason"])
 
 		w.WriteHeader(http.StatusOK)
 	}))
@@ -100,6 +118,11 @@ func TestSendStreamUpdatedEvent(t *testing.T) {
 
 	// Use pointer to "test-reason"
 	sendStreamUpdatedEvent(streamConfig, newString("test-reason"))
+
+	// Delivery is asynchronous, wait for the transmitter to push the event
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, transmitter.Flush(ctx))
 }
 
 func TestGenerateStreamID(t *testing.T) {
@@ -280,9 +303,14 @@ func TestInvalidStreamStatusUpdate(t *testing.T) {
 	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
 }
 
-func generateTestJWT(eventPayload map[string]interface{}, secret string) (string, error) {
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims(eventPayload))
-	return token.SignedString([]byte(secret))
+// generateTestJWT signs a management JWT issued by streamID to the
+// transmitter, unless eventPayload sets iss or aud itself
+func generateTestJWT(streamID string, eventPayload map[string]interface{}, secret string) (string, error) {
+	claims := map[string]interface{}{"iss": streamID, "aud": transmitterIssuer, "exp": time.Now().Add(time.Minute).Unix()}
+	for k, v := range eventPayload {
+		claims[k] = v
+	}
+	return sectoken.Sign(claims, []byte(secret), sectoken.JWTType)
 }
 
 func TestAddSubjectToStreamSection5(t *testing.T) {
@@ -319,8 +347,8 @@ func TestAddSubjectToStreamSection5(t *testing.T) {
 	}
 
 	// Generate a JWT with the event payload
-	secret := "your-signing-secret"
-	tokenString, err := generateTestJWT(eventPayload, secret)
+	secret := streamSecret("f67e39a0a4d34d56b3aa1bc4cff0069f")
+	tokenString, err := generateTestJWT("f67e39a0a4d34d56b3aa1bc4cff0069f", eventPayload, secret)
 	assert.NoError(t, err)
 
 	// Set up a request to add the subject
@@ -383,8 +411,8 @@ func TestRemoveSubjectFromStreamSection5(t *testing.T) {
 	}
 
 	// Generate a JWT with the event payload
-	secret := "your-signing-secret"
-	tokenString, err := generateTestJWT(eventPayload, secret)
+	secret := streamSecret("f67e39a0a4d34d56b3aa1bc4cff0069f")
+	tokenString, err := generateTestJWT("f67e39a0a4d34d56b3aa1bc4cff0069f", eventPayload, secret)
 	assert.NoError(t, err)
 
 	// Set up a request to remove the subject
@@ -467,8 +495,8 @@ func TestStreamUpdatedEventSection5(t *testing.T) {
 	}
 
 	// Generate a JWT containing the event payload
-	secret := "your-signing-secret"
-	tokenString, err := generateTestJWT(eventPayload, secret)
+	secret := streamSecret("f67e39a0a4d34d56b3aa1bc4cff0069f")
+	tokenString, err := generateTestJWT("f67e39a0a4d34d56b3aa1bc4cff0069f", eventPayload, secret)
 	assert.NoError(t, err, "Failed to generate JWT for event payload")
 
 	// Create a request to update the stream status
@@ -498,6 +526,236 @@ func TestStreamUpdatedEventSection5(t *testing.T) {
 	}
 }
 
+// capturedSET is a SET the transmitter would have delivered
+type capturedSET struct {
+	streamID string
+	claims   map[string]interface{}
+}
+
+// captureTransmitter replaces the transmitter with one that records SETs instead of sending them
+func captureTransmitter(t *testing.T) func() []capturedSET {
+	var mu sync.Mutex
+	var captured []capturedSET
+
+	previous := transmitter
+	transmitter = NewTransmitter(TransmitterConfig{MaxPerHost: 1, QueueSize: 16})
+	transmitter.deliver = func(ctx context.Context, streamConfig StreamConfig, set string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		captured = append(captured, capturedSET{streamID: streamConfig.StreamID, claims: decodeSETClaims(t, set)})
+		return nil
+	}
+	t.Cleanup(func() {
+		transmitter.Shutdown(context.Background())
+		transmitter = previous
+	})
+
+	return func() []capturedSET {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		assert.NoError(t, transmitter.Flush(ctx))
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]capturedSET(nil), captured...)
+	}
+}
+
+// streamUpdate extracts the stream-updated event from captured SET claims
+func streamUpdate(t *testing.T, set capturedSET) map[string]interface{} {
+	t.Helper()
+	assert.Equal(t, map[string]interface{}{"format": "opaque", "id": set.streamID}, set.claims["sub_id"])
+	events, ok := set.claims["events"].(map[string]interface{})
+	if !ok {
+		t.Fatalf("SET has no events claim: %v", set.claims)
+	}
+	event, ok := events[secevent.StreamUpdatedType].(map[string]interface{})
+	if !ok {
+		t.Fatalf("SET is not a stream-updated event: %v", set.claims)
+	}
+	return event
+}
+
+func TestStreamLifecycleEmitsStreamUpdatedEvents(t *testing.T) {
+	useMemoryStreamStore(t)
+	useEndpointPolicy(t, endpointPolicy{})
+	useStubResolver(t, stubResolver{"receiver.example.com": {"93.184.216.34"}})
+	sent := captureTransmitter(t)
+
+	router := newRouter()
+
+	// Create
+	body := `{"events_supported": ["event1"], "events_endpoint": "https://receiver.example.com/events"}`
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/stream-config", bytes.NewBufferString(body)))
+	assert.Equal(t, http.StatusCreated, rec.Code)
+	var created StreamConfig
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &created))
+	assert.Equal(t, streamSecret(created.StreamID), created.ManagementSecret)
+	secret := created.ManagementSecret
+
+	// Status change requested by the receiver
+	statusJWT, err := generateTestJWT(created.StreamID, map[string]interface{}{"status": "paused", "reason": "Maintenance"}, secret)
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPut, "/stream-config/"+created.StreamID, bytes.NewBufferString(statusJWT)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// Subject added and removed
+	subject := map[string]interface{}{"format": "email", "email": "example.user@example.com"}
+	subjectJWT, err := generateTestJWT(created.StreamID, map[string]interface{}{"stream_id": created.StreamID, "subject": subject}, secret)
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ssf/subjects:add", bytes.NewBufferString(subjectJWT)))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/ssf/subjects:remove", bytes.NewBufferString(subjectJWT)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+
+	// Delete
+	deleteJWT, err := generateTestJWT(created.StreamID, map[string]interface{}{"stream_id": created.StreamID}, secret)
+	assert.NoError(t, err)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/stream-config/"+created.StreamID, bytes.NewBufferString(deleteJWT)))
+	assert.Equal(t, http.StatusNoContent, rec.Code)
+	rec = httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream-config/"+created.StreamID, nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	expected := []map[string]interface{}{
+		{"status": "enabled", "reason": reasonStreamCreated},
+		{"status": "paused", "reason": "Maintenance"},
+		{"status": "paused", "reason": reasonSubjectAdded},
+		{"status": "paused", "reason": reasonSubjectRemoved},
+		{"status": "disabled", "reason": reasonStreamDeleted},
+	}
+	sets := sent()
+	assert.Len(t, sets, len(expected))
+	for i, set := range sets {
+		assert.Equal(t, created.StreamID, set.streamID)
+		assert.Equal(t, expected[i], streamUpdate(t, set))
+	}
+}
+
+func TestDeleteStreamRequiresSignedJWTForTheStream(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	sent := captureTransmitter(t)
+	for _, streamID := range []string{"victim-stream", "attacker-stream"} {
+		assert.NoError(t, store.Create(context.Background(), StreamConfig{
+			StreamID:       streamID,
+			EventsEndpoint: "https://receiver.example.com/events",
+			Status:         "enabled",
+		}))
+	}
+
+	otherStream, err := generateTestJWT("attacker-stream", map[string]interface{}{"stream_id": "attacker-stream"}, streamSecret("attacker-stream"))
+	assert.NoError(t, err)
+	otherStreamKey, err := generateTestJWT("victim-stream", map[string]interface{}{"stream_id": "victim-stream"}, streamSecret("attacker-stream"))
+	assert.NoError(t, err)
+	wrongKey, err := generateTestJWT("victim-stream", map[string]interface{}{"stream_id": "victim-stream"}, "wrong-secret-of-at-least-thirty-two-bytes")
+	assert.NoError(t, err)
+	noStream, err := generateTestJWT("victim-stream", map[string]interface{}{}, streamSecret("victim-stream"))
+	assert.NoError(t, err)
+	otherIssuer, err := generateTestJWT("victim-stream", map[string]interface{}{"stream_id": "victim-stream", "iss": "attacker-stream"}, streamSecret("victim-stream"))
+	assert.NoError(t, err)
+	otherAudience, err := generateTestJWT("victim-stream", map[string]interface{}{"stream_id": "victim-stream", "aud": "https://other.example.com"}, streamSecret("victim-stream"))
+	assert.NoError(t, err)
+
+	router := newRouter()
+	for name, body := range map[string]string{
+		"no token":                   "",
+		"unsigned token":             "eyJhbGciOiJub25lIn0.eyJzdHJlYW1faWQiOiJ2aWN0aW0tc3RyZWFtIn0.",
+		"token for other stream":     otherStream,
+		"other stream's secret":      otherStreamKey,
+		"token with wrong key":       wrongKey,
+		"token without stream":       noStream,
+		"token from another issuer":  otherIssuer,
+		"token for another audience": otherAudience,
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(http.MethodDelete, "/stream-config/victim-stream", bytes.NewBufferString(body)))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code, name)
+	}
+
+	_, err = store.Get(context.Background(), "victim-stream")
+	assert.NoError(t, err, "the stream must survive rejected deletes")
+	assert.Empty(t, sent())
+}
+
+func TestManagementJWTsOnlyWorkForTheirStream(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	sent := captureTransmitter(t)
+	assert.NoError(t, store.Create(context.Background(), StreamConfig{
+		StreamID:       "victim-stream",
+		EventsEndpoint: "https://receiver.example.com/events",
+		Status:         "enabled",
+	}))
+
+	// A receiver signs with the secret of its own stream, naming another
+	attacker := streamSecret("attacker-stream")
+	subject := map[string]interface{}{"format": "email", "email": "example.user@example.com"}
+	sign := func(claims map[string]interface{}) string {
+		token, err := generateTestJWT("victim-stream", claims, attacker)
+		assert.NoError(t, err)
+		return token
+	}
+
+	router := newRouter()
+	for _, c := range []struct {
+		method, path, body string
+		status             int
+	}{
+		{http.MethodPut, "/stream-config/victim-stream", sign(map[string]interface{}{"status": "disabled"}), http.StatusBadRequest},
+		{http.MethodPost, "/ssf/subjects:add", sign(map[string]interface{}{"stream_id": "victim-stream", "subject": subject}), http.StatusUnauthorized},
+		{http.MethodPost, "/ssf/subjects:remove", sign(map[string]interface{}{"stream_id": "victim-stream", "subject": subject}), http.StatusUnauthorized},
+		{http.MethodPost, "/ssf/verify", sign(map[string]interface{}{"stream_id": "victim-stream"}), http.StatusUnauthorized},
+	} {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest(c.method, c.path, bytes.NewBufferString(c.body)))
+		assert.Equal(t, c.status, rec.Code, c.path)
+	}
+
+	victim, err := store.Get(context.Background(), "victim-stream")
+	assert.NoError(t, err)
+	assert.Equal(t, "enabled", victim.Status)
+	assert.Empty(t, victim.Subjects)
+	assert.Empty(t, sent())
+
+	// The secret is only handed out when the stream is created
+	rec := httptest.NewRecorder()
+	router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stream-config/victim-stream", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), "management_secret")
+}
+
+func TestTransmitterInitiatedStatusChangeNotifiesReceiver(t *testing.T) {
+	store := useMemoryStreamStore(t)
+	sent := captureTransmitter(t)
+
+	assert.NoError(t, store.Create(context.Background(), StreamConfig{
+		StreamID:       "test-stream",
+		EventsEndpoint: "https://receiver.example.com/events",
+		Status:         "enabled",
+	}))
+
+	updated, err := changeStreamStatus(context.Background(), "test-stream", StatusChange{
+		Status:      "paused",
+		Reason:      newReason("Internal error"),
+		InitiatedBy: initiatedByTransmitter,
+		ChangedAt:   time.Now().UTC(),
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "paused", updated.Status)
+	assert.Len(t, updated.StatusHistory, 1)
+	assert.Equal(t, initiatedByTransmitter, updated.StatusHistory[0].InitiatedBy)
+
+	sets := sent()
+	assert.Len(t, sets, 1)
+	assert.Equal(t, map[string]interface{}{"status": "paused", "reason": "Internal error"}, streamUpdate(t, sets[0]))
+
+	_, err = changeStreamStatus(context.Background(), "missing-stream", StatusChange{Status: "paused"})
+	assert.Equal(t, errStreamNotFound, err)
+}
+
 // Helper function to create a string pointer
 func newString(s string) *string {
 	return &s
@@ -0,0 +1,432 @@
+// Package ssfclient is a client for the SSF transmitter's management API,
+// for receivers and for services that manage streams on their behalf. It
+// discovers the transmitter's endpoints from its well-known metadata, signs
+// management requests with each stream's management secret, polls for events
+// and verifies the SETs it receives against the transmitter's published keys.
+package ssfclient
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-jose/go-jose/v4"
+
+	"ssf/secevent"
+	"ssf/sectoken"
+)
+
+// wellKnownPath is where the transmitter publishes its metadata (SSF 6.2)
+const wellKnownPath = "/.well-known/ssf-configuration"
+
+// tokenLifetime is how long the management JWTs the client signs are valid for
+const tokenLifetime = 5 * time.Minute
+
+// Client calls a single SSF transmitter. It is safe for concurrent use.
+type Client struct {
+	// Issuer is the transmitter's issuer URL, used for discovery. The iss of
+	// received SETs and the aud of signed requests is the issuer named in the
+	// transmitter's metadata.
+	Issuer string
+	// HTTPClient sends requests, http.DefaultClient if nil
+	HTTPClient *http.Client
+	// DecryptionKey is the private key matching the encryption key the
+	// receiver publishes, needed to read SETs from streams with encryption
+	DecryptionKey interface{}
+
+	mu       sync.Mutex
+	metadata *secevent.TransmitterMetadata
+	keys     *jose.JSONWebKeySet
+	secrets  map[string][]byte
+}
+
+// New returns a client for the transmitter at issuer
+func New(issuer string) *Client {
+	return &Client{
+		Issuer:  strings.TrimSuffix(issuer, "/"),
+		secrets: map[string][]byte{},
+	}
+}
+
+// SetStreamSecret records the management secret the transmitter returned
+// when a stream was created, for streams this client did not create itself.
+// Requests for a stream are signed with its secret.
+func (c *Client) SetStreamSecret(streamID, secret string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.secrets[streamID] = []byte(secret)
+}
+
+// Stream is a stream configuration as returned by the transmitter
+type Stream struct {
+	StreamID        string               `json:"stream_id"`
+	EventsSupported []string             `json:"events_supported"`
+	EventsEndpoint  string               `json:"events_endpoint"`
+	DeliveryMethod  string               `json:"delivery_method,omitempty"`
+	Status          string               `json:"status"`
+	Reason          string               `json:"reason,omitempty"`
+	Subjects        []secevent.SubjectID `json:"subjects,omitempty"`
+	Delivery        *Delivery            `json:"delivery,omitempty"`
+	Encryption      *Encryption          `json:"encryption,omitempty"`
+	StatusHistory   []StatusChange       `json:"status_history,omitempty"`
+	// ManagementSecret is only returned when the stream is created
+	ManagementSecret string `json:"management_secret,omitempty"`
+}
+
+// StreamRequest describes a stream to create. EventsEndpoint is required for
+// push delivery and ignored for poll delivery.
+type StreamRequest struct {
+	EventsSupported []string    `json:"events_supported"`
+	EventsEndpoint  string      `json:"events_endpoint,omitempty"`
+	DeliveryMethod  string      `json:"delivery_method,omitempty"`
+	Delivery        *Delivery   `json:"delivery,omitempty"`
+	Encryption      *Encryption `json:"encryption,omitempty"`
+}
+
+// Encryption asks the transmitter to encrypt SETs to a key the receiver
+// publishes in a JWKS. KeyID selects the key when the set holds several.
+type Encryption struct {
+	JWKSURI string `json:"jwks_uri"`
+	KeyID   string `json:"kid,omitempty"`
+}
+
+// Delivery holds the credentials the transmitter presents when pushing SETs.
+// Secrets come back from the transmitter as REDACTED.
+type Delivery struct {
+	AuthorizationHeader string      `json:"authorization_header,omitempty"`
+	OAuth               *OAuth      `json:"oauth,omitempty"`
+	ClientCert          *ClientCert `json:"client_cert,omitempty"`
+}
+
+// OAuth configures a client credentials grant against the receiver's token endpoint
+type OAuth struct {
+	TokenURL     string `json:"token_url"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// ClientCert names the files used for mutual TLS, relative to the
+// transmitter's client certificate directory
+type ClientCert struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	CAFile   string `json:"ca_file,omitempty"`
+}
+
+// StatusChange is an entry in a stream's status history
+type StatusChange struct {
+	Status      string    `json:"status"`
+	Reason      string    `json:"reason,omitempty"`
+	InitiatedBy string    `json:"initiated_by"`
+	ChangedAt   time.Time `json:"changed_at"`
+}
+
+// Error is returned when the transmitter responds with a non-2xx status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("ssf transmitter responded with status %d: %s", e.StatusCode, e.Message)
+}
+
+// Discover fetches and caches the transmitter's metadata. The metadata must
+// name the same issuer the client was created for (SSF 6.2.4).
+func (c *Client) Discover(ctx context.Context) (*secevent.TransmitterMetadata, error) {
+	c.mu.Lock()
+	metadata := c.metadata
+	c.mu.Unlock()
+	if metadata != nil {
+		return metadata, nil
+	}
+
+	metadata = &secevent.TransmitterMetadata{}
+	if err := c.do(ctx, http.MethodGet, c.Issuer+wellKnownPath, "", nil, nil, metadata); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(metadata.Issuer, "/") != c.Issuer {
+		return nil, fmt.Errorf("transmitter metadata issuer %q does not match %q", metadata.Issuer, c.Issuer)
+	}
+
+	c.mu.Lock()
+	c.metadata = metadata
+	c.mu.Unlock()
+	return metadata, nil
+}
+
+// CreateStream registers a new stream and records its management secret.
+// Keep the returned ManagementSecret: the transmitter does not send it again.
+func (c *Client) CreateStream(ctx context.Context, req StreamRequest) (*Stream, error) {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var stream Stream
+	if err := c.do(ctx, http.MethodPost, metadata.ConfigurationEndpoint, "application/json", body, nil, &stream); err != nil {
+		return nil, err
+	}
+	if stream.ManagementSecret != "" {
+		c.SetStreamSecret(stream.StreamID, stream.ManagementSecret)
+	}
+	return &stream, nil
+}
+
+// GetStream returns a stream's configuration, status and status history
+func (c *Client) GetStream(ctx context.Context, streamID string) (*Stream, error) {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var stream Stream
+	if err := c.do(ctx, http.MethodGet, metadata.StatusEndpoint+"/"+streamID, "", nil, nil, &stream); err != nil {
+		return nil, err
+	}
+	return &stream, nil
+}
+
+// UpdateStatus sets a stream's status to enabled, paused or disabled
+func (c *Client) UpdateStatus(ctx context.Context, streamID, status, reason string) error {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	claims := map[string]interface{}{"status": status}
+	if reason != "" {
+		claims["reason"] = reason
+	}
+	return c.doSigned(ctx, http.MethodPut, metadata.StatusEndpoint+"/"+streamID, streamID, claims)
+}
+
+// DeleteStream deletes a stream
+func (c *Client) DeleteStream(ctx context.Context, streamID string) error {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	return c.doSigned(ctx, http.MethodDelete, metadata.ConfigurationEndpoint+"/"+streamID, streamID, map[string]interface{}{
+		"stream_id": streamID,
+	})
+}
+
+// AddSubject adds a subject to a stream
+func (c *Client) AddSubject(ctx context.Context, streamID string, subject secevent.SubjectID, verified bool) error {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	return c.doSigned(ctx, http.MethodPost, metadata.AddSubjectEndpoint, streamID, map[string]interface{}{
+		"stream_id": streamID,
+		"subject":   subject,
+		"verified":  verified,
+	})
+}
+
+// RemoveSubject removes a subject from a stream
+func (c *Client) RemoveSubject(ctx context.Context, streamID string, subject secevent.SubjectID) error {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	return c.doSigned(ctx, http.MethodPost, metadata.RemoveSubjectEndpoint, streamID, map[string]interface{}{
+		"stream_id": streamID,
+		"subject":   subject,
+	})
+}
+
+// RequestVerification asks the transmitter to send a verification event on
+// the stream, echoing state if it is not empty
+func (c *Client) RequestVerification(ctx context.Context, streamID, state string) error {
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return err
+	}
+	claims := map[string]interface{}{"stream_id": streamID}
+	if state != "" {
+		claims["state"] = state
+	}
+	return c.doSigned(ctx, http.MethodPost, metadata.VerificationEndpoint, streamID, claims)
+}
+
+// Poll collects SETs from a poll stream (RFC 8936), acknowledging those
+// listed in req. The returned SETs are not verified; use VerifySET with the
+// stream's ID.
+func (c *Client) Poll(ctx context.Context, stream *Stream, req secevent.PollRequest) (*secevent.PollResponse, error) {
+	if stream.DeliveryMethod != secevent.PollDeliveryMethod {
+		return nil, fmt.Errorf("stream %s does not use poll delivery", stream.StreamID)
+	}
+	token, err := c.sign(ctx, stream.StreamID, map[string]interface{}{"stream_id": stream.StreamID})
+	if err != nil {
+		return nil, err
+	}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	var resp secevent.PollResponse
+	header := http.Header{"Authorization": {"Bearer " + token}}
+	if err := c.do(ctx, http.MethodPost, stream.EventsEndpoint, "application/json", body, header, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// VerifySET decrypts the SET if it is encrypted, checks its signature
+// against the transmitter's published keys, that the transmitter issued it to
+// the stream it was received on, and returns its claims
+func (c *Client) VerifySET(ctx context.Context, streamID, set string) (*secevent.SET, error) {
+	if sectoken.IsEncrypted(set) {
+		if c.DecryptionKey == nil {
+			return nil, fmt.Errorf("SET is encrypted and the client has no DecryptionKey")
+		}
+		nested, err := sectoken.Decrypt(set, c.DecryptionKey)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt SET: %v", err)
+		}
+		set = nested
+	}
+
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := c.transmitterKeys(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	var claims secevent.SET
+	expected := sectoken.Expected{Issuer: metadata.Issuer, Audience: streamID}
+	err = sectoken.VerifySET(set, *keys, expected, &claims)
+	if errors.Is(err, jose.ErrJWKSKidNotFound) {
+		// The transmitter may have rotated its key since the keys were fetched
+		if keys, err = c.transmitterKeys(ctx, true); err != nil {
+			return nil, err
+		}
+		err = sectoken.VerifySET(set, *keys, expected, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid SET: %v", err)
+	}
+	if claims.JTI == "" || len(claims.Events) == 0 {
+		return nil, fmt.Errorf("SET is missing jti or events")
+	}
+	return &claims, nil
+}
+
+// transmitterKeys fetches and caches the keys published at the transmitter's
+// jwks_uri, fetching them again if refresh is set
+func (c *Client) transmitterKeys(ctx context.Context, refresh bool) (*jose.JSONWebKeySet, error) {
+	c.mu.Lock()
+	keys := c.keys
+	c.mu.Unlock()
+	if keys != nil && !refresh {
+		return keys, nil
+	}
+
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if metadata.JWKSURI == "" {
+		return nil, fmt.Errorf("transmitter does not publish a jwks_uri to verify SETs with")
+	}
+	keys = &jose.JSONWebKeySet{}
+	if err := c.do(ctx, http.MethodGet, metadata.JWKSURI, "", nil, nil, keys); err != nil {
+		return nil, fmt.Errorf("failed to fetch transmitter keys: %v", err)
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return keys, nil
+}
+
+// sign creates the HS256 JWT, keyed with the stream's management secret, used
+// to authenticate a management request. It is issued by the stream to the
+// transmitter.
+func (c *Client) sign(ctx context.Context, streamID string, claims map[string]interface{}) (string, error) {
+	c.mu.Lock()
+	secret, ok := c.secrets[streamID]
+	c.mu.Unlock()
+	if !ok {
+		return "", fmt.Errorf("no management secret for stream %s, see SetStreamSecret", streamID)
+	}
+	metadata, err := c.Discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	claims["iss"] = streamID
+	claims["aud"] = metadata.Issuer
+	now := time.Now()
+	if _, ok := claims["iat"]; !ok {
+		claims["iat"] = now.Unix()
+	}
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = now.Add(tokenLifetime).Unix()
+	}
+	return sectoken.Sign(claims, secret, sectoken.JWTType)
+}
+
+// doSigned sends claims as a JWT request body signed for the stream
+func (c *Client) doSigned(ctx context.Context, method, url, streamID string, claims map[string]interface{}) error {
+	token, err := c.sign(ctx, streamID, claims)
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, method, url, "application/jwt", []byte(token), nil, nil)
+}
+
+// do sends a request and decodes a JSON response into out, if out is not nil
+func (c *Client) do(ctx context.Context, method, url, contentType string, body []byte, header http.Header, out interface{}) error {
+	if url == "" {
+		return fmt.Errorf("transmitter does not advertise an endpoint for this operation")
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if out != nil {
+		req.Header.Set("Accept", "application/json")
+	}
+
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(message))}
+	}
+	if out == nil {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode transmitter response: %v", err)
+	}
+	return nil
+}
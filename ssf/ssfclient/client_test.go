@@ -0,0 +1,250 @@
+package ssfclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/go-jose/go-jose/v4"
+	"github.com/stretchr/testify/assert"
+
+	"ssf/secevent"
+	"ssf/sectoken"
+)
+
+var testSecret = "test-secret-of-at-least-32-bytes"
+
+// newTestSETKey returns an ES256 key like the one the transmitter signs SETs with
+func newTestSETKey(t *testing.T, kid string) jose.JSONWebKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	return jose.JSONWebKey{Key: key, KeyID: kid, Algorithm: string(jose.ES256), Use: "sig"}
+}
+
+// testTransmitter serves transmitter metadata and the public half of its SET
+// keys, and records the management requests it receives
+type testTransmitter struct {
+	*httptest.Server
+	mu       sync.Mutex
+	keys     []jose.JSONWebKey
+	requests []*http.Request
+	bodies   []string
+}
+
+// newMetadataServer serves transmitter metadata naming issuer, or the
+// server's own URL if issuer is empty, with keys published at its jwks_uri
+func newMetadataServer(t *testing.T, issuer string, keys ...jose.JSONWebKey) *testTransmitter {
+	tr := &testTransmitter{keys: keys}
+	tr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case wellKnownPath:
+			metadata := secevent.TransmitterMetadata{
+				Issuer:                tr.URL,
+				JWKSURI:               tr.URL + "/jwks.json",
+				ConfigurationEndpoint: tr.URL + "/stream-config",
+				StatusEndpoint:        tr.URL + "/stream-config",
+			}
+			if issuer != "" {
+				metadata.Issuer = issuer
+			}
+			json.NewEncoder(w).Encode(metadata)
+		case "/jwks.json":
+			tr.mu.Lock()
+			defer tr.mu.Unlock()
+			var published jose.JSONWebKeySet
+			for _, key := range tr.keys {
+				published.Keys = append(published.Keys, key.Public())
+			}
+			json.NewEncoder(w).Encode(published)
+		default:
+			body, _ := io.ReadAll(r.Body)
+			tr.mu.Lock()
+			tr.requests = append(tr.requests, r)
+			tr.bodies = append(tr.bodies, string(body))
+			tr.mu.Unlock()
+			if r.Method == http.MethodGet {
+				http.Error(w, "Stream not found", http.StatusNotFound)
+			}
+		}
+	}))
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+// rotate replaces the published keys
+func (tr *testTransmitter) rotate(keys ...jose.JSONWebKey) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.keys = keys
+}
+
+func signTestSET(t *testing.T, claims map[string]interface{}, key jose.JSONWebKey) string {
+	t.Helper()
+	set, err := sectoken.SignSET(claims, key)
+	assert.NoError(t, err)
+	return set
+}
+
+// unsignedTestSET builds an alg none token, which must never verify
+func unsignedTestSET(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	payload, err := json.Marshal(claims)
+	assert.NoError(t, err)
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"secevent+jwt"}`))
+	return header + "." + base64.RawURLEncoding.EncodeToString(payload) + "."
+}
+
+func testSETClaims(issuer string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":    issuer,
+		"aud":    "stream-1",
+		"iat":    1700000000,
+		"jti":    "abc",
+		"sub_id": map[string]interface{}{"format": "opaque", "id": "stream-1"},
+		"events": map[string]interface{}{
+			secevent.VerificationType: map[string]interface{}{"state": "xyz"},
+		},
+	}
+}
+
+func TestDiscoverRejectsIssuerMismatch(t *testing.T) {
+	ts := newMetadataServer(t, "https://other.example.com")
+
+	_, err := New(ts.URL).Discover(context.Background())
+	assert.Error(t, err)
+}
+
+func TestClientReturnsTransmitterErrors(t *testing.T) {
+	ts := newMetadataServer(t, "")
+
+	_, err := New(ts.URL).GetStream(context.Background(), "missing")
+	var apiErr *Error
+	if assert.True(t, errors.As(err, &apiErr)) {
+		assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+		assert.Equal(t, "Stream not found", apiErr.Message)
+	}
+}
+
+func TestPollRequiresPollStream(t *testing.T) {
+	client := New("https://tr.example.com")
+	_, err := client.Poll(context.Background(), &Stream{StreamID: "s", DeliveryMethod: secevent.PushDeliveryMethod}, secevent.PollRequest{})
+	assert.Error(t, err)
+}
+
+func TestRequestsAreSignedWithTheStreamSecret(t *testing.T) {
+	ts := newMetadataServer(t, "")
+	client := New(ts.URL)
+	ctx := context.Background()
+
+	assert.Error(t, client.UpdateStatus(ctx, "stream-1", "paused", ""), "no secret for the stream")
+	assert.Empty(t, ts.requests)
+
+	client.SetStreamSecret("stream-1", testSecret)
+	client.SetStreamSecret("stream-2", "another-secret-of-at-least-32-bytes")
+	assert.NoError(t, client.UpdateStatus(ctx, "stream-1", "paused", ""))
+	if assert.Len(t, ts.bodies, 1) {
+		var claims map[string]interface{}
+		expected := sectoken.Expected{Issuer: "stream-1", Audience: ts.URL}
+		assert.NoError(t, sectoken.Verify(ts.bodies[0], []byte(testSecret), expected, &claims))
+		assert.Equal(t, "paused", claims["status"])
+	}
+}
+
+func TestVerifySET(t *testing.T) {
+	key := newTestSETKey(t, "set-1")
+	ts := newMetadataServer(t, "", key)
+	client := New(ts.URL + "/")
+	ctx := context.Background()
+	claims := func() map[string]interface{} { return testSETClaims(ts.URL) }
+
+	set, err := client.VerifySET(ctx, "stream-1", signTestSET(t, claims(), key))
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abc", set.JTI)
+		assert.Equal(t, secevent.StreamSubject("stream-1"), *set.SubID)
+		var verification secevent.Verification
+		ok, err := set.Event(secevent.VerificationType, &verification)
+		assert.True(t, ok)
+		assert.NoError(t, err)
+		assert.Equal(t, "xyz", verification.State)
+	}
+
+	_, err = client.VerifySET(ctx, "stream-2", signTestSET(t, claims(), key))
+	assert.Error(t, err, "SET for another stream")
+
+	forged := newTestSETKey(t, "set-1")
+	_, err = client.VerifySET(ctx, "stream-1", signTestSET(t, claims(), forged))
+	assert.Error(t, err, "signature by another key")
+
+	hmac, err := sectoken.Sign(claims(), []byte(testSecret), sectoken.SETType)
+	assert.NoError(t, err)
+	_, err = client.VerifySET(ctx, "stream-1", hmac)
+	assert.Error(t, err, "SET signed with a management secret")
+
+	_, err = client.VerifySET(ctx, "stream-1", unsignedTestSET(t, claims()))
+	assert.Error(t, err, "unsigned SET")
+
+	wrongIssuer := claims()
+	wrongIssuer["iss"] = "https://attacker.example.com"
+	_, err = client.VerifySET(ctx, "stream-1", signTestSET(t, wrongIssuer, key))
+	assert.Error(t, err, "SET from another issuer")
+
+	noEvents := claims()
+	delete(noEvents, "events")
+	_, err = client.VerifySET(ctx, "stream-1", signTestSET(t, noEvents, key))
+	assert.Error(t, err, "SET without events")
+}
+
+func TestVerifySETFetchesRotatedKeys(t *testing.T) {
+	key := newTestSETKey(t, "set-1")
+	ts := newMetadataServer(t, "", key)
+	client := New(ts.URL)
+	ctx := context.Background()
+
+	_, err := client.VerifySET(ctx, "stream-1", signTestSET(t, testSETClaims(ts.URL), key))
+	assert.NoError(t, err)
+
+	rotated := newTestSETKey(t, "set-2")
+	ts.rotate(rotated)
+	_, err = client.VerifySET(ctx, "stream-1", signTestSET(t, testSETClaims(ts.URL), rotated))
+	assert.NoError(t, err)
+	_, err = client.VerifySET(ctx, "stream-1", signTestSET(t, testSETClaims(ts.URL), key))
+	assert.Error(t, err, "the retired key is no longer published")
+}
+
+func TestVerifyEncryptedSET(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	setKey := newTestSETKey(t, "set-1")
+	ts := newMetadataServer(t, "", setKey)
+	client := New(ts.URL)
+	ctx := context.Background()
+
+	set, err := sectoken.Encrypt(signTestSET(t, testSETClaims(ts.URL), setKey), jose.JSONWebKey{Key: &key.PublicKey}, "abc")
+	assert.NoError(t, err)
+
+	_, err = client.VerifySET(ctx, "stream-1", set)
+	assert.Error(t, err, "no decryption key")
+
+	client.DecryptionKey = key
+	verified, err := client.VerifySET(ctx, "stream-1", set)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "abc", verified.JTI)
+	}
+
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	client.DecryptionKey = other
+	_, err = client.VerifySET(ctx, "stream-1", set)
+	assert.Error(t, err, "encrypted to another key")
+}
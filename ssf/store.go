@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"errors"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+var errStreamNotFound = errors.New("stream not found")
+
+// streamStore persists stream configurations. Methods that modify a stream
+// return the configuration as it is after the change.
+type streamStore interface {
+	Create(ctx context.Context, streamConfig StreamConfig) error
+	Get(ctx context.Context, streamID string) (StreamConfig, error)
+	// ListByStatus returns every stream with the given status
+	ListByStatus(ctx context.Context, status string) ([]StreamConfig, error)
+	// UpdateStatus sets the stream's status and appends the change to its history
+	UpdateStatus(ctx context.Context, streamID string, change StatusChange) (StreamConfig, error)
+	AddSubject(ctx context.Context, streamID string, subject Subject) (StreamConfig, error)
+	RemoveSubject(ctx context.Context, streamID string, subject Subject) (StreamConfig, error)
+	Delete(ctx context.Context, streamID string) error
+}
+
+// streams is the store used by the management handlers
+var streams streamStore = mongoStreamStore{}
+
+// mongoStreamStore keeps stream configurations in the package level collection
+type mongoStreamStore struct{}
+
+func (mongoStreamStore) Create(ctx context.Context, streamConfig StreamConfig) error {
+	_, err := collection.InsertOne(ctx, streamConfig)
+	return err
+}
+
+func (mongoStreamStore) Get(ctx context.Context, streamID string) (StreamConfig, error) {
+	var streamConfig StreamConfig
+	err := collection.FindOne(ctx, bson.M{"stream_id": streamID}).Decode(&streamConfig)
+	if err == mongo.ErrNoDocuments {
+		return streamConfig, errStreamNotFound
+	}
+	return streamConfig, err
+}
+
+func (mongoStreamStore) ListByStatus(ctx context.Context, status string) ([]StreamConfig, error) {
+	cursor, err := collection.Find(ctx, bson.M{"status": status})
+	if err != nil {
+		return nil, err
+	}
+	var streamConfigs []StreamConfig
+	err = cursor.All(ctx, &streamConfigs)
+	return streamConfigs, err
+}
+
+func (s mongoStreamStore) UpdateStatus(ctx context.Context, streamID string, change StatusChange) (StreamConfig, error) {
+	update := bson.M{
+		"$set": bson.M{"status": change.Status},
+		"$push": bson.M{"status_history": bson.M{
+			"$each":  []StatusChange{change},
+			"$slice": -maxStatusHistory,
+		}},
+	}
+	if change.Reason != nil {
+		update["$set"].(bson.M)["reason"] = change.Reason
+	} else {
+		update["$unset"] = bson.M{"reason": ""}
+	}
+	return s.findOneAndUpdate(ctx, streamID, update)
+}
+
+func (s mongoStreamStore) AddSubject(ctx context.Context, streamID string, subject Subject) (StreamConfig, error) {
+	return s.findOneAndUpdate(ctx, streamID, bson.M{"$push": bson.M{"subjects": subject}})
+}
+
+func (s mongoStreamStore) RemoveSubject(ctx context.Context, streamID string, subject Subject) (StreamConfig, error) {
+	return s.findOneAndUpdate(ctx, streamID, bson.M{"$pull": bson.M{"subjects": subject}})
+}
+
+func (mongoStreamStore) Delete(ctx context.Context, streamID string) error {
+	result, err := collection.DeleteOne(ctx, bson.M{"stream_id": streamID})
+	if err != nil {
+		return err
+	}
+	if result.DeletedCount == 0 {
+		return errStreamNotFound
+	}
+	return nil
+}
+
+func (mongoStreamStore) findOneAndUpdate(ctx context.Context, streamID string, update bson.M) (StreamConfig, error) {
+	var streamConfig StreamConfig
+	opts := options.FindOneAndUpdate().SetReturnDocument(options.After)
+	err := collection.FindOneAndUpdate(ctx, bson.M{"stream_id": streamID}, update, opts).Decode(&streamConfig)
+	if err == mongo.ErrNoDocuments {
+		return streamConfig, errStreamNotFound
+	}
+	return streamConfig, err
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+)
+
+// memoryStreamStore is an in-process streamStore for tests that do not need MongoDB
+type memoryStreamStore struct {
+	mu      sync.Mutex
+	streams map[string]StreamConfig
+}
+
+func newMemoryStreamStore() *memoryStreamStore {
+	return &memoryStreamStore{streams: map[string]StreamConfig{}}
+}
+
+// useMemoryStreamStore swaps the handlers' store for an empty in-memory one
+func useMemoryStreamStore(t testing.TB) *memoryStreamStore {
+	store := newMemoryStreamStore()
+	previous := streams
+	streams = store
+	t.Cleanup(func() { streams = previous })
+	return store
+}
+
+func (s *memoryStreamStore) Create(ctx context.Context, streamConfig StreamConfig) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.streams[streamConfig.StreamID] = streamConfig
+	return nil
+}
+
+func (s *memoryStreamStore) Get(ctx context.Context, streamID string) (StreamConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streamConfig, ok := s.streams[streamID]
+	if !ok {
+		return StreamConfig{}, errStreamNotFound
+	}
+	return streamConfig, nil
+}
+
+func (s *memoryStreamStore) ListByStatus(ctx context.Context, status string) ([]StreamConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var streamConfigs []StreamConfig
+	for _, streamConfig := range s.streams {
+		if streamConfig.Status == status {
+			streamConfigs = append(streamConfigs, streamConfig)
+		}
+	}
+	return streamConfigs, nil
+}
+
+func (s *memoryStreamStore) UpdateStatus(ctx context.Context, streamID string, change StatusChange) (StreamConfig, error) {
+	return s.update(streamID, func(streamConfig *StreamConfig) {
+		streamConfig.Status = change.Status
+		streamConfig.Reason = change.Reason
+		streamConfig.StatusHistory = append(streamConfig.StatusHistory, change)
+		if len(streamConfig.StatusHistory) > maxStatusHistory {
+			streamConfig.StatusHistory = streamConfig.StatusHistory[len(streamConfig.StatusHistory)-maxStatusHistory:]
+		}
+	})
+}
+
+func (s *memoryStreamStore) AddSubject(ctx context.Context, streamID string, subject Subject) (StreamConfig, error) {
+	return s.update(streamID, func(streamConfig *StreamConfig) {
+		streamConfig.Subjects = append(streamConfig.Subjects, subject)
+	})
+}
+
+func (s *memoryStreamStore) RemoveSubject(ctx context.Context, streamID string, subject Subject) (StreamConfig, error) {
+	return s.update(streamID, func(streamConfig *StreamConfig) {
+		var kept []Subject
+		for _, existing := range streamConfig.Subjects {
+			if existing != subject {
+				kept = append(kept, existing)
+			}
+		}
+		streamConfig.Subjects = kept
+	})
+}
+
+func (s *memoryStreamStore) Delete(ctx context.Context, streamID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.streams[streamID]; !ok {
+		return errStreamNotFound
+	}
+	delete(s.streams, streamID)
+	return nil
+}
+
+func (s *memoryStreamStore) update(streamID string, apply func(*StreamConfig)) (StreamConfig, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	streamConfig, ok := s.streams[streamID]
+	if !ok {
+		return StreamConfig{}, errStreamNotFound
+	}
+	apply(&streamConfig)
+	s.streams[streamID] = streamConfig
+	return streamConfig, nil
+}
@@ -0,0 +1,614 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	errTransmitterStopped = errors.New("transmitter is shutting down")
+	errStreamRemoved      = errors.New("stream has been removed")
+)
+
+// TransmitterConfig bounds the resources used to push SETs to receivers
+type TransmitterConfig struct {
+	// MaxPerHost is the number of concurrent deliveries allowed to a single receiver host
+	MaxPerHost int
+	// QueueSize is the number of SETs buffered per stream before Emit blocks
+	QueueSize int
+	// Outbox, if set, receives SETs still undelivered when Shutdown gives up
+	Outbox eventOutbox
+
+	// FailureBudget is the number of consecutive failed attempts after which a
+	// stream is paused and its SETs are held until the receiver recovers
+	FailureBudget int
+	// RetryBackoff is the delay before the first retry, doubling for each further attempt
+	RetryBackoff time.Duration
+	// ProbeInterval is how often a paused receiver is probed with a verification event
+	ProbeInterval time.Duration
+	// MaxBuffered is the number of SETs held for a paused stream before the oldest are dropped
+	MaxBuffered int
+	// OnStatusChange, if set, is called when the transmitter pauses or re-enables a stream
+	OnStatusChange func(streamID, status, reason string)
+	// StreamStatus, if set, looks up a stream's current status before a SET
+	// is sent, since the configuration queued with the SET may be stale. It
+	// returns errStreamNotFound once the stream has been deleted.
+	StreamStatus func(ctx context.Context, streamID string) (string, error)
+}
+
+// loadTransmitterConfig reads the transmitter limits from the environment
+func loadTransmitterConfig() TransmitterConfig {
+	config := TransmitterConfig{MaxPerHost: 8, QueueSize: 256}
+	if v, err := strconv.Atoi(os.Getenv("SSF_MAX_DELIVERIES_PER_HOST")); err == nil && v > 0 {
+		config.MaxPerHost = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SSF_STREAM_QUEUE_SIZE")); err == nil && v > 0 {
+		config.QueueSize = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SSF_DELIVERY_FAILURE_BUDGET")); err == nil && v > 0 {
+		config.FailureBudget = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SSF_DELIVERY_RETRY_BACKOFF")); err == nil && v > 0 {
+		config.RetryBackoff = v
+	}
+	if v, err := time.ParseDuration(os.Getenv("SSF_PROBE_INTERVAL")); err == nil && v > 0 {
+		config.ProbeInterval = v
+	}
+	if v, err := strconv.Atoi(os.Getenv("SSF_MAX_BUFFERED_PER_STREAM")); err == nil && v > 0 {
+		config.MaxBuffered = v
+	}
+	return config
+}
+
+// outboundSET is a signed SET waiting to be delivered on a stream. Stream
+// events, such as stream-updated and verification, are about the stream
+// itself and are sent whatever its status.
+type outboundSET struct {
+	stream      StreamConfig
+	set         string
+	streamEvent bool
+}
+
+// streamQueue is a stream's queue of SETs, closed down by Remove
+type streamQueue struct {
+	sets    chan outboundSET
+	removed chan struct{}
+	resumed chan struct{}
+	senders sync.WaitGroup
+}
+
+// Transmitter fans signed SETs out to streams. Each stream has its own queue
+// and worker so SETs are delivered in the order they were emitted, while a
+// per-host semaphore bounds how hard any single receiver is pushed.
+type Transmitter struct {
+	config  TransmitterConfig
+	deliver func(ctx context.Context, streamConfig StreamConfig, set string) error
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	workers   sync.WaitGroup
+	enqueuing sync.WaitGroup
+
+	mu      sync.Mutex
+	stopped bool
+	queues  map[string]*streamQueue
+	hosts   map[string]chan struct{}
+	pending int
+	idle    chan struct{}
+	unsent  []pendingSET
+}
+
+// persistTimeout bounds how long Shutdown spends writing undelivered SETs to the outbox
+var persistTimeout = 5 * time.Second
+
+// restoreTimeout bounds how long Restore waits for room in the streams' queues
+var restoreTimeout = time.Minute
+
+// statusLookupTimeout bounds how long a worker waits for a stream's current status
+var statusLookupTimeout = 2 * time.Second
+
+// transmitter is the process wide transmitter used by the management handlers
+var transmitter = NewTransmitter(loadTransmitterConfig())
+
+// NewTransmitter creates a transmitter that delivers with deliverToStream
+func NewTransmitter(config TransmitterConfig) *Transmitter {
+	if config.MaxPerHost <= 0 {
+		config.MaxPerHost = 1
+	}
+	if config.QueueSize <= 0 {
+		config.QueueSize = 1
+	}
+	if config.FailureBudget <= 0 {
+		config.FailureBudget = 5
+	}
+	if config.RetryBackoff <= 0 {
+		config.RetryBackoff = 500 * time.Millisecond
+	}
+	if config.ProbeInterval <= 0 {
+		config.ProbeInterval = 30 * time.Second
+	}
+	if config.MaxBuffered <= 0 {
+		config.MaxBuffered = 1000
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Transmitter{
+		config:  config,
+		deliver: deliverToStream,
+		ctx:     ctx,
+		cancel:  cancel,
+		queues:  map[string]*streamQueue{},
+		hosts:   map[string]chan struct{}{},
+		idle:    make(chan struct{}),
+	}
+}
+
+// Emit signs the event claims once per stream and queues the resulting SETs.
+// Streams are queued concurrently, so a stream whose queue is full only holds
+// up its own SET, and Emit returns once every stream has its SET or ctx is
+// done. A stream that fails does not stop the others; the failures are
+// returned together.
+func (t *Transmitter) Emit(ctx context.Context, claims map[string]interface{}, streams []StreamConfig) error {
+	var (
+		mu   sync.Mutex
+		errs []error
+		wg   sync.WaitGroup
+	)
+	fail := func(streamID string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, fmt.Errorf("stream %s: %w", streamID, err))
+	}
+	for _, streamConfig := range streams {
+		set, err := signEventForStream(claims, streamConfig)
+		if err != nil {
+			fail(streamConfig.StreamID, err)
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := t.Enqueue(ctx, streamConfig, set); err != nil {
+				fail(streamConfig.StreamID, err)
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// EmitBatch emits each event in order to every stream, so each stream
+// receives the batch in the order given. Like Emit it carries on past
+// failures, stopping early only once ctx is done.
+func (t *Transmitter) EmitBatch(ctx context.Context, events []map[string]interface{}, streams []StreamConfig) error {
+	var errs []error
+	for _, claims := range events {
+		if err := t.Emit(ctx, claims, streams); err != nil {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Enqueue queues an already signed SET for delivery on a stream
+func (t *Transmitter) Enqueue(ctx context.Context, streamConfig StreamConfig, set string) error {
+	return t.enqueue(ctx, outboundSET{stream: streamConfig, set: set})
+}
+
+// EnqueueStreamEvent queues an already signed SET about the stream itself,
+// which is sent even while the stream is paused or disabled
+func (t *Transmitter) EnqueueStreamEvent(ctx context.Context, streamConfig StreamConfig, set string) error {
+	return t.enqueue(ctx, outboundSET{stream: streamConfig, set: set, streamEvent: true})
+}
+
+func (t *Transmitter) enqueue(ctx context.Context, out outboundSET) error {
+	t.mu.Lock()
+	if t.stopped {
+		t.mu.Unlock()
+		return errTransmitterStopped
+	}
+	queue := t.queueLocked(out.stream.StreamID)
+	t.pending++
+	t.enqueuing.Add(1)
+	queue.senders.Add(1)
+	t.mu.Unlock()
+	defer t.enqueuing.Done()
+	defer queue.senders.Done()
+
+	select {
+	case queue.sets <- out:
+		return nil
+	case <-queue.removed:
+		t.done()
+		return errStreamRemoved
+	case <-ctx.Done():
+		t.done()
+		return ctx.Err()
+	case <-t.ctx.Done():
+		t.done()
+		return errTransmitterStopped
+	}
+}
+
+// Remove tears down the queue and worker of a deleted stream. Stream events
+// already queued, such as the one announcing the deletion, are still
+// attempted once; every other SET for the stream is dropped.
+func (t *Transmitter) Remove(streamID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if queue, ok := t.queues[streamID]; ok {
+		delete(t.queues, streamID)
+		close(queue.removed)
+	}
+}
+
+// Flush waits until every queued SET has been delivered or ctx is done
+func (t *Transmitter) Flush(ctx context.Context) error {
+	t.mu.Lock()
+	if t.pending == 0 {
+		t.mu.Unlock()
+		return nil
+	}
+	idle := t.idle
+	t.mu.Unlock()
+
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting new SETs and waits for the queued ones to be
+// delivered. If ctx expires first, in-flight deliveries are cancelled and
+// everything not yet delivered is saved to the outbox for the next instance.
+func (t *Transmitter) Shutdown(ctx context.Context) error {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+
+	err := t.Flush(ctx)
+	t.cancel()
+	t.enqueuing.Wait()
+	t.workers.Wait()
+
+	// Anything that raced into a queue after its worker stopped is kept too
+	t.mu.Lock()
+	queues := make([]*streamQueue, 0, len(t.queues))
+	for _, queue := range t.queues {
+		queues = append(queues, queue)
+	}
+	t.mu.Unlock()
+	for _, queue := range queues {
+		t.keepQueued(queue.sets)
+	}
+
+	t.mu.Lock()
+	unsent := t.unsent
+	t.unsent = nil
+	t.mu.Unlock()
+	if len(unsent) == 0 {
+		return err
+	}
+	now := time.Now()
+	for i := range unsent {
+		unsent[i].QueuedAt = now
+	}
+
+	if t.config.Outbox == nil {
+		log.Printf("Discarding %d undelivered SETs, no outbox configured", len(unsent))
+		return err
+	}
+	persistCtx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if perr := t.config.Outbox.Save(persistCtx, unsent); perr != nil {
+		log.Printf("Error persisting %d undelivered SETs: %v", len(unsent), perr)
+		return perr
+	}
+	log.Printf("Persisted %d undelivered SETs for redelivery", len(unsent))
+	return err
+}
+
+// Restore queues SETs left in the outbox by a previous instance. It should be
+// called before the transmitter starts receiving new events. Drain has
+// already removed the SETs from the outbox, so any that cannot be queued
+// before ctx is done are written back for the next instance.
+func (t *Transmitter) Restore(ctx context.Context) error {
+	if t.config.Outbox == nil {
+		return nil
+	}
+	// Drain may return some SETs alongside an error, queue those regardless
+	pending, err := t.config.Outbox.Drain(ctx)
+	for i, p := range pending {
+		qerr := t.enqueue(ctx, outboundSET{stream: p.Stream, set: p.SET, streamEvent: p.StreamEvent})
+		if errors.Is(qerr, errStreamRemoved) {
+			continue
+		}
+		if qerr != nil {
+			log.Printf("Restored %d undelivered SETs from the outbox before giving up: %v", i, qerr)
+			return errors.Join(qerr, err, t.putBack(pending[i:]))
+		}
+	}
+	if len(pending) > 0 {
+		log.Printf("Restored %d undelivered SETs from the outbox", len(pending))
+	}
+	return err
+}
+
+// putBack returns SETs Restore could not queue to the outbox, keeping their
+// original order
+func (t *Transmitter) putBack(unqueued []pendingSET) error {
+	persistCtx, cancel := context.WithTimeout(context.Background(), persistTimeout)
+	defer cancel()
+	if err := t.config.Outbox.Save(persistCtx, unqueued); err != nil {
+		log.Printf("Error returning %d SETs to the outbox: %v", len(unqueued), err)
+		return err
+	}
+	log.Printf("Returned %d SETs to the outbox for the next instance", len(unqueued))
+	return nil
+}
+
+// Resume closes the breaker of a stream its receiver has re-enabled, sending
+// the SETs held for it without waiting for the next probe
+func (t *Transmitter) Resume(streamID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if queue, ok := t.queues[streamID]; ok {
+		select {
+		case queue.resumed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Reopen starts a stream with its breaker open, so that a stream paused
+// after delivery failures before a restart is probed until it recovers. It
+// must be called before anything is queued on the stream.
+func (t *Transmitter) Reopen(streamConfig StreamConfig) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stopped {
+		return
+	}
+	if _, ok := t.queues[streamConfig.StreamID]; ok {
+		return
+	}
+	t.startQueueLocked(streamConfig.StreamID, &streamBreaker{open: true, stream: streamConfig})
+}
+
+// queueLocked returns the stream's queue, starting its worker on first use
+func (t *Transmitter) queueLocked(streamID string) *streamQueue {
+	queue, ok := t.queues[streamID]
+	if !ok {
+		queue = t.startQueueLocked(streamID, &streamBreaker{})
+	}
+	return queue
+}
+
+func (t *Transmitter) startQueueLocked(streamID string, b *streamBreaker) *streamQueue {
+	queue := &streamQueue{
+		sets:    make(chan outboundSET, t.config.QueueSize),
+		removed: make(chan struct{}),
+		resumed: make(chan struct{}, 1),
+	}
+	t.queues[streamID] = queue
+	t.workers.Add(1)
+	go t.runStream(queue, b)
+	return queue
+}
+
+// hostSlots returns the semaphore bounding concurrent deliveries to a host
+func (t *Transmitter) hostSlots(endpoint string) chan struct{} {
+	host := endpoint
+	if u, err := url.Parse(endpoint); err == nil {
+		host = u.Host
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	slots, ok := t.hosts[host]
+	if !ok {
+		slots = make(chan struct{}, t.config.MaxPerHost)
+		t.hosts[host] = slots
+	}
+	return slots
+}
+
+func (t *Transmitter) runStream(queue *streamQueue, b *streamBreaker) {
+	defer t.workers.Done()
+	for {
+		select {
+		case <-queue.removed:
+			t.closeStream(queue, b)
+			return
+		default:
+		}
+		if b.open || b.held {
+			if !t.holdStream(queue, b) {
+				// Shutting down: keep the held SETs and everything behind them, in order
+				t.keepBuffered(b)
+				t.keepQueued(queue.sets)
+				return
+			}
+			continue
+		}
+
+		select {
+		case out := <-queue.sets:
+			if t.send(b, out) == interrupted {
+				t.keepUnsent(out)
+				t.keepQueued(queue.sets)
+				return
+			}
+		case <-queue.resumed:
+			// Nothing is held, so there is nothing to resume
+		case <-queue.removed:
+			t.closeStream(queue, b)
+			return
+		case <-t.ctx.Done():
+			t.keepQueued(queue.sets)
+			return
+		}
+	}
+}
+
+// send delivers a SET unless the stream's current status rules it out: SETs
+// for disabled or deleted streams are dropped and those for paused streams
+// are held. Stream events are always sent. An interrupted SET is left to the
+// caller to keep.
+func (t *Transmitter) send(b *streamBreaker, out outboundSET) deliveryOutcome {
+	if !out.streamEvent {
+		switch status, found := t.streamStatus(out.stream); {
+		case !found, status == "disabled":
+			log.Printf("Dropping SET for stream %s, which is no longer enabled", out.stream.StreamID)
+			t.done()
+			return delivered
+		case status == "paused":
+			b.held = true
+			t.hold(b, out)
+			return delivered
+		}
+	}
+	outcome := t.deliverWithRetry(b, out)
+	switch outcome {
+	case delivered:
+		t.done()
+	case tripped:
+		t.trip(b, out)
+	}
+	return outcome
+}
+
+// streamStatus is the stream's status now, rather than when the SET was
+// queued. found is false once the stream has been deleted. If the status
+// cannot be looked up the queued configuration is trusted.
+func (t *Transmitter) streamStatus(streamConfig StreamConfig) (status string, found bool) {
+	if t.config.StreamStatus == nil {
+		return streamConfig.Status, true
+	}
+	ctx, cancel := context.WithTimeout(t.ctx, statusLookupTimeout)
+	defer cancel()
+	status, err := t.config.StreamStatus(ctx, streamConfig.StreamID)
+	if errors.Is(err, errStreamNotFound) {
+		return "", false
+	}
+	if err != nil {
+		log.Printf("Error looking up status of stream %s: %v", streamConfig.StreamID, err)
+		return streamConfig.Status, true
+	}
+	return status, true
+}
+
+// closeStream finishes the worker of a removed stream once no one can queue
+// on it any more, attempting its queued stream events once and dropping the
+// rest
+func (t *Transmitter) closeStream(queue *streamQueue, b *streamBreaker) {
+	queue.senders.Wait()
+	for range b.buffer {
+		t.done()
+	}
+	b.buffer = nil
+	for {
+		select {
+		case out := <-queue.sets:
+			if out.streamEvent && !b.open && t.ctx.Err() == nil {
+				if err := t.attempt(out); err != nil {
+					log.Printf("Error delivering final SET to removed stream %s: %v", out.stream.StreamID, err)
+				}
+			}
+			t.done()
+		default:
+			return
+		}
+	}
+}
+
+// attempt makes a single delivery, holding one of the receiver host's slots
+func (t *Transmitter) attempt(out outboundSET) error {
+	slots := t.hostSlots(out.stream.EventsEndpoint)
+	select {
+	case slots <- struct{}{}:
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	}
+	defer func() { <-slots }()
+
+	ctx, cancel := context.WithTimeout(t.ctx, deliveryTimeout)
+	defer cancel()
+	return t.deliver(ctx, out.stream, out.set)
+}
+
+// keepQueued moves every SET still buffered in a stream's queue to the unsent list
+func (t *Transmitter) keepQueued(queue chan outboundSET) {
+	for {
+		select {
+		case out := <-queue:
+			t.keepUnsent(out)
+		default:
+			return
+		}
+	}
+}
+
+func (t *Transmitter) keepUnsent(out outboundSET) {
+	t.mu.Lock()
+	t.unsent = append(t.unsent, pendingSET{
+		Stream:      out.stream,
+		SET:         out.set,
+		StreamEvent: out.streamEvent,
+		Seq:         len(t.unsent),
+	})
+	t.mu.Unlock()
+	t.done()
+}
+
+// done marks one queued SET as finished and wakes Flush once nothing is pending
+func (t *Transmitter) done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pending--
+	if t.pending == 0 {
+		close(t.idle)
+		t.idle = make(chan struct{})
+	}
+}
+
+// signEventForStream builds and signs the SET delivered to a single stream,
+// encrypting it if the stream asks for encryption
+func signEventForStream(claims map[string]interface{}, streamConfig StreamConfig) (string, error) {
+	payload := make(map[string]interface{}, len(claims)+2)
+	for k, v := range claims {
+		payload[k] = v
+	}
+	if _, ok := payload["iat"]; !ok {
+		payload["iat"] = time.Now().Unix()
+	}
+	// Every SET is addressed to the stream it is delivered on
+	payload["aud"] = streamConfig.StreamID
+	jti := newJTI()
+	payload["jti"] = jti
+	set, err := generateSecureEventToken(payload)
+	if err != nil {
+		return "", err
+	}
+	return encryptSETForStream(set, jti, streamConfig)
+}
+
+// newJTI returns a random identifier for a SET
+func newJTI() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
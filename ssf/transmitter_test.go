@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"ssf/secevent"
+)
+
+// decodeSETClaims returns the payload of a SET without verifying it
+func decodeSETClaims(t testing.TB, set string) map[string]interface{} {
+	t.Helper()
+	parts := strings.Split(set, ".")
+	if len(parts) != 3 {
+		t.Fatalf("SET is not a compact JWS: %q", set)
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		t.Fatalf("failed to decode SET payload: %v", err)
+	}
+	var claims map[string]interface{}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		t.Fatalf("failed to unmarshal SET payload: %v", err)
+	}
+	return claims
+}
+
+// recordingReceiver collects the "seq" claim of every SET, keyed by request path
+type recordingReceiver struct {
+	t        testing.TB
+	mu       sync.Mutex
+	received map[string][]float64
+}
+
+func (rr *recordingReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rr.record(r.URL.Path, body)
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (rr *recordingReceiver) record(path string, body []byte) {
+	claims := decodeSETClaims(rr.t, string(body))
+	rr.mu.Lock()
+	rr.received[path] = append(rr.received[path], claims["seq"].(float64))
+	rr.mu.Unlock()
+}
+
+func testStreams(baseURL string, n int) []StreamConfig {
+	streams := make([]StreamConfig, n)
+	for i := range streams {
+		streams[i] = StreamConfig{
+			StreamID:       fmt.Sprintf("stream-%d", i),
+			EventsEndpoint: fmt.Sprintf("%s/streams/%d", baseURL, i),
+			Status:         "enabled",
+		}
+	}
+	return streams
+}
+
+func TestTransmitterPreservesPerStreamOrder(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	receiver := &recordingReceiver{t: t, received: map[string][]float64{}}
+	ts := httptest.NewServer(receiver)
+	defer ts.Close()
+
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 8, QueueSize: 4})
+	defer tr.Shutdown(context.Background())
+
+	streams := testStreams(ts.URL, 20)
+	events := make([]map[string]interface{}, 25)
+	for i := range events {
+		events[i] = map[string]interface{}{"event_type": "test", "seq": i}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.EmitBatch(ctx, events, streams))
+	assert.NoError(t, tr.Flush(ctx))
+
+	assert.Len(t, receiver.received, len(streams))
+	for path, seqs := range receiver.received {
+		assert.Len(t, seqs, len(events), path)
+		for i, seq := range seqs {
+			assert.Equal(t, float64(i), seq, "out of order delivery on %s", path)
+		}
+	}
+}
+
+func TestTransmitterBoundsConcurrencyPerHost(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	var inFlight, maxInFlight int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			max := atomic.LoadInt32(&maxInFlight)
+			if n <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, n) {
+				break
+			}
+		}
+		time.Sleep(5 * time.Millisecond)
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer ts.Close()
+
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 3, QueueSize: 8})
+	defer tr.Shutdown(context.Background())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.Emit(ctx, map[string]interface{}{"event_type": "test"}, testStreams(ts.URL, 30)))
+	assert.NoError(t, tr.Flush(ctx))
+
+	assert.LessOrEqual(t, atomic.LoadInt32(&maxInFlight), int32(3))
+	assert.Greater(t, atomic.LoadInt32(&maxInFlight), int32(1), "deliveries to a host should run concurrently")
+}
+
+func TestTransmitterShutdownCancelsInFlightDeliveries(t *testing.T) {
+	allowLocalEndpoints(t)
+
+	started := make(chan struct{}, 1)
+	cancelled := make(chan struct{}, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Consume the body so the server notices when the client goes away
+		io.Copy(io.Discard, r.Body)
+		started <- struct{}{}
+		select {
+		case <-r.Context().Done():
+			cancelled <- struct{}{}
+		case <-time.After(10 * time.Second):
+		}
+	}))
+	defer ts.Close()
+
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 1, QueueSize: 1})
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"event_type": "test"}, testStreams(ts.URL, 1)))
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, tr.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("in-flight delivery was not cancelled by shutdown")
+	}
+
+	err := tr.Emit(context.Background(), map[string]interface{}{"event_type": "test"}, testStreams(ts.URL, 1))
+	assert.ErrorIs(t, err, errTransmitterStopped)
+}
+
+func TestTransmitterEmitIsolatesStreams(t *testing.T) {
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 4, QueueSize: 1})
+	release := make(chan struct{})
+	var mu sync.Mutex
+	delivered := map[string][]float64{}
+	tr.deliver = func(ctx context.Context, streamConfig StreamConfig, set string) error {
+		if streamConfig.StreamID == "slow" {
+			select {
+			case <-release:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		delivered[streamConfig.StreamID] = append(delivered[streamConfig.StreamID], decodeSETClaims(t, set)["seq"].(float64))
+		return nil
+	}
+	defer func() {
+		close(release)
+		tr.Shutdown(context.Background())
+	}()
+
+	// The slow receiver holds one SET in flight and one queued, the broken
+	// stream's receiver keys cannot be fetched so its SETs cannot be encrypted
+	streams := []StreamConfig{
+		{StreamID: "slow", EventsEndpoint: "https://slow.example.com/events"},
+		{StreamID: "broken", EventsEndpoint: "https://broken.example.com/events", Encryption: &EncryptionConfig{JWKSURI: "http://broken.example.com/jwks"}},
+		{StreamID: "fast", EventsEndpoint: "https://fast.example.com/events"},
+	}
+	for seq := 0; seq < 2; seq++ {
+		err := tr.Emit(context.Background(), map[string]interface{}{"seq": seq}, streams)
+		assert.ErrorContains(t, err, "stream broken")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := tr.Emit(ctx, map[string]interface{}{"seq": 2}, streams)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "stream slow")
+	assert.ErrorContains(t, err, "stream broken")
+	assert.NotContains(t, err.Error(), "stream fast")
+
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(delivered["fast"]) == 3
+	}, 5*time.Second, 10*time.Millisecond, "the fast stream gets every event while the slow one is stuck")
+	mu.Lock()
+	assert.Equal(t, []float64{0, 1, 2}, delivered["fast"])
+	assert.Empty(t, delivered["broken"])
+	mu.Unlock()
+}
+
+func TestTransmitterRemoveTearsDownStream(t *testing.T) {
+	receiver := &flakyReceiver{t: t}
+	receiver.healthy.Store(true)
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 1, QueueSize: 4})
+	defer tr.Shutdown(context.Background())
+
+	// Hold the first delivery so the rest stay queued when the stream is removed
+	inFlight := make(chan struct{})
+	release := make(chan struct{})
+	tr.deliver = func(ctx context.Context, streamConfig StreamConfig, set string) error {
+		if decodeSETClaims(t, set)["seq"] == float64(0) {
+			close(inFlight)
+			<-release
+		}
+		return receiver.deliver(ctx, streamConfig, set)
+	}
+
+	stream := testStreams("https://receiver.example.com", 1)
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 0}, stream))
+	<-inFlight
+	assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": 1}, stream))
+	deleted, err := signEventForStream(streamEventClaims("stream-0", secevent.VerificationType, secevent.Verification{}), stream[0])
+	assert.NoError(t, err)
+	assert.NoError(t, tr.EnqueueStreamEvent(context.Background(), stream[0], deleted))
+
+	tr.Remove("stream-0")
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, []float64{0, -1}, receiver.seqs(), "queued stream events are sent, other SETs dropped")
+
+	tr.mu.Lock()
+	assert.Empty(t, tr.queues)
+	tr.mu.Unlock()
+}
+
+func TestTransmitterRechecksStreamStatus(t *testing.T) {
+	receiver := &flakyReceiver{t: t}
+	receiver.healthy.Store(true)
+	var mu sync.Mutex
+	statuses := map[string]string{"stream-0": "paused", "stream-1": "disabled"}
+	tr := NewTransmitter(TransmitterConfig{
+		MaxPerHost:    1,
+		QueueSize:     8,
+		ProbeInterval: 10 * time.Millisecond,
+		StreamStatus: func(ctx context.Context, streamID string) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			status, ok := statuses[streamID]
+			if !ok {
+				return "", errStreamNotFound
+			}
+			return status, nil
+		},
+	})
+	tr.deliver = receiver.deliver
+	defer tr.Shutdown(context.Background())
+
+	// The queued configurations still say enabled
+	streams := testStreams("https://receiver.example.com", 3)
+	for i := 0; i < 2; i++ {
+		assert.NoError(t, tr.Emit(context.Background(), map[string]interface{}{"seq": i}, streams))
+	}
+	notice, err := signEventForStream(streamEventClaims("stream-0", secevent.VerificationType, secevent.Verification{}), streams[0])
+	assert.NoError(t, err)
+	assert.NoError(t, tr.EnqueueStreamEvent(context.Background(), streams[0], notice))
+
+	// Only the paused stream's SETs are left, and its stream event went out
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	assert.Error(t, tr.Flush(ctx), "SETs for a paused stream must be held")
+	cancel()
+	assert.Equal(t, []float64{-1}, receiver.seqs())
+
+	mu.Lock()
+	statuses["stream-0"] = "enabled"
+	mu.Unlock()
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, tr.Flush(ctx))
+	assert.Equal(t, []float64{-1, 0, 1}, receiver.seqs())
+}
+
+// BenchmarkTransmitterFanOut delivers 10M SETs per iteration: 10k events
+// fanned out to 1k streams spread across 10 receiver hosts.
+func BenchmarkTransmitterFanOut(b *testing.B) {
+	allowLocalEndpoints(b)
+
+	const receivers, streamsPerReceiver, eventCount = 10, 100, 10_000
+
+	var streams []StreamConfig
+	for r := 0; r < receivers; r++ {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.WriteHeader(http.StatusAccepted)
+		}))
+		defer ts.Close()
+		for _, s := range testStreams(ts.URL, streamsPerReceiver) {
+			s.StreamID = fmt.Sprintf("receiver-%d-%s", r, s.StreamID)
+			streams = append(streams, s)
+		}
+	}
+
+	events := make([]map[string]interface{}, eventCount)
+	for i := range events {
+		events[i] = map[string]interface{}{"event_type": "https://schemas.openid.net/secevent/risc/event-type/identifier-changed", "seq": i}
+	}
+
+	tr := NewTransmitter(TransmitterConfig{MaxPerHost: 32, QueueSize: 256})
+	defer tr.Shutdown(context.Background())
+
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := tr.EmitBatch(ctx, events, streams); err != nil {
+			b.Fatal(err)
+		}
+		if err := tr.Flush(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(b.N*len(events)*len(streams))/b.Elapsed().Seconds(), "sets/s")
+}